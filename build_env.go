@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// buildEnvOverrides are the variables set with `--env KEY=VALUE`, which take
+// precedence over the package's env file
+var buildEnvOverrides map[string]string
+
+// buildEnvPath is the per-package file of environment variables for makedeb.
+// Like the pins, it lives outside of the package's clone, so that `mpr clean`,
+// `uninstall` or `clone --force` do not delete it.
+func buildEnvPath(pkg string) string {
+	return mprDir(".mpr", "env", pkg)
+}
+
+// readBuildEnvFile parses a file of KEY=VALUE lines. Blank lines and "#"
+// comments are ignored; values are taken literally (no quoting or expansion).
+// A missing file is not an error.
+func readBuildEnvFile(path string) ([]string, error) { // {{{
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	env := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if idx := strings.Index(line, "="); idx <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE, got %q", path, lineNo, line)
+		}
+		env = append(env, line)
+	}
+	return env, scanner.Err()
+} // }}}
+
+// buildEnv is the environment makedeb runs with for pkg. Later entries win,
+// so the precedence is: --env > the package's env file > the inherited
+// environment.
+func buildEnv(pkg string) ([]string, error) { // {{{
+	fileEnv, err := readBuildEnvFile(buildEnvPath(pkg))
+	if err != nil {
+		return nil, err
+	}
+	env := append(os.Environ(), fileEnv...)
+
+	keys := make([]string, 0, len(buildEnvOverrides))
+	for key := range buildEnvOverrides {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		env = append(env, key+"="+buildEnvOverrides[key])
+	}
+	return env, nil
+} // }}}
+
+// makedebCmd creates the makedeb command for op, run in the package's
+// directory and with its build environment
+func makedebCmd(pkg string, op string, confirm bool, extraArgs ...string) (*exec.Cmd, error) {
+	env, err := buildEnv(pkg)
+	if err != nil {
+		return nil, err
+	}
+	cmd := mkcmd(true, makedebBin(), append(assembleMakedebArgs(op, confirm), extraArgs...)...)
+	cmd.Dir = mprDir(pkg)
+	cmd.Env = env
+	return cmd, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildEnvReachesMakedeb(t *testing.T) {
+	setupTestMprDir(t)
+	createTestPackage(t, "foo", "pkgname=foo\npkgver=1.0.0\n")
+	if err := os.MkdirAll(filepath.Dir(buildEnvPath("foo")), 0755); err != nil {
+		t.Fatal(err)
+	}
+	envFile := "# build settings\nMAKEFLAGS=-j4\n\nMPR_TEST_OVERRIDDEN=file\nMPR_TEST_INHERITED=file\n"
+	if err := os.WriteFile(buildEnvPath("foo"), []byte(envFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MPR_TEST_INHERITED", "inherited")
+	t.Setenv("MPR_TEST_UNTOUCHED", "inherited")
+
+	originalMakedeb, originalOverrides := makedebPath, buildEnvOverrides
+	defer func() { makedebPath, buildEnvOverrides = originalMakedeb, originalOverrides }()
+	makedebPath = "/bin/true"
+	buildEnvOverrides = map[string]string{"MPR_TEST_OVERRIDDEN": "flag"}
+
+	var env []string
+	fakeRunCmd(t, func(cmd *exec.Cmd) error {
+		env = cmd.Env
+		return nil
+	})
+	if err := runBuild(buildArgs{pkgName: "foo"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// like os/exec, the last entry for a key wins:
+	lookup := func(key string) string {
+		value := ""
+		for _, entry := range env {
+			if strings.HasPrefix(entry, key+"=") {
+				value = strings.TrimPrefix(entry, key+"=")
+			}
+		}
+		return value
+	}
+	expected := map[string]string{
+		"MAKEFLAGS":           "-j4",
+		"MPR_TEST_OVERRIDDEN": "flag",
+		"MPR_TEST_INHERITED":  "file",
+		"MPR_TEST_UNTOUCHED":  "inherited",
+	}
+	for key, value := range expected {
+		if got := lookup(key); got != value {
+			t.Errorf("expected %s=%s, got %q", key, value, got)
+		}
+	}
+}
+
+func TestReadBuildEnvFileRejectsInvalidLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "env")
+	if err := os.WriteFile(path, []byte("FOO=1\nnot an assignment\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readBuildEnvFile(path); err == nil || !strings.Contains(err.Error(), path+":2:") {
+		t.Errorf("expected the invalid line to be reported, got: %v", err)
+	}
+
+	if env, err := readBuildEnvFile(filepath.Join(t.TempDir(), "missing")); err != nil || len(env) != 0 {
+		t.Errorf("expected a missing file to be empty, got %v (%v)", env, err)
+	}
+}
+
+func TestBuildEnvSurvivesClean(t *testing.T) {
+	setupTestMprDir(t)
+	createTestPackage(t, "foo", "pkgname=foo\npkgver=1.0.0\n")
+	if err := os.MkdirAll(filepath.Dir(buildEnvPath("foo")), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(buildEnvPath("foo"), []byte("MAKEFLAGS=-j4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// `git clean -fdx` only cleans the clone:
+	if err := runClean(cleanArgs{packages: []string{"foo"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(buildEnvPath("foo")); err != nil {
+		t.Errorf("expected the env file to be kept: %v", err)
+	}
+	if packages, _ := listPackages(); strings.Join(packages, ",") != "foo" {
+		t.Errorf("expected the env files not to be mistaken for packages, got %v", packages)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type bundleArgs struct {
+	pkgName string
+	output  string // path of the .tar.gz to write
+	log     bool   // include the most recent build log
+	sources bool   // include the list of sources
+	deps    bool   // include the list of dependencies
+}
+
+type bundleFile struct {
+	name     string
+	contents []byte
+}
+
+// collectBundleFiles gathers the files that make up a bundle of the package
+// in dir: a snapshot of the package's state that can be shared when asking
+// others for help with it
+func collectBundleFiles(dir string, args bundleArgs) ([]bundleFile, error) { // {{{
+	files := make([]bundleFile, 0)
+
+	pkgbuildContents, err := os.ReadFile(filepath.Join(dir, "PKGBUILD"))
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, bundleFile{name: "PKGBUILD", contents: pkgbuildContents})
+
+	if srcinfoContents, err := os.ReadFile(filepath.Join(dir, ".SRCINFO")); err == nil {
+		files = append(files, bundleFile{name: ".SRCINFO", contents: srcinfoContents})
+	}
+
+	pkgbuild := NewPKGBUILD(dir)
+	if args.sources {
+		var sb strings.Builder
+		sources, err := pkgbuild.getSourcesWithMode(true)
+		if err != nil {
+			fmt.Fprintf(&sb, "error: %s\n", err)
+		}
+		for _, source := range sources {
+			status := "missing"
+			if _, err := os.Stat(filepath.Join(dir, source.localName)); err == nil {
+				status = "downloaded"
+			}
+			fmt.Fprintf(&sb, "%s %s %s %s\n", source.localName, source.remoteURL, source.hash, status)
+		}
+		files = append(files, bundleFile{name: "sources.txt", contents: []byte(sb.String())})
+	}
+
+	if args.deps {
+		var sb strings.Builder
+		vars, err := pkgbuild.getVariablesMerged()
+		if err != nil {
+			fmt.Fprintf(&sb, "error: %s\n", err)
+		} else {
+			for _, kind := range []string{"depends", "makedepends", "checkdepends", "optdepends"} {
+				for _, dep := range (*vars)[kind] {
+					fmt.Fprintf(&sb, "%s=%s\n", kind, dep)
+				}
+			}
+		}
+		files = append(files, bundleFile{name: "dependencies.txt", contents: []byte(sb.String())})
+	}
+
+	if args.log {
+		logs, err := filepath.Glob(filepath.Join(dir, "*.log"))
+		if err != nil {
+			return nil, err
+		}
+		// include the most recently modified log:
+		newestLog := ""
+		var newestModTime time.Time
+		for _, log := range logs {
+			info, err := os.Stat(log)
+			if os.IsNotExist(err) {
+				continue // (removed since the glob)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if newestLog == "" || info.ModTime().After(newestModTime) {
+				newestLog, newestModTime = log, info.ModTime()
+			}
+		}
+		if newestLog != "" {
+			logContents, err := os.ReadFile(newestLog)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, bundleFile{name: filepath.Base(newestLog), contents: logContents})
+		}
+	}
+
+	return files, nil
+} // }}}
+
+// writeBundle writes the files into a .tar.gz at the given path, all under a
+// single top-level directory
+func writeBundle(path string, topLevelDir string, files []bundleFile) error { // {{{
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, file := range files {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    topLevelDir + "/" + file.name,
+			Mode:    0644,
+			Size:    int64(len(file.contents)),
+			ModTime: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := tw.Write(file.contents); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+} // }}}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBundle(t *testing.T) {
+	dir := t.TempDir()
+	pkgbuild := "pkgname=foo\npkgver=1.0.0\nsource=(foo.tar.gz)\nsha256sums=(SKIP)\ndepends=(bar)\n"
+	for name, contents := range map[string]string{
+		"PKGBUILD":   pkgbuild,
+		".SRCINFO":   "pkgbase = foo\n",
+		"foo.tar.gz": "",
+		"build.log":  "it broke\n",
+		"old.log":    "it broke before\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// only the most recent log is bundled:
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "old.log"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := collectBundleFiles(dir, bundleArgs{log: true, sources: true, deps: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(t.TempDir(), "foo-bundle.tar.gz")
+	if err := writeBundle(output, "foo-bundle", files); err != nil {
+		t.Fatal(err)
+	}
+
+	// read the bundle back:
+	f, err := os.Open(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	contents := make(map[string]string)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(tr)
+		contents[header.Name] = string(b)
+	}
+
+	if contents["foo-bundle/PKGBUILD"] != pkgbuild {
+		t.Errorf("expected the PKGBUILD to be bundled, got %q", contents["foo-bundle/PKGBUILD"])
+	}
+	if contents["foo-bundle/.SRCINFO"] != "pkgbase = foo\n" {
+		t.Errorf("expected the .SRCINFO to be bundled")
+	}
+	if contents["foo-bundle/build.log"] != "it broke\n" {
+		t.Errorf("expected the build log to be bundled")
+	}
+	if _, ok := contents["foo-bundle/old.log"]; ok {
+		t.Errorf("expected only the most recent log to be bundled")
+	}
+	if !strings.Contains(contents["foo-bundle/sources.txt"], "foo.tar.gz foo.tar.gz SKIP downloaded") {
+		t.Errorf("unexpected sources.txt: %q", contents["foo-bundle/sources.txt"])
+	}
+	if contents["foo-bundle/dependencies.txt"] != "depends=bar\n" {
+		t.Errorf("unexpected dependencies.txt: %q", contents["foo-bundle/dependencies.txt"])
+	}
+
+	// the optional parts can be left out:
+	files, err = collectBundleFiles(dir, bundleArgs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("expected only the PKGBUILD & .SRCINFO, got %d files", len(files))
+	}
+}
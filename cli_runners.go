@@ -1,149 +1,363 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"text/tabwriter"
 	"time"
 
 	"github.com/fatih/color"
 )
 
 func runFallibleCommand(f func() error) { // {{{
-	if err := f(); err != nil {
+	err := f()
+	timings.print(os.Stderr)
+	if err != nil {
 		fmt.Fprintln(os.Stderr, "error:", err)
-		os.Exit(1)
+		os.Exit(exitCodeFor(err))
 	}
 } // }}}
 
 type installArgs struct {
-	packageURL string
-	confirm    bool
+	packageURL     string
+	from           string // the provider of packageURL, see resolvePackageURL
+	review         bool   // open the PKGBUILD in $EDITOR before building
+	confirm        bool   // ask whether to build the package
+	makedebConfirm bool   // let makedeb ask for confirmation (i.e. don't pass --no-confirm)
+	keepOnAbort    bool   // keep the clone if the build is declined
+	cleanAfter     bool   // remove build artifacts after a successful install
+	prefetch       bool   // download the sources with mpr before running makedeb
+	depth          int    // see cloneArgs
+	recurseSubs    bool   // see cloneArgs
+}
+
+type buildArgs struct {
+	pkgName  string
+	prefetch bool // download the sources with mpr before running makedeb
 }
 
 type updateArgs struct {
 	packagesToUpdate []string
 	upgrade          bool
+	dryRun           bool // only print what would be pulled/rebuilt
+	retryFailed      bool // only update the packages that failed in the last run
+	followRedirects  bool // update the remote of packages whose upstream moved, without asking
 	confirm          bool
+	cleanAfter       bool
+	timeout          time.Duration // kill `git pull` after this long (0 for no timeout)
 }
 
 type upgradeArgs struct {
-	packages []string
-	confirm  bool
+	packages    []string
+	confirm     bool
+	cleanAfter  bool // remove build artifacts after each successful upgrade
+	keepGoing   bool // continue upgrading the remaining packages after a failure
+	resume      bool // skip packages upgraded by a previous, interrupted run
+	retryFailed bool // only upgrade the packages that failed in the last run
+	dryRun      bool // only print what would be upgraded
+}
+
+type listArgs struct {
+	long       bool
+	sort       string // one of the listSort* constants
+	showErrors bool   // report package directories that fail to evaluate
+	output     string // one of the listOutput* constants
+	filter     string // only list packages matching this glob
+	pinned     bool   // only list pinned packages
+}
+
+// The output formats supported by `mpr list -o`:
+const (
+	listOutputText = "text"
+	listOutputJSON = "json"
+)
+
+// listEntry is a package, as printed by `mpr list -o json`
+type listEntry struct {
+	Name    string  `json:"name"`
+	Version *string `json:"version"` // null if the PKGBUILD fails to evaluate
+	Path    string  `json:"path"`
+	Error   string  `json:"error,omitempty"`
+}
+
+type outdatedArgs struct {
+	porcelain bool
+	jobs      int
+	filter    string // only check packages matching this glob
+	output    string // one of the listOutput* constants
+	exitCode  bool   // fail if any package is outdated
+}
+
+// outdatedEntry is an outdated package, as printed by `mpr outdated -o json`
+type outdatedEntry struct {
+	Name          string `json:"name"`
+	InstalledHash string `json:"installedHash"` // empty if never installed
+	CurrentHash   string `json:"currentHash"`
+}
+
+type recomputeSumsArgs struct {
+	pkgName string
+	edit    bool
+	srcinfo bool // regenerate the .SRCINFO after updating the sums
+	dirty   dirtyTreeArgs
 }
 
-func runBuild(pkgName string) error { // {{{
+type srcinfoArgs struct {
+	pkgName string // or "." for the current directory
+	stdout  bool   // print the .SRCINFO instead of writing it
+}
+
+type updateVersionArgs struct {
+	pkgName    string
+	newVersion string
+	also       map[string]string // additional variables to set in the same pass
+	edit       bool
+	srcinfo    bool          // regenerate the .SRCINFO after updating the sums
+	noSums     bool          // only update the variables, without running makedeb
+	maxAge     time.Duration // reuse a repology version cached this recently (0 to always ask repology)
+	// resetPkgrel sets pkgrel=1 even if the version doesn't change. By default,
+	// pkgrel is only reset if it does, as is the convention for a new version,
+	// unless keepPkgrel is set.
+	resetPkgrel bool
+	keepPkgrel  bool
+	dirty       dirtyTreeArgs
+}
+
+// dirtyTreeArgs controls what happens when a package has uncommitted changes
+// before its PKGBUILD is edited automatically (by default: a warning)
+type dirtyTreeArgs struct {
+	requireClean bool // abort instead
+	autostash    bool // stash the changes before the edit, and pop them after
+}
+
+// prefetchSources downloads the sources of a package with mpr's own
+// downloader, which verifies their hashes. makedeb finds the files in place,
+// and does not download them again; it returns the arguments that make
+// makedeb skip verifying them again, too (see makedebPrefetchedArgs).
+func prefetchSources(pkg string) ([]string, error) {
+	fmt.Printf("=> prefetching the sources of %s\n", pkg)
+	if _, err := NewPKGBUILD(mprDir(pkg)).downloadSources(defaultJobs); err != nil {
+		return nil, err
+	}
+	return makedebPrefetchedArgs(), nil
+}
+
+func runBuild(args buildArgs) error { // {{{
+	pkgName := args.pkgName
+	if err := ensureMakedeb(); err != nil {
+		return err
+	}
+	var extraArgs []string
+	if args.prefetch {
+		var err error
+		if extraArgs, err = prefetchSources(pkgName); err != nil {
+			return err
+		}
+	}
+
 	fmt.Printf("=> building %s\n", pkgName)
-	cmd := mkcmd(true, "makedeb")
-	cmd.Dir = mprDir(pkgName)
-	return cmd.Run()
+	cmd, err := makedebCmd(pkgName, makedebOpBuild, true, extraArgs...)
+	if err != nil {
+		return err
+	}
+	if err := runCmd(cmd); err != nil {
+		return markError(err, errBuildFailed)
+	}
+	return writeMakedebBuildTime(pkgName, time.Now())
 } // }}}
 
-func runCheckStale() error { // {{{
-	packages, err := listPackages()
+func runBundle(args bundleArgs) error { // {{{
+	installedPkgs, err := listPackages()
 	if err != nil {
 		return err
 	}
-	var counter int64 = 0
+	if !stringSliceContainsString(installedPkgs, args.pkgName) {
+		return markError(fmt.Errorf("package %s is not installed", args.pkgName), errNotFound)
+	}
 
-	type pkgInfo struct {
-		name    string
-		version string
-		newest  string
+	files, err := collectBundleFiles(mprDir(args.pkgName), args)
+	if err != nil {
+		return err
 	}
-	type pkgError struct {
-		name string
-		err  error
+
+	output := args.output
+	if output == "" {
+		output = args.pkgName + "-bundle.tar.gz"
+	}
+	if err := writeBundle(output, args.pkgName+"-bundle", files); err != nil {
+		return err
 	}
+	fmt.Printf("=> wrote %s\n", output)
+	return nil
+} // }}}
+
+type checkStaleArgs struct {
+	jobs    int           // how many packages to evaluate at once
+	maxAge  time.Duration // reuse versions cached by earlier runs for this long
+	anyDiff bool          // report any version that differs from repology's, even an older one
+}
+
+// repologyRateLimitRetries is how many times check-stale asks repology again for
+// a package, after being rate limited
+const repologyRateLimitRetries = 5
+
+func runCheckStale(args checkStaleArgs) error { // {{{
+	packages, err := listPackages()
+	if err != nil {
+		return err
+	}
+	var counter int64 = 0
+
 	mux := sync.Mutex{}
-	updatablePackages := make([]pkgInfo, 0)
-	pkgWithErrors := make([]pkgError, 0)
+	report := staleReport{}
 
-	_setLine := func(line string) {
-		line = fmt.Sprintf("(%d/%d) %s", counter, len(packages), line)
+	// the counter is only advanced while holding mux, so that the lines are
+	// printed in the order of the count (it never appears to go backwards):
+	checked := func(pkg string) {
 		mux.Lock()
 		defer mux.Unlock()
 
-		setLine(line)
+		counter++
+		setLine(fmt.Sprintf("(%d/%d) Checked %s", counter, len(packages), pkg))
 	}
 
-	for i := range packages {
+	fmt.Println(checkStaleHeader(len(packages), repologyLimiter.interval))
+
+	// The PKGBUILDs are evaluated in parallel, and several requests to
+	// repology can be in flight at once, but they are started no faster than
+	// repologyLimiter allows:
+	doParallel(len(packages), args.jobs, func(i int) error {
 		fullPkgName := packages[i]
+		defer checked(fullPkgName)
 
 		addPackageError := func(err error) {
 			mux.Lock()
 			defer mux.Unlock()
-			pkgWithErrors = append(pkgWithErrors, pkgError{
+			report.errors = append(report.errors, stalePkgError{
 				name: fullPkgName,
 				err:  err,
 			})
 		}
+		addNotTracked := func() {
+			mux.Lock()
+			defer mux.Unlock()
+			report.notTracked = append(report.notTracked, fullPkgName)
+		}
 
 		pkgbuild := NewPKGBUILD(mprDir(fullPkgName))
-		newestVersion, err := pkgbuild.getLatestRepologyPkgVersion()
-		if err != nil {
-			addPackageError(err)
-			continue
-		}
-		if newestVersion == "SKIP" {
-			continue
-		}
-		pkgver, err := pkgbuild.getSingleVariable("pkgver")
+		pkgver, err := pkgbuild.getPkgver()
 		if err != nil {
-			addPackageError(fmt.Errorf("could not read pkgver variables"))
-			continue
+			addPackageError(fmt.Errorf("could not read pkgver: %w", err))
+			return nil
 		}
 
 		// remove quotes/single quotes from start/end:
 		pkgver = strings.Trim(pkgver, "\"")
 		pkgver = strings.Trim(pkgver, "'")
+		normalize, err := pkgbuild.getRepologyVersionNormalizer()
+		if err != nil {
+			addPackageError(err)
+			return nil
+		}
 
-		if newestVersion != pkgver {
+		var newestVersion string
+		for attempt := 1; ; attempt++ {
+			interval := repologyLimiter.getInterval()
+			stopTiming := timings.start("repology requests")
+			newestVersion, err = pkgbuild.getLatestRepologyPkgVersionCached(args.maxAge)
+			stopTiming()
+
+			// when repology asks to slow down, do so, and ask again:
+			var rateLimitErr *repologyRateLimitError
+			if !errors.As(err, &rateLimitErr) || attempt > repologyRateLimitRetries {
+				break
+			}
+			atLeast := rateLimitErr.retryAfter
+			if atLeast <= 0 && interval <= 0 {
+				// there is nothing to double:
+				atLeast = defaultRepologyDelay
+			}
+			delay := repologyLimiter.slowDown(interval, atLeast)
 			mux.Lock()
-			updatablePackages = append(updatablePackages, pkgInfo{
+			setLine(fmt.Sprintf("(%d/%d) Rate limited by repology, slowing down to one request every %s", counter, len(packages), delay))
+			mux.Unlock()
+		}
+		if errors.Is(err, errRepologyNotTracked) {
+			addNotTracked()
+			return nil
+		}
+		if err != nil {
+			addPackageError(err)
+			return nil
+		}
+		if newestVersion == "SKIP" {
+			addNotTracked()
+			return nil
+		}
+
+		mux.Lock()
+		defer mux.Unlock()
+		if isStaleVersion(normalize(pkgver), normalize(newestVersion), args.anyDiff) {
+			report.stale = append(report.stale, stalePkgInfo{
 				name:    fullPkgName,
 				version: pkgver,
 				newest:  newestVersion,
 			})
-			mux.Unlock()
+		} else {
+			report.upToDate = append(report.upToDate, fullPkgName)
 		}
-
-		time.Sleep(1100 * time.Millisecond)
-		atomic.AddInt64(&counter, 1)
-		_setLine("Checked " + fullPkgName)
-	}
+		return nil
+	})
 	fmt.Println()
 
-	if len(pkgWithErrors) > 0 {
-		msg := ""
-		for _, pkg := range pkgWithErrors {
-			msg += fmt.Sprintf("- %s: %s\n", pkg.name, pkg.err)
-		}
-		err = fmt.Errorf("some packages had errors:\n%s", msg)
-	}
+	report.sort()
+	report.print(os.Stdout)
 
-	for _, pkg := range updatablePackages {
-		green := color.New(color.FgGreen).SprintFunc()
-		red := color.New(color.FgRed).SprintFunc()
-		fmt.Printf("%s: current=%s, latest=%s\n", pkg.name, red(pkg.version), green(pkg.newest))
+	if len(report.errors) > 0 {
+		return fmt.Errorf("%d package(s) could not be checked", len(report.errors))
 	}
-
-	return err
+	return nil
 } // }}}
 
-func runClean(packages []string) error { // {{{
+type cleanArgs struct {
+	packages []string
+	yes      bool // do not ask for confirmation before cleaning every package
+	dryRun   bool // only print what would be removed
+}
+
+func runClean(args cleanArgs) error { // {{{
 	availablePkgs, err := listPackages()
 	if err != nil {
 		return err
 	}
 
+	packages := args.packages
 	if len(packages) == 0 {
 		packages = availablePkgs
+
+		// `git clean -fdx` cannot be undone, so make sure a bare `mpr clean`
+		// is intended:
+		if !args.yes && !args.dryRun {
+			fmt.Printf("This will permanently delete all untracked files (including downloaded sources and any uncommitted work) in %d package(s).\n", len(packages))
+			proceed, err := promptYesNo(os.Stdout, os.Stdin, "Continue?", false)
+			if err != nil {
+				return err
+			}
+			if !proceed {
+				return markError(fmt.Errorf("clean aborted"), errAborted)
+			}
+		}
 	}
 
 	for _, pkg := range packages {
@@ -153,9 +367,13 @@ func runClean(packages []string) error { // {{{
 		}
 
 		fmt.Printf("=> cleaning %s\n", pkg)
-		cmd := mkcmd(true, "git", "clean", "-fdx")
+		cleanFlags := "-fdx"
+		if args.dryRun {
+			cleanFlags = "-fdxn"
+		}
+		cmd := mkcmd(true, gitBin(), "clean", cleanFlags)
 		cmd.Dir = mprDir(pkg)
-		if err = cmd.Run(); err != nil {
+		if err = runCmd(cmd); err != nil {
 			return err
 		}
 	}
@@ -163,51 +381,324 @@ func runClean(packages []string) error { // {{{
 	return nil
 } // }}}
 
-func runClone(packageURL string) error { // {{{
-	url := getPackageURL(packageURL)
-	pkg := filepath.Base(url)
-	if strings.Contains(pkg, ":") {
-		pkg = strings.Split(pkg, ":")[1]
+type cloneArgs struct {
+	packageURL  string
+	from        string // one of the provider* constants
+	force       bool   // delete an existing clone of the package first
+	confirm     bool   // with force, ask before deleting the existing clone
+	depth       int    // only clone this many commits (0 for the full history)
+	recurseSubs bool   // also clone the submodules
+}
+
+// gitCloneArgs returns the arguments to `git clone` url into dir
+func (args cloneArgs) gitCloneArgs(url string, dir string) []string {
+	gitArgs := []string{"clone"}
+	if args.depth > 0 {
+		// --depth implies --single-branch, which would keep `git pull` from
+		// fetching the other branches:
+		gitArgs = append(gitArgs, "--depth", strconv.Itoa(args.depth), "--no-single-branch")
+	}
+	if args.recurseSubs {
+		gitArgs = append(gitArgs, "--recurse-submodules")
+		if args.depth > 0 {
+			gitArgs = append(gitArgs, "--shallow-submodules")
+		}
 	}
-	pkg = strings.TrimSuffix(pkg, ".git")
+	return append(gitArgs, url, dir)
+}
 
-	packages, err := listPackages()
+// runClone clones a package, returning the name of the directory it was cloned
+// to. The package is cloned to a temporary directory first, which is then
+// named after the PKGBUILD's pkgname (or pkgbase), so that it matches what
+// listPackages reports even when that differs from the name of the repository.
+func runClone(args cloneArgs) (string, error) { // {{{
+	url, err := resolvePackageURL(args.packageURL, args.from)
+	if err != nil {
+		return "", err
+	}
+	urlPkg := getPackageNameFromURL(url)
+	// (the existing clone is only replaced once the new one succeeded)
+	if err := existingCloneError(urlPkg, args); err != nil {
+		return "", err
+	}
+
+	fmt.Printf("=> cloning %s\n", urlPkg)
+	tmpDir, err := os.MkdirTemp(mprDir(), tempDirPrefixClone+urlPkg+"-")
+	if err != nil {
+		return "", err
+	}
+	defer invalidatePackageIndex()
+	cmd := mkcmd(true, gitBin(), args.gitCloneArgs(url, filepath.Base(tmpDir))...)
+	if err := runCmd(cmd); err != nil {
+		// clean up a botched clone:
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+
+	pkg, err := NewPKGBUILD(tmpDir).getPackageName(urlPkg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: could not read the package name from the PKGBUILD (%s), using %s\n", err, urlPkg)
+		pkg = urlPkg
+	}
+	if pkg != urlPkg {
+		fmt.Fprintf(os.Stderr, "warning: the repository is named %s, but its PKGBUILD is for %s; cloning it to %s\n", urlPkg, pkg, mprDir(pkg))
+	}
+	if err := removeExistingClone(pkg, args); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+	if err := os.Rename(tmpDir, mprDir(pkg)); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+	return pkg, nil
+} // }}}
+
+// existingCloneError fails if pkg has already been cloned, unless the clone is
+// to be replaced (with --force)
+func existingCloneError(pkg string, args cloneArgs) error { // {{{
+	if _, err := os.Stat(mprDir(pkg)); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !args.force {
+		return fmt.Errorf("%s has already been cloned to %s (pass --force to clone it again)", pkg, mprDir(pkg))
+	}
+	return nil
+} // }}}
+
+func removeExistingClone(pkg string, args cloneArgs) error { // {{{
+	if err := existingCloneError(pkg, args); err != nil {
+		return err
+	}
+	if _, err := os.Stat(mprDir(pkg)); os.IsNotExist(err) {
+		return nil
+	}
+	if args.confirm {
+		dirty, err := isDirty(pkg)
+		if err != nil {
+			return err
+		}
+		if dirty {
+			fmt.Fprintf(os.Stderr, "warning: %s has uncommitted changes, which will be lost\n", mprDir(pkg))
+		}
+		remove, err := promptYesNo(os.Stdout, os.Stdin, fmt.Sprintf("Do you want to replace %s with the new clone?", mprDir(pkg)), false)
+		if err != nil {
+			return err
+		}
+		if !remove {
+			return markError(fmt.Errorf("clone aborted"), errAborted)
+		}
+	}
+	fmt.Printf("=> removing %s\n", mprDir(pkg))
+	err := os.RemoveAll(mprDir(pkg))
+	invalidatePackageIndex()
+	return err
+} // }}}
+
+type cloneMaintainerArgs struct {
+	maintainer string
+	install    bool // also build and install the cloned packages
+	jobs       int  // how many packages to clone at once
+}
+
+// runCloneMaintainer clones all of the packages that the given user maintains
+// on the MPR, skipping the ones that have already been cloned
+func runCloneMaintainer(args cloneMaintainerArgs) error { // {{{
+	if args.jobs < 1 {
+		return usageErrorf("--jobs must be at least 1, got %d", args.jobs)
+	}
+	results, err := fetchMPRMaintainerPackages(args.maintainer)
 	if err != nil {
 		return err
 	}
-	for _, existingPkg := range packages {
-		if existingPkg == pkg {
-			fmt.Println("package already exists")
-			os.Exit(1)
+	if len(results) == 0 {
+		// the search is empty either way, so ask the MPR whether the user exists:
+		exists, known, err := fetchMPRUserExists(args.maintainer)
+		switch {
+		case err != nil:
+			return err
+		case known && !exists:
+			return markError(fmt.Errorf("there is no MPR user named %q", args.maintainer), errNotFound)
+		case exists:
+			fmt.Printf("%s does not maintain any packages on the MPR\n", args.maintainer)
+			return nil
+		default:
+			return markError(fmt.Errorf("no packages are maintained by %q on the MPR (is the name right?)", args.maintainer), errNotFound)
 		}
 	}
-	fmt.Printf("=> cloning %s\n", pkg)
-	cmd := mkcmd(true, "git", "clone", url, pkg)
-	if err := cmd.Run(); err != nil {
-		// clean up a botched clone:
-		os.RemoveAll(mprDir(pkg))
+
+	installedPkgs, err := listPackages()
+	if err != nil {
 		return err
 	}
+	toClone := make([]string, 0, len(results))
+	skipped := 0
+	for _, result := range results {
+		if stringSliceContainsString(installedPkgs, result.Name) {
+			fmt.Printf("=> skipping %s (already cloned)\n", result.Name)
+			skipped++
+			continue
+		}
+		toClone = append(toClone, result.Name)
+	}
+	sort.Strings(toClone)
+
+	mux := sync.Mutex{}
+	cloned := make([]string, 0, len(toClone))
+	failed := make(map[string]error)
+	doParallel(len(toClone), args.jobs, func(i int) error {
+		pkg := toClone[i]
+		clonedPkg, err := runClone(cloneArgs{packageURL: pkg, from: providerMPR})
+
+		mux.Lock()
+		defer mux.Unlock()
+		if err != nil {
+			failed[pkg] = err
+			return nil
+		}
+		cloned = append(cloned, clonedPkg)
+		return nil
+	})
+	sort.Strings(cloned)
+
+	if args.install {
+		// makedeb still asks for confirmation, but there is no review:
+		for _, pkg := range cloned {
+			err := installClonedPackage(pkg, installArgs{makedebConfirm: true, cleanAfter: cleanAfterInstallDefault()})
+			if err != nil {
+				failed[pkg] = err
+			}
+		}
+	}
+
+	fmt.Printf("\ncloned: %d, skipped: %d, failed: %d\n", len(cloned), skipped, len(failed))
+	if len(failed) > 0 {
+		names := make([]string, 0, len(failed))
+		for pkg := range failed {
+			names = append(names, pkg)
+		}
+		sort.Strings(names)
+		msg := ""
+		for _, pkg := range names {
+			msg += fmt.Sprintf("- %s: %s\n", pkg, failed[pkg])
+		}
+		return fmt.Errorf("some packages failed:\n%s", msg)
+	}
 	return nil
 } // }}}
 
-func runEach(args []string) error { // {{{
+// The output styles supported by `mpr each --parallel`:
+const (
+	eachOutputPrefix = "prefix" // stream lines as they come, prefixed with [pkg]
+	eachOutputGroup  = "group"  // print each package's output at once, when it finishes
+)
+
+type eachArgs struct {
+	command   []string
+	parallel  bool
+	output    string // eachOutputPrefix or eachOutputGroup
+	keepGoing bool   // run the command in all packages, even if it fails in some
+	jobs      int    // with parallel, how many packages to run the command in at once
+}
+
+func runEach(args eachArgs) error { // {{{
 	packages, err := listPackages()
 	if err != nil {
 		return err
 	}
+	if args.parallel {
+		return runEachParallel(os.Stdout, packages, args)
+	}
+
+	failed := make(map[string]error)
 	for _, pkg := range packages {
 		fmt.Println("=> " + pkg)
-		cmd := mkcmd(true, args[0], args[1:]...)
+		cmd := mkcmd(true, args.command[0], args.command[1:]...)
 		cmd.Dir = mprDir(pkg)
 
 		err := cmd.Run()
 		if err != nil {
-			return err
+			if !args.keepGoing {
+				return err
+			}
+			failed[pkg] = err
 		}
 		fmt.Println()
 	}
-	return nil
+	return eachSummary(os.Stdout, len(packages), failed)
+} // }}}
+
+// eachSummary reports the packages whose command failed with --keep-going,
+// returning an error if there were any
+func eachSummary(w io.Writer, total int, failed map[string]error) error { // {{{
+	if len(failed) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(failed))
+	for pkg := range failed {
+		names = append(names, pkg)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "the command failed in %d of %s:\n", len(failed), pluralize(total, "package"))
+	for _, pkg := range names {
+		var exitErr *exec.ExitError
+		if errors.As(failed[pkg], &exitErr) {
+			fmt.Fprintf(w, "  %s: exit status %d\n", pkg, exitErr.ExitCode())
+		} else {
+			fmt.Fprintf(w, "  %s: %s\n", pkg, failed[pkg])
+		}
+	}
+	return fmt.Errorf("the command failed in %s", pluralize(len(failed), "package"))
+} // }}}
+
+// runEachParallel runs the command in all packages concurrently. Commands get
+// no stdin, and their output is written to w in the requested style.
+func runEachParallel(w io.Writer, packages []string, args eachArgs) error { // {{{
+	mux := sync.Mutex{}
+	failed := make(map[string]error)
+	jobs := args.jobs
+	if jobs < 1 {
+		jobs = defaultJobs
+	}
+	err := doParallel(len(packages), jobs, func(i int) error {
+		pkg := packages[i]
+		cmd := exec.Command(args.command[0], args.command[1:]...)
+		cmd.Dir = mprDir(pkg)
+
+		if args.output == eachOutputGroup {
+			output, err := cmd.CombinedOutput()
+			mux.Lock()
+			defer mux.Unlock()
+			fmt.Fprintf(w, "=> %s\n%s\n", pkg, output)
+			if err != nil {
+				failed[pkg] = err
+				return fmt.Errorf("%s: %w", pkg, err)
+			}
+			return nil
+		}
+
+		pw := newPrefixWriter(&mux, w, "["+pkg+"] ")
+		cmd.Stdout = pw
+		cmd.Stderr = pw
+		err := cmd.Run()
+		if flushErr := pw.Flush(); err == nil {
+			err = flushErr
+		}
+		if err != nil {
+			mux.Lock()
+			defer mux.Unlock()
+			failed[pkg] = err
+			return fmt.Errorf("%s: %w", pkg, err)
+		}
+		return nil
+	})
+	if args.keepGoing {
+		return eachSummary(w, len(packages), failed)
+	}
+	return err
 } // }}}
 
 func runEdit(pkgName string) error { // {{{
@@ -222,58 +713,66 @@ func runEdit(pkgName string) error { // {{{
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	return runCmd(cmd)
 } // }}}
 
 func runInstall(args installArgs) error { // {{{
-	url := getPackageURL(args.packageURL)
-	pkg := filepath.Base(url)
-	err := runClone(args.packageURL)
+	pkg, err := runClone(cloneArgs{
+		packageURL:  args.packageURL,
+		from:        args.from,
+		depth:       args.depth,
+		recurseSubs: args.recurseSubs,
+	})
 	if err != nil {
 		return err
 	}
+	return installClonedPackage(pkg, args)
+} // }}}
 
-	if err := installMakedeb(); err != nil {
+// installClonedPackage reviews, builds and installs a package that has just
+// been cloned (args.packageURL is ignored)
+func installClonedPackage(pkg string, args installArgs) error { // {{{
+	if err := ensureMakedeb(); err != nil {
 		return err
 	}
 
-	// open $EDITOR PKGBUILD:
-	if args.confirm {
-		editor := os.Getenv("EDITOR")
-		if editor == "" {
-			editor = "vim"
-		}
-		cmd := exec.Command(editor, mprDir(pkg, "PKGBUILD"))
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
+	if args.review {
+		if err := runEdit(pkg); err != nil {
 			return err
 		}
+	}
 
-		// ask for confirmation:
-		fmt.Print("Do you want to build the package now? [y/N] ")
-		var answer string
-		fmt.Scanln(&answer)
-		if answer != "y" && answer != "Y" {
+	if args.confirm {
+		build, err := promptYesNo(os.Stdout, os.Stdin, "Do you want to build the package now?", false)
+		if err != nil {
+			return err
+		}
+		if !build {
+			if args.keepOnAbort {
+				return markError(fmt.Errorf("installation of %s aborted (the clone was kept in %s)", pkg, mprDir(pkg)), errAborted)
+			}
 			os.RemoveAll(mprDir(pkg))
-			os.Exit(1)
+			invalidatePackageIndex()
+			return markError(fmt.Errorf("installation of %s aborted", pkg), errAborted)
 		}
 	}
 
-	var makedebArgs []string
-	if !args.confirm {
-		makedebArgs = append(makedebArgs, "-si", "--no-confirm")
-	} else {
-		makedebArgs = append(makedebArgs, "-si")
+	var extraArgs []string
+	if args.prefetch {
+		var err error
+		if extraArgs, err = prefetchSources(pkg); err != nil {
+			return err
+		}
 	}
 
 	fmt.Printf("=> installing %s\n", pkg)
-	cmd := mkcmd(true, "makedeb", makedebArgs...)
-	cmd.Dir = mprDir(pkg)
-	err = cmd.Run()
+	cmd, err := makedebCmd(pkg, makedebOpInstall, args.makedebConfirm, extraArgs...)
+	if err != nil {
+		return err
+	}
+	err = runCmd(cmd)
 	if err != nil {
-		os.Exit(1)
+		return markError(err, errBuildFailed)
 	}
 
 	err = updateMakedebInstallReceipt(pkg)
@@ -281,42 +780,1176 @@ func runInstall(args installArgs) error { // {{{
 		return err
 	}
 
+	if args.cleanAfter {
+		return cleanBuildArtifacts(pkg)
+	}
+
 	return nil
 } // }}}
 
-func runList() error { // {{{
-	packages, err := listPackages()
+// runInstallFromFile installs each package listed in file, with the flags in
+// args (args.packageURL is ignored)
+func runInstallFromFile(file string, args installArgs) error { // {{{
+	f, err := os.Open(file)
 	if err != nil {
 		return err
 	}
-	for _, pkg := range packages {
-		fmt.Println(pkg)
+	specs, err := parsePackageList(f)
+	f.Close()
+	if err != nil {
+		return err
 	}
-	return nil
-} // }}}
 
-func runOutdated() error { // {{{
-	var outdatedPkgs []string
-	packages, err := listPackages()
+	installedPkgs, err := listPackages()
 	if err != nil {
 		return err
 	}
-	for _, pkg := range packages {
-		behind, err := isBehind(pkg)
-		if err != nil {
-			return err
+
+	type pkgError struct {
+		spec string
+		err  error
+	}
+	installed := make([]string, 0)
+	skipped := make([]string, 0)
+	failed := make([]pkgError, 0)
+	for _, spec := range specs {
+		url, err := resolvePackageURL(spec, args.from)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: could not install %s: %s\n", spec, err)
+			failed = append(failed, pkgError{spec: spec, err: err})
+			continue
+		}
+		pkg := getPackageNameFromURL(url)
+		if stringSliceContainsString(installedPkgs, pkg) {
+			fmt.Printf("=> skipping %s (already installed)\n", pkg)
+			skipped = append(skipped, pkg)
+			continue
+		}
+
+		pkgArgs := args
+		pkgArgs.packageURL = spec
+		err = runInstall(pkgArgs)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: could not install %s: %s\n", spec, err)
+			failed = append(failed, pkgError{spec: spec, err: err})
+			continue
+		}
+		installed = append(installed, pkg)
+	}
+
+	fmt.Printf("\ninstalled: %d, skipped: %d, failed: %d\n", len(installed), len(skipped), len(failed))
+	if len(failed) > 0 {
+		msg := ""
+		for _, f := range failed {
+			msg += fmt.Sprintf("- %s: %s\n", f.spec, f.err)
+		}
+		return fmt.Errorf("some packages failed to install:\n%s", msg)
+	}
+	return nil
+} // }}}
+
+func runList(args listArgs) error { // {{{
+	packages, broken, err := scanPackages()
+	if err != nil {
+		return err
+	}
+	if packages, err = filterPackages(packages, args.filter); err != nil {
+		return err
+	}
+	if args.filter != "" {
+		for dir := range broken {
+			if matched, _ := path.Match(args.filter, dir); !matched {
+				delete(broken, dir)
+			}
+		}
+	}
+	if args.pinned {
+		pinned, err := readPinnedPackages()
+		if err != nil {
+			return err
+		}
+		kept := make([]string, 0, len(packages))
+		for _, pkg := range packages {
+			if stringSliceContainsString(pinned, pkg) {
+				kept = append(kept, pkg)
+			}
+		}
+		packages = kept
+		for dir := range broken {
+			if !stringSliceContainsString(pinned, dir) {
+				delete(broken, dir)
+			}
+		}
+	}
+	if args.showErrors {
+		// report these on stderr, so that stdout stays a plain list:
+		defer printBrokenPackages(os.Stderr, broken)
+	}
+	packages, err = sortPackages(packages, args.sort)
+	if err != nil {
+		return err
+	}
+	if args.output == listOutputJSON {
+		return writeJSON(os.Stdout, listEntries(packages, broken))
+	}
+	if !args.long {
+		for _, pkg := range packages {
+			fmt.Println(pkg)
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPKGBUILD\tINSTALLED\tLAST BUILT\tSTATE")
+	for _, pkg := range packages {
+		lastBuilt := "-"
+		if t, err := readMakedebBuildTime(pkg); err == nil {
+			lastBuilt = formatBuildTime(t)
+		}
+		pkgbuild := NewPKGBUILD(mprDir(pkg))
+		pkgbuildVersion, err := pkgbuild.getPkgbuildDebVersion()
+		if err != nil {
+			fmt.Fprintf(w, "%s\t-\t-\t%s\terror: %s\n", pkg, lastBuilt, err)
+			continue
+		}
+		state, installedVersion, err := pkgbuild.getInstallState()
+		if err != nil {
+			fmt.Fprintf(w, "%s\t%s\t-\t%s\terror: %s\n", pkg, pkgbuildVersion, lastBuilt, err)
+			continue
+		}
+		if installedVersion == "" {
+			installedVersion = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", pkg, pkgbuildVersion, installedVersion, lastBuilt, state)
+	}
+	return w.Flush()
+} // }}}
+
+// listEntries describes the given packages for `mpr list -o json`. Broken
+// packages are listed last (by name), with their error instead of a version.
+func listEntries(packages []string, broken map[string]error) []listEntry { // {{{
+	entries := make([]listEntry, 0, len(packages)+len(broken))
+	for _, pkg := range packages {
+		entry := listEntry{Name: pkg, Path: mprDir(pkg)}
+		version, err := NewPKGBUILD(mprDir(pkg)).getPkgver()
+		if err != nil {
+			entry.Error = err.Error()
+		} else {
+			entry.Version = &version
 		}
-		if behind {
+		entries = append(entries, entry)
+	}
+
+	brokenPkgs := make([]string, 0, len(broken))
+	for pkg := range broken {
+		brokenPkgs = append(brokenPkgs, pkg)
+	}
+	sort.Strings(brokenPkgs)
+	for _, pkg := range brokenPkgs {
+		entries = append(entries, listEntry{Name: pkg, Path: mprDir(pkg), Error: broken[pkg].Error()})
+	}
+	return entries
+} // }}}
+
+// findOutdated checks which of the given packages are behind their install
+// receipt, using up to `jobs` concurrent workers. Packages that could not be
+// checked are returned separately, with their errors, rather than aborting
+// the whole check.
+func findOutdated(packages []string, jobs int) ([]string, map[string]error) { // {{{
+	mux := sync.Mutex{}
+	outdatedPkgs := make([]string, 0)
+	pkgErrors := make(map[string]error)
+
+	doParallel(len(packages), jobs, func(i int) error {
+		pkg := packages[i]
+		behind, err := isBehind(pkg)
+
+		mux.Lock()
+		defer mux.Unlock()
+		if err != nil {
+			pkgErrors[pkg] = err
+		} else if behind {
 			outdatedPkgs = append(outdatedPkgs, pkg)
 		}
+		return nil
+	})
+
+	sort.Strings(outdatedPkgs)
+	return outdatedPkgs, pkgErrors
+} // }}}
+
+// pkgErrorsError reports the packages that could not be checked, one
+// "- pkg: error" line each, sorted by package
+func pkgErrorsError(pkgErrors map[string]error) error { // {{{
+	erroredPkgs := make([]string, 0, len(pkgErrors))
+	for pkg := range pkgErrors {
+		erroredPkgs = append(erroredPkgs, pkg)
+	}
+	sort.Strings(erroredPkgs)
+
+	msg := ""
+	for _, pkg := range erroredPkgs {
+		msg += fmt.Sprintf("- %s: %s\n", pkg, pkgErrors[pkg])
+	}
+	return fmt.Errorf("could not check %s:\n%s", pluralize(len(pkgErrors), "package"), msg)
+} // }}}
+
+// printBrokenPackages reports package directories that failed to evaluate,
+// as returned by scanPackages
+func printBrokenPackages(w io.Writer, broken map[string]error) {
+	dirs := make([]string, 0, len(broken))
+	for dir := range broken {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	red := color.New(color.FgRed).SprintFunc()
+	for _, dir := range dirs {
+		fmt.Fprintf(w, "%s %s: %s\n", red("error:"), mprDir(dir), broken[dir])
+	}
+}
+
+// The orderings supported by `mpr list --sort`:
+const (
+	listSortName     = "name"     // alphabetically
+	listSortMtime    = "mtime"    // most recently modified PKGBUILD first
+	listSortSize     = "size"     // largest package directory first
+	listSortOutdated = "outdated" // packages behind their receipt first
+)
+
+// sortPackages orders the packages by the given key. The metadata needed for
+// the ordering is gathered concurrently. Ties are broken by name.
+func sortPackages(packages []string, key string) ([]string, error) { // {{{
+	sorted := append([]string{}, packages...)
+	sort.Strings(sorted)
+	if key == listSortName {
+		return sorted, nil
+	}
+
+	// gather a numeric sort key for each package, where larger sorts first:
+	weights := make(map[string]int64)
+	mux := sync.Mutex{}
+	err := doParallel(len(sorted), defaultJobs, func(i int) error {
+		pkg := sorted[i]
+		var weight int64
+		switch key {
+		case listSortMtime:
+			info, err := os.Stat(mprDir(pkg, "PKGBUILD"))
+			if err != nil {
+				return err
+			}
+			weight = info.ModTime().UnixNano()
+		case listSortSize:
+			size, err := dirSize(mprDir(pkg))
+			if err != nil {
+				return err
+			}
+			weight = size
+		case listSortOutdated:
+			behind, err := isBehind(pkg)
+			if err != nil {
+				return err
+			}
+			if behind {
+				weight = 1
+			}
+		default:
+			return fmt.Errorf("unknown sort key: %s", key)
+		}
+
+		mux.Lock()
+		weights[pkg] = weight
+		mux.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return weights[sorted[i]] > weights[sorted[j]]
+	})
+	return sorted, nil
+} // }}}
+
+// resolveLogRange determines the arguments that select the range of commits
+// shown by `mpr log`. By default that is everything since the last install
+// (receipt..HEAD). An explicit --after may be a commit-ish (tag, hash, ...),
+// or a date that git understands (e.g. "2 weeks ago").
+func resolveLogRange(pkg string, after string) ([]string, error) { // {{{
+	if after == "" {
+		receipt, err := readMakedebInstallReceipt(pkg)
+		if err != nil {
+			return nil, err
+		}
+		if receipt == "" {
+			// never installed: show the whole history
+			return []string{"HEAD"}, nil
+		}
+		return []string{receipt + "..HEAD"}, nil
+	}
+
+	if _, err := gitOutput(pkg, "rev-parse", "--verify", "--quiet", after+"^{commit}"); err == nil {
+		return []string{after + "..HEAD"}, nil
+	}
+
+	// not a ref, so try it as a date: git prints "--max-age=<timestamp>", but
+	// falls back to the current time for dates it can't make sense of
+	notADate := fmt.Errorf("%q is neither a commit nor a date", after)
+	out, err := gitOutput(pkg, "rev-parse", "--since="+after)
+	if err != nil || !strings.HasPrefix(out, "--max-age=") {
+		return nil, notADate
+	}
+	timestamp, err := strconv.ParseInt(strings.TrimPrefix(out, "--max-age="), 10, 64)
+	if err != nil {
+		return nil, notADate
+	}
+	if after != "now" && time.Now().Unix()-timestamp < 2 {
+		return nil, notADate
+	}
+	return []string{"--since=" + after, "HEAD"}, nil
+} // }}}
+
+// runDiff shows the local modifications of a package (or of all packages,
+// if pkgName is empty) with `git diff`
+func runDiff(pkgName string) error { // {{{
+	installedPkgs, err := listPackages()
+	if err != nil {
+		return err
+	}
+	if pkgName != "" {
+		if !stringSliceContainsString(installedPkgs, pkgName) {
+			return markError(fmt.Errorf("package %s is not installed", pkgName), errNotFound)
+		}
+		// git pages the output itself:
+		cmd := mkcmd(false, gitBin(), "diff")
+		cmd.Dir = mprDir(pkgName)
+		return runCmd(cmd)
+	}
+
+	return withPager(func(w io.Writer) error {
+		return writeDiffs(w, installedPkgs)
+	})
+} // }}}
+
+// writeDiffs writes the `git diff` of each package that has local
+// modifications to w, under a header with the package's name
+func writeDiffs(w io.Writer, packages []string) error { // {{{
+	colorArg := "--color=always"
+	if color.NoColor {
+		colorArg = "--color=never"
+	}
+	for _, pkg := range packages {
+		diff, err := gitOutput(pkg, "diff", colorArg)
+		if err != nil {
+			return err
+		}
+		if diff == "" {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "=> %s\n%s\n\n", pkg, diff); err != nil {
+			return err
+		}
+	}
+	return nil
+} // }}}
+
+func runLog(pkgName string, after string) error { // {{{
+	installedPkgs, err := listPackages()
+	if err != nil {
+		return err
+	}
+	if !stringSliceContainsString(installedPkgs, pkgName) {
+		return markError(fmt.Errorf("package %s is not installed", pkgName), errNotFound)
+	}
+
+	logRange, err := resolveLogRange(pkgName, after)
+	if err != nil {
+		return err
+	}
+	cmd := mkcmd(false, gitBin(), append([]string{"log"}, logRange...)...)
+	cmd.Dir = mprDir(pkgName)
+	return runCmd(cmd)
+} // }}}
+
+func getOutdatedEntry(pkg string) (outdatedEntry, error) {
+	installedHash, err := readMakedebInstallReceipt(pkg)
+	if err != nil {
+		return outdatedEntry{}, err
+	}
+	currentHash, err := getPkgHEADCommitHash(pkg)
+	if err != nil {
+		return outdatedEntry{}, err
+	}
+	return outdatedEntry{Name: pkg, InstalledHash: installedHash, CurrentHash: currentHash}, nil
+}
+
+func runOutdated(args outdatedArgs) error { // {{{
+	packages, err := listPackages()
+	if err != nil {
+		return err
+	}
+	if packages, err = filterPackages(packages, args.filter); err != nil {
+		return err
+	}
+
+	outdatedPkgs, pkgErrors := findOutdated(packages, args.jobs)
+	entries := make([]outdatedEntry, 0, len(outdatedPkgs))
+	for _, pkg := range outdatedPkgs {
+		if args.output == listOutputJSON {
+			entry, err := getOutdatedEntry(pkg)
+			if err != nil {
+				pkgErrors[pkg] = err
+				continue
+			}
+			entries = append(entries, entry)
+			continue
+		}
+		if args.porcelain {
+			state, err := getPkgState(pkg)
+			if err != nil {
+				pkgErrors[pkg] = err
+				continue
+			}
+			fmt.Printf("%s %s\n", state.porcelainFlags(), pkg)
+			continue
+		}
+		fmt.Println(pkg)
+	}
+	if args.output == listOutputJSON {
+		if err := writeJSON(os.Stdout, entries); err != nil {
+			return err
+		}
+	}
+
+	if len(pkgErrors) > 0 {
+		return pkgErrorsError(pkgErrors)
+	}
+	if args.exitCode && len(outdatedPkgs) > 0 {
+		return markError(fmt.Errorf("%s outdated", pluralize(len(outdatedPkgs), "package")), errOutdated)
+	}
+	return nil
+} // }}}
+
+// guardDirtyTree checks the git working tree in dir before an automated edit,
+// so that the edit does not get mixed in with unrelated changes. The returned
+// function must be called once the edit is done.
+func guardDirtyTree(w io.Writer, dir string, args dirtyTreeArgs) (func() error, error) { // {{{
+	done := func() error { return nil }
+	dirty, err := isDirtyDir(dir)
+	if err != nil {
+		return done, err
+	}
+	if !dirty {
+		return done, nil
+	}
+
+	switch {
+	case args.requireClean:
+		return done, fmt.Errorf("%s has uncommitted changes (commit or stash them first, or use --autostash)", dir)
+	case args.autostash:
+		fmt.Fprintf(w, "=> stashing uncommitted changes in %s\n", dir)
+		// only the tracked changes are stashed: build artifacts are untracked,
+		// and popping them over re-created ones would conflict
+		cmd := mkcmd(true, gitBin(), "stash", "push", "-m", "mpr autostash")
+		cmd.Dir = dir
+		if err := runCmd(cmd); err != nil {
+			return done, err
+		}
+		return func() error {
+			fmt.Fprintf(w, "=> restoring uncommitted changes in %s\n", dir)
+			cmd := mkcmd(true, gitBin(), "stash", "pop")
+			cmd.Dir = dir
+			return runCmd(cmd)
+		}, nil
+	default:
+		fmt.Fprintf(w, "warning: %s has uncommitted changes, which will be mixed in with this edit (use --require-clean or --autostash)\n", dir)
+		return done, nil
+	}
+} // }}}
+
+// withCleanTree runs edit between guardDirtyTree and its cleanup, making sure
+// the cleanup runs even if the edit fails
+func withCleanTree(dir string, args dirtyTreeArgs, edit func() error) error {
+	done, err := guardDirtyTree(os.Stderr, dir, args)
+	if err != nil {
+		return err
+	}
+	err = edit()
+	if doneErr := done(); err == nil {
+		err = doneErr
+	}
+	return err
+}
+
+func runPin(pkgName string) error { // {{{
+	packages, err := listPackages()
+	if err != nil {
+		return err
+	}
+	if !stringSliceContainsString(packages, pkgName) {
+		return markError(fmt.Errorf("package not installed: %s", pkgName), errNotFound)
+	}
+	pinned, err := readPinnedPackages()
+	if err != nil {
+		return err
+	}
+	if stringSliceContainsString(pinned, pkgName) {
+		fmt.Printf("%s is already pinned\n", pkgName)
+		return nil
+	}
+	if err := writePinnedPackages(append(pinned, pkgName)); err != nil {
+		return err
+	}
+	fmt.Printf("=> pinned %s (update and upgrade will skip it until it is unpinned)\n", pkgName)
+	return nil
+} // }}}
+
+func runUnpin(pkgName string) error { // {{{
+	pinned, err := readPinnedPackages()
+	if err != nil {
+		return err
+	}
+	kept := make([]string, 0, len(pinned))
+	for _, pkg := range pinned {
+		if pkg != pkgName {
+			kept = append(kept, pkg)
+		}
+	}
+	if len(kept) == len(pinned) {
+		return markError(fmt.Errorf("package not pinned: %s", pkgName), errNotFound)
+	}
+	if err := writePinnedPackages(kept); err != nil {
+		return err
+	}
+	fmt.Printf("=> unpinned %s\n", pkgName)
+	return nil
+} // }}}
+
+func runRecomputeSums(args recomputeSumsArgs) error { // {{{
+	pkgName := args.pkgName
+	dir := ""
+	if pkgName == "." {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		dir = cwd
+	} else {
+		dir = mprDir(pkgName)
+	}
+
+	return withCleanTree(dir, args.dirty, func() error {
+		return recomputeSums(dir, args)
+	})
+} // }}}
+
+func recomputeSums(dir string, args recomputeSumsArgs) error { // {{{
+	if err := ensureMakedeb(); err != nil {
+		return err
+	}
+
+	var sberr strings.Builder
+	cmd := exec.Command(makedebBin(), "-g")
+	cmd.Dir = dir
+	cmd.Stderr = &sberr
+	outputBytes, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("could not run makedeb -g: %s%s", err, outputTail(sberr.String(), 10))
+	}
+
+	varsToReplace := parseMakedebG(outputBytes)
+	pkgbuild := NewPKGBUILD(dir)
+	err = pkgbuild.updateVars(varsToReplace)
+	if err != nil {
+		return err
+	}
+
+	if args.srcinfo {
+		if err := writeSRCINFO(dir); err != nil {
+			return err
+		}
+	}
+
+	if args.edit {
+		return runEdit(args.pkgName)
+	}
+
+	return nil
+} // }}}
+
+func runSRCINFO(w io.Writer, args srcinfoArgs) error { // {{{
+	if err := ensureMakedeb(); err != nil {
+		return err
+	}
+	dir := ""
+	if args.pkgName == "." {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		dir = cwd
+	} else {
+		dir = mprDir(args.pkgName)
+	}
+	if _, err := os.Stat(path.Join(dir, "PKGBUILD")); os.IsNotExist(err) {
+		if args.pkgName == "." {
+			return markError(fmt.Errorf("no PKGBUILD in %s", dir), errNotFound)
+		}
+		return markError(fmt.Errorf("package not installed: %s", args.pkgName), errNotFound)
+	}
+
+	if args.stdout {
+		contents, err := generateSRCINFO(dir)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(contents)
+		return err
+	}
+	if err := writeSRCINFO(dir); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "=> wrote %s\n", path.Join(dir, ".SRCINFO"))
+	return nil
+} // }}}
+
+func runReinstall(pkgName string, cleanAfter bool) error { // {{{
+	if err := ensureMakedeb(); err != nil {
+		return err
+	}
+
+	fmt.Printf("=> reinstalling %s\n", pkgName)
+	cmd, err := makedebCmd(pkgName, makedebOpReinstall, true)
+	if err != nil {
+		return err
+	}
+	if err := runCmd(cmd); err != nil {
+		return markError(err, errBuildFailed)
+	}
+	if err := writeMakedebBuildTime(pkgName, time.Now()); err != nil {
+		return err
+	}
+
+	if cleanAfter {
+		return cleanBuildArtifacts(pkgName)
+	}
+	return nil
+} // }}}
+
+type whyArgs struct {
+	pkgName string
+	fetch   bool          // fetch the remote before comparing
+	maxAge  time.Duration // reuse a repology version cached this recently
+}
+
+func runWhy(w io.Writer, args whyArgs) error { // {{{
+	installedPkgs, err := listPackages()
+	if err != nil {
+		return err
+	}
+	if !stringSliceContainsString(installedPkgs, args.pkgName) {
+		return markError(fmt.Errorf("package %s is not installed", args.pkgName), errNotFound)
+	}
+	report, err := gatherWhyReport(args.pkgName, args.fetch, args.maxAge)
+	if err != nil {
+		return err
+	}
+	report.print(w)
+	return nil
+} // }}}
+
+type depsArgs struct {
+	pkgName string
+	reverse bool // list the packages that depend on pkgName instead
+}
+
+func runDeps(w io.Writer, args depsArgs) error { // {{{
+	installedPkgs, err := listPackages()
+	if err != nil {
+		return err
+	}
+	// the reverse dependencies of apt packages can be looked up, too:
+	if !args.reverse && !stringSliceContainsString(installedPkgs, args.pkgName) {
+		return markError(fmt.Errorf("package %s is not installed", args.pkgName), errNotFound)
+	}
+	graph, err := loadLocalDependencies(installedPkgs)
+	if err != nil {
+		return err
+	}
+
+	if !args.reverse {
+		graph.writeTree(w, args.pkgName)
+		return nil
+	}
+	dependents := graph.dependents(args.pkgName)
+	if len(dependents) == 0 {
+		fmt.Fprintf(os.Stderr, "no packages depend on %s\n", args.pkgName)
+		return nil
+	}
+	for _, dependent := range dependents {
+		fmt.Fprintf(w, "%s (%s: %s)\n", dependent.pkg, dependent.kind, dependent.spec)
+	}
+	return nil
+} // }}}
+
+func runShowCmd(pkgName string, op string, confirm bool) error { // {{{
+	installedPkgs, err := listPackages()
+	if err != nil {
+		return err
+	}
+	if !stringSliceContainsString(installedPkgs, pkgName) {
+		return markError(fmt.Errorf("package %s is not installed", pkgName), errNotFound)
+	}
+
+	cmdLine := append([]string{makedebBin()}, assembleMakedebArgs(op, confirm)...)
+	fmt.Println("dir:", mprDir(pkgName))
+	fmt.Println("cmd:", strings.Join(cmdLine, " "))
+	return nil
+} // }}}
+
+// defaultUpdatePullTimeout is how long `git pull` may take for a single
+// package, unless `update --timeout` says otherwise
+const defaultUpdatePullTimeout = 10 * time.Second
+
+// pluralize formats a count of things, e.g. "1 package" or "2 packages"
+func pluralize(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+func updateHeader(count int, jobs int, timeout time.Duration) string {
+	timeoutText := timeout.String()
+	if timeout <= 0 {
+		timeoutText = "none"
+	}
+	return fmt.Sprintf("Updating %s (jobs=%d, timeout=%s)", pluralize(count, "package"), jobs, timeoutText)
+}
+
+func upgradeHeader(count int) string {
+	return fmt.Sprintf("Checking %s for upgrades", pluralize(count, "package"))
+}
+
+// checkStaleHeader estimates how long checking count packages takes, given
+// that requests to repology are made at most once per interval
+func checkStaleHeader(count int, interval time.Duration) string {
+	estimate := (time.Duration(count) * interval).Round(time.Second)
+	return fmt.Sprintf("Checking %s against repology (rate-limited, ~%s estimated)", pluralize(count, "package"), estimate)
+}
+
+func runUpdate(args updateArgs) error { // {{{
+	packages, err := listPackages()
+	if err != nil {
+		return err
+	}
+	if args.retryFailed {
+		if len(args.packagesToUpdate) > 0 {
+			return fmt.Errorf("--retry-failed cannot be combined with a list of packages")
+		}
+		packages, err = failedPackagesToRetry("update", packages)
+		if err != nil {
+			return err
+		}
+		if len(packages) == 0 {
+			fmt.Println("No failed packages to retry")
+			return nil
+		}
+		args.packagesToUpdate = packages
+	} else if len(args.packagesToUpdate) > 0 {
+		// validate that each package in packagesToUpdate exists:
+		for _, pkg := range args.packagesToUpdate {
+			installed := stringSliceContainsString(packages, pkg)
+			if !installed {
+				return fmt.Errorf("package not installed: %s", pkg)
+			}
+		}
+		packages = args.packagesToUpdate
+	}
+	if packages, err = withoutPinnedPackages(packages); err != nil {
+		return err
+	}
+	if len(packages) == 0 {
+		fmt.Println("No packages to update")
+		return nil
+	}
+	// (so that --upgrade does not skip the pinned packages all over again)
+	args.packagesToUpdate = packages
+
+	if args.dryRun {
+		return printUpdatePlan(os.Stdout, packages, args.upgrade)
+	}
+
+	// create an atomic counter:
+	var counter int64 = 0
+	mux := sync.Mutex{}
+	movedPackages := make(map[string]string) // package -> new remote URL
+
+	// the workers share the status line, so it is only written while holding
+	// lineMux:
+	lineMux := sync.Mutex{}
+	_setLine := func(line string) {
+		lineMux.Lock()
+		defer lineMux.Unlock()
+		line = fmt.Sprintf("(%d/%d) %s", atomic.LoadInt64(&counter), len(packages), line)
+		setLine(line)
+	}
+
+	fmt.Println(updateHeader(len(packages), defaultJobs, args.timeout))
+	_setLine("Updating")
+	stopTotalTiming := timings.start("update (total)")
+	pullErrors := doParallelCollect(len(packages), defaultJobs, func(i int) error {
+		pkg := packages[i]
+		defer timings.start("update " + pkg)()
+		// kill the command if it takes too long:
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if args.timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, args.timeout)
+		}
+		defer cancel()
+		var sberr strings.Builder
+		cmd := exec.CommandContext(ctx, gitBin(), "pull")
+		cmd.Dir = mprDir(pkg)
+		cmd.Stderr = &sberr
+		err := runCmd(cmd)
+		if err != nil && ctx.Err() == nil && isShallowHistoryError(sberr.String()) && isShallowClone(pkg) {
+			// a shallow clone (see `clone --depth`) may lack the history that
+			// the pull needs:
+			_setLine(fmt.Sprintf("Unshallowing %s", pkg))
+			sberr.Reset()
+			err = unshallowAndPull(ctx, pkg, &sberr)
+		}
+		timedOut := errors.Is(ctx.Err(), context.DeadlineExceeded)
+		atomic.AddInt64(&counter, 1)
+		if err != nil {
+			if timedOut {
+				err = fmt.Errorf("killed, took longer than %s", args.timeout)
+				_setLine(fmt.Sprintf("Killed: %s (took longer than %s)", pkg, args.timeout))
+			} else {
+				err = errors.New(commandErrorLine(sberr.String(), err))
+				_setLine(fmt.Sprintf("Failed: %s: %s", pkg, err))
+			}
+			if isRepoNotFound(sberr.String()) {
+				if newURL := findMovedRemote(pkg); newURL != "" {
+					mux.Lock()
+					movedPackages[pkg] = newURL
+					mux.Unlock()
+				}
+			}
+			return err
+		}
+		_setLine(fmt.Sprintf("Updated %s", pkg))
+
+		return nil
+	})
+	stopTotalTiming()
+	fmt.Println()
+
+	failed := make(map[string]error)
+	for i, err := range pullErrors {
+		if err != nil {
+			failed[packages[i]] = err
+		}
+	}
+	if len(movedPackages) > 0 {
+		fixed, err := followMovedRemotes(movedPackages, args)
+		if err != nil {
+			return err
+		}
+		for _, pkg := range fixed {
+			delete(failed, pkg)
+		}
+	}
+	failedPackages := make([]string, 0, len(failed))
+	for pkg := range failed {
+		failedPackages = append(failedPackages, pkg)
+	}
+	sort.Strings(failedPackages)
+
+	if err := writeFailedPackages("update", packages, failedPackages); err != nil {
+		return err
+	}
+	if len(failedPackages) > 0 {
+		msg := ""
+		for _, pkg := range failedPackages {
+			msg += fmt.Sprintf("- %s: %s\n", pkg, failed[pkg])
+		}
+		return fmt.Errorf("mpr update failed for some packages (re-run with --retry-failed to retry them):\n%s", msg)
+	}
+
+	if args.upgrade {
+		return runUpgrade(upgradeArgs{
+			packages:   args.packagesToUpdate,
+			confirm:    args.confirm,
+			cleanAfter: args.cleanAfter,
+		})
+	} else {
+		fmt.Println("Checking for outdated packages...")
+		return runOutdated(outdatedArgs{jobs: defaultJobs})
+	}
+} // }}}
+
+// findMovedRemote checks whether the origin of a package whose pull failed
+// has moved, returning its new URL (or "" if it cannot tell)
+func findMovedRemote(pkg string) string { // {{{
+	originURL, err := gitOutput(pkg, "remote", "get-url", "origin")
+	if err != nil {
+		return ""
+	}
+	newURL, err := findRepoRedirect(originURL)
+	if err != nil {
+		return ""
+	}
+	return newURL
+} // }}}
+
+// followMovedRemotes reports the packages whose upstream moved, and (with
+// --follow-redirects, or after asking) points their origin at the new location
+// and pulls again. It returns the packages that were updated successfully.
+func followMovedRemotes(moved map[string]string, args updateArgs) ([]string, error) { // {{{
+	pkgs := make([]string, 0, len(moved))
+	for pkg := range moved {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+
+	fixed := make([]string, 0)
+	fmt.Println("Some upstream repositories have moved:")
+	for _, pkg := range pkgs {
+		fmt.Printf("  %s -> %s\n", pkg, moved[pkg])
+	}
+	for _, pkg := range pkgs {
+		follow := args.followRedirects
+		if !follow && args.confirm {
+			var err error
+			follow, err = promptYesNo(os.Stdout, os.Stdin, fmt.Sprintf("Update the remote of %s to %s?", pkg, moved[pkg]), false)
+			if err != nil {
+				return fixed, err
+			}
+		}
+		if !follow {
+			continue
+		}
+
+		cmd := exec.Command(gitBin(), "remote", "set-url", "origin", moved[pkg])
+		cmd.Dir = mprDir(pkg)
+		if err := runCmd(cmd); err != nil {
+			return fixed, fmt.Errorf("could not update the remote of %s: %w", pkg, err)
+		}
+		cmd = exec.Command(gitBin(), "pull")
+		cmd.Dir = mprDir(pkg)
+		if err := runCmd(cmd); err != nil {
+			fmt.Fprintf(os.Stderr, "error: could not update %s from its new remote: %s\n", pkg, err)
+			continue
+		}
+		fmt.Printf("=> updated the remote of %s\n", pkg)
+		fixed = append(fixed, pkg)
+	}
+	return fixed, nil
+} // }}}
+
+// failedPackagesToRetry returns the packages that failed in the last run of
+// command, leaving out those that have been uninstalled since
+func failedPackagesToRetry(command string, installed []string) ([]string, error) { // {{{
+	failed, err := readFailedPackages(command)
+	if err != nil {
+		return nil, err
+	}
+	packages := make([]string, 0, len(failed))
+	for _, pkg := range failed {
+		if stringSliceContainsString(installed, pkg) {
+			packages = append(packages, pkg)
+		}
+	}
+	return packages, nil
+} // }}}
+
+// printUpgradePlan describes what `mpr upgrade` would do: which packages are
+// behind (see isBehind), in the order they would be upgraded, with the commit
+// that was last installed and the commit that would be built
+func printUpgradePlan(w io.Writer, packages []string, skip []string) error { // {{{
+	type plannedUpgrade struct {
+		pkg, installedHash, headHash string
+	}
+	planned := make([]plannedUpgrade, 0)
+	pkgErrors := make(map[string]error)
+	for _, pkg := range packages {
+		if stringSliceContainsString(skip, pkg) {
+			continue
+		}
+		behind, err := isBehind(pkg)
+		if err != nil {
+			pkgErrors[pkg] = err
+			continue
+		}
+		if !behind {
+			continue
+		}
+		entry, err := getOutdatedEntry(pkg)
+		if err != nil {
+			pkgErrors[pkg] = err
+			continue
+		}
+		planned = append(planned, plannedUpgrade{pkg: pkg, installedHash: entry.InstalledHash, headHash: entry.CurrentHash})
+	}
+
+	fmt.Fprintf(w, "Would upgrade %s:\n", pluralize(len(planned), "package"))
+	for _, upgrade := range planned {
+		installedHash := upgrade.installedHash
+		if installedHash == "" {
+			installedHash = "(never installed)"
+		}
+		fmt.Fprintf(w, "  %s: %s -> %s\n", upgrade.pkg, installedHash, upgrade.headHash)
+	}
+	if len(pkgErrors) > 0 {
+		return pkgErrorsError(pkgErrors)
+	}
+	return nil
+} // }}}
+
+// printUpdatePlan describes what `mpr update` would do, without pulling
+// anything. What gets rebuilt by --upgrade depends on the HEADs after pulling,
+// so the prediction can only be based on the current state of each package.
+func printUpdatePlan(w io.Writer, packages []string, upgrade bool) error { // {{{
+	fmt.Fprintf(w, "Would pull %d package(s):\n", len(packages))
+	for _, pkg := range packages {
+		fmt.Fprintf(w, "  %s\n", pkg)
+	}
+	if !upgrade {
+		return nil
+	}
+
+	outdated, pkgErrors := findOutdated(packages, defaultJobs)
+	fmt.Fprintf(w, "Would rebuild at least %d package(s) (based on the current state, before pulling):\n", len(outdated))
+	for _, pkg := range outdated {
+		fmt.Fprintf(w, "  %s\n", pkg)
+	}
+	if len(pkgErrors) > 0 {
+		return pkgErrorsError(pkgErrors)
+	}
+	return nil
+} // }}}
+
+func runUpdateVersion(args updateVersionArgs) error { // {{{
+	pkgName := args.pkgName
+	newVersion := args.newVersion
+	dir := ""
+	if pkgName == "." {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		dir = cwd
+	} else {
+		dir = mprDir(pkgName)
+	}
+
+	if newVersion == "" {
+		pkgbuild := NewPKGBUILD(dir)
+		latestRepologyVersion, err := pkgbuild.getLatestRepologyPkgVersionCached(args.maxAge)
+		if err != nil {
+			return err
+		}
+		newVersion = latestRepologyVersion
+	}
+
+	newValues := map[string]string{"pkgver": newVersion}
+	// (a PKGBUILD without a pkgrel has no pkgrel to reset)
+	hasPkgrel, err := NewPKGBUILD(dir).hasVar("pkgrel")
+	if err != nil {
+		return err
+	}
+	if !hasPkgrel {
+		if args.resetPkgrel {
+			fmt.Fprintf(os.Stderr, "warning: %s has no pkgrel to reset\n", path.Join(dir, "PKGBUILD"))
+		}
+	} else if args.resetPkgrel {
+		newValues["pkgrel"] = "1"
+	} else if !args.keepPkgrel {
+		oldVersion, err := NewPKGBUILD(dir).getSingleVariable("pkgver")
+		if err != nil {
+			return err
+		}
+		if oldVersion != newVersion {
+			newValues["pkgrel"] = "1"
+		}
+	}
+	for name, value := range args.also {
+		newValues[name] = value
+	}
+
+	return withCleanTree(dir, args.dirty, func() error {
+		// updateVars fails without touching the PKGBUILD if any of the variables
+		// doesn't exist:
+		pkgbuild := NewPKGBUILD(dir)
+		if err := pkgbuild.updateVars(newValues); err != nil {
+			return err
+		}
+
+		if args.noSums {
+			if args.edit {
+				return runEdit(pkgName)
+			}
+			return nil
+		}
+
+		return recomputeSums(dir, recomputeSumsArgs{
+			pkgName: pkgName,
+			edit:    args.edit,
+			srcinfo: args.srcinfo,
+		})
+	})
+} // }}}
+
+func runValidate(args validateArgs) error { // {{{
+	dir := ""
+	if args.pkgName == "." {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		dir = cwd
+	} else {
+		dir = mprDir(args.pkgName)
+	}
+
+	pkgbuild := NewPKGBUILD(dir)
+	issues, err := pkgbuild.validate(args)
+	if err != nil {
+		return err
+	}
+
+	yellow := color.New(color.FgYellow).SprintFunc()
+	red := color.New(color.FgRed).SprintFunc()
+	errorCount := 0
+	for _, issue := range issues {
+		if issue.severity == severityError {
+			errorCount++
+			fmt.Printf("%s: %s\n", red(issue.severity), issue.message)
+		} else {
+			fmt.Printf("%s: %s\n", yellow(issue.severity), issue.message)
+		}
 	}
-	for _, pkg := range outdatedPkgs {
-		fmt.Println(pkg)
+
+	if errorCount > 0 {
+		return fmt.Errorf("%s has %d error(s)", args.pkgName, errorCount)
+	}
+	if len(issues) == 0 {
+		fmt.Println("no problems found")
 	}
 	return nil
 } // }}}
 
-func runRecomputeSums(pkgName string, edit bool) error { // {{{
+type sourcesArgs struct {
+	pkgName  string
+	lenient  bool
+	download bool // download the sources into the package directory
+	jobs     int  // how many sources to download at once
+}
+
+func runSources(args sourcesArgs) error { // {{{
+	pkgName, lenient := args.pkgName, args.lenient
 	dir := ""
 	if pkgName == "." {
 		cwd, err := os.Getwd()
@@ -328,181 +1961,328 @@ func runRecomputeSums(pkgName string, edit bool) error { // {{{
 		dir = mprDir(pkgName)
 	}
 
-	cmd := exec.Command("makedeb", "-g")
-	cmd.Dir = dir
-	outputBytes, err := cmd.Output()
+	pkgbuild := NewPKGBUILD(dir)
+	if args.download {
+		_, err := pkgbuild.downloadSources(args.jobs)
+		return err
+	}
+
+	sources, err := pkgbuild.getSourcesWithMode(lenient)
 	if err != nil {
-		return fmt.Errorf("could not run makedeb -g: %s", err)
+		if !lenient {
+			return fmt.Errorf("%w (use --lenient to list them anyway)", err)
+		}
+		return err
 	}
 
-	varsToReplace := parseMakedebG(outputBytes)
-	pkgbuild := NewPKGBUILD(dir)
-	for varName, varValue := range varsToReplace {
-		err = pkgbuild.updateVar(varName, varValue)
-		if err != nil {
-			return err
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tURL\tHASH")
+	for _, source := range sources {
+		hash := source.hash
+		if hash == "" {
+			hash = "-"
 		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", source.localName, source.remoteURL, hash)
 	}
+	return w.Flush()
+} // }}}
 
-	cmd = exec.Command("makedeb", "--print-srcinfo")
-	cmd.Dir = dir
-	outputBytes, err = cmd.Output()
+type statusArgs struct {
+	dirtyOnly bool // only show packages with local modifications
+	porcelain bool // print "<flags> <name>" lines, see porcelainFlags
+}
+
+func runStatus(w io.Writer, args statusArgs) error { // {{{
+	packages, err := listPackages()
 	if err != nil {
-		return fmt.Errorf("could not run makedeb --print-srcinfo: %s", err)
+		return err
 	}
 
-	os.WriteFile(path.Join(dir, ".SRCINFO"), outputBytes, 0)
+	states := make([]pkgState, len(packages))
+	errs := make([]error, len(packages))
+	doParallel(len(packages), defaultJobs, func(i int) error {
+		states[i], errs[i] = getPkgState(packages[i])
+		return nil
+	})
 
-	if edit {
-		return runEdit(pkgName)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	failed := 0
+	for i, pkg := range packages {
+		if errs[i] != nil {
+			failed++
+			if args.porcelain {
+				// stdout only ever has porcelain lines:
+				fmt.Fprintf(os.Stderr, "error: %s: %s\n", pkg, errs[i])
+			} else {
+				fmt.Fprintf(tw, "%s\terror: %s\n", pkg, errs[i])
+			}
+			continue
+		}
+		if args.dirtyOnly && !states[i].dirty {
+			continue
+		}
+		if args.porcelain {
+			fmt.Fprintf(w, "%s %s\n", states[i].porcelainFlags(), pkg)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", pkg, states[i].summary())
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("could not get the status of %s", pluralize(failed, "package"))
 	}
-
 	return nil
 } // }}}
 
-func runReinstall(pkgName string) error { // {{{
-	fmt.Printf("=> reinstalling %s\n", pkgName)
-	cmd := mkcmd(true, "makedeb", "-si")
-	cmd.Dir = mprDir(pkgName)
-	return cmd.Run()
-} // }}}
+type uninstallArgs struct {
+	pkgName     string
+	keepSources bool // only remove the apt package, not the git clone
+	purge       bool // also remove the package's configuration files
+	confirm     bool // ask before removing the git clone
+}
 
-func runUpdate(args updateArgs) error { // {{{
-	packages, err := listPackages()
+func runUninstall(args uninstallArgs) error { // {{{
+	pkgName := args.pkgName
+	installedPkgs, err := listPackages()
 	if err != nil {
 		return err
 	}
-	if len(args.packagesToUpdate) > 0 {
-		// validate that each package in packagesToUpdate exists:
-		for _, pkg := range args.packagesToUpdate {
-			installed := stringSliceContainsString(packages, pkg)
-			if !installed {
-				return fmt.Errorf("package not installed: %s", pkg)
-			}
-		}
-		packages = args.packagesToUpdate
+	if !stringSliceContainsString(installedPkgs, pkgName) {
+		return markError(fmt.Errorf("package %s is not installed", pkgName), errNotFound)
 	}
 
-	// create an atomic counter:
-	var counter int64 = 0
-	failedPackages := make([]string, 0)
-
-	_setLine := func(line string) {
-		line = fmt.Sprintf("(%d/%d) %s", counter, len(packages), line)
-		setLine(line)
+	// uninstall the package:
+	fmt.Printf("=> uninstalling %s\n", pkgName)
+	aptOp := "remove"
+	if args.purge {
+		aptOp = "purge"
+	}
+	cmd := mkcmd(true, "sudo", aptBin(), aptOp, pkgName)
+	if err = runCmd(cmd); err != nil {
+		return err
 	}
 
-	_setLine("Updating")
-	err = doParallel(len(packages), 10, func(i int) error {
-		pkg := packages[i]
-		cmd := exec.Command("git", "pull")
-		cmd.Dir = mprDir(pkg)
-		// kill the command if it takes too long:
-		timer := time.AfterFunc(10*time.Second, func() {
-			if err := cmd.Process.Kill(); err != nil {
-				panic(err)
-			}
-			_setLine(fmt.Sprintf("Killed: %s (took too long)", pkg))
-		})
-		_, err := cmd.Output()
-		atomic.AddInt64(&counter, 1)
-		timer.Stop()
+	if args.keepSources {
+		fmt.Printf("=> keeping %s\n", mprDir(pkgName))
+		return nil
+	}
+	// local edits to the PKGBUILD would be lost for good:
+	dirty, err := isDirty(pkgName)
+	if err != nil {
+		return err
+	}
+	if args.confirm {
+		if dirty {
+			fmt.Fprintf(os.Stderr, "warning: %s has uncommitted changes (a patch of them will be saved to %s)\n", mprDir(pkgName), backupsDir())
+		}
+		remove, err := promptYesNo(os.Stdout, os.Stdin, fmt.Sprintf("Do you want to delete %s?", mprDir(pkgName)), !dirty)
 		if err != nil {
-			_setLine(fmt.Sprintf("Killed: %s (took too long)", pkg))
-			failedPackages = append(failedPackages, pkg)
+			return err
 		}
-		_setLine(fmt.Sprintf("Updated %s", pkg))
+		if !remove {
+			fmt.Printf("=> keeping %s\n", mprDir(pkgName))
+			return nil
+		}
+	}
+	if dirty {
+		backup, err := backupLocalChanges(pkgName)
+		if err != nil {
+			return fmt.Errorf("could not back up the uncommitted changes of %s, so it was kept: %w", pkgName, err)
+		}
+		fmt.Printf("=> saved the uncommitted changes of %s to %s (restore them with `git apply`)\n", pkgName, backup)
+	}
 
-		return nil
-	})
-	fmt.Println()
+	// remove the mpr directory:
+	err = os.RemoveAll(mprDir(pkgName))
+	invalidatePackageIndex()
+	if err != nil {
+		return err
+	}
 
+	return nil
+} // }}}
+
+type pkgInfoArgs struct {
+	pkgName     string
+	srcinfoDiff bool
+	merged      bool // merge `foo_<arch>` variables into `foo`
+}
+
+func runPkgInfo(args pkgInfoArgs) error { // {{{
+	pkgName := args.pkgName
+	pkgbuild := NewPKGBUILD(mprDir(pkgName))
+	getVariables := pkgbuild.getVariables
+	if args.merged {
+		getVariables = pkgbuild.getVariablesMerged
+	}
+	allVars, err := getVariables()
 	if err != nil {
 		return err
 	}
 
-	if len(failedPackages) > 0 {
-		return fmt.Errorf("mpr update failed for some packages: %s", strings.Join(failedPackages, ", "))
+	if args.srcinfoDiff {
+		srcinfo, err := readSRCINFO(mprDir(pkgName))
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s has no .SRCINFO (generate one with `mpr srcinfo %s`)", pkgName, pkgName)
+		}
+		if err != nil {
+			return err
+		}
+
+		diffs := diffSRCINFO(srcinfo, *allVars)
+		if len(diffs) == 0 {
+			fmt.Println(".SRCINFO is up to date with the PKGBUILD")
+			return nil
+		}
+		sort.Slice(diffs, func(i, j int) bool { return diffs[i].name < diffs[j].name })
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VARIABLE\t.SRCINFO\tPKGBUILD")
+		for _, diff := range diffs {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", diff.name, strings.Join(diff.srcinfo, " "), strings.Join(diff.pkgbuild, " "))
+		}
+		return w.Flush()
 	}
 
-	if args.upgrade {
-		return runUpgrade(upgradeArgs{
-			packages: args.packagesToUpdate,
-			confirm:  args.confirm,
-		})
+	// the header goes to stderr, so that stdout stays parseable:
+	if lastBuilt, err := readMakedebBuildTime(pkgName); err == nil {
+		fmt.Fprintf(os.Stderr, "# last built: %s\n", formatBuildTime(lastBuilt))
+	}
+	if pkgnames := (*allVars)["pkgname"]; len(pkgnames) > 1 {
+		fmt.Fprintf(os.Stderr, "# split package: %s\n", strings.Join(pkgnames, " "))
+	}
+	if args.merged {
+		fmt.Fprintf(os.Stderr, "# variables merged for %s (foo_%s is appended to foo)\n", debianArch(), debianArch())
 	} else {
-		fmt.Println("Checking for outdated packages...")
-		return runOutdated()
+		fmt.Fprintln(os.Stderr, "# raw variables (arch-specific ones are listed separately; see --merged)")
+	}
+	for k, vals := range *allVars {
+		for _, v := range vals {
+			fmt.Printf("%s=%s\n", k, v)
+		}
+	}
+	if runPkgver {
+		pkgver, err := pkgbuild.getPkgver()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("pkgver()=%s\n", pkgver)
+	}
+	for _, issue := range checkScriptlets(mprDir(pkgName), *allVars) {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", issue.message)
 	}
+	return nil
 } // }}}
 
-func runUpdateVersion(pkgName string, newVersion string, edit bool) error { // {{{
+type getArgs struct {
+	pkgName  string // or "." for the current directory
+	variable string
+	merged   bool // merge `foo_<arch>` variables into `foo`
+}
+
+// runGet prints the values of a single variable of a PKGBUILD, one per line
+func runGet(w io.Writer, args getArgs) error { // {{{
 	dir := ""
-	if pkgName == "." {
+	if args.pkgName == "." {
 		cwd, err := os.Getwd()
 		if err != nil {
 			return err
 		}
 		dir = cwd
 	} else {
-		dir = mprDir(pkgName)
+		dir = mprDir(args.pkgName)
+		if _, err := os.Stat(path.Join(dir, "PKGBUILD")); os.IsNotExist(err) {
+			return markError(fmt.Errorf("package not installed: %s", args.pkgName), errNotFound)
+		}
 	}
 
-	if newVersion == "" {
-		pkgbuild := NewPKGBUILD(dir)
-		latestRepologyVersion, err := pkgbuild.getLatestRepologyPkgVersion()
+	pkgbuild := NewPKGBUILD(dir)
+	var values []string
+	if args.merged {
+		vars, err := pkgbuild.getVariablesMerged()
 		if err != nil {
 			return err
 		}
-		newVersion = latestRepologyVersion
+		var ok bool
+		if values, ok = (*vars)[args.variable]; !ok {
+			return markError(fmt.Errorf("variable %s not found", args.variable), errNotFound)
+		}
+	} else {
+		// getVariable cannot tell a missing variable from a PKGBUILD that fails
+		// to evaluate, so evaluate it first:
+		if _, err := pkgbuild.getVariables(); err != nil {
+			return err
+		}
+		var err error
+		if values, err = pkgbuild.getVariable(args.variable); err != nil {
+			return markError(err, errNotFound)
+		}
 	}
-
-	pkgbuild := NewPKGBUILD(dir)
-	err := pkgbuild.updateVar("pkgver", newVersion)
-	if err != nil {
-		return err
+	for _, value := range values {
+		fmt.Fprintln(w, value)
 	}
-
-	return runRecomputeSums(pkgName, edit)
+	return nil
 } // }}}
 
-func runUninstall(pkgName string) error { // {{{
-	installedPkgs, err := listPackages()
-	if err != nil {
-		return err
-	}
-	if !stringSliceContainsString(installedPkgs, pkgName) {
-		return fmt.Errorf("package %s is not installed", pkgName)
-	}
+type setArgs struct {
+	pkgName       string // or "." for the current directory
+	variable      string
+	value         string // written as-is, so it must be quoted as in a PKGBUILD
+	create        bool   // append the variable if the PKGBUILD does not declare it
+	recomputeSums bool
+	dirty         dirtyTreeArgs
+}
 
-	// uninstall the package:
-	fmt.Printf("=> uninstalling %s\n", pkgName)
-	cmd := mkcmd(true, "sudo", "apt-get", "remove", pkgName)
-	if err = cmd.Run(); err != nil {
-		return err
+// runSet replaces the value of a single variable of a PKGBUILD
+func runSet(args setArgs) error { // {{{
+	if !varNameRegex.MatchString(args.variable) {
+		return usageErrorf("invalid variable name %q: expected letters, digits and underscores, not starting with a digit", args.variable)
+	}
+	dir := ""
+	if args.pkgName == "." {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		dir = cwd
+	} else {
+		dir = mprDir(args.pkgName)
+		if _, err := os.Stat(path.Join(dir, "PKGBUILD")); os.IsNotExist(err) {
+			return markError(fmt.Errorf("package not installed: %s", args.pkgName), errNotFound)
+		}
 	}
 
-	// remove the mpr directory:
-	err = os.RemoveAll(mprDir(pkgName))
+	pkgbuild := NewPKGBUILD(dir)
+	exists, err := pkgbuild.hasVar(args.variable)
 	if err != nil {
 		return err
 	}
+	if !exists && !args.create {
+		return markError(fmt.Errorf("variable %s not found (use --create to add it)", args.variable), errNotFound)
+	}
 
-	return nil
-} // }}}
+	return withCleanTree(dir, args.dirty, func() error {
+		if exists {
+			err = pkgbuild.updateVar(args.variable, args.value)
+		} else {
+			err = pkgbuild.appendVar(args.variable, args.value)
+		}
+		if err != nil {
+			return err
+		}
 
-func runPkgInfo(pkgName string) error { // {{{
-	pkgbuild := NewPKGBUILD(mprDir(pkgName))
-	allVars, err := pkgbuild.getVariables()
-	if err != nil {
-		return err
-	}
-	for k, vals := range *allVars {
-		for _, v := range vals {
-			fmt.Printf("%s=%s\n", k, v)
+		if args.recomputeSums {
+			// (recomputeSums rather than runRecomputeSums, since the tree is
+			// already guarded)
+			return recomputeSums(dir, recomputeSumsArgs{
+				pkgName: args.pkgName,
+				srcinfo: true,
+			})
 		}
-	}
-	return nil
+		return nil
+	})
 } // }}}
 
 func runUpgrade(args upgradeArgs) error { // {{{
@@ -510,7 +2290,19 @@ func runUpgrade(args upgradeArgs) error { // {{{
 	if err != nil {
 		return err
 	}
-	if len(args.packages) > 0 {
+	if args.retryFailed {
+		if len(args.packages) > 0 {
+			return fmt.Errorf("--retry-failed cannot be combined with a list of packages")
+		}
+		packages, err = failedPackagesToRetry("upgrade", packages)
+		if err != nil {
+			return err
+		}
+		if len(packages) == 0 {
+			fmt.Println("No failed packages to retry")
+			return nil
+		}
+	} else if len(args.packages) > 0 {
 		for _, pkg := range args.packages {
 			installed := stringSliceContainsString(packages, pkg)
 			if !installed {
@@ -519,37 +2311,137 @@ func runUpgrade(args upgradeArgs) error { // {{{
 		}
 		packages = args.packages
 	}
-	for _, pkg := range packages {
-		behind, err := isBehind(pkg)
-		if err != nil {
-			return err
+	if packages, err = withoutPinnedPackages(packages); err != nil {
+		return err
+	}
+	if len(packages) == 0 {
+		fmt.Println("No packages to upgrade")
+		return nil
+	}
+
+	// build dependencies before the packages that need them. A package whose
+	// PKGBUILD cannot be read fails (or is skipped, with --keep-going) when it
+	// is upgraded, so here it only costs the ordering:
+	if graph, err := loadLocalDependencies(packages); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: could not order the packages by their dependencies: %s\n", err)
+	} else {
+		var cycle []string
+		packages, cycle = graph.buildOrder(packages)
+		if len(cycle) > 0 {
+			fmt.Fprintf(os.Stderr, "warning: could not order %s by their dependencies, because of a dependency cycle\n", strings.Join(cycle, ", "))
 		}
-		if !behind {
-			continue
+	}
+
+	// the upgrade state records which packages have been upgraded so far, so
+	// that an interrupted run can be resumed with --resume:
+	state := upgradeState{Upgraded: make([]string, 0)}
+	if args.dryRun {
+		if args.resume {
+			if state, err = readUpgradeState(); err != nil {
+				return err
+			}
 		}
-		if err := installMakedeb(); err != nil {
+		return printUpgradePlan(os.Stdout, packages, state.Upgraded)
+	}
+	if args.resume {
+		state, err = readUpgradeState()
+		if err != nil {
 			return err
 		}
+	} else if err := clearUpgradeState(); err != nil {
+		return err
+	}
 
-		var makedebArgs []string
-		if !args.confirm {
-			makedebArgs = append(makedebArgs, "-si", "--no-confirm")
-		} else {
-			makedebArgs = append(makedebArgs, "-si")
+	type pkgError struct {
+		name string
+		err  error
+	}
+	fmt.Println(upgradeHeader(len(packages)))
+	failed := make([]pkgError, 0)
+	failedNames := func() []string {
+		names := make([]string, 0, len(failed))
+		for _, f := range failed {
+			names = append(names, f.name)
+		}
+		return names
+	}
+	for idx, pkg := range packages {
+		if stringSliceContainsString(state.Upgraded, pkg) {
+			fmt.Printf("=> skipping %s (already upgraded)\n", pkg)
+			continue
 		}
 
-		fmt.Printf("=> upgrading %s\n", pkg)
-		cmd := mkcmd(true, "makedeb", makedebArgs...)
-		cmd.Dir = mprDir(pkg)
-		err = cmd.Run()
+		upgraded, err := upgradePackage(pkg, args)
 		if err != nil {
-			return err
+			if !args.keepGoing {
+				failed = append(failed, pkgError{name: pkg, err: err})
+				// (the packages that this run didn't get to keep their record)
+				if err := writeFailedPackages("upgrade", packages[:idx+1], failedNames()); err != nil {
+					return err
+				}
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "error: could not upgrade %s: %s\n", pkg, err)
+			failed = append(failed, pkgError{name: pkg, err: err})
+			continue
 		}
+		if upgraded {
+			state.Upgraded = append(state.Upgraded, pkg)
+			if err := writeUpgradeState(state); err != nil {
+				return err
+			}
+		}
+	}
 
-		err = updateMakedebInstallReceipt(pkg)
-		if err != nil {
-			return err
+	if err := writeFailedPackages("upgrade", packages, failedNames()); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		msg := ""
+		for _, f := range failed {
+			msg += fmt.Sprintf("- %s: %s\n", f.name, f.err)
 		}
+		return fmt.Errorf("some packages failed to upgrade (re-run with --resume or --retry-failed to retry them):\n%s", msg)
 	}
-	return nil
+
+	return clearUpgradeState()
+} // }}}
+
+// upgradePackage rebuilds and installs a single package, if it is behind its
+// install receipt. It reports whether the package was upgraded.
+func upgradePackage(pkg string, args upgradeArgs) (bool, error) { // {{{
+	behind, err := isBehind(pkg)
+	if err != nil {
+		return false, err
+	}
+	if !behind {
+		return false, nil
+	}
+	if err := ensureMakedeb(); err != nil {
+		return false, err
+	}
+
+	fmt.Printf("=> upgrading %s\n", pkg)
+	cmd, err := makedebCmd(pkg, makedebOpUpgrade, args.confirm)
+	if err != nil {
+		return false, err
+	}
+	stopTiming := timings.start("build " + pkg)
+	err = runCmd(cmd)
+	stopTiming()
+	if err != nil {
+		return false, markError(err, errBuildFailed)
+	}
+
+	err = updateMakedebInstallReceipt(pkg)
+	if err != nil {
+		return false, err
+	}
+
+	if args.cleanAfter {
+		if err := cleanBuildArtifacts(pkg); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
 } // }}}
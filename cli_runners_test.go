@@ -0,0 +1,1736 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFindOutdated(t *testing.T) {
+	setupTestMprDir(t)
+
+	createTestPackage(t, "behind", "pkgname=behind\npkgver=1.0.0\n")
+
+	createTestPackage(t, "up-to-date", "pkgname=up-to-date\npkgver=1.0.0\n")
+	if err := updateMakedebInstallReceipt("up-to-date"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a receipt that can't be read (because it is a directory) makes isBehind
+	// fail for this package:
+	createTestPackage(t, "erroring", "pkgname=erroring\npkgver=1.0.0\n")
+	if err := os.Mkdir(mprDir("erroring", ".git", "makedeb-install-receipt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	packages, err := listPackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packages) != 3 {
+		t.Fatalf("expected 3 packages, got %v", packages)
+	}
+
+	outdated, pkgErrors := findOutdated(packages, 2)
+	if strings.Join(outdated, ",") != "behind" {
+		t.Errorf("expected only 'behind' to be outdated, got %v", outdated)
+	}
+	if len(pkgErrors) != 1 || pkgErrors["erroring"] == nil {
+		t.Errorf("expected only 'erroring' to have an error, got %v", pkgErrors)
+	}
+}
+
+func TestRunOutdatedJSONAndExitCode(t *testing.T) {
+	setupTestMprDir(t)
+	createTestPackage(t, "behind", "pkgname=behind\npkgver=1.0.0\n")
+	createTestPackage(t, "up-to-date", "pkgname=up-to-date\npkgver=1.0.0\n")
+	if err := updateMakedebInstallReceipt("up-to-date"); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := getOutdatedEntry("behind")
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := getPkgHEADCommitHash("behind")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry != (outdatedEntry{Name: "behind", CurrentHash: head}) {
+		t.Errorf("unexpected entry for a package that was never installed: %+v", entry)
+	}
+	var out strings.Builder
+	if err := writeJSON(&out, []outdatedEntry{entry}); err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf(`"name": "behind",
+    "installedHash": "",
+    "currentHash": "%s"`, head)
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("expected the JSON to contain %s, got:\n%s", expected, out.String())
+	}
+
+	if err := runOutdated(outdatedArgs{jobs: 1, output: listOutputJSON}); err != nil {
+		t.Errorf("expected no error without --exit-code, got %v", err)
+	}
+	if err := runOutdated(outdatedArgs{jobs: 1, output: listOutputJSON, exitCode: true}); err == nil || exitCodeFor(err) != exitOutdated {
+		t.Errorf("expected --exit-code to fail when a package is outdated, got %v", err)
+	}
+	if err := runOutdated(outdatedArgs{jobs: 1, filter: "up-*", exitCode: true}); err != nil {
+		t.Errorf("expected --exit-code to succeed when nothing is outdated, got %v", err)
+	}
+}
+
+func BenchmarkFindOutdated(b *testing.B) {
+	setupTestMprDir(b)
+	for _, pkg := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		createTestPackage(b, pkg, "pkgname="+pkg+"\npkgver=1.0.0\n")
+	}
+	packages, err := listPackages()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("serial", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			findOutdated(packages, 1)
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			findOutdated(packages, defaultJobs)
+		}
+	})
+}
+
+func TestRunUpgradeResume(t *testing.T) {
+	setupTestMprDir(t)
+	for _, pkg := range []string{"a", "b", "c"} {
+		createTestPackage(t, pkg, "pkgname="+pkg+"\npkgver=1.0.0\n")
+	}
+
+	// the first run fails while building "b":
+	built := make([]string, 0)
+	fakeRunCmd(t, func(cmd *exec.Cmd) error {
+		if filepath.Base(cmd.Args[0]) != "makedeb" {
+			return nil
+		}
+		pkg := filepath.Base(cmd.Dir)
+		if pkg == "b" {
+			return fmt.Errorf("build failed")
+		}
+		built = append(built, pkg)
+		return nil
+	})
+	if err := runUpgrade(upgradeArgs{}); err == nil {
+		t.Fatal("expected the upgrade to fail")
+	}
+	if strings.Join(built, ",") != "a" {
+		t.Errorf("expected only a to be built, got %v", built)
+	}
+
+	state, err := readUpgradeState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(state.Upgraded, ",") != "a" {
+		t.Errorf("expected the upgrade state to record a, got %v", state.Upgraded)
+	}
+
+	// forget that "a" was installed, so that only the checkpoint prevents it
+	// from being rebuilt:
+	if err := os.Remove(mprDir("a", ".git", "makedeb-install-receipt")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the resumed run only processes the remainder:
+	built = make([]string, 0)
+	fakeRunCmd(t, func(cmd *exec.Cmd) error {
+		if filepath.Base(cmd.Args[0]) == "makedeb" {
+			built = append(built, filepath.Base(cmd.Dir))
+		}
+		return nil
+	})
+	if err := runUpgrade(upgradeArgs{resume: true}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(built, ",") != "b,c" {
+		t.Errorf("expected b and c to be built, got %v", built)
+	}
+
+	// the checkpoint is cleared after a successful run:
+	if _, err := os.Stat(upgradeStatePath()); !os.IsNotExist(err) {
+		t.Errorf("expected the upgrade state to be cleared, got %v", err)
+	}
+}
+
+func TestRunUpgradeDryRun(t *testing.T) {
+	setupTestMprDir(t)
+	for _, pkg := range []string{"a", "b", "c"} {
+		createTestPackage(t, pkg, "pkgname="+pkg+"\npkgver=1.0.0\n")
+	}
+	if err := updateMakedebInstallReceipt("b"); err != nil {
+		t.Fatal(err)
+	}
+	// c was installed, and has a new commit since:
+	if err := updateMakedebInstallReceipt("c"); err != nil {
+		t.Fatal(err)
+	}
+	installedC, _ := getPkgHEADCommitHash("c")
+	runTestGit(t, mprDir("c"), "commit", "-q", "--allow-empty", "-m", "new")
+	headA, _ := getPkgHEADCommitHash("a")
+	headC, _ := getPkgHEADCommitHash("c")
+
+	var out strings.Builder
+	if err := printUpgradePlan(&out, []string{"a", "b", "c"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("Would upgrade 2 packages:\n  a: (never installed) -> %s\n  c: %s -> %s\n", headA, installedC, headC)
+	if out.String() != expected {
+		t.Errorf("expected the plan:\n%s\nGot:\n%s", expected, out.String())
+	}
+
+	// packages that can't be checked are listed one per line:
+	err := printUpgradePlan(io.Discard, []string{"missing-b", "a", "missing-a"}, nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "could not check 2 packages:\n- missing-a: ") || !strings.Contains(err.Error(), "\n- missing-b: ") {
+		t.Errorf("expected both missing packages to be reported, got %v", err)
+	}
+
+	fakeRunCmd(t, func(cmd *exec.Cmd) error {
+		t.Errorf("expected nothing to be run, got %v", cmd.Args)
+		return nil
+	})
+	var runErr error
+	printed := withTestStdout(t, func() { runErr = runUpgrade(upgradeArgs{dryRun: true}) })
+	if runErr != nil {
+		t.Fatal(runErr)
+	}
+	if printed != expected {
+		t.Errorf("expected upgrade --dry-run to print the plan:\n%s\nGot:\n%s", expected, printed)
+	}
+	if _, err := os.Stat(upgradeStatePath()); !os.IsNotExist(err) {
+		t.Errorf("expected a dry run not to write the upgrade state, got %v", err)
+	}
+
+	// with --resume, the packages already upgraded are left out of the plan:
+	if err := writeUpgradeState(upgradeState{Upgraded: []string{"a"}}); err != nil {
+		t.Fatal(err)
+	}
+	printed = withTestStdout(t, func() { runErr = runUpgrade(upgradeArgs{dryRun: true, resume: true}) })
+	if runErr != nil {
+		t.Fatal(runErr)
+	}
+	expected = fmt.Sprintf("Would upgrade 1 package:\n  c: %s -> %s\n", installedC, headC)
+	if printed != expected {
+		t.Errorf("expected upgrade --resume --dry-run to print the plan:\n%s\nGot:\n%s", expected, printed)
+	}
+	state, err := readUpgradeState()
+	if err != nil || len(state.Upgraded) != 1 || state.Upgraded[0] != "a" {
+		t.Errorf("expected a dry run to leave the upgrade state alone, got %v (%v)", state, err)
+	}
+}
+
+func TestSortPackages(t *testing.T) {
+	setupTestMprDir(t)
+
+	createTestPackage(t, "b-large-old", "pkgname=b-large-old\npkgver=1.0.0\n")
+	if err := os.WriteFile(mprDir("b-large-old", "big-file"), make([]byte, 1<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldTime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(mprDir("b-large-old", "PKGBUILD"), oldTime, oldTime); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateMakedebInstallReceipt("b-large-old"); err != nil {
+		t.Fatal(err)
+	}
+
+	createTestPackage(t, "a-small-new", "pkgname=a-small-new\npkgver=1.0.0\n")
+	if err := updateMakedebInstallReceipt("a-small-new"); err != nil {
+		t.Fatal(err)
+	}
+
+	createTestPackage(t, "c-outdated", "pkgname=c-outdated\npkgver=1.0.0\n")
+	midTime := time.Now().Add(-time.Minute)
+	if err := os.Chtimes(mprDir("c-outdated", "PKGBUILD"), midTime, midTime); err != nil {
+		t.Fatal(err)
+	}
+
+	packages := []string{"c-outdated", "a-small-new", "b-large-old"}
+	tests := map[string]string{
+		listSortName:     "a-small-new,b-large-old,c-outdated",
+		listSortMtime:    "a-small-new,c-outdated,b-large-old",
+		listSortSize:     "b-large-old,a-small-new,c-outdated",
+		listSortOutdated: "c-outdated,a-small-new,b-large-old",
+	}
+	for key, expected := range tests {
+		sorted, err := sortPackages(packages, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(sorted, ",") != expected {
+			t.Errorf("--sort %s: expected %s, got %s", key, expected, strings.Join(sorted, ","))
+		}
+	}
+}
+
+func TestResolveLogRange(t *testing.T) {
+	setupTestMprDir(t)
+	dir := createTestPackage(t, "foo", "pkgname=foo\npkgver=1.0.0\n")
+	runTestGit(t, dir, "tag", "v1.0.0")
+
+	logRange, err := resolveLogRange("foo", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(logRange, " ") != "HEAD" {
+		t.Errorf("expected the whole history for a package that was never installed, got %v", logRange)
+	}
+
+	if err := updateMakedebInstallReceipt("foo"); err != nil {
+		t.Fatal(err)
+	}
+	receipt, _ := readMakedebInstallReceipt("foo")
+	logRange, _ = resolveLogRange("foo", "")
+	if strings.Join(logRange, " ") != receipt+"..HEAD" {
+		t.Errorf("expected receipt..HEAD, got %v", logRange)
+	}
+
+	logRange, err = resolveLogRange("foo", "v1.0.0")
+	if err != nil || strings.Join(logRange, " ") != "v1.0.0..HEAD" {
+		t.Errorf("expected v1.0.0..HEAD, got %v (%v)", logRange, err)
+	}
+
+	logRange, err = resolveLogRange("foo", "2 weeks ago")
+	if err != nil || strings.Join(logRange, " ") != "--since=2 weeks ago HEAD" {
+		t.Errorf("expected a --since range, got %v (%v)", logRange, err)
+	}
+
+	if _, err := resolveLogRange("foo", "not-a-ref-or-date"); err == nil {
+		t.Errorf("expected an error for something that is neither a ref nor a date")
+	}
+}
+
+func TestRunUpdateVersionAlso(t *testing.T) {
+	setupTestMprDir(t)
+	dir := createTestPackage(t, "foo", "pkgname=foo\npkgver=1.0.0\n_commit=aaaa\npkgrel=1\n")
+
+	// a makedeb that computes no new sums:
+	fakeMakedeb := filepath.Join(t.TempDir(), "makedeb")
+	if err := os.WriteFile(fakeMakedeb, []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	originalMakedeb := makedebPath
+	makedebPath = fakeMakedeb
+	defer func() { makedebPath = originalMakedeb }()
+
+	err := runUpdateVersion(updateVersionArgs{
+		pkgName:    "foo",
+		newVersion: "2.0.0",
+		also:       map[string]string{"_commit": "bbbb"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := os.ReadFile(filepath.Join(dir, "PKGBUILD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "pkgname=foo\npkgver=2.0.0\n_commit=bbbb\npkgrel=1\n" {
+		t.Errorf("expected pkgver and _commit to be updated, got:\n%s", contents)
+	}
+
+	err = runUpdateVersion(updateVersionArgs{
+		pkgName:    "foo",
+		newVersion: "3.0.0",
+		also:       map[string]string{"_missing": "x"},
+	})
+	if err == nil {
+		t.Errorf("expected an error for a variable that doesn't exist")
+	}
+	contents, _ = os.ReadFile(filepath.Join(dir, "PKGBUILD"))
+	if !strings.Contains(string(contents), "pkgver=2.0.0") {
+		t.Errorf("expected the PKGBUILD to be left untouched, got:\n%s", contents)
+	}
+}
+
+func TestRunUpdateDryRun(t *testing.T) {
+	setupTestMprDir(t)
+	upstream := t.TempDir()
+	if err := os.WriteFile(filepath.Join(upstream, "PKGBUILD"), []byte("pkgname=foo\npkgver=1.0.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runTestGit(t, upstream, "init", "-q")
+	runTestGit(t, upstream, "add", "PKGBUILD")
+	runTestGit(t, upstream, "commit", "-q", "-m", "initial commit")
+	runTestGit(t, mprDir(), "clone", "-q", upstream, "foo")
+	if err := updateMakedebInstallReceipt("foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	// add a commit upstream that a real update would pull:
+	if err := os.WriteFile(filepath.Join(upstream, "PKGBUILD"), []byte("pkgname=foo\npkgver=2.0.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runTestGit(t, upstream, "commit", "-q", "-am", "bump")
+
+	headBefore, err := getPkgHEADCommitHash("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetchHeadBefore, fetchHeadErr := os.Stat(filepath.Join(mprDir("foo"), ".git", "FETCH_HEAD"))
+
+	if err := runUpdate(updateArgs{packagesToUpdate: []string{"foo"}, upgrade: true, dryRun: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	headAfter, err := getPkgHEADCommitHash("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headAfter != headBefore {
+		t.Errorf("expected HEAD to be unchanged by a dry run")
+	}
+	fetchHeadAfter, err := os.Stat(filepath.Join(mprDir("foo"), ".git", "FETCH_HEAD"))
+	if (fetchHeadErr == nil) != (err == nil) || (err == nil && !fetchHeadAfter.ModTime().Equal(fetchHeadBefore.ModTime())) {
+		t.Errorf("expected a dry run not to fetch")
+	}
+}
+
+func TestRunUpdateTimeout(t *testing.T) {
+	setupTestMprDir(t)
+	createTestPackage(t, "slow", "pkgname=slow\npkgver=1.0\n")
+	createTestPackage(t, "quick", "pkgname=quick\npkgver=1.0\n")
+
+	// a git that hangs when pulling slow, and fails at once otherwise:
+	fakeGit := filepath.Join(t.TempDir(), "git")
+	script := "#!/bin/sh\ncase \"$PWD\" in */slow) exec sleep 5;; esac\necho 'fatal: boom' >&2\nexit 1\n"
+	if err := os.WriteFile(fakeGit, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	originalGitPath := gitPath
+	gitPath = fakeGit
+	t.Cleanup(func() { gitPath = originalGitPath })
+
+	start := time.Now()
+	err := runUpdate(updateArgs{timeout: 100 * time.Millisecond})
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("expected the slow pull to be killed after the timeout, but the update took %s", elapsed)
+	}
+	if err == nil || !strings.Contains(err.Error(), "- quick: fatal: boom\n- slow: killed, took longer than 100ms\n") {
+		t.Errorf("expected both packages to fail, with their reasons, got %v", err)
+	}
+}
+
+// TestRunUpdateConcurrentFailures updates more packages than are pulled at
+// once, so that the workers race to report their failures (run with -race)
+func TestRunUpdateConcurrentFailures(t *testing.T) {
+	setupTestMprDir(t)
+	expectedFailures := make([]string, 0)
+	for i := 0; i < 2*defaultJobs; i++ {
+		pkg := fmt.Sprintf("ok-%02d", i)
+		if i%3 == 0 {
+			pkg = fmt.Sprintf("fail-%02d", i)
+			expectedFailures = append(expectedFailures, pkg)
+		}
+		createTestPackage(t, pkg, fmt.Sprintf("pkgname=%s\npkgver=1.0\n", pkg))
+	}
+
+	fakeGit := filepath.Join(t.TempDir(), "git")
+	script := "#!/bin/sh\ncase \"$PWD\" in */fail-*) echo 'fatal: boom' >&2; exit 1;; esac\nexit 0\n"
+	if err := os.WriteFile(fakeGit, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	originalGitPath := gitPath
+	gitPath = fakeGit
+	t.Cleanup(func() { gitPath = originalGitPath })
+
+	err := runUpdate(updateArgs{timeout: defaultUpdatePullTimeout})
+	expected := "mpr update failed for some packages (re-run with --retry-failed to retry them):\n"
+	for _, pkg := range expectedFailures {
+		expected += fmt.Sprintf("- %s: fatal: boom\n", pkg)
+	}
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected exactly %v to fail, got %v", expectedFailures, err)
+	}
+	failed, err := readFailedPackages("update")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(failed, ",") != strings.Join(expectedFailures, ",") {
+		t.Errorf("expected the failures %v to be recorded, got %v", expectedFailures, failed)
+	}
+}
+
+func TestRunPinSkipsPinnedPackages(t *testing.T) {
+	setupTestMprDir(t)
+	for _, pkg := range []string{"a", "b", "c"} {
+		createTestPackage(t, pkg, "pkgname="+pkg+"\npkgver=1.0\n")
+	}
+	if err := runPin("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := runPin("b"); err != nil {
+		t.Errorf("expected pinning twice to be fine, got %v", err)
+	}
+	if err := runPin("not-installed"); !errors.Is(err, errNotFound) {
+		t.Errorf("expected pinning a package that is not installed to fail, got %v", err)
+	}
+	if err := runUnpin("a"); !errors.Is(err, errNotFound) {
+		t.Errorf("expected unpinning a package that is not pinned to fail, got %v", err)
+	}
+	if contents, _ := os.ReadFile(mprDir(".mpr", "pinned")); string(contents) != "b\n" {
+		t.Errorf("expected only b to be pinned, got %q", contents)
+	}
+	if packages, _ := listPackages(); strings.Join(packages, ",") != "a,b,c" {
+		t.Errorf("expected the pins not to be mistaken for a package, got %v", packages)
+	}
+
+	// every pull fails, so the error lists the packages that were pulled:
+	fakeGit := filepath.Join(t.TempDir(), "git")
+	if err := os.WriteFile(fakeGit, []byte("#!/bin/sh\necho 'fatal: boom' >&2\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	originalGitPath := gitPath
+	gitPath = fakeGit
+	t.Cleanup(func() { gitPath = originalGitPath })
+
+	err := runUpdate(updateArgs{timeout: defaultUpdatePullTimeout})
+	expected := "mpr update failed for some packages (re-run with --retry-failed to retry them):\n- a: fatal: boom\n- c: fatal: boom\n"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected the pinned package to be skipped, got %v", err)
+	}
+
+	if err := runUnpin("b"); err != nil {
+		t.Fatal(err)
+	}
+	if pinned, err := readPinnedPackages(); err != nil || len(pinned) != 0 {
+		t.Errorf("expected nothing to be pinned, got %v (%v)", pinned, err)
+	}
+}
+
+func TestPrintUpdatePlan(t *testing.T) {
+	setupTestMprDir(t)
+	createTestPackage(t, "behind", "pkgname=behind\npkgver=1.0.0\n")
+	createTestPackage(t, "current", "pkgname=current\npkgver=1.0.0\n")
+	if err := updateMakedebInstallReceipt("current"); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := printUpdatePlan(&out, []string{"behind", "current"}, true); err != nil {
+		t.Fatal(err)
+	}
+	expected := "Would pull 2 package(s):\n  behind\n  current\n" +
+		"Would rebuild at least 1 package(s) (based on the current state, before pulling):\n  behind\n"
+	if out.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+
+	err := printUpdatePlan(io.Discard, []string{"behind", "missing"}, true)
+	if err == nil || !strings.HasPrefix(err.Error(), "could not check 1 package:\n- missing: ") {
+		t.Errorf("expected the missing package to be reported, got %v", err)
+	}
+}
+
+func TestRunEachParallel(t *testing.T) {
+	setupTestMprDir(t)
+	createTestPackage(t, "a", "pkgname=a\npkgver=1.0.0\n")
+	createTestPackage(t, "b", "pkgname=b\npkgver=1.0.0\n")
+	command := []string{"sh", "-c", "printf 'one\\ntwo'"}
+
+	var out strings.Builder
+	if err := runEachParallel(&out, []string{"a", "b"}, eachArgs{command: command, output: eachOutputPrefix}); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"[a] one\n", "[a] two\n", "[b] one\n", "[b] two\n"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected %q in output, got %q", expected, out.String())
+		}
+	}
+
+	out.Reset()
+	if err := runEachParallel(&out, []string{"a", "b"}, eachArgs{command: command, output: eachOutputGroup}); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"=> a\none\ntwo\n", "=> b\none\ntwo\n"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected %q in output, got %q", expected, out.String())
+		}
+	}
+
+	// with a single job, the packages run (and print) one after the other:
+	out.Reset()
+	if err := runEachParallel(&out, []string{"a", "b"}, eachArgs{command: command, output: eachOutputGroup, jobs: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "=> a\none\ntwo\n=> b\none\ntwo\n"; out.String() != expected {
+		t.Errorf("expected %q, got %q", expected, out.String())
+	}
+
+	out.Reset()
+	if err := runEachParallel(&out, []string{"a"}, eachArgs{command: []string{"false"}, output: eachOutputPrefix}); err == nil {
+		t.Errorf("expected a failing command to return an error")
+	}
+}
+
+func TestRunEachKeepGoing(t *testing.T) {
+	setupTestMprDir(t)
+	for _, pkg := range []string{"a", "b", "c"} {
+		createTestPackage(t, pkg, "pkgname="+pkg+"\npkgver=1.0.0\n")
+	}
+	// fails with 3 in "a" and "b", and leaves a marker in every package it runs in:
+	command := []string{"sh", "-c", "touch ran; [ \"$(basename \"$PWD\")\" = c ] || exit 3"}
+	ran := func() []string {
+		var pkgs []string
+		for _, pkg := range []string{"a", "b", "c"} {
+			if _, err := os.Stat(mprDir(pkg, "ran")); err == nil {
+				pkgs = append(pkgs, pkg)
+				os.Remove(mprDir(pkg, "ran"))
+			}
+		}
+		return pkgs
+	}
+
+	// fail fast by default:
+	if err := runEach(eachArgs{command: command}); err == nil {
+		t.Errorf("expected a failing command to return an error")
+	}
+	if pkgs := ran(); strings.Join(pkgs, ",") != "a" {
+		t.Errorf("expected the command to only run in a, ran in %v", pkgs)
+	}
+
+	if err := runEach(eachArgs{command: command, keepGoing: true}); err == nil || !strings.Contains(err.Error(), "2 packages") {
+		t.Errorf("expected an error for the 2 failed packages, got %v", err)
+	}
+	if pkgs := ran(); strings.Join(pkgs, ",") != "a,b,c" {
+		t.Errorf("expected the command to run in all packages, ran in %v", pkgs)
+	}
+
+	var out strings.Builder
+	if err := runEachParallel(&out, []string{"a", "b", "c"}, eachArgs{command: command, output: eachOutputGroup, keepGoing: true}); err == nil {
+		t.Errorf("expected an error for the failed packages")
+	}
+	expected := "the command failed in 2 of 3 packages:\n  a: exit status 3\n  b: exit status 3\n"
+	if !strings.HasSuffix(out.String(), expected) {
+		t.Errorf("expected the output to end with the summary %q, got %q", expected, out.String())
+	}
+}
+
+func TestRunUpgradeRetryFailed(t *testing.T) {
+	setupTestMprDir(t)
+	for _, pkg := range []string{"a", "b", "c", "d"} {
+		createTestPackage(t, pkg, "pkgname="+pkg+"\npkgver=1.0.0\n")
+	}
+
+	// the first run fails for "b" and "d":
+	fakeRunCmd(t, func(cmd *exec.Cmd) error {
+		if filepath.Base(cmd.Args[0]) != "makedeb" {
+			return nil
+		}
+		if pkg := filepath.Base(cmd.Dir); pkg == "b" || pkg == "d" {
+			return fmt.Errorf("build failed")
+		}
+		return nil
+	})
+	if err := runUpgrade(upgradeArgs{keepGoing: true}); err == nil {
+		t.Fatal("expected the upgrade to fail")
+	}
+	failed, err := readFailedPackages("upgrade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(failed, ",") != "b,d" {
+		t.Errorf("expected b and d to be recorded as failed, got %v", failed)
+	}
+
+	// forget that "a" and "c" were installed, so that only --retry-failed
+	// keeps them from being rebuilt:
+	for _, pkg := range []string{"a", "c"} {
+		if err := os.Remove(mprDir(pkg, ".git", "makedeb-install-receipt")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	built := make([]string, 0)
+	fakeRunCmd(t, func(cmd *exec.Cmd) error {
+		if filepath.Base(cmd.Args[0]) == "makedeb" {
+			built = append(built, filepath.Base(cmd.Dir))
+		}
+		return nil
+	})
+	if err := runUpgrade(upgradeArgs{retryFailed: true}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(built, ",") != "b,d" {
+		t.Errorf("expected exactly b and d to be retried, got %v", built)
+	}
+
+	// a run over some of the packages only updates their record:
+	if err := writeFailedPackages("upgrade", nil, []string{"b", "d"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runUpgrade(upgradeArgs{packages: []string{"b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if failed, err := readFailedPackages("upgrade"); err != nil || strings.Join(failed, ",") != "d" {
+		t.Errorf("expected d to still be recorded as failed, got %v (%v)", failed, err)
+	}
+
+	// the record is cleared after a successful run:
+	if err := runUpgrade(upgradeArgs{retryFailed: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(failedPackagesPath("upgrade")); !os.IsNotExist(err) {
+		t.Errorf("expected the failed packages to be cleared, got %v", err)
+	}
+}
+
+func TestRunUpgradeUnreadableDependencies(t *testing.T) {
+	setupTestMprDir(t)
+	// a clone whose directory is not named after its pkgname cannot be read
+	// by name:
+	createTestPackage(t, "misnamed-git", "pkgname=misnamed\npkgver=1.0.0\n")
+	createTestPackage(t, "ok", "pkgname=ok\npkgver=1.0.0\n")
+
+	built := make([]string, 0)
+	fakeRunCmd(t, func(cmd *exec.Cmd) error {
+		if filepath.Base(cmd.Args[0]) == "makedeb" {
+			built = append(built, filepath.Base(cmd.Dir))
+		}
+		return nil
+	})
+	// a package whose dependencies cannot be read does not keep the others from
+	// being upgraded:
+	runUpgrade(upgradeArgs{keepGoing: true})
+	if !stringSliceContainsString(built, "ok") {
+		t.Errorf("expected ok to be upgraded, got %v", built)
+	}
+}
+
+func TestRunUpdateRetryFailed(t *testing.T) {
+	setupTestMprDir(t)
+	if err := writeFailedPackages("update", nil, []string{"gone"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// packages that have since been uninstalled are not retried:
+	if err := runUpdate(updateArgs{retryFailed: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runUpdate(updateArgs{retryFailed: true, packagesToUpdate: []string{"a"}}); err == nil {
+		t.Errorf("expected --retry-failed with a list of packages to be rejected")
+	}
+}
+
+func TestRunRecomputeSumsSurfacesStderr(t *testing.T) {
+	setupTestMprDir(t)
+	createTestPackage(t, "foo", "pkgname=foo\npkgver=1.0.0\n")
+
+	fakeMakedeb := filepath.Join(t.TempDir(), "makedeb")
+	script := "#!/bin/sh\necho 'progress on stdout'\necho 'ERROR: Failure while downloading foo.tar.gz' >&2\nexit 1\n"
+	if err := os.WriteFile(fakeMakedeb, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	originalMakedeb := makedebPath
+	makedebPath = fakeMakedeb
+	defer func() { makedebPath = originalMakedeb }()
+
+	err := runRecomputeSums(recomputeSumsArgs{pkgName: "foo"})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), "ERROR: Failure while downloading foo.tar.gz") {
+		t.Errorf("expected makedeb's stderr in the error, got: %v", err)
+	}
+}
+
+func TestRunSRCINFO(t *testing.T) {
+	setupTestMprDir(t)
+	dir := createTestPackage(t, "foo", "pkgname=foo\npkgver=1.0.0\n")
+
+	fakeMakedeb := filepath.Join(t.TempDir(), "makedeb")
+	script := "#!/bin/sh\n[ \"$1\" = --print-srcinfo ] || exit 1\necho \"pkgbase = $(basename \"$PWD\")\"\n"
+	if err := os.WriteFile(fakeMakedeb, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	originalMakedeb := makedebPath
+	makedebPath = fakeMakedeb
+	defer func() { makedebPath = originalMakedeb }()
+
+	var out strings.Builder
+	if err := runSRCINFO(&out, srcinfoArgs{pkgName: "foo", stdout: true}); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "pkgbase = foo\n" {
+		t.Errorf("expected the .SRCINFO to be printed, got %q", out.String())
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".SRCINFO")); !os.IsNotExist(err) {
+		t.Errorf("expected --stdout not to write the .SRCINFO, got %v", err)
+	}
+
+	// "." is the package in the current directory:
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err := runSRCINFO(io.Discard, srcinfoArgs{pkgName: "."}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, ".SRCINFO"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("expected the .SRCINFO to be written with mode 0644, got %v", info.Mode().Perm())
+	}
+	if contents, _ := os.ReadFile(filepath.Join(dir, ".SRCINFO")); string(contents) != "pkgbase = foo\n" {
+		t.Errorf("expected the .SRCINFO to be written, got %q", contents)
+	}
+
+	if err := runSRCINFO(io.Discard, srcinfoArgs{pkgName: "missing"}); !errors.Is(err, errNotFound) {
+		t.Errorf("expected a missing package to be reported as such, got %v", err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if err := runSRCINFO(io.Discard, srcinfoArgs{pkgName: "."}); !errors.Is(err, errNotFound) || !strings.Contains(err.Error(), "no PKGBUILD") {
+		t.Errorf("expected a directory without a PKGBUILD to be reported as such, got %v", err)
+	}
+}
+
+func TestRunRecomputeSumsWritesSRCINFO(t *testing.T) {
+	setupTestMprDir(t)
+	dir := createTestPackage(t, "foo", "pkgname=foo\npkgver=1.0.0\n")
+
+	// a makedeb that computes no new sums, and prints a .SRCINFO:
+	fakeMakedeb := filepath.Join(t.TempDir(), "makedeb")
+	script := "#!/bin/sh\n[ \"$1\" = --print-srcinfo ] && echo 'pkgbase = foo'\nexit 0\n"
+	if err := os.WriteFile(fakeMakedeb, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	originalMakedeb := makedebPath
+	makedebPath = fakeMakedeb
+	defer func() { makedebPath = originalMakedeb }()
+
+	if err := runRecomputeSums(recomputeSumsArgs{pkgName: "foo", srcinfo: true}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, ".SRCINFO"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("expected the .SRCINFO to be written with mode 0644, got %v", info.Mode().Perm())
+	}
+
+	// a .SRCINFO that cannot be written is an error:
+	if err := os.Remove(filepath.Join(dir, ".SRCINFO")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, ".SRCINFO"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := runRecomputeSums(recomputeSumsArgs{pkgName: "foo", srcinfo: true}); err == nil {
+		t.Errorf("expected an error when the .SRCINFO cannot be written")
+	}
+}
+
+func TestRunGet(t *testing.T) {
+	setupTestMprDir(t)
+	dir := createTestPackage(t, "foo", "pkgname=foo\npkgver=1.0.0\ndepends=('bar' 'baz')\ndepends_"+debianArch()+"=('qux')\n")
+
+	get := func(args getArgs) (string, error) {
+		var out strings.Builder
+		err := runGet(&out, args)
+		return out.String(), err
+	}
+	for _, test := range []struct {
+		args     getArgs
+		expected string
+	}{
+		{getArgs{pkgName: "foo", variable: "pkgver"}, "1.0.0\n"},
+		{getArgs{pkgName: "foo", variable: "depends"}, "bar\nbaz\n"},
+		{getArgs{pkgName: "foo", variable: "depends", merged: true}, "bar\nbaz\nqux\n"},
+	} {
+		actual, err := get(test.args)
+		if err != nil {
+			t.Errorf("%+v: %v", test.args, err)
+		} else if actual != test.expected {
+			t.Errorf("%+v: expected %q, got %q", test.args, test.expected, actual)
+		}
+	}
+
+	if _, err := get(getArgs{pkgName: "foo", variable: "missing"}); !errors.Is(err, errNotFound) {
+		t.Errorf("expected a missing variable to be reported as such, got %v", err)
+	}
+	if _, err := get(getArgs{pkgName: "missing", variable: "pkgver"}); !errors.Is(err, errNotFound) {
+		t.Errorf("expected a missing package to be reported as such, got %v", err)
+	}
+
+	// "." is the package in the current directory:
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if actual, err := get(getArgs{pkgName: ".", variable: "pkgname"}); err != nil || actual != "foo\n" {
+		t.Errorf("expected foo, got %q (%v)", actual, err)
+	}
+}
+
+func TestRunSet(t *testing.T) {
+	setupTestMprDir(t)
+	dir := createTestPackage(t, "foo", "pkgname=foo\npkgver=1.0.0\ndepends=('bar')")
+	readPKGBUILD := func() string {
+		contents, err := os.ReadFile(filepath.Join(dir, "PKGBUILD"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(contents)
+	}
+
+	if err := runSet(setArgs{pkgName: "foo", variable: "pkgver", value: "2.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runSet(setArgs{pkgName: "foo", variable: "depends", value: "('bar' 'baz')"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runSet(setArgs{pkgName: "foo", variable: "pkgrel", value: "2"}); !errors.Is(err, errNotFound) {
+		t.Errorf("expected a variable that is not declared to be reported as such, got %v", err)
+	}
+	if actual := readPKGBUILD(); actual != "pkgname=foo\npkgver=2.0.0\ndepends=('bar' 'baz')" {
+		t.Errorf("expected pkgver and depends to be set, got:\n%s", actual)
+	}
+	if err := runSet(setArgs{pkgName: "foo", variable: "pkgrel", value: "2", create: true}); err != nil {
+		t.Fatal(err)
+	}
+	if actual := readPKGBUILD(); actual != "pkgname=foo\npkgver=2.0.0\ndepends=('bar' 'baz')\npkgrel=2\n" {
+		t.Errorf("expected pkgrel to be appended, got:\n%s", actual)
+	}
+	for _, name := range []string{"x y", "1x", "x;touch pwned", "$(touch pwned)", ""} {
+		if err := runSet(setArgs{pkgName: "foo", variable: name, value: "1", create: true}); exitCodeFor(err) != exitUsage {
+			t.Errorf("expected the variable name %q to be rejected, got %v", name, err)
+		}
+	}
+	if values, err := NewPKGBUILD(dir).getVariable("depends"); err != nil || strings.Join(values, ",") != "bar,baz" {
+		t.Errorf("expected the PKGBUILD to still evaluate, got %v (%v)", values, err)
+	}
+
+	// with --recompute-sums, the .SRCINFO is regenerated too:
+	fakeMakedeb := filepath.Join(t.TempDir(), "makedeb")
+	script := "#!/bin/sh\n[ \"$1\" = --print-srcinfo ] && echo 'pkgbase = foo'\nexit 0\n"
+	if err := os.WriteFile(fakeMakedeb, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	originalMakedeb := makedebPath
+	makedebPath = fakeMakedeb
+	defer func() { makedebPath = originalMakedeb }()
+	if err := runSet(setArgs{pkgName: "foo", variable: "pkgver", value: "3.0.0", recomputeSums: true}); err != nil {
+		t.Fatal(err)
+	}
+	if contents, err := os.ReadFile(filepath.Join(dir, ".SRCINFO")); err != nil || string(contents) != "pkgbase = foo\n" {
+		t.Errorf("expected the .SRCINFO to be regenerated, got %q (%v)", contents, err)
+	}
+}
+
+func TestRunCleanConfirmation(t *testing.T) {
+	setupTestMprDir(t)
+	createTestPackage(t, "a", "pkgname=a\npkgver=1.0.0\n")
+	createTestPackage(t, "b", "pkgname=b\npkgver=1.0.0\n")
+
+	cleaned := make([]string, 0)
+	fakeRunCmd(t, func(cmd *exec.Cmd) error {
+		cleaned = append(cleaned, filepath.Base(cmd.Dir))
+		return nil
+	})
+
+	// declining the prompt cleans nothing:
+	var err error
+	withTestStdin(t, "n\n", func() { err = runClean(cleanArgs{}) })
+	if err == nil {
+		t.Errorf("expected declining to abort the clean")
+	}
+	if len(cleaned) != 0 {
+		t.Errorf("expected nothing to be cleaned, got %v", cleaned)
+	}
+
+	withTestStdin(t, "y\n", func() { err = runClean(cleanArgs{}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(cleaned, ",") != "a,b" {
+		t.Errorf("expected every package to be cleaned, got %v", cleaned)
+	}
+
+	// --yes and named packages skip the prompt (EOF would decline it):
+	cleaned = make([]string, 0)
+	withTestStdin(t, "", func() { err = runClean(cleanArgs{yes: true}) })
+	if err != nil || strings.Join(cleaned, ",") != "a,b" {
+		t.Errorf("expected --yes to clean every package, got %v (%v)", cleaned, err)
+	}
+	cleaned = make([]string, 0)
+	withTestStdin(t, "", func() { err = runClean(cleanArgs{packages: []string{"b"}}) })
+	if err != nil || strings.Join(cleaned, ",") != "b" {
+		t.Errorf("expected b to be cleaned without asking, got %v (%v)", cleaned, err)
+	}
+}
+
+func TestRunCleanDryRun(t *testing.T) {
+	setupTestMprDir(t)
+	dir := createTestPackage(t, "a", "pkgname=a\npkgver=1.0.0\n")
+	untracked := filepath.Join(dir, "a.deb")
+	if err := os.WriteFile(untracked, []byte("deb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// no confirmation is needed, since nothing is deleted:
+	var err error
+	withTestStdin(t, "", func() { err = runClean(cleanArgs{dryRun: true}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(untracked); err != nil {
+		t.Errorf("expected a dry run to keep untracked files: %v", err)
+	}
+}
+
+func TestListEntriesJSON(t *testing.T) {
+	setupTestMprDir(t)
+	createTestPackage(t, "good", "pkgname=good\npkgver=1.2.3\n")
+	createTestPackage(t, "broken", "pkgname=(broken\npkgver=1.0.0\n")
+
+	packages, broken, err := scanPackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := writeJSON(&out, listEntries(packages, broken)); err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []map[string]interface{}
+	if err := json.Unmarshal([]byte(out.String()), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %s", out.String())
+	}
+	good, bad := entries[0], entries[1]
+	if good["name"] != "good" || good["version"] != "1.2.3" || good["path"] != mprDir("good") || good["error"] != nil {
+		t.Errorf("unexpected entry for the good package: %v", good)
+	}
+	if v, ok := bad["version"]; bad["name"] != "broken" || !ok || v != nil || bad["error"] == nil {
+		t.Errorf("expected the broken package to have a null version and an error: %v", bad)
+	}
+}
+
+func TestGuardDirtyTree(t *testing.T) {
+	setupTestMprDir(t)
+	dir := createTestPackage(t, "foo", "pkgname=foo\npkgver=1.0.0\n")
+
+	// a clean tree passes silently:
+	var out strings.Builder
+	if _, err := guardDirtyTree(&out, dir, dirtyTreeArgs{requireClean: true}); err != nil || out.Len() != 0 {
+		t.Errorf("expected a clean tree to pass silently, got %q (%v)", out.String(), err)
+	}
+
+	// untracked files, e.g. build artifacts, do not make the tree dirty:
+	if err := os.MkdirAll(filepath.Join(dir, "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "foo_1.0.0-1_amd64.deb"), []byte("deb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := guardDirtyTree(&out, dir, dirtyTreeArgs{requireClean: true}); err != nil || out.Len() != 0 {
+		t.Errorf("expected untracked files to be ignored, got %q (%v)", out.String(), err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "PKGBUILD"), []byte("pkgname=foo\npkgver=2.0.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// by default, a dirty tree is only warned about:
+	out.Reset()
+	if _, err := guardDirtyTree(&out, dir, dirtyTreeArgs{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "warning: "+dir+" has uncommitted changes") {
+		t.Errorf("expected a warning about the dirty tree, got %q", out.String())
+	}
+
+	if _, err := guardDirtyTree(&out, dir, dirtyTreeArgs{requireClean: true}); err == nil {
+		t.Errorf("expected --require-clean to abort on a dirty tree")
+	}
+
+	gitCmds := make([]string, 0)
+	fakeRunCmd(t, func(cmd *exec.Cmd) error {
+		if stringSliceContainsString(cmd.Args, "--include-untracked") {
+			t.Errorf("expected only tracked changes to be stashed, got %v", cmd.Args)
+		}
+		gitCmds = append(gitCmds, strings.Join(cmd.Args[1:3], " "))
+		return nil
+	})
+	done, err := guardDirtyTree(&out, dir, dirtyTreeArgs{autostash: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := done(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(gitCmds, ",") != "stash push,stash pop" {
+		t.Errorf("expected --autostash to stash and pop, got %v", gitCmds)
+	}
+}
+
+func TestSummaryHeaders(t *testing.T) {
+	if header := updateHeader(147, 10, 10*time.Second); header != "Updating 147 packages (jobs=10, timeout=10s)" {
+		t.Errorf("unexpected update header: %q", header)
+	}
+	if header := updateHeader(2, 10, 0); header != "Updating 2 packages (jobs=10, timeout=none)" {
+		t.Errorf("unexpected update header without a timeout: %q", header)
+	}
+	if header := upgradeHeader(1); header != "Checking 1 package for upgrades" {
+		t.Errorf("unexpected upgrade header: %q", header)
+	}
+	// 147 requests, one every 1.1s:
+	if header := checkStaleHeader(147, 1100*time.Millisecond); header != "Checking 147 packages against repology (rate-limited, ~2m42s estimated)" {
+		t.Errorf("unexpected check-stale header: %q", header)
+	}
+}
+
+func TestRunBuildPrefetch(t *testing.T) {
+	setupTestMprDir(t)
+	var downloads int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&downloads, 1)
+		w.Write([]byte("hello world"))
+	}))
+	defer server.Close()
+	createTestPackage(t, "foo", "pkgname=foo\npkgver=1.0.0\nsource=("+server.URL+"/foo.tar.gz)\n"+
+		"sha256sums=(b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9)\n")
+
+	// a makedeb that can skip verifying the sources:
+	fakeMakedeb := filepath.Join(t.TempDir(), "makedeb")
+	script := "#!/bin/sh\necho '  --skip-integrity-check  Do not verify the source files'\n"
+	if err := os.WriteFile(fakeMakedeb, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	originalMakedeb := makedebPath
+	makedebPath = fakeMakedeb
+	defer func() { makedebPath = originalMakedeb }()
+
+	// makedeb must only run once the verified source is in place, and be told
+	// not to verify it again:
+	sourceWasThere := false
+	var makedebArgs []string
+	fakeRunCmd(t, func(cmd *exec.Cmd) error {
+		_, err := os.Stat(mprDir("foo", "foo.tar.gz"))
+		sourceWasThere = err == nil
+		makedebArgs = cmd.Args[1:]
+		return nil
+	})
+	if err := runBuild(buildArgs{pkgName: "foo", prefetch: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !sourceWasThere {
+		t.Errorf("expected the source to be downloaded before makedeb runs")
+	}
+	if strings.Join(makedebArgs, " ") != "--skip-integrity-check" {
+		t.Errorf("expected makedeb to skip verifying the sources, got the arguments %v", makedebArgs)
+	}
+
+	// a rebuild reuses the verified download:
+	if err := runBuild(buildArgs{pkgName: "foo", prefetch: true}); err != nil {
+		t.Fatal(err)
+	}
+	if downloads != 1 {
+		t.Errorf("expected the source to be downloaded once, got %d downloads", downloads)
+	}
+
+	if err := runBuild(buildArgs{pkgName: "foo"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(makedebArgs) != 0 {
+		t.Errorf("expected a plain build without --prefetch, got the arguments %v", makedebArgs)
+	}
+
+	// a makedeb without the option builds as usual:
+	makedebPath = "/bin/true"
+	if err := runBuild(buildArgs{pkgName: "foo", prefetch: true}); err != nil {
+		t.Fatal(err)
+	}
+	if len(makedebArgs) != 0 {
+		t.Errorf("expected a plain build with an older makedeb, got the arguments %v", makedebArgs)
+	}
+}
+
+func TestRunInstallConfirmationFlags(t *testing.T) {
+	// the package is cloned from a local repository:
+	upstream := filepath.Join(t.TempDir(), "foo")
+	if err := os.MkdirAll(upstream, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(upstream, "PKGBUILD"), []byte("pkgname=foo\npkgver=1.0\npkgrel=1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runTestGit(t, upstream, "init", "-q")
+	runTestGit(t, upstream, "add", "PKGBUILD")
+	runTestGit(t, upstream, "commit", "-q", "-m", "initial commit")
+
+	originalMakedeb := makedebPath
+	makedebPath = "/bin/true"
+	defer func() { makedebPath = originalMakedeb }()
+	t.Setenv("EDITOR", "fake-editor")
+
+	tests := []struct {
+		name        string
+		args        installArgs
+		answer      string
+		wantEdited  bool
+		wantMakedeb []string // nil if makedeb must not run
+		wantAborted bool
+		wantKept    bool
+	}{
+		{
+			name:        "review, confirm and let makedeb confirm",
+			args:        installArgs{review: true, confirm: true, makedebConfirm: true},
+			answer:      "y\n",
+			wantEdited:  true,
+			wantMakedeb: []string{"-si"},
+		},
+		{
+			name:        "confirm without reviewing",
+			args:        installArgs{confirm: true, makedebConfirm: true},
+			answer:      "y\n",
+			wantMakedeb: []string{"-si"},
+		},
+		{
+			name:        "review without confirming",
+			args:        installArgs{review: true, makedebConfirm: true},
+			wantEdited:  true,
+			wantMakedeb: []string{"-si"},
+		},
+		{
+			name:        "confirm, but not makedeb",
+			args:        installArgs{confirm: true},
+			answer:      "y\n",
+			wantMakedeb: []string{"-si", "--no-confirm"},
+		},
+		{
+			name:        "no confirmation at all",
+			args:        installArgs{},
+			wantMakedeb: []string{"-si", "--no-confirm"},
+		},
+		{
+			name:        "declined",
+			args:        installArgs{review: true, confirm: true, makedebConfirm: true},
+			answer:      "n\n",
+			wantEdited:  true,
+			wantAborted: true,
+		},
+		{
+			name:        "declined, keeping the clone",
+			args:        installArgs{confirm: true, keepOnAbort: true},
+			answer:      "n\n",
+			wantAborted: true,
+			wantKept:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestMprDir(t)
+			edited := false
+			var makedebArgs []string
+			fakeRunCmd(t, func(cmd *exec.Cmd) error {
+				switch {
+				case cmd.Path == "/bin/true":
+					makedebArgs = cmd.Args[1:]
+				case filepath.Base(cmd.Path) == "git":
+					return cmd.Run()
+				default:
+					if filepath.Base(cmd.Args[0]) != "fake-editor" {
+						t.Errorf("unexpected command %v", cmd.Args)
+					}
+					edited = true
+				}
+				return nil
+			})
+
+			args := tt.args
+			args.packageURL = upstream
+			var err error
+			withTestStdin(t, tt.answer, func() { err = runInstall(args) })
+
+			if tt.wantAborted {
+				if !errors.Is(err, errAborted) {
+					t.Fatalf("runInstall() = %v, want an aborted error", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if edited != tt.wantEdited {
+				t.Errorf("edited = %v, want %v", edited, tt.wantEdited)
+			}
+			if strings.Join(makedebArgs, " ") != strings.Join(tt.wantMakedeb, " ") || (makedebArgs == nil) != (tt.wantMakedeb == nil) {
+				t.Errorf("makedeb args = %q, want %q", makedebArgs, tt.wantMakedeb)
+			}
+			_, statErr := os.Stat(mprDir("foo", "PKGBUILD"))
+			if kept := statErr == nil; tt.wantAborted && kept != tt.wantKept {
+				t.Errorf("clone kept = %v, want %v", kept, tt.wantKept)
+			}
+		})
+	}
+}
+
+func TestRunCloneMaintainer(t *testing.T) {
+	setupTestMprDir(t)
+	createTestPackage(t, "bar", "pkgname=bar\npkgver=1.0\n")
+	fakeMPR(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/account/alice", "/account/bob":
+			return
+		case "/account/nobody":
+			http.NotFound(w, r)
+			return
+		case "/account/private":
+			http.Error(w, "log in", http.StatusUnauthorized)
+			return
+		}
+		query := r.URL.Query()
+		if query.Get("type") != "search" || query.Get("by") != "maintainer" {
+			http.Error(w, "unexpected request: "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		switch query.Get("arg") {
+		case "alice":
+			w.Write([]byte(`{"type":"search","results":[{"Name":"foo"},{"Name":"bar"},{"Name":"baz"}]}`))
+		default:
+			w.Write([]byte(`{"type":"search","results":[]}`))
+		}
+	})
+
+	cloned := fakeGitClone(t, map[string]string{
+		"foo": "pkgname=foo\npkgver=1.0\n",
+		"baz": "pkgname=baz\npkgver=1.0\n",
+	})
+
+	if err := runCloneMaintainer(cloneMaintainerArgs{maintainer: "alice", jobs: 2}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{mprURL + "baz", mprURL + "foo"}
+	if strings.Join(cloned(), "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected the clones:\n%s\n\nGot:\n%s", strings.Join(expected, "\n"), strings.Join(cloned(), "\n"))
+	}
+
+	// a user without packages is told apart from one that does not exist:
+	if err := runCloneMaintainer(cloneMaintainerArgs{maintainer: "bob", jobs: 2}); err != nil {
+		t.Errorf("expected no error for a user without packages, got %v", err)
+	}
+	err := runCloneMaintainer(cloneMaintainerArgs{maintainer: "nobody", jobs: 2})
+	if !errors.Is(err, errNotFound) || !strings.Contains(err.Error(), "no MPR user") {
+		t.Errorf("expected a not found error for a nonexistent user, got %v", err)
+	}
+	err = runCloneMaintainer(cloneMaintainerArgs{maintainer: "private", jobs: 2})
+	if !errors.Is(err, errNotFound) || !strings.Contains(err.Error(), "is the name right?") {
+		t.Errorf("expected a not found error if the MPR does not say whether the user exists, got %v", err)
+	}
+
+	if err := runCloneMaintainer(cloneMaintainerArgs{maintainer: "alice", jobs: 0}); exitCodeFor(err) != exitUsage {
+		t.Errorf("expected a usage error for --jobs 0, got %v", err)
+	}
+}
+
+func TestRunCloneExisting(t *testing.T) {
+	setupTestMprDir(t)
+	createTestPackage(t, "foo", "pkgname=foo\npkgver=1.0\n")
+	cloned := fakeGitClone(t, map[string]string{"foo": "pkgname=foo\npkgver=2.0\n"})
+
+	_, err := runClone(cloneArgs{packageURL: "foo", from: providerMPR})
+	if err == nil || !strings.Contains(err.Error(), "--force") {
+		t.Errorf("expected an error suggesting --force, got %v", err)
+	}
+	withTestStdin(t, "n\n", func() {
+		_, err = runClone(cloneArgs{packageURL: "foo", from: providerMPR, force: true, confirm: true})
+	})
+	if !errors.Is(err, errAborted) {
+		t.Errorf("expected declining to delete the clone to abort, got %v", err)
+	}
+	if pkgbuild, _ := os.ReadFile(mprDir("foo", "PKGBUILD")); !strings.Contains(string(pkgbuild), "pkgver=1.0") {
+		t.Fatalf("expected the existing clone to be kept, got the PKGBUILD:\n%s", pkgbuild)
+	}
+	if entries, _ := os.ReadDir(mprDir()); len(entries) != 1 {
+		t.Fatalf("expected the new clone to be removed, got %v", entries)
+	}
+
+	if _, err := runClone(cloneArgs{packageURL: "foo", from: providerMPR, force: true}); err != nil {
+		t.Fatal(err)
+	}
+	if pkgbuild, _ := os.ReadFile(mprDir("foo", "PKGBUILD")); !strings.Contains(string(pkgbuild), "pkgver=2.0") {
+		t.Errorf("expected foo to be cloned again, got the PKGBUILD:\n%s", pkgbuild)
+	}
+	if strings.Join(cloned(), "\n") != mprURL+"foo\n"+mprURL+"foo" {
+		t.Errorf("expected foo to be cloned again, got %v", cloned())
+	}
+
+	// a clone that fails leaves the existing one alone:
+	fakeRunCmd(t, func(cmd *exec.Cmd) error {
+		return fmt.Errorf("could not resolve host")
+	})
+	if _, err := runClone(cloneArgs{packageURL: "foo", from: providerMPR, force: true}); err == nil {
+		t.Errorf("expected the failed clone to be reported")
+	}
+	if pkgbuild, _ := os.ReadFile(mprDir("foo", "PKGBUILD")); !strings.Contains(string(pkgbuild), "pkgver=2.0") {
+		t.Errorf("expected the existing clone to be kept, got the PKGBUILD:\n%s", pkgbuild)
+	}
+}
+
+func TestRunCloneRenamesToPkgname(t *testing.T) {
+	setupTestMprDir(t)
+	fakeGitClone(t, map[string]string{
+		"foo-git":  "pkgname=foo\npkgver=1.0\n",
+		"split":    "pkgbase=split\npkgname=(split-a split-b)\npkgver=1.0\n",
+		"unnamed!": "pkgver=1.0\n",
+	})
+
+	for url, expected := range map[string]string{
+		"https://example.com/foo-git":  "foo",
+		"https://example.com/split":    "split",
+		"https://example.com/unnamed!": "unnamed!",
+	} {
+		pkg, err := runClone(cloneArgs{packageURL: url, from: providerURL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkg != expected {
+			t.Errorf("expected %s to be cloned to %s, got %s", url, expected, pkg)
+		}
+		if _, err := os.Stat(mprDir(expected, ".git")); err != nil {
+			t.Errorf("expected %s to be cloned to %s: %v", url, mprDir(expected), err)
+		}
+	}
+
+	entries, err := os.ReadDir(mprDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), tempDirPrefixClone) {
+			t.Errorf("expected no temporary directories to be left behind, got %s", entry.Name())
+		}
+	}
+
+	// the name from the PKGBUILD is checked for existing clones, too:
+	if _, err := runClone(cloneArgs{packageURL: "https://example.com/foo-git", from: providerURL}); err == nil {
+		t.Error("expected an error when the PKGBUILD names a package that has already been cloned")
+	}
+}
+
+func TestRunCloneShallow(t *testing.T) {
+	setupTestMprDir(t)
+	upstream := t.TempDir()
+	if err := os.WriteFile(filepath.Join(upstream, "PKGBUILD"), []byte("pkgname=deep\npkgver=1.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runTestGit(t, upstream, "init", "-q")
+	runTestGit(t, upstream, "add", "PKGBUILD")
+	for i := 0; i < 3; i++ {
+		runTestGit(t, upstream, "commit", "-q", "--allow-empty-message", "--allow-empty", "-m", "")
+	}
+
+	args := cloneArgs{packageURL: "file://" + upstream, from: providerURL, depth: 1, recurseSubs: true}
+	expected := "clone --depth 1 --no-single-branch --recurse-submodules --shallow-submodules url dir"
+	if actual := strings.Join(args.gitCloneArgs("url", "dir"), " "); actual != expected {
+		t.Errorf("expected the git arguments %q, got %q", expected, actual)
+	}
+
+	pkg, err := runClone(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := gitOutput(pkg, "rev-list", "--count", "HEAD"); count != "1" || !isShallowClone(pkg) {
+		t.Fatalf("expected a shallow clone with 1 commit, got %s commit(s)", count)
+	}
+
+	runTestGit(t, upstream, "commit", "-q", "--allow-empty", "-m", "new")
+	if err := unshallowAndPull(context.Background(), pkg, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := gitOutput(pkg, "rev-list", "--count", "HEAD"); count != "4" || isShallowClone(pkg) {
+		t.Errorf("expected the full history of 4 commits after unshallowing, got %s commit(s)", count)
+	}
+}
+
+func TestRunUpdateUnshallowsOnlyForShallowHistory(t *testing.T) {
+	tests := []struct {
+		name      string
+		stderr    string
+		unshallow bool
+	}{
+		{"missing history", "fatal: refusing to merge unrelated histories", true},
+		{"network error", "fatal: unable to access 'https://mpr.makedeb.org/foo/': Could not resolve host", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestMprDir(t)
+			createTestPackage(t, "foo", "pkgname=foo\npkgver=1.0\n")
+
+			// a shallow clone whose pull fails until it is unshallowed:
+			log := filepath.Join(t.TempDir(), "log")
+			fakeGit := filepath.Join(t.TempDir(), "git")
+			script := "#!/bin/sh\necho \"$*\" >> " + log + "\ncase \"$*\" in\n" +
+				"'rev-parse --is-shallow-repository') echo true;;\n" +
+				"'fetch --unshallow') touch .unshallowed;;\n" +
+				"pull) [ -e .unshallowed ] || { echo \"" + tt.stderr + "\" >&2; exit 1; };;\n" +
+				"esac\n"
+			if err := os.WriteFile(fakeGit, []byte(script), 0755); err != nil {
+				t.Fatal(err)
+			}
+			originalGitPath := gitPath
+			gitPath = fakeGit
+			t.Cleanup(func() { gitPath = originalGitPath })
+
+			err := runUpdate(updateArgs{timeout: defaultUpdatePullTimeout})
+			if tt.unshallow && err != nil {
+				t.Errorf("expected the pull to succeed after unshallowing, got %v", err)
+			}
+			if !tt.unshallow && err == nil {
+				t.Errorf("expected the pull to fail")
+			}
+			calls, _ := os.ReadFile(log)
+			if unshallowed := strings.Contains(string(calls), "fetch --unshallow"); unshallowed != tt.unshallow {
+				t.Errorf("expected unshallowing: %v, got the git calls:\n%s", tt.unshallow, calls)
+			}
+		})
+	}
+}
+
+func TestRunUninstallKeepsSources(t *testing.T) {
+	var removed []string
+	fakeRunCmd(t, func(cmd *exec.Cmd) error {
+		removed = append(removed, strings.Join(cmd.Args, " "))
+		return nil
+	})
+
+	tests := []struct {
+		name      string
+		args      uninstallArgs
+		dirty     bool
+		artifacts bool // untracked files, as left behind by a build
+		answer    string
+		wantKept  bool
+	}{
+		{name: "keep sources", args: uninstallArgs{keepSources: true, confirm: true}, wantKept: true},
+		{name: "confirmed", args: uninstallArgs{confirm: true}, answer: "y\n", wantKept: false},
+		{name: "declined", args: uninstallArgs{confirm: true}, answer: "n\n", wantKept: true},
+		{name: "dirty defaults to keeping", args: uninstallArgs{confirm: true}, dirty: true, answer: "\n", wantKept: true},
+		{name: "clean defaults to deleting", args: uninstallArgs{confirm: true}, answer: "\n", wantKept: false},
+		{name: "no confirm", args: uninstallArgs{}, dirty: true, wantKept: false},
+		{name: "build artifacts are not changes", args: uninstallArgs{confirm: true}, artifacts: true, answer: "\n", wantKept: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestMprDir(t)
+			dir := createTestPackage(t, "foo", "pkgname=foo\npkgver=1.0\n")
+			if tt.dirty {
+				if err := os.WriteFile(filepath.Join(dir, "PKGBUILD"), []byte("pkgname=foo\npkgver=2.0\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.artifacts {
+				if err := os.WriteFile(filepath.Join(dir, "foo_1.0-1_amd64.deb"), []byte("deb"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			removed = nil
+
+			args := tt.args
+			args.pkgName = "foo"
+			var err error
+			withTestStdin(t, tt.answer, func() { err = runUninstall(args) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(removed) != 1 || removed[0] != "sudo apt-get remove foo" {
+				t.Errorf("expected the package to be removed with apt-get, got %q", removed)
+			}
+			_, statErr := os.Stat(dir)
+			if kept := statErr == nil; kept != tt.wantKept {
+				t.Errorf("clone kept = %v, want %v", kept, tt.wantKept)
+			}
+			// the changes of a deleted, dirty clone are backed up:
+			backups, _ := filepath.Glob(filepath.Join(backupsDir(), "foo-*.patch"))
+			if expected := tt.dirty && !tt.wantKept; (len(backups) == 1) != expected {
+				t.Errorf("expected a backup: %v, got %v", expected, backups)
+			} else if expected {
+				if patch, _ := os.ReadFile(backups[0]); !strings.Contains(string(patch), "+pkgver=2.0") {
+					t.Errorf("expected the backup to have the changes, got:\n%s", patch)
+				}
+			}
+		})
+	}
+}
+
+func TestRunUninstallPurge(t *testing.T) {
+	setupTestMprDir(t)
+	createTestPackage(t, "foo", "pkgname=foo\npkgver=1.0\n")
+	original := aptPath
+	aptPath = "nala"
+	defer func() { aptPath = original }()
+
+	var commands []string
+	fakeRunCmd(t, func(cmd *exec.Cmd) error {
+		commands = append(commands, strings.Join(cmd.Args, " "))
+		return nil
+	})
+	if err := runUninstall(uninstallArgs{pkgName: "foo", purge: true, keepSources: true}); err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 1 || commands[0] != "sudo nala purge foo" {
+		t.Errorf("expected the package to be purged with nala, got %q", commands)
+	}
+}
+
+func TestWriteDiffs(t *testing.T) {
+	setupTestMprDir(t)
+	createTestPackage(t, "clean", "pkgname=clean\npkgver=1.0\n")
+	dir := createTestPackage(t, "edited", "pkgname=edited\npkgver=1.0\n")
+	if err := os.WriteFile(filepath.Join(dir, "PKGBUILD"), []byte("pkgname=edited\npkgver=2.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := writeDiffs(&out, []string{"clean", "edited"}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "=> clean") {
+		t.Errorf("expected packages without modifications to be skipped, got:\n%s", out.String())
+	}
+	if !strings.HasPrefix(out.String(), "=> edited\n") || !strings.Contains(out.String(), "-pkgver=1.0\n+pkgver=2.0") {
+		t.Errorf("expected the diff of the edited package, got:\n%s", out.String())
+	}
+
+	if err := runDiff("missing"); !errors.Is(err, errNotFound) {
+		t.Errorf("expected a not found error for an unknown package, got %v", err)
+	}
+}
+
+func TestRunUpdateVersionNoSums(t *testing.T) {
+	setupTestMprDir(t)
+	dir := createTestPackage(t, "foo", "pkgname=foo\npkgver=1.0.0\npkgrel=3\nsha256sums=('aaaa')\n")
+
+	// makedeb must not run with --no-sums:
+	originalMakedeb := makedebPath
+	makedebPath = "/bin/false"
+	defer func() { makedebPath = originalMakedeb }()
+
+	err := runUpdateVersion(updateVersionArgs{
+		pkgName:     "foo",
+		newVersion:  "2.0.0",
+		noSums:      true,
+		resetPkgrel: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := os.ReadFile(filepath.Join(dir, "PKGBUILD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "pkgname=foo\npkgver=2.0.0\npkgrel=1\nsha256sums=('aaaa')\n" {
+		t.Errorf("expected only pkgver and pkgrel to be updated, got:\n%s", contents)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".SRCINFO")); !os.IsNotExist(err) {
+		t.Errorf("expected no .SRCINFO to be generated, got %v", err)
+	}
+}
+
+func TestRunUpdateVersionResetsPkgrel(t *testing.T) {
+	tests := []struct {
+		name       string
+		pkgbuild   string
+		newVersion string
+		keepPkgrel bool
+		expected   string
+	}{
+		{name: "version bump", newVersion: "3.0.2", expected: "pkgver=3.0.2\npkgrel=1\n"},
+		{name: "same version", newVersion: "3.0.1", expected: "pkgver=3.0.1\npkgrel=4\n"},
+		{name: "keep pkgrel", newVersion: "3.0.2", keepPkgrel: true, expected: "pkgver=3.0.2\npkgrel=4\n"},
+		{name: "no pkgrel", pkgbuild: "pkgver=3.0.1\n", newVersion: "3.0.2", expected: "pkgver=3.0.2\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestMprDir(t)
+			pkgbuild := "pkgver=3.0.1\npkgrel=4\n"
+			if tt.pkgbuild != "" {
+				pkgbuild = tt.pkgbuild
+			}
+			dir := createTestPackage(t, "foo", pkgbuild)
+			err := runUpdateVersion(updateVersionArgs{
+				pkgName:    "foo",
+				newVersion: tt.newVersion,
+				noSums:     true,
+				keepPkgrel: tt.keepPkgrel,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents, err := os.ReadFile(filepath.Join(dir, "PKGBUILD"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(contents) != tt.expected {
+				t.Errorf("expected:\n%s\ngot:\n%s", tt.expected, contents)
+			}
+		})
+	}
+}
+
+func TestRunUpdateVersionAsksRepology(t *testing.T) {
+	setupTestMprDir(t)
+	dir := createTestPackage(t, "foo", "pkgname=foo\npkgver=1.0\npkgrel=1\n")
+	fakeRepology(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"status":"newest","version":"2.0"}]`))
+	})
+
+	// a version cached by an earlier check-stale is only reused with --max-age:
+	for _, tt := range []struct {
+		maxAge   time.Duration
+		expected string
+	}{
+		{0, "pkgver=2.0"},
+		{time.Hour, "pkgver=1.5"},
+	} {
+		if err := writeRepologyCache("foo", repologyCacheEntry{Version: "1.5", FetchedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+		if err := runUpdateVersion(updateVersionArgs{pkgName: "foo", noSums: true, maxAge: tt.maxAge}); err != nil {
+			t.Fatal(err)
+		}
+		contents, err := os.ReadFile(filepath.Join(dir, "PKGBUILD"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(contents), tt.expected+"\n") {
+			t.Errorf("maxAge %s: expected %s, got:\n%s", tt.maxAge, tt.expected, contents)
+		}
+	}
+}
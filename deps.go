@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// The kinds of dependencies a PKGBUILD declares, in the order they are shown:
+var dependencyKinds = []string{"depends", "makedepends", "optdepends"}
+
+// pkgDependency is a single entry of a dependency array in a PKGBUILD
+type pkgDependency struct {
+	kind string // one of dependencyKinds
+	spec string // as written in the PKGBUILD, e.g. "libfoo>=1.2" or "bar: for bar support"
+}
+
+// dependencyNames returns the names of the packages that satisfy a dependency:
+// without a version constraint or (for optdepends) a description, and with an
+// entry for each alternative of e.g. "foo|bar"
+func dependencyNames(spec string) []string { // {{{
+	if i := strings.Index(spec, ":"); i >= 0 {
+		spec = spec[:i]
+	}
+	names := make([]string, 0, 1)
+	for _, alternative := range strings.Split(spec, "|") {
+		if i := strings.IndexAny(alternative, "<>="); i >= 0 {
+			alternative = alternative[:i]
+		}
+		if alternative = strings.TrimSpace(alternative); alternative != "" {
+			names = append(names, alternative)
+		}
+	}
+	return names
+} // }}}
+
+// localDependencies is the dependency graph of the locally-managed packages
+type localDependencies struct {
+	deps     map[string][]pkgDependency
+	provider map[string]string // pkgname -> the local package that builds it
+}
+
+// loadLocalDependencies reads the dependency arrays of each of packages. Each
+// package is known by its own name and by each of its pkgnames, so that the
+// packages of a split package can be depended on.
+func loadLocalDependencies(packages []string) (*localDependencies, error) { // {{{
+	graph := &localDependencies{
+		deps:     make(map[string][]pkgDependency, len(packages)),
+		provider: make(map[string]string, len(packages)),
+	}
+	for _, pkg := range packages {
+		graph.provider[pkg] = pkg
+	}
+	for _, pkg := range packages {
+		vars, err := NewPKGBUILD(mprDir(pkg)).getVariablesMerged()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", pkg, err)
+		}
+		for _, pkgname := range (*vars)["pkgname"] {
+			if _, ok := graph.provider[pkgname]; !ok {
+				graph.provider[pkgname] = pkg
+			}
+		}
+		deps := make([]pkgDependency, 0)
+		for _, kind := range dependencyKinds {
+			for _, spec := range (*vars)[kind] {
+				deps = append(deps, pkgDependency{kind: kind, spec: spec})
+			}
+		}
+		graph.deps[pkg] = deps
+	}
+	return graph, nil
+} // }}}
+
+// localPackageFor returns the local package that satisfies a dependency, or ""
+// if it has to come from apt
+func (g *localDependencies) localPackageFor(spec string) string {
+	for _, name := range dependencyNames(spec) {
+		if pkg, ok := g.provider[name]; ok {
+			return pkg
+		}
+	}
+	return ""
+}
+
+// writeTree prints the dependencies of pkg, recursing into the ones that are
+// local packages
+func (g *localDependencies) writeTree(w io.Writer, pkg string) { // {{{
+	fmt.Fprintln(w, pkg)
+	g.writeSubtree(w, pkg, "  ", map[string]bool{pkg: true})
+} // }}}
+
+func (g *localDependencies) writeSubtree(w io.Writer, pkg string, indent string, path map[string]bool) { // {{{
+	for _, dep := range g.deps[pkg] {
+		local := g.localPackageFor(dep.spec)
+		switch {
+		case local == "":
+			fmt.Fprintf(w, "%s%s: %s\n", indent, dep.kind, dep.spec)
+		case path[local]:
+			fmt.Fprintf(w, "%s%s: %s (mpr, cycle)\n", indent, dep.kind, dep.spec)
+		default:
+			fmt.Fprintf(w, "%s%s: %s (mpr)\n", indent, dep.kind, dep.spec)
+			path[local] = true
+			g.writeSubtree(w, local, indent+"  ", path)
+			delete(path, local)
+		}
+	}
+} // }}}
+
+// reverseDependency is a local package that depends on another package
+type reverseDependency struct {
+	pkg string
+	pkgDependency
+}
+
+// dependents lists the local packages that depend on name, which is either a
+// local package (or one of its pkgnames) or an apt package
+func (g *localDependencies) dependents(name string) []reverseDependency { // {{{
+	target := g.provider[name]
+	found := make([]reverseDependency, 0)
+	for pkg, deps := range g.deps {
+		for _, dep := range deps {
+			matches := target != "" && g.localPackageFor(dep.spec) == target
+			if !matches {
+				matches = stringSliceContainsString(dependencyNames(dep.spec), name)
+			}
+			if matches {
+				found = append(found, reverseDependency{pkg: pkg, pkgDependency: dep})
+			}
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i].pkg < found[j].pkg })
+	return found
+} // }}}
+
+// buildOrder orders packages so that each package comes after the ones among
+// packages that it depends (or makedepends) on, and otherwise keeps the order
+// of packages. The packages that are part of (or depend on) a dependency cycle
+// cannot be ordered: they are returned as cycle, and come last, in their
+// original order.
+func (g *localDependencies) buildOrder(packages []string) (order []string, cycle []string) { // {{{
+	selected := make(map[string]bool, len(packages))
+	for _, pkg := range packages {
+		selected[pkg] = true
+	}
+	requires := make(map[string][]string, len(packages))
+	for _, pkg := range packages {
+		for _, dep := range g.deps[pkg] {
+			if dep.kind == "optdepends" {
+				continue
+			}
+			local := g.localPackageFor(dep.spec)
+			if local != "" && local != pkg && selected[local] {
+				requires[pkg] = append(requires[pkg], local)
+			}
+		}
+	}
+
+	order = make([]string, 0, len(packages))
+	done := make(map[string]bool, len(packages))
+	for len(order) < len(packages) {
+		progressed := false
+		for _, pkg := range packages {
+			if done[pkg] {
+				continue
+			}
+			ready := true
+			for _, required := range requires[pkg] {
+				ready = ready && done[required]
+			}
+			if ready {
+				order = append(order, pkg)
+				done[pkg] = true
+				progressed = true
+				// start over, so that packages keep their order when possible:
+				break
+			}
+		}
+		if !progressed {
+			break
+		}
+	}
+
+	cycle = make([]string, 0)
+	for _, pkg := range packages {
+		if !done[pkg] {
+			cycle = append(cycle, pkg)
+		}
+	}
+	return append(order, cycle...), cycle
+} // }}}
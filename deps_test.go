@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDependencyNames(t *testing.T) {
+	for spec, expected := range map[string]string{
+		"libfoo":                  "libfoo",
+		"libfoo>=1.2":             "libfoo",
+		"libfoo=1.2-1":            "libfoo",
+		"python3: for the script": "python3",
+		"foo|bar>=2":              "foo,bar",
+		"":                        "",
+	} {
+		if actual := strings.Join(dependencyNames(spec), ","); actual != expected {
+			t.Errorf("dependencyNames(%q): expected %q, got %q", spec, expected, actual)
+		}
+	}
+}
+
+func TestLocalDependencies(t *testing.T) {
+	setupTestMprDir(t)
+	createTestPackage(t, "app", "pkgname=app\npkgver=1.0\ndepends=('libfoo-bin>=1.0' 'libc6')\nmakedepends=('cmake')\noptdepends=('plugin: for plugins')\n")
+	createTestPackage(t, "libfoo", "pkgbase=libfoo\npkgname=(libfoo-bin libfoo-dev)\npkgver=1.0\ndepends=('libc6')\n")
+	createTestPackage(t, "plugin", "pkgname=plugin\npkgver=1.0\ndepends=('app')\n")
+
+	packages, err := listPackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, err := loadLocalDependencies(packages)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	graph.writeTree(&out, "app")
+	expected := `app
+  depends: libfoo-bin>=1.0 (mpr)
+    depends: libc6
+  depends: libc6
+  makedepends: cmake
+  optdepends: plugin: for plugins (mpr)
+    depends: app (mpr, cycle)
+`
+	if out.String() != expected {
+		t.Errorf("expected the tree:\n%s\nGot:\n%s", expected, out.String())
+	}
+
+	for name, expected := range map[string]string{
+		"libfoo":     "app depends",
+		"libfoo-dev": "app depends", // a pkgname of the same split package
+		"libc6":      "app depends,libfoo depends",
+		"app":        "plugin depends",
+		"cmake":      "app makedepends",
+		"unrelated":  "",
+	} {
+		actual := make([]string, 0)
+		for _, dependent := range graph.dependents(name) {
+			actual = append(actual, fmt.Sprintf("%s %s", dependent.pkg, dependent.kind))
+		}
+		if strings.Join(actual, ",") != expected {
+			t.Errorf("dependents(%q): expected %q, got %q", name, expected, strings.Join(actual, ","))
+		}
+	}
+}
+
+func TestBuildOrder(t *testing.T) {
+	dependOn := func(specs ...string) []pkgDependency {
+		deps := make([]pkgDependency, 0, len(specs))
+		for _, spec := range specs {
+			deps = append(deps, pkgDependency{kind: "depends", spec: spec})
+		}
+		return deps
+	}
+	graph := &localDependencies{
+		deps: map[string][]pkgDependency{
+			"app":     dependOn("libfoo-bin>=1.0", "libc6"),
+			"libfoo":  dependOn("libbar"),
+			"libbar":  nil,
+			"other":   {{kind: "optdepends", spec: "app: not needed to build"}},
+			"cycle-a": dependOn("cycle-b"),
+			"cycle-b": dependOn("cycle-a"),
+			"needs-a": dependOn("cycle-a"),
+		},
+		provider: map[string]string{"libfoo-bin": "libfoo"},
+	}
+	for pkg := range graph.deps {
+		graph.provider[pkg] = pkg
+	}
+
+	for _, test := range []struct{ packages, order, cycle string }{
+		{"app,libbar,libfoo,other", "libbar,libfoo,app,other", ""},
+		// dependencies that are not being upgraded don't matter:
+		{"app,other", "app,other", ""},
+		{"other,app", "other,app", ""},
+		{"app,cycle-a,cycle-b,libfoo,needs-a", "libfoo,app,cycle-a,cycle-b,needs-a", "cycle-a,cycle-b,needs-a"},
+	} {
+		order, cycle := graph.buildOrder(strings.Split(test.packages, ","))
+		if strings.Join(order, ",") != test.order || strings.Join(cycle, ",") != test.cycle {
+			t.Errorf("buildOrder(%s): expected %s (cycle: %q), got %s (cycle: %q)", test.packages, test.order, test.cycle, strings.Join(order, ","), strings.Join(cycle, ","))
+		}
+	}
+}
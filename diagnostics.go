@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"text/tabwriter"
+
+	"github.com/fatih/color"
+)
+
+// The JSON emitted by `mpr doctor/env/stats --json` is meant for monitoring,
+// so these schemas must stay stable: only ever add fields.
+
+// doctorCheck is the result of a single `mpr doctor` check
+type doctorCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// envInfo is the configuration mpr resolved from its flags and environment
+type envInfo struct {
+	MprDir            string `json:"mpr_dir"`
+	Makedeb           string `json:"makedeb"`
+	Git               string `json:"git"`
+	Apt               string `json:"apt"`
+	MprURL            string `json:"mpr_url"`
+	RepologyURL       string `json:"repology_url"`
+	MakedebInstall    string `json:"makedeb_install"`
+	CleanAfterInstall bool   `json:"clean_after_install"`
+	Color             bool   `json:"color"`
+}
+
+// statsInfo are aggregate counts over all packages
+type statsInfo struct {
+	Packages int `json:"packages"`
+	Outdated int `json:"outdated"` // behind their install receipt
+	Dirty    int `json:"dirty"`    // with local modifications
+	Broken   int `json:"broken"`   // whose PKGBUILD fails to evaluate
+	Errors   int `json:"errors"`   // that could not be checked
+}
+
+// writeJSON writes v as indented JSON, followed by a newline
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func doctorChecks() []doctorCheck { // {{{
+	checks := make([]doctorCheck, 0)
+
+	dirCheck := doctorCheck{Name: "mpr-dir", OK: true, Detail: mprDir()}
+	if f, err := os.CreateTemp(mprDir(), ".doctor-"); err != nil {
+		dirCheck.OK, dirCheck.Detail = false, fmt.Sprintf("%s is not writable: %s", mprDir(), err)
+	} else {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	checks = append(checks, dirCheck)
+
+	for _, bin := range []struct{ name, path string }{{"git", gitBin()}, {"makedeb", makedebBin()}} {
+		check := doctorCheck{Name: bin.name, OK: true}
+		if path, err := exec.LookPath(bin.path); err != nil {
+			check.OK, check.Detail = false, fmt.Sprintf("%s not found", bin.path)
+		} else {
+			check.Detail = path
+		}
+		checks = append(checks, check)
+	}
+	if !checks[len(checks)-1].OK && makedebInstallPolicy != makedebInstallNever {
+		// a missing makedeb is installed on demand:
+		checks[len(checks)-1].OK = true
+		checks[len(checks)-1].Detail += fmt.Sprintf(" (it will be installed when needed, per --makedeb-install=%s)", makedebInstallPolicy)
+	}
+
+	packagesCheck := doctorCheck{Name: "packages", OK: true}
+	packages, broken, err := scanPackages()
+	switch {
+	case err != nil:
+		packagesCheck.OK, packagesCheck.Detail = false, err.Error()
+	case len(broken) > 0:
+		packagesCheck.OK, packagesCheck.Detail = false, fmt.Sprintf("%d package(s) fail to evaluate (see `mpr list --show-errors`)", len(broken))
+	default:
+		packagesCheck.Detail = fmt.Sprintf("%d package(s)", len(packages))
+	}
+	checks = append(checks, packagesCheck)
+
+	return checks
+} // }}}
+
+func runDoctor(w io.Writer, jsonOutput bool) error { // {{{
+	checks := doctorChecks()
+	failed := 0
+	for _, check := range checks {
+		if !check.OK {
+			failed++
+		}
+	}
+
+	if jsonOutput {
+		if err := writeJSON(w, checks); err != nil {
+			return err
+		}
+	} else {
+		green := color.New(color.FgGreen).SprintFunc()
+		red := color.New(color.FgRed).SprintFunc()
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		for _, check := range checks {
+			status := green("ok")
+			if !check.OK {
+				status = red("FAIL")
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", status, check.Name, check.Detail)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d check(s) failed", failed)
+	}
+	return nil
+} // }}}
+
+func currentEnv() envInfo {
+	return envInfo{
+		MprDir:            mprDir(),
+		Makedeb:           makedebBin(),
+		Git:               gitBin(),
+		Apt:               aptBin(),
+		MprURL:            mprURL,
+		RepologyURL:       repologyURL,
+		MakedebInstall:    makedebInstallPolicy,
+		CleanAfterInstall: cleanAfterInstallDefault(),
+		Color:             !color.NoColor,
+	}
+}
+
+func runEnv(w io.Writer, jsonOutput bool) error { // {{{
+	env := currentEnv()
+	if jsonOutput {
+		return writeJSON(w, env)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "mpr dir\t%s\n", env.MprDir)
+	fmt.Fprintf(tw, "makedeb\t%s\n", env.Makedeb)
+	fmt.Fprintf(tw, "git\t%s\n", env.Git)
+	fmt.Fprintf(tw, "apt\t%s\n", env.Apt)
+	fmt.Fprintf(tw, "mpr url\t%s\n", env.MprURL)
+	fmt.Fprintf(tw, "repology url\t%s\n", env.RepologyURL)
+	fmt.Fprintf(tw, "makedeb install\t%s\n", env.MakedebInstall)
+	fmt.Fprintf(tw, "clean after install\t%v\n", env.CleanAfterInstall)
+	fmt.Fprintf(tw, "color\t%v\n", env.Color)
+	return tw.Flush()
+} // }}}
+
+func collectStats() (statsInfo, error) { // {{{
+	packages, broken, err := scanPackages()
+	if err != nil {
+		return statsInfo{}, err
+	}
+	outdated, pkgErrors := findOutdated(packages, defaultJobs)
+
+	stats := statsInfo{
+		Packages: len(packages),
+		Outdated: len(outdated),
+		Broken:   len(broken),
+	}
+	for _, pkg := range packages {
+		dirty, err := isDirty(pkg)
+		if err != nil {
+			pkgErrors[pkg] = err
+			continue
+		}
+		if dirty {
+			stats.Dirty++
+		}
+	}
+	stats.Errors = len(pkgErrors)
+	return stats, nil
+} // }}}
+
+func runStats(w io.Writer, jsonOutput bool) error { // {{{
+	stats, err := collectStats()
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return writeJSON(w, stats)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "packages\t%d\n", stats.Packages)
+	fmt.Fprintf(tw, "outdated\t%d\n", stats.Outdated)
+	fmt.Fprintf(tw, "dirty\t%d\n", stats.Dirty)
+	fmt.Fprintf(tw, "broken\t%d\n", stats.Broken)
+	fmt.Fprintf(tw, "errors\t%d\n", stats.Errors)
+	return tw.Flush()
+} // }}}
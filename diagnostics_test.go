@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// jsonKeys decodes a JSON object and returns its keys, sorted
+func jsonKeys(t *testing.T, data string) string {
+	var object map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &object); err != nil {
+		t.Fatalf("invalid JSON object: %s\n%s", err, data)
+	}
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+func TestDoctorJSON(t *testing.T) {
+	setupTestMprDir(t)
+	createTestPackage(t, "broken", "pkgname=(broken\n")
+
+	var out strings.Builder
+	if err := runDoctor(&out, true); err == nil {
+		t.Errorf("expected doctor to fail for a broken package")
+	}
+
+	var checks []map[string]interface{}
+	if err := json.Unmarshal([]byte(out.String()), &checks); err != nil {
+		t.Fatalf("invalid JSON: %s\n%s", err, out.String())
+	}
+	names := make([]string, 0)
+	for _, check := range checks {
+		encoded, _ := json.Marshal(check)
+		if keys := jsonKeys(t, string(encoded)); keys != "detail,name,ok" {
+			t.Errorf("unexpected check keys: %s", keys)
+		}
+		names = append(names, check["name"].(string))
+		if check["name"] == "packages" && check["ok"] != false {
+			t.Errorf("expected the packages check to fail, got %v", check)
+		}
+	}
+	if strings.Join(names, ",") != "mpr-dir,git,makedeb,packages" {
+		t.Errorf("unexpected checks: %v", names)
+	}
+}
+
+func TestEnvJSON(t *testing.T) {
+	dir := setupTestMprDir(t)
+
+	var out strings.Builder
+	if err := runEnv(&out, true); err != nil {
+		t.Fatal(err)
+	}
+	expected := "apt,clean_after_install,color,git,makedeb,makedeb_install,mpr_dir,mpr_url,repology_url"
+	if keys := jsonKeys(t, out.String()); keys != expected {
+		t.Errorf("expected keys %s, got %s", expected, keys)
+	}
+	var env envInfo
+	if err := json.Unmarshal([]byte(out.String()), &env); err != nil {
+		t.Fatal(err)
+	}
+	if env.MprDir != dir {
+		t.Errorf("expected mpr_dir to be %s, got %s", dir, env.MprDir)
+	}
+}
+
+func TestStatsJSON(t *testing.T) {
+	setupTestMprDir(t)
+	createTestPackage(t, "a", "pkgname=a\npkgver=1.0.0\n")
+	createTestPackage(t, "b", "pkgname=b\npkgver=1.0.0\n")
+	if err := updateMakedebInstallReceipt("b"); err != nil {
+		t.Fatal(err)
+	}
+	createTestPackage(t, "broken", "pkgname=(broken\n")
+
+	var out strings.Builder
+	if err := runStats(&out, true); err != nil {
+		t.Fatal(err)
+	}
+	if keys := jsonKeys(t, out.String()); keys != "broken,dirty,errors,outdated,packages" {
+		t.Errorf("unexpected keys: %s", keys)
+	}
+	var stats statsInfo
+	if err := json.Unmarshal([]byte(out.String()), &stats); err != nil {
+		t.Fatal(err)
+	}
+	expected := statsInfo{Packages: 2, Outdated: 1, Broken: 1}
+	if stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// downloadStallTimeout is how long a download may go without receiving any
+// data before it is given up on. A timeout on the whole download would fail
+// large downloads over slow connections instead.
+var downloadStallTimeout = 30 * time.Second
+
+// watchdogWriter restarts timer whenever data is written to it
+type watchdogWriter struct {
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (w watchdogWriter) Write(data []byte) (int, error) {
+	w.timer.Reset(w.timeout)
+	return len(data), nil
+}
+
+// downloadHTTP downloads remoteURL to localPath, reporting its progress to
+// onProgress (totalLength is -1 if the server does not send it). A partial
+// download is removed again.
+func downloadHTTP(remoteURL string, localPath string, onProgress func(progress int64, totalLength int64)) (err error) { // {{{
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var stalled int32
+	watchdog := time.AfterFunc(downloadStallTimeout, func() {
+		atomic.StoreInt32(&stalled, 1)
+		cancel()
+	})
+	defer watchdog.Stop()
+	defer func() {
+		if err != nil && atomic.LoadInt32(&stalled) == 1 {
+			err = markError(fmt.Errorf("GET %s: no data received for %s", remoteURL, downloadStallTimeout), errNetwork)
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, remoteURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("GET %s: %s", remoteURL, resp.Status)
+	}
+
+	localFile, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := localFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(localPath)
+		}
+	}()
+
+	progress := newProgressReader(resp.ContentLength, onProgress)
+	_, err = io.Copy(localFile, io.TeeReader(resp.Body, io.MultiWriter(watchdogWriter{watchdog, downloadStallTimeout}, progress)))
+	if err != nil {
+		return err
+	}
+	progress.report()
+	return nil
+} // }}}
+
+// downloadCurl is the fallback for URLs that net/http cannot fetch
+func downloadCurl(remoteURL string, localPath string) error {
+	// -sS: several downloads can run at once, so curl's own progress bars
+	// would garble each other
+	cmd := exec.Command("curl", "-sS", "-L", "--fail", "-o", localPath, remoteURL)
+	var sberr strings.Builder
+	cmd.Stderr = &sberr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(sberr.String()))
+	}
+	return nil
+}
+
+// isUnsupportedSchemeError reports whether net/http refused a URL because of
+// its scheme (e.g. ftp://)
+func isUnsupportedSchemeError(err error) bool {
+	var urlErr *url.Error
+	return errors.As(err, &urlErr) && strings.Contains(urlErr.Err.Error(), "unsupported protocol scheme")
+}
+
+// formatProgress formats the progress of a download, e.g. "45% (1.5 MiB/3.3 MiB)"
+func formatProgress(progress int64, totalLength int64) string {
+	if totalLength <= 0 {
+		return formatBytes(progress)
+	}
+	return fmt.Sprintf("%d%% (%s/%s)", progress*100/totalLength, formatBytes(progress), formatBytes(totalLength))
+}
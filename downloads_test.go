@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressReaderAccumulates(t *testing.T) {
+	var last int64
+	p := newProgressReader(10, func(progress int64, totalLength int64) { last = progress })
+	p.Write([]byte("abcd"))
+	p.Write([]byte("efgh"))
+	if last != 4 {
+		t.Errorf("expected only the first write to be reported right away, got %d", last)
+	}
+	p.report()
+	if last != 8 {
+		t.Errorf("expected the progress to accumulate to 8, got %d", last)
+	}
+}
+
+func TestDownloadHTTPStalled(t *testing.T) {
+	original := downloadStallTimeout
+	downloadStallTimeout = 100 * time.Millisecond
+	defer func() { downloadStallTimeout = original }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("some of it"))
+		w.(http.Flusher).Flush()
+		// never send the rest:
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	localPath := filepath.Join(t.TempDir(), "foo")
+	err := downloadHTTP(server.URL, localPath, func(progress int64, totalLength int64) {})
+	if !errors.Is(err, errNetwork) || !strings.Contains(err.Error(), "no data received") {
+		t.Errorf("expected the stalled download to fail, got %v", err)
+	}
+	if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+		t.Errorf("expected the partial download to be removed, got %v", err)
+	}
+}
+
+func TestDownloadHTTPReportsProgress(t *testing.T) {
+	body := strings.Repeat("x", 100000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	localPath := filepath.Join(t.TempDir(), "foo")
+	var lastProgress, lastTotal int64
+	err := downloadHTTP(server.URL, localPath, func(progress int64, totalLength int64) {
+		lastProgress, lastTotal = progress, totalLength
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastProgress != int64(len(body)) || lastTotal != int64(len(body)) {
+		t.Errorf("expected the progress to reach %d/%d, got %d/%d", len(body), len(body), lastProgress, lastTotal)
+	}
+	contents, err := os.ReadFile(localPath)
+	if err != nil || string(contents) != body {
+		t.Errorf("expected the body to be written (%v)", err)
+	}
+}
+
+func TestDownloadSourceFallsBackToCurl(t *testing.T) {
+	// a fake curl that records its arguments and writes the -o file:
+	bin := t.TempDir()
+	script := "#!/bin/sh\nwhile [ \"$1\" != -o ]; do shift; done\necho \"$3\" > \"$2\"\n"
+	if err := os.WriteFile(filepath.Join(bin, "curl"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	pkgbuild, err := NewPKGBUILDFromContents("pkgname=foo\nsource=(ftp://example.com/foo.tar.gz)\nsha256sums=(SKIP)\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pkgbuild.downloadSources(1); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := os.ReadFile(filepath.Join(pkgbuild.dirPath, "foo.tar.gz"))
+	if err != nil || strings.TrimSpace(string(contents)) != "ftp://example.com/foo.tar.gz" {
+		t.Errorf("expected curl to download the ftp:// source, got %q (%v)", contents, err)
+	}
+}
+
+func TestFormatProgress(t *testing.T) {
+	if got := formatProgress(512, 2048); got != "25% (512 B/2.0 KiB)" {
+		t.Errorf("unexpected progress: %q", got)
+	}
+	if got := formatProgress(512, -1); got != "512 B" {
+		t.Errorf("unexpected progress without a length: %q", got)
+	}
+}
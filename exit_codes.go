@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+)
+
+// The exit codes of mpr, so that scripts can tell failures apart:
+const (
+	exitOK          = 0
+	exitError       = 1  // any error not covered below
+	exitUsage       = 2  // invalid flags or arguments
+	exitNotFound    = 3  // a package (or file) does not exist
+	exitNetwork     = 4  // a request to the network failed
+	exitBuildFailed = 5  // makedeb failed
+	exitOutdated    = 6  // packages are outdated (outdated --exit-code)
+	exitAborted     = 10 // the user declined a confirmation
+)
+
+// exitCodesHelp documents the exit codes in `mpr --help`
+const exitCodesHelp = `Exit codes:
+  0   success
+  1   general error
+  2   invalid flags or arguments
+  3   package not found
+  4   network error
+  5   build failed
+  6   packages are outdated (outdated --exit-code)
+  10  aborted by the user`
+
+// The kinds of errors that map to an exit code. Errors are tagged with a kind
+// using markError, so that their message stays the same:
+var (
+	errUsage       = errors.New("usage error")
+	errNotFound    = errors.New("not found")
+	errNetwork     = errors.New("network error")
+	errBuildFailed = errors.New("build failed")
+	errAborted     = errors.New("aborted")
+	errOutdated    = errors.New("outdated")
+)
+
+type markedError struct {
+	error
+	kind error
+}
+
+func (e markedError) Unwrap() error        { return e.error }
+func (e markedError) Is(target error) bool { return target == e.kind }
+
+func markError(err error, kind error) error { return markedError{err, kind} }
+
+func usageErrorf(format string, a ...interface{}) error {
+	return markError(fmt.Errorf(format, a...), errUsage)
+}
+
+// exitCodeFor maps an error returned by a runner to the exit code of mpr
+func exitCodeFor(err error) int {
+	var netErr net.Error
+	var urlErr *url.Error
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errUsage):
+		return exitUsage
+	case errors.Is(err, errAborted):
+		return exitAborted
+	case errors.Is(err, errBuildFailed):
+		return exitBuildFailed
+	case errors.Is(err, errOutdated):
+		return exitOutdated
+	case errors.Is(err, errNotFound), errors.Is(err, errRepologyNotTracked), errors.Is(err, fs.ErrNotExist):
+		return exitNotFound
+	case errors.Is(err, errNetwork), errors.As(err, &urlErr), errors.As(err, &netErr):
+		return exitNetwork
+	default:
+		return exitError
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestExitCodeFor(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"success", nil, exitOK},
+		{"general", errors.New("boom"), exitError},
+		{"usage", usageErrorf("--jobs must be at least 1, got %d", 0), exitUsage},
+		{"not installed", markError(errors.New("package foo is not installed"), errNotFound), exitNotFound},
+		{"missing file", fmt.Errorf("reading PKGBUILD: %w", os.ErrNotExist), exitNotFound},
+		{"not tracked", fmt.Errorf("foo: %w", errRepologyNotTracked), exitNotFound},
+		{"network", &url.Error{Op: "Get", URL: "https://repology.org", Err: errors.New("connection refused")}, exitNetwork},
+		{"build failed", markError(&exec.ExitError{}, errBuildFailed), exitBuildFailed},
+		{"outdated", markError(errors.New("2 packages outdated"), errOutdated), exitOutdated},
+		{"aborted", fmt.Errorf("foo: %w", markError(errors.New("clean aborted"), errAborted)), exitAborted},
+	}
+	for _, c := range cases {
+		if code := exitCodeFor(c.err); code != c.code {
+			t.Errorf("%s: expected exit code %d, got %d", c.name, c.code, code)
+		}
+	}
+}
+
+func TestMarkErrorKeepsMessage(t *testing.T) {
+	err := markError(errors.New("package foo is not installed"), errNotFound)
+	if err.Error() != "package foo is not installed" {
+		t.Errorf("expected the message to be unchanged, got %q", err.Error())
+	}
+	if errors.Is(err, errAborted) {
+		t.Errorf("expected the error to only match its own kind")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// tempDirPrefixPkgbuild is the prefix of the temporary directories that
+// PKGBUILDs are evaluated in
+const tempDirPrefixPkgbuild = "mpr-pkgbuild-"
+
+// tempDirPrefixClone is the prefix of the directories in the mpr directory that
+// packages are cloned to, before they are named after their PKGBUILD
+const tempDirPrefixClone = ".mpr-clone-"
+
+// legacyTempDirPrefixCwd is the prefix of the temporary directories that older
+// versions of getVariables created in the cwd, before it used the system temp
+// dir
+const legacyTempDirPrefixCwd = "tmp-pkgbuild"
+
+// orphanedTempDirMinAge keeps `mpr gc` from removing the temporary directories
+// of mpr invocations that are still running
+const orphanedTempDirMinAge = time.Hour
+
+type gcArgs struct {
+	temp   bool // remove orphaned temporary directories
+	yes    bool // do not ask for confirmation
+	dryRun bool // only list what would be removed
+}
+
+type orphanedTempDir struct {
+	path string
+	size int64
+}
+
+// tempDirLocation is a directory that mpr creates temporary directories in,
+// and the prefixes of the ones it creates there
+type tempDirLocation struct {
+	dir      string
+	prefixes []string
+}
+
+// findOrphanedTempDirs lists the directories in each of locations that mpr
+// created and that have not been modified since `before`
+func findOrphanedTempDirs(locations []tempDirLocation, before time.Time) ([]orphanedTempDir, error) { // {{{
+	found := make([]orphanedTempDir, 0)
+	for _, location := range locations {
+		dir := location.dir
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() || !hasAnyPrefix(entry.Name(), location.prefixes) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return nil, err
+			}
+			if info.ModTime().After(before) {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			size, err := dirSize(path)
+			if err != nil {
+				return nil, err
+			}
+			found = append(found, orphanedTempDir{path: path, size: size})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].path < found[j].path })
+	return found, nil
+} // }}}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func runGC(w io.Writer, args gcArgs) error { // {{{
+	if !args.temp {
+		return usageErrorf("nothing to collect (use --temp)")
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	// each directory is only searched for what mpr creates there, so that
+	// e.g. a user's own "pkgbuild-foo" directory is never removed:
+	locations := []tempDirLocation{{dir: os.TempDir(), prefixes: []string{tempDirPrefixPkgbuild}}}
+	if cwd != os.TempDir() {
+		locations = append(locations, tempDirLocation{dir: cwd, prefixes: []string{legacyTempDirPrefixCwd}})
+	}
+	// interrupted clones are left in the mpr directory, next to the packages
+	// (whose names may well start with e.g. "pkgbuild-"):
+	if _, err := os.Stat(mprDir()); err == nil && mprDir() != cwd {
+		locations = append(locations, tempDirLocation{dir: mprDir(), prefixes: []string{tempDirPrefixClone}})
+	}
+	orphans, err := findOrphanedTempDirs(locations, time.Now().Add(-orphanedTempDirMinAge))
+	if err != nil {
+		return err
+	}
+
+	if len(orphans) == 0 {
+		fmt.Fprintln(w, "No orphaned temporary directories")
+		return nil
+	}
+
+	var total int64
+	fmt.Fprintf(w, "Would remove %d temporary director(ies):\n", len(orphans))
+	for _, orphan := range orphans {
+		fmt.Fprintf(w, "  %s (%s)\n", orphan.path, formatBytes(orphan.size))
+		total += orphan.size
+	}
+	if args.dryRun {
+		return nil
+	}
+	if !args.yes {
+		proceed, err := promptYesNo(w, os.Stdin, "Continue?", false)
+		if err != nil {
+			return err
+		}
+		if !proceed {
+			return markError(fmt.Errorf("gc aborted"), errAborted)
+		}
+	}
+
+	var reclaimed int64
+	for _, orphan := range orphans {
+		if err := os.RemoveAll(orphan.path); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "removed %s (%s)\n", orphan.path, formatBytes(orphan.size))
+		reclaimed += orphan.size
+	}
+	fmt.Fprintf(w, "removed %d temporary director(ies), reclaimed %s\n", len(orphans), formatBytes(reclaimed))
+	return nil
+} // }}}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindOrphanedTempDirs(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-2 * orphanedTempDirMinAge)
+	for _, name := range []string{"mpr-pkgbuild-1", "pkgbuild-2", "tmp-pkgbuild3", "unrelated", "mpr-pkgbuild-recent"} {
+		path := filepath.Join(dir, name)
+		if err := os.Mkdir(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(path, "PKGBUILD"), []byte("pkgname=foo\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if name != "mpr-pkgbuild-recent" {
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// a file with a matching name is not a temp dir:
+	if err := os.WriteFile(filepath.Join(dir, "pkgbuild-file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	orphans, err := findOrphanedTempDirs([]tempDirLocation{{dir: dir, prefixes: []string{tempDirPrefixPkgbuild, legacyTempDirPrefixCwd}}}, time.Now().Add(-orphanedTempDirMinAge))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0)
+	for _, orphan := range orphans {
+		names = append(names, filepath.Base(orphan.path))
+		if orphan.size == 0 {
+			t.Errorf("expected the size of %s to be counted", orphan.path)
+		}
+	}
+	if strings.Join(names, ",") != "mpr-pkgbuild-1,tmp-pkgbuild3" {
+		t.Errorf("expected only the old, matching directories, got %v", names)
+	}
+}
+
+func TestRunGCRemovesOrphanedTempDirs(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	old := time.Now().Add(-2 * orphanedTempDirMinAge)
+	orphan := filepath.Join(tmp, "mpr-pkgbuild-123")
+	if err := os.Mkdir(orphan, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(orphan, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := runGC(&out, gcArgs{temp: true, yes: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed", orphan)
+	}
+	if !strings.Contains(out.String(), "removed "+orphan) {
+		t.Errorf("expected the removal to be reported, got %q", out.String())
+	}
+}
+
+func TestRunGCKeepsPackages(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	setupTestMprDir(t)
+	old := time.Now().Add(-2 * orphanedTempDirMinAge)
+	pkg := createTestPackage(t, "pkgbuild-foo", "pkgname=pkgbuild-foo\npkgver=1.0.0\n")
+	clone := mprDir(tempDirPrefixClone + "bar-123")
+	if err := os.Mkdir(clone, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{pkg, clone} {
+		if err := os.Chtimes(dir, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out strings.Builder
+	if err := runGC(&out, gcArgs{temp: true, yes: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(pkg); err != nil {
+		t.Errorf("expected the package %s to be kept, got %v", pkg, err)
+	}
+	if _, err := os.Stat(clone); !os.IsNotExist(err) {
+		t.Errorf("expected the interrupted clone %s to be removed", clone)
+	}
+}
+
+func TestRunGCConfirmation(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	setupTestMprDir(t)
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	work := t.TempDir()
+	if err := os.Chdir(work); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+
+	old := time.Now().Add(-2 * orphanedTempDirMinAge)
+	orphan := filepath.Join(work, legacyTempDirPrefixCwd+"123")
+	// directories of the user's that merely look like mpr's:
+	mine := []string{filepath.Join(work, "pkgbuild-mine"), filepath.Join(tmp, "pkgbuild-mine")}
+	for _, dir := range append([]string{orphan}, mine...) {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(dir, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out strings.Builder
+	if err := runGC(&out, gcArgs{temp: true, dryRun: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), orphan) {
+		t.Errorf("expected the dry run to list %s, got %q", orphan, out.String())
+	}
+	withTestStdin(t, "n\n", func() {
+		err = runGC(&out, gcArgs{temp: true})
+	})
+	if !errors.Is(err, errAborted) {
+		t.Errorf("expected declining the prompt to abort, got %v", err)
+	}
+	if _, err := os.Stat(orphan); err != nil {
+		t.Fatalf("expected nothing to be removed yet, got %v", err)
+	}
+
+	withTestStdin(t, "y\n", func() {
+		err = runGC(&out, gcArgs{temp: true})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed", orphan)
+	}
+	for _, dir := range mine {
+		if _, err := os.Stat(dir); err != nil {
+			t.Errorf("expected %s to be kept, got %v", dir, err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// gitSourceDir returns the directory a git source is checked out to,
+// relative to the PKGBUILD directory: the local name without its fragment
+// and ".git" suffix (e.g. "foo" for "git+https://example.com/foo.git#tag=v1")
+func gitSourceDir(source PKGBUILD_source) string {
+	name, _, _ := parseSourceFragment(filepath.Base(source.localName))
+	return strings.TrimSuffix(name, ".git")
+}
+
+// gitRevParse resolves rev to a full commit hash in the repository at dir
+func gitRevParse(dir string, rev string) (string, error) {
+	var sbout, sberr strings.Builder
+	cmd := exec.Command(gitBin(), "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	cmd.Dir = dir
+	cmd.Stdout = &sbout
+	cmd.Stderr = &sberr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("could not resolve %s in %s: %w: %s", rev, dir, err, strings.TrimSpace(sberr.String()))
+	}
+	return strings.TrimSpace(sbout.String()), nil
+}
+
+// verifyGitPin checks that the checkout at dir actually matches the ref that a
+// source pins with its fragment: for #commit=, HEAD must be that commit (an
+// abbreviated hash is fine); for #tag=, HEAD must be the commit the tag points
+// to. Other fragments (e.g. #branch=) are moving targets and are not checked.
+func verifyGitPin(dir string, key string, value string) error {
+	if key != "commit" && key != "tag" {
+		return nil
+	}
+
+	head, err := gitRevParse(dir, "HEAD")
+	if err != nil {
+		return err
+	}
+
+	switch key {
+	case "commit":
+		if value == "" || !strings.HasPrefix(head, strings.ToLower(value)) {
+			return fmt.Errorf("%s: checked out commit %s does not match pinned commit %s", dir, head, value)
+		}
+	case "tag":
+		target, err := gitRevParse(dir, "refs/tags/"+value)
+		if err != nil {
+			return err
+		}
+		if head != target {
+			return fmt.Errorf("%s: checked out commit %s does not match tag %s (%s)", dir, head, value, target)
+		}
+	}
+	return nil
+}
+
+// gitCloneURL returns the URL to pass to `git clone` for a git source: the
+// URL without its fragment, and without makedeb's "git+" scheme prefix
+func gitCloneURL(remoteURL string) string {
+	base, _, _ := parseSourceFragment(remoteURL)
+	return strings.TrimPrefix(base, "git+")
+}
+
+// gitInDir runs git in dir, folding its stderr into the returned error
+func gitInDir(dir string, args ...string) error {
+	var sberr strings.Builder
+	cmd := exec.Command(gitBin(), args...)
+	cmd.Dir = dir
+	cmd.Stderr = &sberr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(sberr.String()))
+	}
+	return nil
+}
+
+// cloneGitSource clones a git source to checkoutDir, and checks out the ref
+// named by its #commit=, #tag= or #branch= fragment (or the default branch,
+// without a fragment). A failed clone is removed again.
+func cloneGitSource(checkoutDir string, source PKGBUILD_source) (err error) { // {{{
+	cloneURL := gitCloneURL(source.remoteURL)
+	_, key, value := parseSourceFragment(source.remoteURL)
+	defer func() {
+		if err != nil {
+			os.RemoveAll(checkoutDir)
+		}
+	}()
+
+	args := []string{"clone", "--quiet"}
+	if key == "branch" {
+		args = append(args, "--branch", value)
+	}
+	args = append(args, cloneURL, checkoutDir)
+	if err := gitInDir(filepath.Dir(checkoutDir), args...); err != nil {
+		return err
+	}
+
+	var rev string
+	switch key {
+	case "commit":
+		rev = value
+	case "tag":
+		rev = "refs/tags/" + value
+	default:
+		return nil
+	}
+	if _, err := gitRevParse(checkoutDir, rev); err != nil {
+		return fmt.Errorf("%s %s does not exist in %s", key, value, cloneURL)
+	}
+	if err := gitInDir(checkoutDir, "checkout", "--quiet", "--detach", rev); err != nil {
+		return err
+	}
+	return verifyGitPin(checkoutDir, key, value)
+} // }}}
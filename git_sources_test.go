@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGitSourceDir(t *testing.T) {
+	tests := map[string]string{
+		"git+https://example.com/foo.git#commit=abc": "foo",
+		"git+https://example.com/bar#tag=v1.0":       "bar",
+		"baz::git+https://example.com/foo.git":       "baz",
+	}
+	for spec, expected := range tests {
+		source := PKGBUILD_source{localName: filepath.Base(spec), remoteURL: spec}
+		if parts := strings.SplitN(spec, "::", 2); len(parts) == 2 {
+			source = PKGBUILD_source{localName: parts[0], remoteURL: parts[1]}
+		}
+		if dir := gitSourceDir(source); dir != expected {
+			t.Errorf("gitSourceDir(%q): expected %q, got %q", spec, expected, dir)
+		}
+	}
+}
+
+func TestVerifyGitPin(t *testing.T) {
+	dir := t.TempDir()
+	runTestGit(t, dir, "init", "-q")
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runTestGit(t, dir, "add", "file")
+	runTestGit(t, dir, "commit", "-q", "-m", "first")
+	runTestGit(t, dir, "tag", "v1")
+	first, err := gitRevParse(dir, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifyGitPin(dir, "commit", first); err != nil {
+		t.Errorf("expected the pinned commit to match: %v", err)
+	}
+	if err := verifyGitPin(dir, "commit", first[:8]); err != nil {
+		t.Errorf("expected an abbreviated pinned commit to match: %v", err)
+	}
+	if err := verifyGitPin(dir, "tag", "v1"); err != nil {
+		t.Errorf("expected the pinned tag to match: %v", err)
+	}
+
+	wrong := strings.Repeat("0", len(first))
+	if err := verifyGitPin(dir, "commit", wrong); err == nil {
+		t.Errorf("expected a mismatched pinned commit to be caught")
+	}
+
+	// move HEAD past the tag:
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runTestGit(t, dir, "commit", "-q", "-am", "second")
+	if err := verifyGitPin(dir, "tag", "v1"); err == nil {
+		t.Errorf("expected a checkout that doesn't match the tag to be caught")
+	}
+	if err := verifyGitPin(dir, "tag", "missing"); err == nil {
+		t.Errorf("expected a missing tag to be caught")
+	}
+	if err := verifyGitPin(dir, "branch", "main"); err != nil {
+		t.Errorf("expected branches not to be verified: %v", err)
+	}
+}
+
+func TestDownloadGitSources(t *testing.T) {
+	upstream := filepath.Join(t.TempDir(), "upstream")
+	runTestGit(t, filepath.Dir(upstream), "init", "-q", "-b", "main", upstream)
+	commit := func(contents string) string {
+		if err := os.WriteFile(filepath.Join(upstream, "file"), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		runTestGit(t, upstream, "add", "file")
+		runTestGit(t, upstream, "commit", "-q", "-m", contents)
+		hash, err := gitRevParse(upstream, "HEAD")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+	first := commit("1")
+	runTestGit(t, upstream, "tag", "v1")
+	runTestGit(t, upstream, "checkout", "-q", "-b", "dev")
+	dev := commit("dev")
+	runTestGit(t, upstream, "checkout", "-q", "main")
+	latest := commit("2")
+
+	sourceURL := "git+file://" + upstream
+	pkgbuild, err := NewPKGBUILDFromContents("pkgname=foo\n" +
+		"source=(default::" + sourceURL + " pinned::" + sourceURL + "#commit=" + first[:10] + " " +
+		"tagged::" + sourceURL + "#tag=v1 branch::" + sourceURL + "#branch=dev)\n" +
+		"sha256sums=(SKIP SKIP SKIP SKIP)\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pkgbuild.downloadSources(2); err != nil {
+		t.Fatal(err)
+	}
+	for dir, expected := range map[string]string{"default": latest, "pinned": first, "tagged": first, "branch": dev} {
+		head, err := gitRevParse(filepath.Join(pkgbuild.dirPath, dir), "HEAD")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head != expected {
+			t.Errorf("expected %s to be checked out at %s, got %s", dir, expected, head)
+		}
+	}
+
+	// a pin that does not exist is reported, and the clone is removed:
+	pkgbuild, err = NewPKGBUILDFromContents("pkgname=foo\nsource=(missing::" + sourceURL + "#tag=v9)\nsha256sums=(SKIP)\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pkgbuild.downloadSources(1)
+	if err == nil || !strings.Contains(err.Error(), "tag v9 does not exist in file://"+upstream) {
+		t.Errorf("expected the missing tag to be reported, got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(pkgbuild.dirPath, "missing")); !os.IsNotExist(err) {
+		t.Errorf("expected the failed clone to be removed")
+	}
+}
@@ -4,14 +4,15 @@ go 1.18
 
 require (
 	github.com/fatih/color v1.15.0
+	github.com/mattn/go-isatty v0.0.19
 	github.com/spf13/cobra v1.7.0
+	golang.org/x/crypto v0.10.0
 	golang.org/x/sync v0.3.0
 )
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
-	github.com/mattn/go-isatty v0.0.19 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 	golang.org/x/sys v0.9.0 // indirect
 )
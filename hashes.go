@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// hashVariables are the sums arrays makedeb supports, in the order in which
+// getHashes prefers them
+var hashVariables = []string{"cksums", "md5sums", "sha1sums", "sha224sums", "sha256sums", "sha384sums", "sha512sums", "b2sums"}
+
+// newHasher returns the hash for the entries of the given sums array. cksums
+// (POSIX CRCs) are not supported, and yield nil.
+func newHasher(hashesVar string) hash.Hash {
+	switch hashesVar {
+	case "md5sums":
+		return md5.New()
+	case "sha1sums":
+		return sha1.New()
+	case "sha224sums":
+		return sha256.New224()
+	case "sha256sums":
+		return sha256.New()
+	case "sha384sums":
+		return sha512.New384()
+	case "sha512sums":
+		return sha512.New()
+	case "b2sums":
+		hasher, _ := blake2b.New512(nil) // (only fails for a key that is too long)
+		return hasher
+	default:
+		return nil
+	}
+}
+
+// verifySourceHash checks the downloaded file at path against the hash of its
+// source. Sources whose hash is SKIP (or missing) are not checked, nor are
+// those whose algorithm is not supported, with a warning.
+func verifySourceHash(path string, source PKGBUILD_source) error { // {{{
+	if source.hash == "" || source.hash == "SKIP" {
+		return nil
+	}
+	hasher := newHasher(source.hashesVar)
+	if hasher == nil {
+		fmt.Fprintf(os.Stderr, "warning: %s was not verified (%s are not supported)\n", source.localName, source.hashesVar)
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return err
+	}
+
+	actual := hex.EncodeToString(hasher.Sum(nil))
+	if !strings.EqualFold(actual, source.hash) {
+		return fmt.Errorf("%s does not match its %s entry: expected %s, got %s", source.localName, source.hashesVar, source.hash, actual)
+	}
+	return nil
+} // }}}
+
+// isDownloaded reports whether a source was already downloaded to path, and
+// its hash verifies. Sources that cannot be verified are always downloaded.
+func isDownloaded(path string, source PKGBUILD_source) bool {
+	if source.hash == "" || source.hash == "SKIP" || newHasher(source.hashesVar) == nil {
+		return false
+	}
+	if _, err := os.Stat(path); err != nil {
+		return false
+	}
+	return verifySourceHash(path, source) == nil
+}
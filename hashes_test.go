@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifySourceHash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "foo.txt")
+	if err := os.WriteFile(path, []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	source := PKGBUILD_source{
+		localName: "foo.txt",
+		hash:      "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+		hashesVar: "sha256sums",
+	}
+	if err := verifySourceHash(path, source); err != nil {
+		t.Errorf("expected a matching sha256 to verify: %v", err)
+	}
+
+	source.hashesVar, source.hash = "md5sums", "5EB63BBBE01EEED093CB22BB8F5ACDC3"
+	if err := verifySourceHash(path, source); err != nil {
+		t.Errorf("expected a matching (uppercase) md5 to verify: %v", err)
+	}
+
+	source.hashesVar, source.hash = "b2sums", "021ced8799296ceca557832ab941a50b4a11f83478cf141f51f933f653ab9fbcc05a037cddbed06e309bf334942c4e58cdf1a46e237911ccd7fcf9787cbc7fd0"
+	if err := verifySourceHash(path, source); err != nil {
+		t.Errorf("expected a matching b2sum to verify: %v", err)
+	}
+	source.hash = strings.Repeat("0", 128)
+	if err := verifySourceHash(path, source); err == nil {
+		t.Errorf("expected a mismatching b2sum to be reported")
+	}
+
+	source.hashesVar, source.hash = "sha256sums", strings.Repeat("0", 64)
+	err := verifySourceHash(path, source)
+	if err == nil || !strings.Contains(err.Error(), "foo.txt does not match its sha256sums entry") {
+		t.Errorf("expected a mismatch to be reported, got: %v", err)
+	}
+
+	source.hash = "SKIP"
+	if err := verifySourceHash(path, source); err != nil {
+		t.Errorf("expected SKIP to skip verification: %v", err)
+	}
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
@@ -16,12 +20,17 @@ import (
 // main.Version=...")
 var Version string
 
+// defaultJobs is the default number of packages that are processed
+// concurrently by commands that support --jobs
+const defaultJobs = 10
+
 func main() {
 	cmd := func() *cobra.Command {
 		// create the root cobra command: this is the one we will attach all of the
 		// subcommands to
 		cmd := &cobra.Command{
-			Use: "mpr",
+			Use:  "mpr",
+			Long: "A CLI for the makedeb Package Repository\n\n" + exitCodesHelp,
 			RunE: func(cmd *cobra.Command, args []string) error {
 				version, _ := cmd.PersistentFlags().GetBool("version")
 				if version {
@@ -30,177 +39,855 @@ func main() {
 				}
 
 				err := cmd.Help()
-				os.Exit(1)
+				os.Exit(exitUsage)
 				return err
 			},
 		}
 		cmd.PersistentFlags().BoolP("version", "V", false, "print version information and exit")
+		cmd.PersistentFlags().BoolP("yes", "y", false, "do not ask for any confirmation (takes precedence over the commands' own flags)")
+		cmd.PersistentFlags().Bool("timings", false, "print how long each phase of the command took")
+		cmd.PersistentFlags().String("color", colorAuto, "when to use colors: auto (honors $NO_COLOR), always or never")
+		cmd.PersistentFlags().String("makedeb", "", "path to the makedeb binary (default $MPR_MAKEDEB, or makedeb on $PATH)")
+		cmd.PersistentFlags().String("git", "", "path to the git binary (default $MPR_GIT, or git on $PATH)")
+		cmd.PersistentFlags().Bool("run-pkgver", false, "compute the version of VCS packages by running their pkgver() function")
+		cmd.PersistentFlags().Duration("pkgver-timeout", pkgverTimeout, "how long pkgver() may run with --run-pkgver")
+		cmd.PersistentFlags().String("makedeb-install", "", "what to do when makedeb is missing: auto, prompt (unless --yes) or never (default $MPR_MAKEDEB_INSTALL, or auto)")
+		cmd.PersistentFlags().String("mpr-url", "", "base URL of the MPR (default $MPR_URL, or "+defaultMPRURL+")")
+		cmd.PersistentFlags().String("repology-url", "", "base URL of the repology API (default $MPR_REPOLOGY_URL, or "+defaultRepologyURL+")")
+		cmd.PersistentFlags().StringArray("env", nil, "set KEY=VALUE in makedeb's environment (repeatable; overrides the package's .mpr/env/<pkg> in the mpr directory)")
+		cmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+			timings.enabled, _ = cmd.Flags().GetBool("timings")
+			runPkgver, _ = cmd.Flags().GetBool("run-pkgver")
+			pkgverTimeout, _ = cmd.Flags().GetDuration("pkgver-timeout")
+			colorMode, _ := cmd.Flags().GetString("color")
+			if err := applyColorMode(colorMode); err != nil {
+				return err
+			}
 
-		cmd.AddCommand(&cobra.Command{
-			Use:   "build <pkg>",
-			Short: "Builds a package",
-			Long:  `Builds a package. This is equivalent to running "makedeb" in the package's directory.`,
-			Args:  cobra.ExactArgs(1),
-			Run: func(cmd *cobra.Command, args []string) {
-				runFallibleCommand(func() error {
-					pkgName := args[0]
-					return runBuild(pkgName)
-				})
-			},
-		})
+			var err error
+			makedebFlag, _ := cmd.Flags().GetString("makedeb")
+			if makedebPath, err = resolveBinary(makedebFlag, "MPR_MAKEDEB", "makedeb"); err != nil {
+				return err
+			}
+			gitFlag, _ := cmd.Flags().GetString("git")
+			if gitPath, err = resolveBinary(gitFlag, "MPR_GIT", "git"); err != nil {
+				return err
+			}
+			if aptPath, err = resolveAptBinary(); err != nil {
+				return err
+			}
 
-		cmd.AddCommand(&cobra.Command{
-			Use:   "clean [pkgs ...]",
-			Short: "Cleans a package's src/ & pkg/ directories",
-			Run: func(cmd *cobra.Command, args []string) {
-				runFallibleCommand(func() error {
-					return runClean(args)
-				})
-			},
-		})
+			makedebInstallFlag, _ := cmd.Flags().GetString("makedeb-install")
+			if makedebInstallFlag == "" {
+				makedebInstallFlag = os.Getenv("MPR_MAKEDEB_INSTALL")
+			}
+			if makedebInstallPolicy, err = parseMakedebInstallPolicy(makedebInstallFlag); err != nil {
+				return err
+			}
+			makedebInstallYes, _ = cmd.Flags().GetBool("yes")
 
-		cmd.AddCommand(&cobra.Command{
-			Use:   "check-stale",
-			Short: "Checks for stale packages",
-			Long:  `Checks for stale packages. A package is considered stale if it's version is behind repology's record.`,
-			Run: func(cmd *cobra.Command, args []string) {
-				runFallibleCommand(runCheckStale)
-			},
-		})
+			mprURLFlag, _ := cmd.Flags().GetString("mpr-url")
+			if mprURL, err = resolveBaseURL(mprURLFlag, "MPR_URL", defaultMPRURL); err != nil {
+				return err
+			}
+
+			repologyURLFlag, _ := cmd.Flags().GetString("repology-url")
+			if repologyURL, err = resolveBaseURL(repologyURLFlag, "MPR_REPOLOGY_URL", defaultRepologyURL); err != nil {
+				return err
+			}
+
+			envSpecs, _ := cmd.Flags().GetStringArray("env")
+			if buildEnvOverrides, err = parseVarAssignments(envSpecs); err != nil {
+				return err
+			}
+			return nil
+		}
+
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "build [pkg]",
+				Short: "Builds a package",
+				Long:  `Builds a package. This is equivalent to running "makedeb" in the package's directory. Without a package, one can be picked interactively.`,
+				Args:  cobra.MaximumNArgs(1),
+				Run: func(cmd *cobra.Command, args []string) {
+					runFallibleCommand(func() error {
+						pkgName, err := pkgArg(args)
+						if err != nil {
+							return err
+						}
+						prefetch, _ := cmd.Flags().GetBool("prefetch")
+						return runBuild(buildArgs{pkgName: pkgName, prefetch: prefetch})
+					})
+				},
+			}
+			cmd.Flags().Bool("prefetch", false, "download and verify the sources with mpr before running makedeb (which then skips verifying them, if it can)")
+			return &cmd
+		}())
+
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "bundle <pkg>",
+				Short: "Bundles a package's state into a .tar.gz for sharing",
+				Long:  `Bundles a package's PKGBUILD, .SRCINFO, sources, dependencies, and most recent build log (any *.log file in the package's directory) into a .tar.gz, e.g. for attaching to a bug report.`,
+				Args:  cobra.ExactArgs(1),
+				Run: func(cmd *cobra.Command, args []string) {
+					runFallibleCommand(func() error {
+						output, _ := cmd.Flags().GetString("output")
+						noLog, _ := cmd.Flags().GetBool("no-log")
+						noSources, _ := cmd.Flags().GetBool("no-sources")
+						noDeps, _ := cmd.Flags().GetBool("no-deps")
+						return runBundle(bundleArgs{
+							pkgName: args[0],
+							output:  output,
+							log:     !noLog,
+							sources: !noSources,
+							deps:    !noDeps,
+						})
+					})
+				},
+			}
+			cmd.Flags().StringP("output", "o", "", "path of the bundle to write (default <pkg>-bundle.tar.gz)")
+			cmd.Flags().Bool("no-log", false, "do not include the build log")
+			cmd.Flags().Bool("no-sources", false, "do not include the list of sources")
+			cmd.Flags().Bool("no-deps", false, "do not include the list of dependencies")
+			return &cmd
+		}())
+
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "clean [pkgs ...]",
+				Short: "Cleans a package's src/ & pkg/ directories",
+				Long:  `Cleans packages by running "git clean -fdx" in their directories, which deletes all untracked files. Without a list of packages, every package is cleaned, after asking for confirmation (unless the global --yes is passed).`,
+				Run: func(cmd *cobra.Command, args []string) {
+					runFallibleCommand(func() error {
+						yes, _ := cmd.Flags().GetBool("yes")
+						dryRun, _ := cmd.Flags().GetBool("dry-run")
+						return runClean(cleanArgs{
+							packages: args,
+							yes:      yes,
+							dryRun:   dryRun,
+						})
+					})
+				},
+			}
+			cmd.Flags().Bool("dry-run", false, "only print what would be removed (git clean -n)")
+			return &cmd
+		}())
+
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "check-stale",
+				Short: "Checks for stale packages",
+				Long:  `Checks for stale packages. A package is considered stale if it's version is behind repology's record (as ordered by dpkg, so that e.g. 1.10.0 is newer than 1.2.0; with --any-diff, if it differs at all). Both versions are compared without a leading "v" or packaging suffixes such as "+dfsg"; a PKGBUILD can set repology_version_regex to extract the version (its first group) instead. PKGBUILDs are evaluated in parallel, but requests to repology are spaced out by --rate-limit (by default, at most one a second).`,
+				Run: func(cmd *cobra.Command, args []string) {
+					runFallibleCommand(func() error {
+						jobs, _ := cmd.Flags().GetInt("jobs")
+						if jobs < 1 {
+							return usageErrorf("--jobs must be at least 1, got %d", jobs)
+						}
+						rateLimit, _ := cmd.Flags().GetDuration("rate-limit")
+						delay, err := resolveRepologyDelay(rateLimit, cmd.Flags().Changed("rate-limit"))
+						if err != nil {
+							return err
+						}
+						repologyLimiter = newRateLimiter(delay)
+						maxAge, _ := cmd.Flags().GetDuration("max-age")
+						anyDiff, _ := cmd.Flags().GetBool("any-diff")
+						return runCheckStale(checkStaleArgs{jobs: jobs, maxAge: maxAge, anyDiff: anyDiff})
+					})
+				},
+			}
+			cmd.Flags().IntP("jobs", "j", defaultJobs, "how many packages to evaluate at once")
+			cmd.Flags().Duration("rate-limit", defaultRepologyDelay, "minimum delay between requests to repology (overrides $MPR_REPOLOGY_DELAY)")
+			cmd.Flags().Duration("max-age", defaultRepologyMaxAge, "reuse versions fetched from repology within this long (0 to always ask repology)")
+			cmd.Flags().Bool("any-diff", false, "report packages whose version differs from repology's at all, even if repology's is older")
+			return &cmd
+		}())
+
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "clone <package-url>",
+				Short: "Clones a package",
+				Long: `Clones a package. This is equivalent to running "git clone" in the packages directory. With --maintainer, all of the packages maintained by the given user on the MPR are cloned instead.
+
+` + shallowCloneHelp + `
+
+` + yesHelp,
+				RunE: func(cmd *cobra.Command, args []string) error {
+					maintainer, _ := cmd.Flags().GetString("maintainer")
+					if maintainer == "" && len(args) != 1 {
+						return fmt.Errorf("expected 1 argument, got %d", len(args))
+					}
+					if maintainer != "" && len(args) != 0 {
+						return fmt.Errorf("expected no arguments with --maintainer, got %d", len(args))
+					}
+
+					runFallibleCommand(func() error {
+						if maintainer != "" {
+							install, _ := cmd.Flags().GetBool("install")
+							jobs, _ := cmd.Flags().GetInt("jobs")
+							return runCloneMaintainer(cloneMaintainerArgs{
+								maintainer: maintainer,
+								install:    install,
+								jobs:       jobs,
+							})
+						}
+						from, _ := cmd.Flags().GetString("from")
+						force, _ := cmd.Flags().GetBool("force")
+						noConfirm := noConfirmFromFlags(cmd)
+						depth, _ := cmd.Flags().GetInt("depth")
+						if depth < 0 {
+							return usageErrorf("--depth must not be negative, got %d", depth)
+						}
+						recurseSubs, _ := cmd.Flags().GetBool("recurse-submodules")
+						_, err := runClone(cloneArgs{
+							packageURL:  args[0],
+							from:        from,
+							force:       force,
+							confirm:     !noConfirm,
+							depth:       depth,
+							recurseSubs: recurseSubs,
+						})
+						return err
+					})
+					return nil
+				},
+			}
+			cmd.Flags().String("from", providerAuto, "where the package is from: mpr, github or url (default: inferred from the package URL)")
+			cmd.Flags().String("maintainer", "", "clone all of the packages maintained by this MPR user")
+			cmd.Flags().Bool("install", false, "with --maintainer, also build and install the cloned packages")
+			cmd.Flags().IntP("jobs", "j", defaultJobs, "with --maintainer, how many packages to clone at once")
+			cmd.Flags().Bool("force", false, "replace an existing clone of the package (once the new clone succeeded)")
+			cmd.Flags().Bool("no-confirm", false, "with --force, do not ask before deleting the existing clone")
+			cmd.Flags().Int("depth", 0, "only clone this many of the most recent commits (see --help)")
+			cmd.Flags().Bool("recurse-submodules", false, "also clone the package's git submodules")
+			return &cmd
+		}())
+
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "deps <pkg>",
+				Args:  cobra.ExactArgs(1),
+				Short: "Shows the dependencies of a package",
+				Long: `Shows the dependencies (depends, makedepends and optdepends) of a package as a
+tree. Dependencies marked with "(mpr)" are packages managed by mpr, whose own
+dependencies are shown below them; all others are installed with apt.
+
+With --reverse, the packages managed by mpr that depend on the given package
+(which can also be an apt package) are listed instead, e.g. to see which
+packages an upgrade affects.`,
+				Run: func(cmd *cobra.Command, args []string) {
+					runFallibleCommand(func() error {
+						reverse, _ := cmd.Flags().GetBool("reverse")
+						return runDeps(os.Stdout, depsArgs{
+							pkgName: args[0],
+							reverse: reverse,
+						})
+					})
+				},
+			}
+			cmd.Flags().Bool("reverse", false, "list the packages that depend on the package instead")
+			return &cmd
+		}())
 
 		cmd.AddCommand(&cobra.Command{
-			Use:   "clone <package-url>",
-			Short: "Clones a package",
-			Long:  `Clones a package. This is equivalent to running "git clone" in the packages directory.`,
-			Args:  cobra.ExactArgs(1),
+			Use:   "diff [pkg]",
+			Short: "Shows the local modifications of a package",
+			Long:  `Shows the local modifications of a package (e.g. edits to its PKGBUILD), with "git diff". Without a package, the modifications of all packages are shown. The output is paged with $GIT_PAGER or $PAGER.`,
+			Args:  cobra.MaximumNArgs(1),
 			Run: func(cmd *cobra.Command, args []string) {
 				runFallibleCommand(func() error {
-					packageURL := args[0]
-					return runClone(packageURL)
+					pkgName := ""
+					if len(args) == 1 {
+						pkgName = args[0]
+					}
+					return runDiff(pkgName)
 				})
 			},
 		})
 
-		cmd.AddCommand(&cobra.Command{
-			Use:   "each ...",
-			Short: "Runs a command in each package's directory",
-			RunE: func(cmd *cobra.Command, args []string) error {
-				if len(args) == 0 {
-					return fmt.Errorf("expected at least 1 argument, got 0")
-				}
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "doctor",
+				Short: "Checks that mpr's environment is healthy",
+				Args:  cobra.NoArgs,
+				Run: func(cmd *cobra.Command, args []string) {
+					runFallibleCommand(func() error {
+						jsonOutput, _ := cmd.Flags().GetBool("json")
+						return runDoctor(os.Stdout, jsonOutput)
+					})
+				},
+			}
+			cmd.Flags().Bool("json", false, "print the checks as JSON")
+			return &cmd
+		}())
 
-				runFallibleCommand(func() error {
-					return runEach(args)
-				})
-				return nil
-			},
-		})
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "each ...",
+				Short: "Runs a command in each package's directory",
+				Long:  `Runs a command in each package's directory, one package at a time. With -j N (N > 1), the command runs in N packages at once, and the output of each package is printed when it finishes; interactive commands need -j 1, as they get no stdin.`,
+				RunE: func(cmd *cobra.Command, args []string) error {
+					if len(args) == 0 {
+						return fmt.Errorf("expected at least 1 argument, got 0")
+					}
+					parallel, _ := cmd.Flags().GetBool("parallel")
+					keepGoing, _ := cmd.Flags().GetBool("keep-going")
+					jobs, _ := cmd.Flags().GetInt("jobs")
+					if jobs < 1 {
+						return fmt.Errorf("--jobs must be at least 1, got %d", jobs)
+					}
+					// -j buffers each package's output, unless --prefix is given:
+					output := eachOutputPrefix
+					switch {
+					case jobs > 1:
+						parallel = true
+						output = eachOutputGroup
+					case parallel && !cmd.Flags().Changed("jobs"):
+						jobs = defaultJobs
+					}
+					output = eachOutputFromFlags(cmd, output)
+
+					runFallibleCommand(func() error {
+						return runEach(eachArgs{
+							command:   args,
+							parallel:  parallel,
+							output:    output,
+							keepGoing: keepGoing,
+							jobs:      jobs,
+						})
+					})
+					return nil
+				},
+			}
+			cmd.Flags().BoolP("parallel", "p", false, "run the command in all packages concurrently (no stdin)")
+			cmd.Flags().Bool("prefix", false, "with --parallel, stream output prefixed with [pkg] (default)")
+			cmd.Flags().Bool("group", false, "with --parallel, print each package's output at once, when it finishes")
+			cmd.MarkFlagsMutuallyExclusive("prefix", "group")
+			cmd.Flags().BoolP("keep-going", "k", false, "run the command in all packages, even if it fails in some, and summarize the failures")
+			cmd.Flags().IntP("jobs", "j", 1, "how many packages to run the command in at once (interactive commands need 1)")
+			// everything after the command name belongs to the command:
+			cmd.Flags().SetInterspersed(false)
+			return &cmd
+		}())
 
 		cmd.AddCommand(&cobra.Command{
-			Use:   "edit <package-name>",
+			Use:   "edit [package-name]",
 			Short: "Edits a package's PKGBUILD",
-			Long:  `Edits a package's PKGBUILD. This is equivalent to running "$EDITOR PKGBUILD" in the package's directory.`,
-			Args:  cobra.ExactArgs(1),
+			Long:  `Edits a package's PKGBUILD. This is equivalent to running "$EDITOR PKGBUILD" in the package's directory. Without a package, one can be picked interactively.`,
+			Args:  cobra.MaximumNArgs(1),
 			Run: func(cmd *cobra.Command, args []string) {
 				runFallibleCommand(func() error {
-					pkgName := args[0]
+					pkgName, err := pkgArg(args)
+					if err != nil {
+						return err
+					}
 					return runEdit(pkgName)
 				})
 			},
 		})
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "env",
+				Short: "Shows the configuration resolved from flags and the environment",
+				Args:  cobra.NoArgs,
+				Run: func(cmd *cobra.Command, args []string) {
+					runFallibleCommand(func() error {
+						jsonOutput, _ := cmd.Flags().GetBool("json")
+						return runEnv(os.Stdout, jsonOutput)
+					})
+				},
+			}
+			cmd.Flags().Bool("json", false, "print the configuration as JSON")
+			return &cmd
+		}())
+
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "gc",
+				Short: "Removes files left behind by interrupted or older runs of mpr",
+				Long:  `Removes files left behind by interrupted or older runs of mpr. With --temp, mpr's orphaned temporary directories (older than an hour) are removed from the system temp dir, the current directory (where older versions of mpr created them) and the mpr directory (interrupted clones). The directories are listed first, and removed after asking for confirmation (unless the global --yes is passed).`,
+				Args:  cobra.NoArgs,
+				Run: func(cmd *cobra.Command, args []string) {
+					runFallibleCommand(func() error {
+						temp, _ := cmd.Flags().GetBool("temp")
+						yes, _ := cmd.Flags().GetBool("yes")
+						dryRun, _ := cmd.Flags().GetBool("dry-run")
+						return runGC(os.Stdout, gcArgs{temp: temp, yes: yes, dryRun: dryRun})
+					})
+				},
+			}
+			cmd.Flags().Bool("temp", false, "remove orphaned temporary directories")
+			cmd.Flags().Bool("dry-run", false, "only list what would be removed")
+			return &cmd
+		}())
+
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "get <pkg> <variable>",
+				Args:  cobra.ExactArgs(2),
+				Short: "Prints the value of a variable in a package's PKGBUILD",
+				Long:  `Prints the value of a variable in a package's PKGBUILD, one line per value for arrays. Exits with an error if the PKGBUILD does not set the variable. Use "." for the package in the current directory.`,
+				Run: func(cmd *cobra.Command, args []string) {
+					runFallibleCommand(func() error {
+						merged, _ := cmd.Flags().GetBool("merged")
+						return runGet(os.Stdout, getArgs{
+							pkgName:  args[0],
+							variable: args[1],
+							merged:   merged,
+						})
+					})
+				},
+			}
+			cmd.Flags().Bool("merged", false, "merge architecture-specific variables (e.g. depends_amd64) into their base variable")
+			return &cmd
+		}())
 
 		cmd.AddCommand(func() *cobra.Command {
 			// this subcommand will have its own flags, so we set it up inside of a
 			// closure to avoid polluting the global flag set
 			cmd := &cobra.Command{
-				Use:   "install <package-url>",
+				Use:   "install [package-url]",
 				Short: "Installs a package",
-				Long:  `Installs a package. This is equivalent to cloning and running "makepkg ..." in the package's directory.`,
-				Args:  cobra.ExactArgs(1),
+				Long: `Installs a package. This is equivalent to cloning and running "makepkg ..." in the package's directory. With --from-file, the packages are read from a file instead (one per line; blank lines and "#" comments are ignored).
+
+` + shallowCloneHelp + `
+
+` + yesHelp,
+				RunE: func(cmd *cobra.Command, args []string) error {
+					fromFile, _ := cmd.Flags().GetString("from-file")
+					if fromFile == "" && len(args) != 1 {
+						return fmt.Errorf("expected 1 argument, got %d", len(args))
+					}
+					if fromFile != "" && len(args) != 0 {
+						return fmt.Errorf("expected no arguments with --from-file, got %d", len(args))
+					}
+
+					runFallibleCommand(func() error {
+						// --no-confirm (or the global --yes) is a shorthand for
+						// all of --no-review, --no-prompt and --makedeb-no-confirm:
+						noConfirm := noConfirmFromFlags(cmd)
+						noReview, _ := cmd.Flags().GetBool("no-review")
+						noPrompt, _ := cmd.Flags().GetBool("no-prompt")
+						makedebNoConfirm, _ := cmd.Flags().GetBool("makedeb-no-confirm")
+						keepOnAbort, _ := cmd.Flags().GetBool("keep-on-abort")
+						cleanAfter, _ := cmd.Flags().GetBool("clean-after")
+						prefetch, _ := cmd.Flags().GetBool("prefetch")
+						from, _ := cmd.Flags().GetString("from")
+						depth, _ := cmd.Flags().GetInt("depth")
+						if depth < 0 {
+							return usageErrorf("--depth must not be negative, got %d", depth)
+						}
+						recurseSubs, _ := cmd.Flags().GetBool("recurse-submodules")
+						install := installArgs{
+							from:           from,
+							review:         !noConfirm && !noReview,
+							confirm:        !noConfirm && !noPrompt,
+							makedebConfirm: !noConfirm && !makedebNoConfirm,
+							keepOnAbort:    keepOnAbort,
+							cleanAfter:     cleanAfter,
+							prefetch:       prefetch,
+							depth:          depth,
+							recurseSubs:    recurseSubs,
+						}
+						if fromFile != "" {
+							return runInstallFromFile(fromFile, install)
+						}
+
+						install.packageURL = args[0]
+						return runInstall(install)
+					})
+					return nil
+				},
+			}
+			cmd.Flags().Bool("no-confirm", false, "do not review the PKGBUILD or ask for any confirmation (implies --no-review, --no-prompt and --makedeb-no-confirm)")
+			cmd.Flags().Bool("no-review", false, "do not open the PKGBUILD in $EDITOR before building")
+			cmd.Flags().Bool("no-prompt", false, "do not ask whether to build the package")
+			cmd.Flags().Bool("makedeb-no-confirm", false, "pass --no-confirm to makedeb")
+			cmd.Flags().Bool("keep-on-abort", false, "keep the cloned package if the build is declined")
+			cmd.Flags().String("from", providerAuto, "where the package is from: mpr, github or url (default: inferred from the package URL)")
+			cmd.Flags().StringP("from-file", "f", "", "install the packages listed in the given file")
+			cmd.Flags().Bool("clean-after", cleanAfterInstallDefault(), "remove build artifacts after a successful install")
+			cmd.Flags().Bool("prefetch", false, "download and verify the sources with mpr before running makedeb (which then skips verifying them, if it can)")
+			cmd.Flags().Int("depth", 0, "only clone this many of the most recent commits (see --help)")
+			cmd.Flags().Bool("recurse-submodules", false, "also clone the package's git submodules")
+			return cmd
+		}())
+
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "list",
+				Short: "Lists all packages",
+				Long:  `Lists all packages. With --long, the version in each PKGBUILD is also compared against the version installed on the system (per dpkg).`,
 				Run: func(cmd *cobra.Command, args []string) {
 					runFallibleCommand(func() error {
-						packageURL := args[0]
-						noConfirm, _ := cmd.Flags().GetBool("no-confirm")
-						return runInstall(installArgs{
-							packageURL: packageURL,
-							confirm:    !noConfirm,
+						long, _ := cmd.Flags().GetBool("long")
+						showErrors, _ := cmd.Flags().GetBool("show-errors")
+						sortKey, _ := cmd.Flags().GetString("sort")
+						switch sortKey {
+						case listSortName, listSortMtime, listSortSize, listSortOutdated:
+						default:
+							return usageErrorf("invalid --sort %q (expected name, mtime, size or outdated)", sortKey)
+						}
+						output, _ := cmd.Flags().GetString("output")
+						if output != listOutputText && output != listOutputJSON {
+							return usageErrorf("invalid --output %q (expected text or json)", output)
+						}
+						filter, _ := cmd.Flags().GetString("filter")
+						pinned, _ := cmd.Flags().GetBool("pinned")
+						return runList(listArgs{
+							long:       long,
+							sort:       sortKey,
+							showErrors: showErrors,
+							output:     output,
+							filter:     filter,
+							pinned:     pinned,
 						})
 					})
 				},
 			}
-			cmd.Flags().Bool("no-confirm", false, "do not ask for confirmation")
-			return cmd
+			cmd.Flags().BoolP("long", "l", false, "show PKGBUILD & installed versions")
+			cmd.Flags().String("sort", listSortName, "sort by name, mtime (newest first), size (largest first) or outdated (outdated first)")
+			cmd.Flags().Bool("show-errors", false, "also report package directories whose PKGBUILD fails to evaluate")
+			cmd.Flags().String("filter", "", "only list packages whose names match this glob, e.g. 'python-*'")
+			cmd.Flags().Bool("pinned", false, "only list pinned packages (see `mpr pin`)")
+			cmd.PersistentFlags().StringP("output", "o", listOutputText, "output format: text or json (json includes broken packages, with an error)")
+			return &cmd
 		}())
 
-		cmd.AddCommand(&cobra.Command{
-			Use:   "list",
-			Short: "Lists all packages",
-			Run: func(cmd *cobra.Command, args []string) {
-				runFallibleCommand(runList)
-			},
-		})
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "log <pkg>",
+				Args:  cobra.ExactArgs(1),
+				Short: "Shows the commits to a package since it was last installed",
+				Long:  `Shows the commits to a package since it was last installed. With --after, the commits after the given commit, tag, or date (e.g. "2 weeks ago") are shown instead.`,
+				Run: func(cmd *cobra.Command, args []string) {
+					runFallibleCommand(func() error {
+						after, _ := cmd.Flags().GetString("after")
+						return runLog(args[0], after)
+					})
+				},
+			}
+			cmd.Flags().String("after", "", "show commits after this commit, tag, or date")
+			return &cmd
+		}())
 
-		cmd.AddCommand(&cobra.Command{
-			Use:   "outdated",
-			Short: "Lists all outdated packages",
-			Run: func(cmd *cobra.Command, args []string) {
-				runFallibleCommand(runOutdated)
-			},
-		})
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "outdated",
+				Short: "Lists all outdated packages",
+				Long: `Lists all outdated packages.
+
+` + porcelainHelp + `
+
+With -o json, the outdated packages are printed as an array of objects with
+the fields "name", "installedHash" (the commit that was last installed, empty
+if the package was never installed) and "currentHash" (the commit at HEAD).
+
+With --exit-code, mpr exits with 6 if any package is outdated.`,
+				Run: func(cmd *cobra.Command, args []string) {
+					runFallibleCommand(func() error {
+						porcelain, _ := cmd.Flags().GetBool("porcelain")
+						output, _ := cmd.Flags().GetString("output")
+						if output != listOutputText && output != listOutputJSON {
+							return usageErrorf("invalid --output %q (expected text or json)", output)
+						}
+						if porcelain && output != listOutputText {
+							return usageErrorf("--porcelain cannot be combined with --output %s", output)
+						}
+						exitCode, _ := cmd.Flags().GetBool("exit-code")
+						jobs, _ := cmd.Flags().GetInt("jobs")
+						if jobs < 1 {
+							return usageErrorf("--jobs must be at least 1, got %d", jobs)
+						}
+						filter, _ := cmd.Flags().GetString("filter")
+						return runOutdated(outdatedArgs{
+							porcelain: porcelain,
+							jobs:      jobs,
+							filter:    filter,
+							output:    output,
+							exitCode:  exitCode,
+						})
+					})
+				},
+			}
+			cmd.Flags().Bool("porcelain", false, "print output in a stable, machine-readable format")
+			cmd.Flags().StringP("output", "o", listOutputText, "output format: text or json")
+			cmd.Flags().Bool("exit-code", false, "exit with 6 if any package is outdated")
+			cmd.Flags().IntP("jobs", "j", defaultJobs, "number of packages to check concurrently")
+			cmd.Flags().String("filter", "", "only check packages whose names match this glob, e.g. 'lib*'")
+			return &cmd
+		}())
 
 		cmd.AddCommand(&cobra.Command{
-			Use:   "reinstall <pkg>",
-			Short: "Reinstalls a package",
+			Use:   "pin <pkg>",
 			Args:  cobra.ExactArgs(1),
+			Short: "Pins a package, so that update and upgrade skip it",
+			Long:  `Pins a package, so that update and upgrade skip it (saying so) until it is unpinned with unpin. Pins are recorded in .mpr/pinned in the mpr directory, so they survive e.g. a git clean of the package. Use "list --pinned" to list the pinned packages.`,
 			Run: func(cmd *cobra.Command, args []string) {
 				runFallibleCommand(func() error {
-					pkgName := args[0]
-					return runReinstall(pkgName)
+					return runPin(args[0])
 				})
 			},
 		})
 
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "reinstall <pkg>",
+				Short: "Reinstalls a package",
+				Args:  cobra.ExactArgs(1),
+				Run: func(cmd *cobra.Command, args []string) {
+					runFallibleCommand(func() error {
+						pkgName := args[0]
+						cleanAfter, _ := cmd.Flags().GetBool("clean-after")
+						return runReinstall(pkgName, cleanAfter)
+					})
+				},
+			}
+			cmd.Flags().Bool("clean-after", cleanAfterInstallDefault(), "remove build artifacts after a successful install")
+			return &cmd
+		}())
+
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "search <term>",
+				Args:  cobra.ExactArgs(1),
+				Short: "Searches the MPR for packages",
+				Long:  `Searches the MPR for packages, printing their names, versions and descriptions. Results are cached for an hour, and the cache is also used when the MPR cannot be reached.`,
+				Run: func(cmd *cobra.Command, args []string) {
+					runFallibleCommand(func() error {
+						cached, _ := cmd.Flags().GetBool("cached")
+						refresh, _ := cmd.Flags().GetBool("refresh")
+						jsonOutput, _ := cmd.Flags().GetBool("json")
+						return runSearch(os.Stdout, searchArgs{
+							term:       args[0],
+							cached:     cached,
+							refresh:    refresh,
+							jsonOutput: jsonOutput,
+						})
+					})
+				},
+			}
+			cmd.Flags().Bool("cached", false, "only show cached results (works offline)")
+			cmd.Flags().Bool("refresh", false, "ignore cached results")
+			cmd.MarkFlagsMutuallyExclusive("cached", "refresh")
+			cmd.Flags().Bool("json", false, "print the results as JSON")
+			return &cmd
+		}())
+
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "set <pkg> <variable> <value>",
+				Args:  cobra.ExactArgs(3),
+				Short: "Sets the value of a variable in a package's PKGBUILD",
+				Long: `Sets the value of a variable in a package's PKGBUILD. The value is written as-is, so arrays and values with spaces have to be quoted as they would be in the PKGBUILD, e.g. "('foo' 'bar')". Use "." for the package in the current directory.
+
+The variable has to be declared in the PKGBUILD already, unless --create is given, in which case it is appended to the PKGBUILD.`,
+				Run: func(cmd *cobra.Command, args []string) {
+					runFallibleCommand(func() error {
+						create, _ := cmd.Flags().GetBool("create")
+						recomputeSums, _ := cmd.Flags().GetBool("recompute-sums")
+						return runSet(setArgs{
+							pkgName:       args[0],
+							variable:      args[1],
+							value:         args[2],
+							create:        create,
+							recomputeSums: recomputeSums,
+							dirty:         getDirtyTreeArgs(cmd),
+						})
+					})
+				},
+			}
+			cmd.Flags().Bool("create", false, "append the variable to the PKGBUILD if it is not declared")
+			cmd.Flags().Bool("recompute-sums", false, "update the checksums (and the .SRCINFO) after setting the variable")
+			addDirtyTreeFlags(&cmd)
+			return &cmd
+		}())
+
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "show-cmd <pkg>",
+				Short: "Prints the makedeb command that would be run for a package",
+				Long:  `Prints the makedeb command (and the directory it would be run in) for building, installing, or upgrading a package, without running it.`,
+				Args:  cobra.ExactArgs(1),
+				Run: func(cmd *cobra.Command, args []string) {
+					runFallibleCommand(func() error {
+						pkgName := args[0]
+						install, _ := cmd.Flags().GetBool("install")
+						upgrade, _ := cmd.Flags().GetBool("upgrade")
+						noConfirm, _ := cmd.Flags().GetBool("no-confirm")
+
+						op := makedebOpBuild
+						if install {
+							op = makedebOpInstall
+						} else if upgrade {
+							op = makedebOpUpgrade
+						}
+						return runShowCmd(pkgName, op, !noConfirm)
+					})
+				},
+			}
+			cmd.Flags().Bool("build", false, "show the command used by `build` (default)")
+			cmd.Flags().Bool("install", false, "show the command used by `install`")
+			cmd.Flags().Bool("upgrade", false, "show the command used by `upgrade`")
+			cmd.Flags().Bool("no-confirm", false, "show the command as run with --no-confirm")
+			cmd.MarkFlagsMutuallyExclusive("build", "install", "upgrade")
+			return &cmd
+		}())
+
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "sources <pkg>",
+				Args:  cobra.ExactArgs(1),
+				Short: "Lists a package's sources and their hashes",
+				Long:  `Lists a package's sources and their hashes. By default, the source and hashes arrays must have the same length. With --lenient, they are paired by index instead: sources without a hash are shown with "-", and surplus hashes are ignored. With --download, the sources are downloaded (in parallel) instead.`,
+				Run: func(cmd *cobra.Command, args []string) {
+					runFallibleCommand(func() error {
+						lenient, _ := cmd.Flags().GetBool("lenient")
+						download, _ := cmd.Flags().GetBool("download")
+						jobs, _ := cmd.Flags().GetInt("jobs")
+						if jobs < 1 {
+							return usageErrorf("--jobs must be at least 1, got %d", jobs)
+						}
+						return runSources(sourcesArgs{
+							pkgName:  args[0],
+							lenient:  lenient,
+							download: download,
+							jobs:     jobs,
+						})
+					})
+				},
+			}
+			cmd.Flags().Bool("lenient", false, "tolerate source and hashes arrays of different lengths")
+			cmd.Flags().Bool("download", false, "download the sources into the package directory instead of listing them")
+			cmd.Flags().IntP("jobs", "j", defaultJobs, "with --download, how many sources to download at once")
+			return &cmd
+		}())
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "srcinfo <pkg>",
+				Args:  cobra.ExactArgs(1),
+				Short: "Regenerates a package's .SRCINFO",
+				Long:  `Regenerates a package's .SRCINFO from its PKGBUILD (per makedeb --print-srcinfo), without touching the checksums like recompute-sums does. Use "." for the package in the current directory.`,
+				Run: func(cmd *cobra.Command, args []string) {
+					runFallibleCommand(func() error {
+						stdout, _ := cmd.Flags().GetBool("stdout")
+						return runSRCINFO(os.Stdout, srcinfoArgs{pkgName: args[0], stdout: stdout})
+					})
+				},
+			}
+			cmd.Flags().Bool("stdout", false, "print the .SRCINFO instead of writing it")
+			return &cmd
+		}())
+
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "stats",
+				Short: "Shows aggregate counts over all packages",
+				Args:  cobra.NoArgs,
+				Run: func(cmd *cobra.Command, args []string) {
+					runFallibleCommand(func() error {
+						jsonOutput, _ := cmd.Flags().GetBool("json")
+						return runStats(os.Stdout, jsonOutput)
+					})
+				},
+			}
+			cmd.Flags().Bool("json", false, "print the counts as JSON")
+			return &cmd
+		}())
+
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "status",
+				Short: "Shows the git state of every package",
+				Long: `Shows the git state of every package's clone: whether it has local modifications (to tracked files), and how far it is ahead of/behind its upstream branch (as of the last fetch).
+
+` + porcelainHelp,
+				Args: cobra.NoArgs,
+				Run: func(cmd *cobra.Command, args []string) {
+					runFallibleCommand(func() error {
+						dirtyOnly, _ := cmd.Flags().GetBool("dirty-only")
+						porcelain, _ := cmd.Flags().GetBool("porcelain")
+						return runStatus(os.Stdout, statusArgs{dirtyOnly: dirtyOnly, porcelain: porcelain})
+					})
+				},
+			}
+			cmd.Flags().Bool("dirty-only", false, "only show packages with local modifications")
+			cmd.Flags().Bool("porcelain", false, "print output in a stable, machine-readable format")
+			return &cmd
+		}())
+
 		cmd.AddCommand(func() *cobra.Command {
 			cmd := cobra.Command{
 				Use:   "update [pkgs]",
 				Short: "Updates all/specified packages (runs `git pull`)",
-				Long:  `Updates all/specified packages. This is equivalent to running "git fetch" in each package's directory.`,
+				Long: `Updates all/specified packages. This is equivalent to running "git fetch" in each package's directory.
+
+` + yesHelp,
 				Run: func(cmd *cobra.Command, args []string) {
 					upgrade, _ := cmd.Flags().GetBool("upgrade")
-					noConfirm, _ := cmd.Flags().GetBool("no-confirm")
+					noConfirm := noConfirmFromFlags(cmd)
+					dryRun, _ := cmd.Flags().GetBool("dry-run")
+					retryFailed, _ := cmd.Flags().GetBool("retry-failed")
+					followRedirects, _ := cmd.Flags().GetBool("follow-redirects")
+					timeout, _ := cmd.Flags().GetDuration("timeout")
 
 					runFallibleCommand(func() error {
+						if timeout < 0 {
+							return usageErrorf("--timeout must not be negative, got %s", timeout)
+						}
 						return runUpdate(updateArgs{
 							packagesToUpdate: args,
 							upgrade:          upgrade,
+							dryRun:           dryRun,
+							retryFailed:      retryFailed,
+							followRedirects:  followRedirects,
 							confirm:          !noConfirm,
+							cleanAfter:       cleanAfterInstallDefault(),
+							timeout:          timeout,
 						})
 					})
 				},
 			}
 			cmd.Flags().BoolP("upgrade", "u", false, "run `upgrade` following an update")
 			cmd.Flags().Bool("no-confirm", false, "do not ask for confirmation")
+			cmd.Flags().Bool("dry-run", false, "show what would be pulled (and rebuilt), without making any changes")
+			cmd.Flags().Bool("retry-failed", false, "only update the packages that failed in the last run")
+			cmd.Flags().Bool("follow-redirects", false, "point packages whose upstream moved at the new location without asking")
+			cmd.Flags().Duration("timeout", defaultUpdatePullTimeout, "how long `git pull` may take for each package (0 for no timeout)")
 			return &cmd
 		}())
 
-		cmd.AddCommand(&cobra.Command{
-			Use:   "recompute-sums <pkg>",
-			Args:  cobra.ExactArgs(1),
-			Short: "Updates the checksums of a package",
-			Run: func(cmd *cobra.Command, args []string) {
-				pkgName := args[0]
-				runFallibleCommand(func() error {
-					edit, _ := cmd.Flags().GetBool("edit")
-					return runRecomputeSums(pkgName, edit)
-				})
-				cmd.PersistentFlags().BoolP("edit", "e", false, "edit the PKGBUILD after a successful update")
-			},
-		})
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "recompute-sums <pkg>",
+				Args:  cobra.ExactArgs(1),
+				Short: "Updates the checksums of a package",
+				Run: func(cmd *cobra.Command, args []string) {
+					pkgName := args[0]
+					runFallibleCommand(func() error {
+						edit, _ := cmd.Flags().GetBool("edit")
+						noSrcinfo, _ := cmd.Flags().GetBool("no-srcinfo")
+						return runRecomputeSums(recomputeSumsArgs{
+							pkgName: pkgName,
+							edit:    edit,
+							srcinfo: !noSrcinfo,
+							dirty:   getDirtyTreeArgs(cmd),
+						})
+					})
+				},
+			}
+			cmd.PersistentFlags().BoolP("edit", "e", false, "edit the PKGBUILD after a successful update")
+			cmd.PersistentFlags().Bool("no-srcinfo", false, "do not regenerate the .SRCINFO file")
+			addDirtyTreeFlags(&cmd)
+			return &cmd
+		}())
 
 		cmd.AddCommand(func() *cobra.Command {
 			cmd := cobra.Command{
 				Use:   "update-version <pkg> [new-version]",
 				Short: "Updates the version of a package in a PKGBUILD file",
+				Long:  `Updates the version of a package in a PKGBUILD file (by default, to the newest version known to repology, which is asked again unless --max-age is given), and recomputes its sums. When the version changes, pkgrel is reset to 1, unless --keep-pkgrel is given.`,
 				RunE: func(cmd *cobra.Command, args []string) error {
 					if len(args) != 1 {
 						return fmt.Errorf("expected at 1 argument, got %d", len(args))
@@ -210,56 +897,191 @@ func main() {
 						pkgName := args[0]
 						newVersion, _ := cmd.Flags().GetString("version")
 						edit, _ := cmd.Flags().GetBool("edit")
-						return runUpdateVersion(pkgName, newVersion, edit)
+						noSrcinfo, _ := cmd.Flags().GetBool("no-srcinfo")
+						noSums, _ := cmd.Flags().GetBool("no-sums")
+						resetPkgrel, _ := cmd.Flags().GetBool("reset-pkgrel")
+						keepPkgrel, _ := cmd.Flags().GetBool("keep-pkgrel")
+						maxAge, _ := cmd.Flags().GetDuration("max-age")
+						alsoSpecs, _ := cmd.Flags().GetStringArray("also")
+						also, err := parseVarAssignments(alsoSpecs)
+						if err != nil {
+							return err
+						}
+						return runUpdateVersion(updateVersionArgs{
+							pkgName:     pkgName,
+							newVersion:  newVersion,
+							also:        also,
+							edit:        edit,
+							srcinfo:     !noSrcinfo,
+							noSums:      noSums,
+							resetPkgrel: resetPkgrel,
+							keepPkgrel:  keepPkgrel,
+							maxAge:      maxAge,
+							dirty:       getDirtyTreeArgs(cmd),
+						})
 					})
 					return nil
 				},
 			}
 			cmd.PersistentFlags().StringP("version", "v", "", "new version")
 			cmd.PersistentFlags().BoolP("edit", "e", false, "edit the PKGBUILD after a successful update")
+			cmd.PersistentFlags().Bool("no-srcinfo", false, "do not regenerate the .SRCINFO file")
+			cmd.PersistentFlags().StringArray("also", nil, "also set <var>=<value> in the same pass (repeatable)")
+			cmd.PersistentFlags().Bool("no-sums", false, "only update the version, without recomputing the sums or the .SRCINFO (no network access)")
+			cmd.PersistentFlags().Bool("reset-pkgrel", false, "set pkgrel=1, even if the version does not change")
+			cmd.PersistentFlags().Bool("keep-pkgrel", false, "do not set pkgrel=1 when the version changes")
+			cmd.PersistentFlags().Duration("max-age", 0, "reuse a version fetched from repology within this long, e.g. by check-stale (by default, always ask repology)")
+			cmd.MarkFlagsMutuallyExclusive("reset-pkgrel", "keep-pkgrel")
+			addDirtyTreeFlags(&cmd)
 			return &cmd
 		}())
 
-		cmd.AddCommand(&cobra.Command{
-			Use:   "uninstall <pkg>",
-			Short: "Uninstalls a package",
-			Args:  cobra.ExactArgs(1),
-			Run: func(cmd *cobra.Command, args []string) {
-				runFallibleCommand(func() error {
-					pkgName := args[0]
-					return runUninstall(pkgName)
-				})
-			},
-		})
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "uninstall [pkg]",
+				Short: "Uninstalls a package",
+				Long: `Uninstalls a package, and deletes its git clone. Without a package, one can be picked interactively. Uncommitted changes to the clone are saved as a patch in .mpr/backups in the mpr directory before it is deleted.
+
+` + yesHelp,
+				Args: cobra.MaximumNArgs(1),
+				Run: func(cmd *cobra.Command, args []string) {
+					runFallibleCommand(func() error {
+						pkgName, err := pkgArg(args)
+						if err != nil {
+							return err
+						}
+						keepSources, _ := cmd.Flags().GetBool("keep-sources")
+						purge, _ := cmd.Flags().GetBool("purge")
+						noConfirm := noConfirmFromFlags(cmd)
+						return runUninstall(uninstallArgs{
+							pkgName:     pkgName,
+							keepSources: keepSources,
+							purge:       purge,
+							confirm:     !noConfirm,
+						})
+					})
+				},
+			}
+			cmd.Flags().Bool("keep-sources", false, "only remove the installed package, keeping its git clone")
+			cmd.Flags().Bool("purge", false, "also remove the package's configuration files (apt-get purge)")
+			cmd.Flags().Bool("no-confirm", false, "do not ask before deleting the git clone")
+			return &cmd
+		}())
+
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "info [pkg]",
+				Args:  cobra.MaximumNArgs(1),
+				Short: "Shows information about a package",
+				Long:  `Shows information about a package. Without a package, one can be picked interactively.`,
+				Run: func(cmd *cobra.Command, args []string) {
+					runFallibleCommand(func() error {
+						pkgName, err := pkgArg(args)
+						if err != nil {
+							return err
+						}
+						srcinfoDiff, _ := cmd.Flags().GetBool("srcinfo-diff")
+						merged, _ := cmd.Flags().GetBool("merged")
+						return runPkgInfo(pkgInfoArgs{
+							pkgName:     pkgName,
+							srcinfoDiff: srcinfoDiff,
+							merged:      merged,
+						})
+					})
+				},
+			}
+			cmd.Flags().Bool("srcinfo-diff", false, "only show variables whose values differ from the .SRCINFO")
+			cmd.Flags().Bool("merged", false, "merge architecture-specific variables (e.g. depends_amd64) into their base variable")
+			cmd.MarkFlagsMutuallyExclusive("srcinfo-diff", "merged")
+			return &cmd
+		}())
 
 		cmd.AddCommand(&cobra.Command{
-			Use:   "info <pkg>",
+			Use:   "unpin <pkg>",
 			Args:  cobra.ExactArgs(1),
-			Short: "Shows information about a package",
+			Short: "Unpins a package pinned with pin",
 			Run: func(cmd *cobra.Command, args []string) {
 				runFallibleCommand(func() error {
-					pkgName := args[0]
-					return runPkgInfo(pkgName)
+					return runUnpin(args[0])
 				})
 			},
 		})
 
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "validate <pkg>",
+				Args:  cobra.ExactArgs(1),
+				Short: "Checks a package's PKGBUILD for common problems",
+				Run: func(cmd *cobra.Command, args []string) {
+					runFallibleCommand(func() error {
+						skipVCSPins, _ := cmd.Flags().GetBool("skip-vcs-pins")
+						return runValidate(validateArgs{
+							pkgName:     args[0],
+							skipVCSPins: skipVCSPins,
+						})
+					})
+				},
+			}
+			cmd.Flags().Bool("skip-vcs-pins", false, "do not warn about VCS sources without a pinned #commit= or #tag=")
+			return &cmd
+		}())
+
 		cmd.AddCommand(func() *cobra.Command {
 			cmd := cobra.Command{
 				Use:   "upgrade [pkgs]",
 				Short: "Installs newly available versions",
-				Long:  `Upgrades all/selected packages. This is equivalent to running "makedeb ..." in each package's directory.`,
+				Long: `Upgrades all/selected packages. This is equivalent to running "makedeb ..." in each package's directory. Packages are upgraded after the packages they depend on (see "mpr deps").
+
+` + yesHelp,
 				Run: func(cmd *cobra.Command, args []string) {
 					runFallibleCommand(func() error {
-						noConfirm, _ := cmd.Flags().GetBool("no-confirm")
+						noConfirm := noConfirmFromFlags(cmd)
+						cleanAfter, _ := cmd.Flags().GetBool("clean-after")
+						keepGoing, _ := cmd.Flags().GetBool("keep-going")
+						resume, _ := cmd.Flags().GetBool("resume")
+						retryFailed, _ := cmd.Flags().GetBool("retry-failed")
+						dryRun, _ := cmd.Flags().GetBool("dry-run")
 						return runUpgrade(upgradeArgs{
-							packages: args,
-							confirm:  !noConfirm,
+							packages:    args,
+							confirm:     !noConfirm,
+							cleanAfter:  cleanAfter,
+							keepGoing:   keepGoing,
+							resume:      resume,
+							retryFailed: retryFailed,
+							dryRun:      dryRun,
 						})
 					})
 				},
 			}
 			cmd.Flags().Bool("no-confirm", false, "do not ask for confirmation")
+			cmd.Flags().Bool("clean-after", cleanAfterInstallDefault(), "remove build artifacts after each successful upgrade")
+			cmd.Flags().Bool("dry-run", false, "show which packages would be upgraded (and from which commit to which), without building anything")
+			cmd.Flags().BoolP("keep-going", "k", false, "continue upgrading other packages after a failure")
+			cmd.Flags().Bool("resume", false, "skip packages already upgraded by a previous, interrupted run")
+			cmd.Flags().Bool("retry-failed", false, "only upgrade the packages that failed in the last run")
+			return &cmd
+		}())
+
+		cmd.AddCommand(func() *cobra.Command {
+			cmd := cobra.Command{
+				Use:   "why <pkg>",
+				Args:  cobra.ExactArgs(1),
+				Short: "Explains why a package is (or is not) considered out of date",
+				Long:  `Explains why a package is (or is not) considered out of date: compares the last installed commit with HEAD (outdated), HEAD with the remote (update), the pkgver with repology (check-stale), and the version installed on the system with the PKGBUILD. Like check-stale, it reuses versions fetched from repology within --max-age.`,
+				Run: func(cmd *cobra.Command, args []string) {
+					runFallibleCommand(func() error {
+						fetch, _ := cmd.Flags().GetBool("fetch")
+						maxAge, _ := cmd.Flags().GetDuration("max-age")
+						return runWhy(os.Stdout, whyArgs{
+							pkgName: args[0],
+							fetch:   fetch,
+							maxAge:  maxAge,
+						})
+					})
+				},
+			}
+			cmd.Flags().Bool("fetch", false, "fetch the remote before comparing HEAD with it")
+			cmd.Flags().Duration("max-age", defaultRepologyMaxAge, "reuse versions fetched from repology within this long (0 to always ask repology)")
 			return &cmd
 		}())
 
@@ -268,8 +1090,40 @@ func main() {
 	}()
 
 	// run the command
+	defaultHelp := cmd.HelpFunc()
+	cmd.SetHelpFunc(func(c *cobra.Command, args []string) {
+		defaultHelp(c, args)
+		if c == cmd {
+			printPlugins(c.OutOrStdout())
+		}
+	})
+
+	if plugin, ok := lookupPlugin(cmd, os.Args[1:]); ok {
+		// resolve the configuration from the global flags, as for any command:
+		if err := cmd.ParseFlags(plugin.globalArgs); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(exitUsage)
+		}
+		if err := cmd.PersistentPreRunE(cmd, nil); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(exitCodeFor(err))
+		}
+		if err := runPlugin(plugin.path, plugin.args); err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				os.Exit(exitErr.ExitCode())
+			}
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(exitCodeFor(err))
+		}
+		return
+	}
+
+	// runners exit by themselves (see runFallibleCommand), so whatever
+	// reaches here is cobra rejecting the flags or arguments:
 	if err := cmd.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(exitUsage)
 	}
 }
 
@@ -293,6 +1147,73 @@ func mprDir(segments ...string) string {
 	return filepath.Join(append([]string{userCacheDir}, segments...)...)
 }
 
+// cleanAfterInstallDefault reports whether build artifacts should be removed
+// after a successful install when --clean-after is not given. This is
+// controlled by the MPR_CLEAN_AFTER_INSTALL environment variable.
+func cleanAfterInstallDefault() bool {
+	switch strings.ToLower(os.Getenv("MPR_CLEAN_AFTER_INSTALL")) {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
+
+// shallowCloneHelp documents --depth and --recurse-submodules of clone and
+// install
+const shallowCloneHelp = `With --depth, only the most recent commits are cloned, which is faster for
+packages with a long history. "mpr update" keeps working (if a pull needs
+more of the history, all of it is fetched), but "mpr log" and "git log" only
+show the commits that were cloned.
+With --recurse-submodules, the package's git submodules are cloned as well
+(shallowly, with --depth).`
+
+// porcelainHelp documents the --porcelain output of outdated and status
+const porcelainHelp = `With --porcelain, each line is "<flags> <name>", where <flags> is always three
+characters, with "." standing in for a flag that is not set:
+
+  D  the package's working tree has local modifications
+  B  HEAD differs from the commit that was last installed
+  R  the upstream branch has commits that are not in HEAD
+
+This format is meant for scripts, and will not change between versions.`
+
+// yesHelp documents how the global --yes combines with --no-confirm
+const yesHelp = `The global --yes (-y) answers every prompt of mpr, and takes precedence over
+--no-confirm: with --yes, no confirmation is asked for, whatever --no-confirm
+(or the flags it implies) is set to.`
+
+// noConfirmFromFlags tells whether a command should skip its confirmations,
+// given its own --no-confirm (if it has one) and the global --yes
+func noConfirmFromFlags(cmd *cobra.Command) bool {
+	yes, _ := cmd.Flags().GetBool("yes")
+	noConfirm, _ := cmd.Flags().GetBool("no-confirm")
+	return resolveNoConfirm(yes, noConfirm)
+}
+
+// eachOutputFromFlags picks the output of `mpr each` from --prefix and
+// --group (which are mutually exclusive), by their values: e.g.
+// --prefix=false means grouped output. Without either, it is defaultOutput.
+func eachOutputFromFlags(cmd *cobra.Command, defaultOutput string) string {
+	prefix, _ := cmd.Flags().GetBool("prefix")
+	group, _ := cmd.Flags().GetBool("group")
+	switch {
+	case cmd.Flags().Changed("prefix") && prefix, cmd.Flags().Changed("group") && !group:
+		return eachOutputPrefix
+	case cmd.Flags().Changed("group") && group, cmd.Flags().Changed("prefix") && !prefix:
+		return eachOutputGroup
+	}
+	return defaultOutput
+}
+
+// resolveNoConfirm combines the global --yes with a command's --no-confirm:
+// --yes takes precedence, even over an explicit --no-confirm=false
+func resolveNoConfirm(yes bool, noConfirm bool) bool {
+	if yes {
+		return true
+	}
+	return noConfirm
+}
+
 func mkcmd(loud bool, name string, arg ...string) *exec.Cmd {
 	if loud {
 		fmt.Printf("[#] %s ", name)
@@ -309,27 +1230,125 @@ func mkcmd(loud bool, name string, arg ...string) *exec.Cmd {
 	return cmd
 }
 
-func installMakedeb() error {
-	_, err := exec.LookPath("makedeb")
-	if err == nil {
-		return nil
+// makedebPath/gitPath are the binaries that mpr invokes, as resolved from the
+// command line/environment at startup. Use makedebBin()/gitBin() to read them.
+var makedebPath string
+var gitPath string
+
+// aptPath is the apt front-end used to remove packages (e.g. apt-get, nala or
+// aptitude), as resolved from $MPR_APT. Use aptBin() to read it.
+var aptPath string
+
+// resolveBinary determines which binary to use for a tool: the value of its
+// command-line flag, then the value of its environment variable, and finally
+// the default name (to be looked up on $PATH). An explicitly given binary
+// must exist and be executable.
+func resolveBinary(flagValue string, envName string, defaultName string) (string, error) {
+	bin := flagValue
+	if bin == "" {
+		bin = os.Getenv(envName)
+	}
+	if bin == "" {
+		return defaultName, nil
 	}
-	cmd := mkcmd(true, "bash", "-c", "wget -qO - 'https://shlink.makedeb.org/install' | MAKEDEB_RELEASE=makedeb bash -")
-	if err := cmd.Run(); err != nil {
-		return err
+
+	if _, err := exec.LookPath(bin); err != nil {
+		return "", fmt.Errorf("invalid %s binary %q: %w", defaultName, bin, err)
 	}
-	return nil
+	return bin, nil
+}
+
+// resolveAptBinary resolves $MPR_APT. As it is run with sudo, it is rejected
+// if it contains any shell metacharacters, even though no shell is involved.
+func resolveAptBinary() (string, error) {
+	if bin := os.Getenv("MPR_APT"); strings.ContainsAny(bin, " \t\n;&|<>()$`\\\"'*?[]#~=%!{}") {
+		return "", fmt.Errorf("invalid MPR_APT %q: must be the name or path of a binary", bin)
+	}
+	return resolveBinary("", "MPR_APT", "apt-get")
+}
+
+// resolveBaseURL picks a base URL from (in order of precedence) a flag
+// value, an environment variable, or a default, and validates it
+func resolveBaseURL(flagValue string, envName string, def string) (string, error) {
+	baseURL := flagValue
+	if baseURL == "" {
+		baseURL = os.Getenv(envName)
+	}
+	if baseURL == "" {
+		return def, nil
+	}
+	return validateBaseURL(envName, baseURL)
+}
+
+func makedebBin() string {
+	if makedebPath == "" {
+		return "makedeb"
+	}
+	return makedebPath
+}
+
+func aptBin() string {
+	if aptPath == "" {
+		return "apt-get"
+	}
+	return aptPath
+}
+
+func gitBin() string {
+	if gitPath == "" {
+		return "git"
+	}
+	return gitPath
+}
+
+// runCmd runs a command created by mkcmd. It is a variable so that tests can
+// intercept the commands that would otherwise be run (e.g. makedeb).
+var runCmd = func(cmd *exec.Cmd) error {
+	return cmd.Run()
 }
 
 func listPackages() ([]string, error) {
+	packages, _, err := scanPackages()
+	return packages, err
+}
+
+// filterPackages keeps the packages whose names match the glob pattern (see
+// path.Match). An empty pattern matches all packages.
+func filterPackages(packages []string, pattern string) ([]string, error) {
+	if pattern == "" {
+		return packages, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, usageErrorf("invalid --filter %q: %s", pattern, err)
+	}
+	filtered := make([]string, 0, len(packages))
+	for _, pkg := range packages {
+		if matched, _ := path.Match(pattern, pkg); matched {
+			filtered = append(filtered, pkg)
+		}
+	}
+	return filtered, nil
+}
+
+// scanPackages finds all packages in the mpr directory. Directories that look
+// like packages (they have a PKGBUILD and a .git directory) but whose PKGBUILD
+// fails to evaluate to a single pkgname are returned separately, keyed by
+// directory name, with the reason.
+func scanPackages() ([]string, map[string]error, error) {
+	return packageIndex.get(mprDir())
+}
+
+// walkPackages does the actual work of scanPackages, without the cache
+func walkPackages() ([]string, map[string]error, error) {
 	// find all sub-directories in the mpr directory that:
 	// 1. Contain a PKGBUILD file
 	// 2. Contain a ".git" directory
 	packages := make([]string, 0)
+	broken := make(map[string]error)
 
 	candidateFiles, err := os.ReadDir(mprDir())
 	if err != nil {
-		return packages, err
+		return packages, broken, err
 	}
 
 	for _, entry := range candidateFiles {
@@ -350,8 +1369,9 @@ func listPackages() ([]string, error) {
 
 		// now read the PKGBUILD file and check if it contains a "pkgname" variable:
 		pkgbuild := NewPKGBUILD(mprDir(entry.Name()))
-		pkgname, err := pkgbuild.getSingleVariable("pkgname")
+		pkgname, err := pkgbuild.getPackageName(entry.Name())
 		if err != nil {
+			broken[entry.Name()] = err
 			continue
 		}
 
@@ -359,12 +1379,12 @@ func listPackages() ([]string, error) {
 	}
 
 	sort.Strings(packages)
-	return packages, nil
+	return packages, broken, nil
 }
 
 func getPkgHEADCommitHash(pkg string) (string, error) {
 	var sbout, sberr strings.Builder
-	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd := exec.Command(gitBin(), "rev-parse", "HEAD")
 	cmd.Stdout = &sbout
 	cmd.Stderr = &sberr
 	cmd.Dir = mprDir(pkg)
@@ -380,18 +1400,141 @@ func getPkgHEADCommitHash(pkg string) (string, error) {
 	return strings.TrimSpace(string(sbout.String())), nil
 }
 
+// getPackageNameFromURL derives the name of the directory a package will be
+// cloned into from its URL
+func getPackageNameFromURL(url string) string {
+	pkg := filepath.Base(url)
+	if strings.Contains(pkg, ":") {
+		pkg = strings.Split(pkg, ":")[1]
+	}
+	return strings.TrimSuffix(pkg, ".git")
+}
+
+// parseVarAssignments parses a list of "<var>=<value>" specs into a map
+func parseVarAssignments(specs []string) (map[string]string, error) {
+	assignments := make(map[string]string)
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, usageErrorf("invalid assignment %q: expected <var>=<value>", spec)
+		}
+		assignments[parts[0]] = parts[1]
+	}
+	return assignments, nil
+}
+
+// addDirtyTreeFlags registers the flags read by getDirtyTreeArgs, for commands
+// that edit a PKGBUILD automatically
+func addDirtyTreeFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("require-clean", false, "abort if the package has uncommitted changes")
+	cmd.Flags().Bool("autostash", false, "stash uncommitted changes before the edit, and restore them after")
+	cmd.MarkFlagsMutuallyExclusive("require-clean", "autostash")
+}
+
+func getDirtyTreeArgs(cmd *cobra.Command) dirtyTreeArgs {
+	requireClean, _ := cmd.Flags().GetBool("require-clean")
+	autostash, _ := cmd.Flags().GetBool("autostash")
+	return dirtyTreeArgs{requireClean: requireClean, autostash: autostash}
+}
+
+// parsePackageList reads a newline-delimited list of package specs, skipping
+// blank lines and "#" comments
+func parsePackageList(r io.Reader) ([]string, error) {
+	specs := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		specs = append(specs, line)
+	}
+	return specs, scanner.Err()
+}
+
+const defaultMPRURL = "https://mpr.makedeb.org/"
+
+// mprURL is the base URL of the MPR (or any aurweb-compatible instance). It can
+// be overridden with --mpr-url or $MPR_URL.
+var mprURL = defaultMPRURL
+
+var (
+	githubSpecRegex = regexp.MustCompile(`^([^/:]+)/([^/:]+)$`)
+	mprPkgnameRegex = regexp.MustCompile(`(?i)^[a-z0-9_-]+$`)
+)
+
+// forgePrefix is a shorthand for the repositories hosted on a forge, e.g.
+// "gl:user/repo" for https://gitlab.com/user/repo
+type forgePrefix struct {
+	prefix  string
+	baseURL string
+}
+
+const githubBaseURL = "https://github.com/"
+
+var forgePrefixes = []forgePrefix{
+	{prefix: "gh:", baseURL: githubBaseURL},
+	{prefix: "gl:", baseURL: "https://gitlab.com/"},
+	{prefix: "sr:", baseURL: "https://git.sr.ht/"}, // e.g. sr:~user/repo
+}
+
+// expandForgePrefix expands a spec with one of the forgePrefixes into a URL
+func expandForgePrefix(spec string) (string, bool) {
+	for _, forge := range forgePrefixes {
+		if strings.HasPrefix(spec, forge.prefix) {
+			return forge.baseURL + strings.TrimPrefix(spec, forge.prefix), true
+		}
+	}
+	return "", false
+}
+
 func getPackageURL(spec string) string {
+	// if the spec names a forge, e.g. gl:user/repo, use that:
+	if url, ok := expandForgePrefix(spec); ok {
+		return url
+	}
+
 	// if the spec is in USER/REPO format, assume it's a GitHub repo:
-	matched, _ := regexp.MatchString(`^([^/:]+)/([^/:]+)$`, spec)
-	if matched {
-		return "https://github.com/" + spec
+	if githubSpecRegex.MatchString(spec) {
+		return githubBaseURL + spec
 	}
 
 	// if the spec is ID (case insensitive), assume it's an MPR package:
-	matched, _ = regexp.MatchString(`(?i)^[a-z0-9_-]+$`, spec)
-	if matched {
-		return "https://mpr.makedeb.org/" + spec
+	if mprPkgnameRegex.MatchString(spec) {
+		return mprURL + spec
 	}
 
 	return spec
 }
+
+// The providers that can be given to --from, to override the inference of
+// getPackageURL:
+const (
+	providerAuto   = "" // infer the provider from the spec
+	providerMPR    = "mpr"
+	providerGitHub = "github"
+	providerURL    = "url" // use the spec verbatim
+)
+
+// resolvePackageURL turns a package spec into the URL of its Git repository.
+// Unless a provider is given, it is inferred by getPackageURL.
+func resolvePackageURL(spec string, from string) (string, error) {
+	switch from {
+	case providerAuto:
+		return getPackageURL(spec), nil
+	case providerMPR:
+		if !mprPkgnameRegex.MatchString(spec) {
+			return "", usageErrorf("%q is not a valid MPR package name", spec)
+		}
+		return mprURL + spec, nil
+	case providerGitHub:
+		if !githubSpecRegex.MatchString(spec) {
+			return "", usageErrorf("%q is not a GitHub USER/REPO", spec)
+		}
+		return githubBaseURL + spec, nil
+	case providerURL:
+		return spec, nil
+	default:
+		return "", usageErrorf("invalid provider %q (expected %s, %s or %s)", from, providerMPR, providerGitHub, providerURL)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestGetPackageNameFromURL(t *testing.T) {
+	tests := map[string]string{
+		"https://mpr.makedeb.org/foo":       "foo",
+		"https://github.com/user/bar.git":   "bar",
+		"git@github.com:user/baz.git":       "baz",
+		"git@mpr.makedeb.org:qux":           "qux",
+		"https://gitlab.com/group/sub/quux": "quux",
+	}
+	for url, expected := range tests {
+		if pkg := getPackageNameFromURL(url); pkg != expected {
+			t.Errorf("getPackageNameFromURL(%q): expected %q, got %q", url, expected, pkg)
+		}
+	}
+}
+
+func TestParsePackageList(t *testing.T) {
+	specs, err := parsePackageList(strings.NewReader(`# my packages
+mpr
+
+  user/repo  
+# a comment
+https://example.com/pkg.git
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"mpr", "user/repo", "https://example.com/pkg.git"}
+	if strings.Join(specs, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, got %v", expected, specs)
+	}
+}
+
+func TestResolveBinary(t *testing.T) {
+	t.Setenv("MPR_TEST_BIN", "")
+	bin, err := resolveBinary("", "MPR_TEST_BIN", "makedeb")
+	if err != nil || bin != "makedeb" {
+		t.Errorf("expected the default name, got %q (%v)", bin, err)
+	}
+
+	t.Setenv("MPR_TEST_BIN", "/bin/sh")
+	bin, err = resolveBinary("", "MPR_TEST_BIN", "makedeb")
+	if err != nil || bin != "/bin/sh" {
+		t.Errorf("expected the environment variable to be used, got %q (%v)", bin, err)
+	}
+
+	bin, err = resolveBinary("/bin/true", "MPR_TEST_BIN", "makedeb")
+	if err != nil || bin != "/bin/true" {
+		t.Errorf("expected the flag to take precedence, got %q (%v)", bin, err)
+	}
+
+	if _, err := resolveBinary("/does/not/exist", "MPR_TEST_BIN", "makedeb"); err == nil {
+		t.Errorf("expected a non-existent binary to be rejected")
+	}
+}
+
+func TestGetPackageURLHonorsMPRURL(t *testing.T) {
+	t.Setenv("MPR_URL", "https://mpr.example.com")
+	original := mprURL
+	defer func() { mprURL = original }()
+
+	var err error
+	if mprURL, err = resolveBaseURL("", "MPR_URL", defaultMPRURL); err != nil {
+		t.Fatal(err)
+	}
+	if url := getPackageURL("foo"); url != "https://mpr.example.com/foo" {
+		t.Errorf("expected the MPR URL override to be used, got %q", url)
+	}
+	if url := getPackageURL("user/repo"); url != "https://github.com/user/repo" {
+		t.Errorf("expected GitHub specs to be unaffected, got %q", url)
+	}
+
+	t.Setenv("MPR_URL", "not a url")
+	if _, err := resolveBaseURL("", "MPR_URL", defaultMPRURL); err == nil {
+		t.Errorf("expected an invalid MPR URL to be rejected")
+	}
+}
+
+func TestParseVarAssignments(t *testing.T) {
+	assignments, err := parseVarAssignments([]string{"_commit=abc", "_url=https://example.com/?a=b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assignments["_commit"] != "abc" || assignments["_url"] != "https://example.com/?a=b" {
+		t.Errorf("unexpected assignments: %v", assignments)
+	}
+
+	for _, spec := range []string{"novalue", "=value"} {
+		if _, err := parseVarAssignments([]string{spec}); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestScanPackagesReportsBrokenPKGBUILDs(t *testing.T) {
+	setupTestMprDir(t)
+	createTestPackage(t, "good", "pkgname=good\npkgver=1.0.0\n")
+	createTestPackage(t, "broken", "pkgname=(broken\npkgver=1.0.0\n")
+	createTestPackage(t, "nameless", "pkgver=1.0.0\n")
+
+	packages, broken, err := scanPackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(packages, ",") != "good" {
+		t.Errorf("expected only the good package to be listed, got %v", packages)
+	}
+	for _, dir := range []string{"broken", "nameless"} {
+		if broken[dir] == nil {
+			t.Errorf("expected %s to be reported as broken, got %v", dir, broken)
+		}
+	}
+
+	// listPackages keeps skipping them silently:
+	packages, err = listPackages()
+	if err != nil || strings.Join(packages, ",") != "good" {
+		t.Errorf("expected listPackages to list only the good package, got %v (%v)", packages, err)
+	}
+
+	var out strings.Builder
+	printBrokenPackages(&out, broken)
+	if !strings.Contains(out.String(), mprDir("broken")+": ") || !strings.Contains(out.String(), mprDir("nameless")+": ") {
+		t.Errorf("expected both broken directories to be reported, got %q", out.String())
+	}
+}
+
+func TestScanPackagesSplitPackages(t *testing.T) {
+	setupTestMprDir(t)
+	createTestPackage(t, "foo", "pkgbase=foo\npkgname=(foo-lib foo-dev)\npkgver=1.0.0\n")
+	createTestPackage(t, "bar", "pkgname=(bar-lib bar-dev)\npkgver=1.0.0\n")
+
+	packages, broken, err := scanPackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(broken) != 0 {
+		t.Errorf("expected no broken packages, got %v", broken)
+	}
+	// foo is listed by its pkgbase, bar (without a pkgbase) by its directory:
+	if strings.Join(packages, ",") != "bar,foo" {
+		t.Errorf("expected the split packages to be listed as bar,foo, got %v", packages)
+	}
+}
+
+func TestListPackagesMissingMprDir(t *testing.T) {
+	t.Setenv("MPR_DIR", filepath.Join(t.TempDir(), "does-not-exist"))
+	if _, err := listPackages(); err == nil {
+		t.Errorf("expected an error for a non-existent MPR_DIR")
+	}
+}
+
+func TestResolvePackageURL(t *testing.T) {
+	original := mprURL
+	mprURL = "https://mpr.example.com/"
+	defer func() { mprURL = original }()
+
+	tests := []struct {
+		spec     string
+		from     string
+		expected string
+		wantErr  bool
+	}{
+		{spec: "foo", from: providerAuto, expected: "https://mpr.example.com/foo"},
+		{spec: "user/repo", from: providerAuto, expected: "https://github.com/user/repo"},
+		{spec: "jrop", from: providerMPR, expected: "https://mpr.example.com/jrop"},
+		{spec: "user/repo", from: providerMPR, wantErr: true},
+		{spec: "user/repo", from: providerGitHub, expected: "https://github.com/user/repo"},
+		{spec: "foo", from: providerGitHub, wantErr: true},
+		{spec: "foo", from: providerURL, expected: "foo"},
+		{spec: "user/repo", from: providerURL, expected: "user/repo"},
+		{spec: "foo", from: "gitlab", wantErr: true},
+	}
+	for _, tt := range tests {
+		url, err := resolvePackageURL(tt.spec, tt.from)
+		if tt.wantErr {
+			if !errors.Is(err, errUsage) {
+				t.Errorf("resolvePackageURL(%q, %q): expected a usage error, got %q, %v", tt.spec, tt.from, url, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("resolvePackageURL(%q, %q): %s", tt.spec, tt.from, err)
+		} else if url != tt.expected {
+			t.Errorf("resolvePackageURL(%q, %q) = %q, want %q", tt.spec, tt.from, url, tt.expected)
+		}
+	}
+}
+
+func TestGetPackageURL(t *testing.T) {
+	original := mprURL
+	mprURL = "https://mpr.example.com/"
+	defer func() { mprURL = original }()
+
+	tests := map[string]string{
+		"gh:user/repo":                 "https://github.com/user/repo",
+		"gl:user/repo":                 "https://gitlab.com/user/repo",
+		"gl:group/sub/repo":            "https://gitlab.com/group/sub/repo",
+		"sr:~user/repo":                "https://git.sr.ht/~user/repo",
+		"user/repo":                    "https://github.com/user/repo",
+		"foo":                          "https://mpr.example.com/foo",
+		"https://example.com/foo.git":  "https://example.com/foo.git",
+		"git@github.com:user/repo.git": "git@github.com:user/repo.git",
+	}
+	for spec, expected := range tests {
+		if url := getPackageURL(spec); url != expected {
+			t.Errorf("getPackageURL(%q) = %q, want %q", spec, url, expected)
+		}
+	}
+}
+
+func TestResolveAptBinary(t *testing.T) {
+	t.Setenv("MPR_APT", "")
+	if bin, err := resolveAptBinary(); err != nil || bin != "apt-get" {
+		t.Errorf("resolveAptBinary() = %q, %v, want apt-get by default", bin, err)
+	}
+
+	t.Setenv("MPR_APT", "/bin/true")
+	if bin, err := resolveAptBinary(); err != nil || bin != "/bin/true" {
+		t.Errorf("resolveAptBinary() = %q, %v, want /bin/true", bin, err)
+	}
+
+	for _, bin := range []string{"apt-get; rm -rf /", "nala && true", "$(id)", "apt-get -y", "`id`"} {
+		t.Setenv("MPR_APT", bin)
+		if _, err := resolveAptBinary(); err == nil {
+			t.Errorf("expected MPR_APT=%q to be rejected", bin)
+		}
+	}
+}
+
+func TestFilterPackages(t *testing.T) {
+	packages := []string{"libfoo", "libbar-git", "python-requests", "python3-foo", "mpr", "zlib"}
+	tests := map[string]string{
+		"":          "libfoo,libbar-git,python-requests,python3-foo,mpr,zlib",
+		"lib*":      "libfoo,libbar-git",
+		"python-*":  "python-requests",
+		"python?-*": "python3-foo",
+		"*-git":     "libbar-git",
+		"*lib*":     "libfoo,libbar-git,zlib",
+		"[mz]*":     "mpr,zlib",
+		"nothing*":  "",
+	}
+	for pattern, expected := range tests {
+		filtered, err := filterPackages(packages, pattern)
+		if err != nil {
+			t.Errorf("filterPackages(%q): %s", pattern, err)
+			continue
+		}
+		if got := strings.Join(filtered, ","); got != expected {
+			t.Errorf("filterPackages(%q) = %s, want %s", pattern, got, expected)
+		}
+	}
+
+	if _, err := filterPackages(packages, "[lib"); !errors.Is(err, errUsage) {
+		t.Errorf("expected a usage error for an invalid pattern, got %v", err)
+	}
+}
+
+func TestNoConfirmFromFlags(t *testing.T) {
+	tests := []struct {
+		args      []string
+		noConfirm bool
+	}{
+		{[]string{"sub"}, false},
+		{[]string{"sub", "--no-confirm"}, true},
+		{[]string{"--yes", "sub"}, true},
+		{[]string{"sub", "-y"}, true},
+		// --yes takes precedence:
+		{[]string{"sub", "-y", "--no-confirm=false"}, true},
+	}
+	for _, test := range tests {
+		var noConfirm bool
+		root := &cobra.Command{Use: "mpr"}
+		root.PersistentFlags().BoolP("yes", "y", false, "")
+		sub := &cobra.Command{
+			Use: "sub",
+			Run: func(cmd *cobra.Command, args []string) { noConfirm = noConfirmFromFlags(cmd) },
+		}
+		sub.Flags().Bool("no-confirm", false, "")
+		root.AddCommand(sub)
+		root.SetArgs(test.args)
+		if err := root.Execute(); err != nil {
+			t.Fatal(err)
+		}
+		if noConfirm != test.noConfirm {
+			t.Errorf("%v: expected noConfirm=%v, got %v", test.args, test.noConfirm, noConfirm)
+		}
+	}
+
+	// commands without a --no-confirm of their own only have --yes:
+	if !resolveNoConfirm(true, false) || resolveNoConfirm(false, false) {
+		t.Error("expected --yes alone to decide")
+	}
+}
+
+func TestEachOutputFromFlags(t *testing.T) {
+	tests := []struct {
+		args          []string
+		defaultOutput string
+		expected      string
+	}{
+		{nil, eachOutputGroup, eachOutputGroup},
+		{[]string{"--prefix"}, eachOutputGroup, eachOutputPrefix},
+		{[]string{"--prefix=false"}, eachOutputPrefix, eachOutputGroup},
+		{[]string{"--group"}, eachOutputPrefix, eachOutputGroup},
+		{[]string{"--group=false"}, eachOutputGroup, eachOutputPrefix},
+	}
+	for _, tt := range tests {
+		cmd := &cobra.Command{}
+		cmd.Flags().Bool("prefix", false, "")
+		cmd.Flags().Bool("group", false, "")
+		if err := cmd.ParseFlags(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		if output := eachOutputFromFlags(cmd, tt.defaultOutput); output != tt.expected {
+			t.Errorf("%v: expected %s output, got %s", tt.args, tt.expected, output)
+		}
+	}
+}
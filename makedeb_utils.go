@@ -1,10 +1,114 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"regexp"
 	"strings"
 )
 
+// The operations that mpr invokes makedeb for:
+const (
+	makedebOpBuild     = "build"
+	makedebOpInstall   = "install"
+	makedebOpReinstall = "reinstall"
+	makedebOpUpgrade   = "upgrade"
+)
+
+// The policies for installing makedeb when it is missing:
+const (
+	makedebInstallAuto   = "auto"   // install it without asking
+	makedebInstallPrompt = "prompt" // ask before installing it
+	makedebInstallNever  = "never"  // fail instead
+)
+
+// makedebInstallPolicy is set from --makedeb-install/$MPR_MAKEDEB_INSTALL at
+// startup
+var makedebInstallPolicy = makedebInstallAuto
+
+// makedebInstallYes is set from the global --yes at startup, so that the
+// prompt policy installs makedeb without asking
+var makedebInstallYes = false
+
+// parseMakedebInstallPolicy validates a policy name, with "" meaning the
+// default
+func parseMakedebInstallPolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return makedebInstallAuto, nil
+	case makedebInstallAuto, makedebInstallPrompt, makedebInstallNever:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid makedeb install policy %q: expected %s, %s or %s", policy, makedebInstallAuto, makedebInstallPrompt, makedebInstallNever)
+}
+
+// ensureMakedeb makes sure makedeb is available, installing it according to
+// makedebInstallPolicy if it is not. Every runner that invokes makedeb should
+// call this first.
+func ensureMakedeb() error {
+	if _, err := exec.LookPath(makedebBin()); err == nil {
+		return nil
+	}
+
+	switch makedebInstallPolicy {
+	case makedebInstallNever:
+		return fmt.Errorf("%s not found, and installing makedeb is disabled (--makedeb-install=%s)", makedebBin(), makedebInstallNever)
+	case makedebInstallPrompt:
+		if resolveNoConfirm(makedebInstallYes, false) {
+			break
+		}
+		install, err := promptYesNo(os.Stdout, os.Stdin, "makedeb is not installed. Install it now?", false)
+		if err != nil {
+			return err
+		}
+		if !install {
+			return fmt.Errorf("%s not found", makedebBin())
+		}
+	}
+
+	cmd := mkcmd(true, "bash", "-c", "wget -qO - 'https://shlink.makedeb.org/install' | MAKEDEB_RELEASE=makedeb bash -")
+	return runCmd(cmd)
+}
+
+// assembleMakedebArgs returns the arguments that mpr passes to makedeb for the
+// given operation. Every place that invokes makedeb to build a package should
+// go through this, so that `mpr show-cmd` reports exactly what would be run.
+func assembleMakedebArgs(op string, confirm bool) []string {
+	var args []string
+	switch op {
+	case makedebOpInstall, makedebOpReinstall, makedebOpUpgrade:
+		args = append(args, "-si")
+	}
+	if !confirm && len(args) > 0 {
+		args = append(args, "--no-confirm")
+	}
+	return args
+}
+
+// makedebSkipIntegrityOptions are the names that makedeb versions have used
+// for the option that skips verifying the sources (makepkg's --skipinteg)
+var makedebSkipIntegrityOptions = []string{"--skip-integrity-check", "--skipinteg"}
+
+// makedebPrefetchedArgs returns the arguments with which makedeb reuses the
+// sources that mpr already downloaded and verified (see --prefetch), instead
+// of checking them again. The installed makedeb is asked for its options with
+// `makedeb --help`: versions without such an option get no arguments, and
+// build as usual.
+func makedebPrefetchedArgs() []string {
+	help, err := exec.Command(makedebBin(), "--help").CombinedOutput()
+	if err != nil {
+		return nil
+	}
+	for _, option := range makedebSkipIntegrityOptions {
+		if regexp.MustCompile(`(^|\s)` + regexp.QuoteMeta(option) + `\b`).Match(help) {
+			return []string{option}
+		}
+	}
+	return nil
+}
+
 // The following is a utility to parse the output of `makedeb -g`, which is
 // used to get the updated hashes of the sources. The output of `makedeb -g`
 // looks like this:
@@ -31,13 +135,15 @@ func parseMakedebG(outputBytes []byte) map[string]string {
 		if nextMatch == nil {
 			matchEnd = len(outputBytes)
 		} else {
-			matchEnd = matchStart + nextMatch[1]
+			matchEnd = b + nextMatch[0]
 		}
 
 		// Now we know enough to get the entire var declaration:
 		varDecl := strings.TrimSpace(string(outputBytes[matchStart:matchEnd])) // sha256sums=...
-		varName := strings.Split(varDecl, "=")[0]                              // e.g. "sha256sums"
-		varValue := strings.Split(varDecl, "=")[1]                             // e.g. "sha256sums"
+		// split on the first "=" only, since values may contain "=" too:
+		parts := strings.SplitN(varDecl, "=", 2)
+		varName := parts[0]  // e.g. "sha256sums"
+		varValue := parts[1] // e.g. "('...')"
 
 		// And now we know the variable name/value:
 		varsToReplace[varName] = varValue
@@ -45,3 +151,40 @@ func parseMakedebG(outputBytes []byte) map[string]string {
 
 	return varsToReplace
 }
+
+// findBuildArtifacts returns the paths of the artifacts that makedeb leaves
+// behind in a package directory after a build: the src/ and pkg/ directories,
+// and any built .deb files. Downloaded sources are not considered artifacts,
+// so that they can be reused by subsequent builds.
+func findBuildArtifacts(dir string) ([]string, error) {
+	artifacts := make([]string, 0)
+	for _, name := range []string{"src", "pkg"} {
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil && info.IsDir() {
+			artifacts = append(artifacts, filepath.Join(dir, name))
+		}
+	}
+
+	debs, err := filepath.Glob(filepath.Join(dir, "*.deb"))
+	if err != nil {
+		return nil, err
+	}
+	artifacts = append(artifacts, debs...)
+	return artifacts, nil
+}
+
+// cleanBuildArtifacts removes the build artifacts from a package's directory,
+// reporting each one that was removed
+func cleanBuildArtifacts(pkg string) error {
+	artifacts, err := findBuildArtifacts(mprDir(pkg))
+	if err != nil {
+		return err
+	}
+
+	for _, artifact := range artifacts {
+		fmt.Printf("=> removing %s\n", artifact)
+		if err := os.RemoveAll(artifact); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -24,3 +29,134 @@ sha256sums3=789`)
 		t.Errorf("expected sha256sums3 to be 789, got %s", vars["sha256sums3"])
 	}
 }
+
+func TestAssembleMakedebArgs(t *testing.T) {
+	tests := []struct {
+		op       string
+		confirm  bool
+		expected string
+	}{
+		{makedebOpBuild, true, ""},
+		{makedebOpBuild, false, ""},
+		{makedebOpInstall, true, "-si"},
+		{makedebOpInstall, false, "-si --no-confirm"},
+		{makedebOpUpgrade, false, "-si --no-confirm"},
+		{makedebOpReinstall, true, "-si"},
+	}
+
+	for _, test := range tests {
+		args := strings.Join(assembleMakedebArgs(test.op, test.confirm), " ")
+		if args != test.expected {
+			t.Errorf("assembleMakedebArgs(%s, %v): expected %q, got %q", test.op, test.confirm, test.expected, args)
+		}
+	}
+}
+
+func TestFindBuildArtifacts(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"src", "pkg", ".git"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"PKGBUILD", "foo_1.0.0-1_amd64.deb", "foo-1.0.0.tar.gz"} {
+		if err := os.WriteFile(filepath.Join(dir, f), []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	artifacts, err := findBuildArtifacts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range artifacts {
+		artifacts[i] = filepath.Base(artifacts[i])
+	}
+	if strings.Join(artifacts, ",") != "src,pkg,foo_1.0.0-1_amd64.deb" {
+		t.Errorf("expected src, pkg & the .deb to be artifacts, got %v", artifacts)
+	}
+}
+
+func TestEnsureMakedebPolicies(t *testing.T) {
+	originalMakedeb, originalPolicy := makedebPath, makedebInstallPolicy
+	defer func() { makedebPath, makedebInstallPolicy = originalMakedeb, originalPolicy }()
+	makedebPath = "mpr-test-nonexistent-makedeb"
+
+	tests := []struct {
+		policy          string
+		input           string
+		yes             bool
+		expectInstalled bool
+		expectErr       bool
+	}{
+		{makedebInstallAuto, "", false, true, false},
+		{makedebInstallPrompt, "y\n", false, true, false},
+		{makedebInstallPrompt, "n\n", false, false, true},
+		{makedebInstallPrompt, "", true, true, false},
+		{makedebInstallNever, "", true, false, true},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s %s yes=%v", test.policy, strings.TrimSpace(test.input), test.yes), func(t *testing.T) {
+			installed := false
+			fakeRunCmd(t, func(cmd *exec.Cmd) error {
+				installed = true
+				return nil
+			})
+			makedebInstallPolicy, makedebInstallYes = test.policy, test.yes
+			defer func() { makedebInstallYes = false }()
+
+			var err error
+			withTestStdin(t, test.input, func() { err = ensureMakedeb() })
+			if (err != nil) != test.expectErr {
+				t.Errorf("expected error=%v, got %v", test.expectErr, err)
+			}
+			if installed != test.expectInstalled {
+				t.Errorf("expected installed=%v, got %v", test.expectInstalled, installed)
+			}
+		})
+	}
+
+	// nothing is installed when makedeb is already there:
+	makedebPath = "/bin/true"
+	makedebInstallPolicy = makedebInstallAuto
+	fakeRunCmd(t, func(cmd *exec.Cmd) error {
+		t.Errorf("expected no install, got %v", cmd.Args)
+		return nil
+	})
+	if err := ensureMakedeb(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseMakedebInstallPolicy(t *testing.T) {
+	if policy, err := parseMakedebInstallPolicy(""); err != nil || policy != makedebInstallAuto {
+		t.Errorf("expected the default policy to be auto, got %q (%v)", policy, err)
+	}
+	if _, err := parseMakedebInstallPolicy("sometimes"); err == nil {
+		t.Errorf("expected an invalid policy to be rejected")
+	}
+}
+
+func TestParseMakedebGMultiLineValues(t *testing.T) {
+	input := []byte(`md5sums=('0123'
+          'YWJj==')
+sha256sums=('ZGVm='
+            'SKIP')
+b2sums=('x=y')
+`)
+
+	vars := parseMakedebG(input)
+	expected := map[string]string{
+		"md5sums":    "('0123'\n          'YWJj==')",
+		"sha256sums": "('ZGVm='\n            'SKIP')",
+		"b2sums":     "('x=y')",
+	}
+	if len(vars) != len(expected) {
+		t.Errorf("expected %d vars, got %d: %v", len(expected), len(vars), vars)
+	}
+	for name, value := range expected {
+		if vars[name] != value {
+			t.Errorf("expected %s to be %q, got %q", name, value, vars[name])
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import "sync"
+
+// packageIndex caches the result of scanning the mpr directory for the rest
+// of the invocation, so that commands which list the packages several times
+// (e.g. to validate their arguments, and then to iterate) only walk the
+// directory and evaluate the PKGBUILDs once, and see a consistent set of
+// packages. Commands that add or remove packages must invalidate it.
+var packageIndex = &cachedPackageIndex{}
+
+type cachedPackageIndex struct {
+	mux      sync.Mutex
+	dir      string // the mpr directory the index is for
+	valid    bool
+	packages []string
+	broken   map[string]error
+}
+
+func (idx *cachedPackageIndex) get(dir string) ([]string, map[string]error, error) {
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+
+	if !idx.valid || idx.dir != dir {
+		packages, broken, err := walkPackages()
+		if err != nil {
+			// don't cache errors, e.g. a missing mpr directory that is about
+			// to be created:
+			return packages, broken, err
+		}
+		idx.dir, idx.valid, idx.packages, idx.broken = dir, true, packages, broken
+	}
+
+	// hand out copies, so that callers can't modify the index:
+	packages := append([]string{}, idx.packages...)
+	broken := make(map[string]error, len(idx.broken))
+	for pkg, err := range idx.broken {
+		broken[pkg] = err
+	}
+	return packages, broken, nil
+}
+
+// invalidatePackageIndex makes the next scan walk the mpr directory again
+func invalidatePackageIndex() {
+	packageIndex.mux.Lock()
+	defer packageIndex.mux.Unlock()
+	packageIndex.valid = false
+}
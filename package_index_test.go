@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestPackageIndexWalksOnce(t *testing.T) {
+	setupTestMprDir(t)
+	createTestPackage(t, "foo", "pkgname=foo\npkgver=1.0\n")
+	createTestPackage(t, "bar", "pkgname=bar\npkgver=1.0\n")
+
+	for i := 0; i < 3; i++ {
+		packages, err := listPackages()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"bar", "foo"}; !reflect.DeepEqual(packages, want) {
+			t.Fatalf("listPackages() = %v, want %v", packages, want)
+		}
+		// callers may modify what they get back:
+		packages[0] = "modified"
+
+		// a package cloned behind the index's back (createTestPackage would
+		// invalidate it) is not seen until the index is invalidated, i.e. the
+		// directory is not walked again:
+		if i == 0 {
+			if err := os.MkdirAll(mprDir("baz"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(mprDir("baz", "PKGBUILD"), []byte("pkgname=baz\npkgver=1.0\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			runTestGit(t, mprDir("baz"), "init", "-q")
+		}
+	}
+
+	// a mutating command invalidates the index:
+	if err := os.RemoveAll(mprDir("foo")); err != nil {
+		t.Fatal(err)
+	}
+	invalidatePackageIndex()
+	packages, err := listPackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"bar", "baz"}; !reflect.DeepEqual(packages, want) {
+		t.Errorf("listPackages() after invalidation = %v, want %v", packages, want)
+	}
+}
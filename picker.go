@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/mattn/go-isatty"
+)
+
+// pkgArg returns the package named on the command line, or, if there is none,
+// lets the user pick one interactively
+func pkgArg(args []string) (string, error) {
+	if len(args) > 0 {
+		return args[0], nil
+	}
+	if !isatty.IsTerminal(os.Stdin.Fd()) {
+		return "", fmt.Errorf("no package given (and stdin is not a terminal, so one cannot be picked interactively)")
+	}
+
+	packages, err := listPackages()
+	if err != nil {
+		return "", err
+	}
+	if len(packages) == 0 {
+		return "", fmt.Errorf("no packages installed")
+	}
+
+	if _, err := exec.LookPath("fzf"); err == nil {
+		return pickWithFzf(packages)
+	}
+	return pickFromMenu(os.Stdout, os.Stdin, packages)
+}
+
+// pickWithFzf lets the user fuzzy-find a package with fzf
+func pickWithFzf(packages []string) (string, error) {
+	var sbout strings.Builder
+	cmd := exec.Command("fzf", "--prompt", "package> ")
+	cmd.Stdin = strings.NewReader(strings.Join(packages, "\n"))
+	cmd.Stdout = &sbout
+	cmd.Stderr = os.Stderr // fzf draws its UI on stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("no package picked: %w", err)
+	}
+	return strings.TrimSpace(sbout.String()), nil
+}
+
+// pickFromMenu shows a numbered menu of packages. The user can either answer
+// with a number, or with some text to narrow the menu down to the packages
+// that contain it; a filter that matches exactly one package, or is the exact
+// name of one (e.g. foo, next to foo-git), picks it.
+func pickFromMenu(w io.Writer, r io.Reader, packages []string) (string, error) {
+	candidates := packages
+	for {
+		for idx, pkg := range candidates {
+			fmt.Fprintf(w, "%3d) %s\n", idx+1, pkg)
+		}
+		fmt.Fprint(w, "Pick a package (number, or text to filter by): ")
+		// (readLine leaves the input of any later prompt unread)
+		line, err := readLine(r)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if err == io.EOF && line == "" {
+			return "", fmt.Errorf("no package picked")
+		}
+		answer := strings.TrimSpace(line)
+		if answer == "" {
+			candidates = packages
+			continue
+		}
+
+		if n, err := strconv.Atoi(answer); err == nil {
+			if n >= 1 && n <= len(candidates) {
+				return candidates[n-1], nil
+			}
+			fmt.Fprintf(w, "%d is not in the list\n", n)
+			continue
+		}
+
+		if stringSliceContainsString(packages, answer) {
+			return answer, nil
+		}
+		filtered := make([]string, 0)
+		for _, pkg := range packages {
+			if strings.Contains(strings.ToLower(pkg), strings.ToLower(answer)) {
+				filtered = append(filtered, pkg)
+			}
+		}
+		switch len(filtered) {
+		case 0:
+			fmt.Fprintf(w, "no packages match %q\n", answer)
+		case 1:
+			return filtered[0], nil
+		default:
+			candidates = filtered
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPickFromMenu(t *testing.T) {
+	packages := []string{"foo", "foo-bin", "bar", "baz"}
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"by number", "3\n", "bar"},
+		{"filter to a single match", "bar\n", "bar"},
+		{"exact name over a longer match", "foo\n", "foo"},
+		{"filter case-insensitively", "BIN\n", "foo-bin"},
+		{"number within the filtered list", "ba\n2\n", "baz"},
+		{"out of range, then valid", "9\n1\n", "foo"},
+		{"no match, then a match", "qux\nfoo-\n", "foo-bin"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out strings.Builder
+			pkg, err := pickFromMenu(&out, strings.NewReader(test.input), packages)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pkg != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, pkg)
+			}
+		})
+	}
+
+	var out strings.Builder
+	if _, err := pickFromMenu(&out, strings.NewReader(""), packages); err == nil {
+		t.Errorf("expected an error when nothing is picked")
+	}
+}
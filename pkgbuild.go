@@ -1,15 +1,18 @@
 package main
 
 import (
+	"context"
 	"embed"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"net/http"
+	"io"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -29,10 +32,14 @@ type PKGBUILD struct {
 	allVariablesOnce sync.Once            // ensures that the variables are only read once
 }
 
+// errRepologyNotTracked is returned when repology has no record of a project
+var errRepologyNotTracked = errors.New("project is not tracked by repology")
+
 type PKGBUILD_source struct {
 	localName string
 	remoteURL string
 	hash      string
+	hashesVar string // the sums array the hash comes from, e.g. sha256sums
 }
 
 func NewPKGBUILD(dirPath string) *PKGBUILD {
@@ -43,7 +50,7 @@ func NewPKGBUILD(dirPath string) *PKGBUILD {
 // is useful for when you want to create a PKGBUILD from scratch, or when you
 // want to use this utility in an in-memory fashion.
 func NewPKGBUILDFromContents(contents string) (*PKGBUILD, error) {
-	dirPath, err := os.MkdirTemp(os.TempDir(), "pkgbuild-")
+	dirPath, err := os.MkdirTemp(os.TempDir(), tempDirPrefixPkgbuild)
 	if err != nil {
 		return nil, err
 	}
@@ -98,7 +105,11 @@ func (p *PKGBUILD) writeContents(contents string) error { // {{{
 // that are set in the PKGBUILD file.
 func (p *PKGBUILD) getVariables() (*map[string][]string, error) { // {{{
 	p.allVariablesOnce.Do(func() {
-		tmpDir, err := os.MkdirTemp(".", "tmp-pkgbuild")
+		tmpDir, err := os.MkdirTemp("", tempDirPrefixPkgbuild)
+		if err != nil {
+			p.allVariablesErr = err
+			return
+		}
 		defer os.RemoveAll(tmpDir)
 
 		contents, err := p.readContents()
@@ -131,6 +142,10 @@ func (p *PKGBUILD) getVariables() (*map[string][]string, error) { // {{{
 		cmd.Dir = tmpDir
 		out, err := cmd.Output()
 		if err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+				err = fmt.Errorf("could not evaluate PKGBUILD: %w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+			}
 			p.allVariablesErr = err
 			return
 		}
@@ -160,6 +175,30 @@ func (p *PKGBUILD) getVariables() (*map[string][]string, error) { // {{{
 	return p.allVariables, p.allVariablesErr
 } // }}}
 
+// debianArches maps the GOARCH values whose Debian architecture is named
+// differently (as in `dpkg --print-architecture`)
+var debianArches = map[string]string{
+	"386":      "i386",
+	"arm":      "armhf",
+	"ppc64le":  "ppc64el",
+	"mipsle":   "mipsel",
+	"mips64le": "mips64el",
+}
+
+// debianArchFor returns the Debian name of a GOARCH, which is what makedeb
+// suffixes arch-specific variables with (e.g. depends_i386)
+func debianArchFor(goarch string) string {
+	if arch, ok := debianArches[goarch]; ok {
+		return arch
+	}
+	return goarch
+}
+
+// debianArch returns the Debian architecture of the current system
+func debianArch() string {
+	return debianArchFor(runtime.GOARCH)
+}
+
 func (p *PKGBUILD) getVariablesMerged() (*map[string][]string, error) { // {{{
 	varsAddr, err := p.getVariables()
 	if err != nil {
@@ -170,9 +209,9 @@ func (p *PKGBUILD) getVariablesMerged() (*map[string][]string, error) { // {{{
 	// Do variable merging to make other operations more simple. That is, if a
 	// variable named `foo_<ARCH>` exists, then merge it with the `foo`
 	// variable. This will make it easier to get the source variable, for
-	// example. We will use runtime.GOARCH to get the architecture of the
-	// current system.
-	arch := runtime.GOARCH
+	// example. We will use debianArch to get the architecture of the current
+	// system.
+	arch := debianArch()
 	for name, val := range vars {
 		if !strings.HasSuffix(name, "_"+arch) {
 			continue
@@ -218,17 +257,37 @@ func (p *PKGBUILD) getSingleVariable(name string) (string, error) { // {{{
 	return val[0], nil
 } // }}}
 
-func (p *PKGBUILD) updateVar(varName string, newValue string) error { // {{{
-	source, err := p.readContents()
+// getPackageName returns the name that a package is listed under: its
+// pkgname, or for split packages (with several pkgnames), its pkgbase. If a
+// split package has no pkgbase, the name of its directory (dirName) is used.
+func (p *PKGBUILD) getPackageName(dirName string) (string, error) { // {{{
+	pkgnames, err := p.getVariable("pkgname")
 	if err != nil {
-		return err
+		return "", err
+	}
+	switch len(pkgnames) {
+	case 0:
+		return "", fmt.Errorf("variable pkgname has 0 values")
+	case 1:
+		return pkgnames[0], nil
+	}
+
+	if pkgbase, err := p.getSingleVariable("pkgbase"); err == nil && pkgbase != "" {
+		return pkgbase, nil
 	}
+	return dirName, nil
+} // }}}
 
+// findVarValue locates the value of the variable declaration `varName=...`
+// in source, returning the [start, end) byte range of the value. The
+// declaration must start a line (after optional indentation), so that e.g.
+// `_pkgver=` or `url=` in a comment do not match `pkgver=` or `url=`.
+func findVarValue(source string, varName string) (int, int, error) { // {{{
 	// find the variable
 	varPrefix := varName + "="
-	varPrefixStart := strings.Index(source, varPrefix)
+	varPrefixStart := findVarDeclaration(source, varPrefix)
 	if varPrefixStart == -1 {
-		return fmt.Errorf("variable %s not found", varName)
+		return -1, -1, fmt.Errorf("variable %s not found", varName)
 	}
 
 	varPrefixEnd := varPrefixStart + len(varPrefix)
@@ -264,7 +323,11 @@ func (p *PKGBUILD) updateVar(varName string, newValue string) error { // {{{
 		}
 	} else if source[start] == '(' {
 		// find the matching ):
-		varEnd = strings.Index(source[start:], ")") + start + 1
+		end, err := findClosingParen(source, start)
+		if err != nil {
+			return -1, -1, fmt.Errorf("variable %s: %w", varName, err)
+		}
+		varEnd = end + 1
 	} else {
 		idx := strings.IndexFunc(source[start:], unicode.IsSpace)
 		if idx == -1 {
@@ -273,6 +336,86 @@ func (p *PKGBUILD) updateVar(varName string, newValue string) error { // {{{
 		varEnd = start + idx
 	}
 
+	return start, varEnd, nil
+} // }}}
+
+// findVarDeclaration returns the index of the first occurrence of varPrefix
+// that is at the start of a line, ignoring leading spaces and tabs, or -1
+func findVarDeclaration(source string, varPrefix string) int {
+	for offset := 0; ; {
+		idx := strings.Index(source[offset:], varPrefix)
+		if idx == -1 {
+			return -1
+		}
+		idx += offset
+
+		lineStart := strings.LastIndexByte(source[:idx], '\n') + 1
+		if strings.Trim(source[lineStart:idx], " \t") == "" {
+			return idx
+		}
+		offset = idx + 1
+	}
+}
+
+// findClosingParen returns the index of the ")" that closes the "(" at
+// source[open]. Like bash, it skips over nested parentheses, quoted strings,
+// backslash escapes and comments, so that e.g. an array element "a)b" does not
+// end the array.
+func findClosingParen(source string, open int) (int, error) { // {{{
+	depth := 0
+	for i := open; i < len(source); i++ {
+		switch c := source[i]; c {
+		case '\\':
+			i++ // skip the escaped character
+		case '\'':
+			// single quotes cannot contain escapes:
+			end := strings.IndexByte(source[i+1:], '\'')
+			if end == -1 {
+				return -1, fmt.Errorf("unterminated ' in array")
+			}
+			i += end + 1
+		case '"':
+			for i++; i < len(source) && source[i] != '"'; i++ {
+				if source[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(source) {
+				return -1, fmt.Errorf("unterminated \" in array")
+			}
+		case '#':
+			// a comment only starts at the beginning of a word:
+			if i > 0 && !unicode.IsSpace(rune(source[i-1])) && source[i-1] != '(' {
+				continue
+			}
+			end := strings.IndexByte(source[i:], '\n')
+			if end == -1 {
+				end = len(source) - i
+			}
+			i += end
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i, nil
+			}
+		}
+	}
+	return -1, fmt.Errorf("unterminated ( in array")
+} // }}}
+
+func (p *PKGBUILD) updateVar(varName string, newValue string) error { // {{{
+	source, err := p.readContents()
+	if err != nil {
+		return err
+	}
+
+	start, varEnd, err := findVarValue(source, varName)
+	if err != nil {
+		return err
+	}
+
 	// replace the variable:
 	source = source[:start] + newValue + source[varEnd:]
 	err = p.writeContents(source)
@@ -283,22 +426,101 @@ func (p *PKGBUILD) updateVar(varName string, newValue string) error { // {{{
 	return nil
 } // }}}
 
+// hasVar tells whether the PKGBUILD declares varName (as updateVar would find
+// it)
+func (p *PKGBUILD) hasVar(varName string) (bool, error) { // {{{
+	source, err := p.readContents()
+	if err != nil {
+		return false, err
+	}
+	return findVarDeclaration(source, varName+"=") != -1, nil
+} // }}}
+
+// varNameRegex matches the names of shell variables, which is what a PKGBUILD
+// declares (anything else would be sourced as arbitrary shell)
+var varNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// appendVar adds the declaration `varName=value` to the end of the PKGBUILD
+func (p *PKGBUILD) appendVar(varName string, value string) error { // {{{
+	source, err := p.readContents()
+	if err != nil {
+		return err
+	}
+	if source != "" && !strings.HasSuffix(source, "\n") {
+		source += "\n"
+	}
+	return p.writeContents(source + varName + "=" + value + "\n")
+} // }}}
+
+// updateVars is the batch version of updateVar: it replaces the values of all
+// of the given variables in a single pass, and writes the PKGBUILD only once.
+// If any of the variables cannot be found, the PKGBUILD is left untouched.
+func (p *PKGBUILD) updateVars(newValues map[string]string) error { // {{{
+	source, err := p.readContents()
+	if err != nil {
+		return err
+	}
+
+	type edit struct {
+		start, end int
+		newValue   string
+	}
+	edits := make([]edit, 0, len(newValues))
+	for varName, newValue := range newValues {
+		start, end, err := findVarValue(source, varName)
+		if err != nil {
+			return err
+		}
+		edits = append(edits, edit{start, end, newValue})
+	}
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+	for i := 1; i < len(edits); i++ {
+		if edits[i].start < edits[i-1].end {
+			return fmt.Errorf("cannot update overlapping variable declarations")
+		}
+	}
+
+	// apply the edits right-to-left, so that the offsets of the edits that
+	// have yet to be applied remain valid:
+	for i := len(edits) - 1; i >= 0; i-- {
+		e := edits[i]
+		source = source[:e.start] + e.newValue + source[e.end:]
+	}
+
+	return p.writeContents(source)
+} // }}}
+
 func (p *PKGBUILD) getHashes() ([]string, error) { // {{{
-	// Return the first of the following variables that exists:
-	// cksums, md5sums, sha1sums, sha224sums, sha256sums, sha384sums, sha512sums, b2sums
-	for _, name := range []string{"cksums", "md5sums", "sha1sums", "sha224sums", "sha256sums", "sha384sums", "sha512sums", "b2sums"} {
+	_, hashes, err := p.getHashesVar()
+	return hashes, err
+} // }}}
+
+// getHashesVar returns the first of the hashVariables that exists, along with
+// its name
+func (p *PKGBUILD) getHashesVar() (string, []string, error) { // {{{
+	for _, name := range hashVariables {
 		if val, err := p.getVariable(name); err == nil {
-			return val, nil
+			return name, val, nil
 		}
 	}
 
 	// return an empty slice if none of the above variables exist
 	emptyHashes := make([]string, 0)
-	return emptyHashes, nil
+	return "", emptyHashes, nil
 } // }}}
 
 func (p *PKGBUILD) getSources() ([]PKGBUILD_source, error) { // {{{
-	hashesVar, err := p.getHashes()
+	return p.getSourcesWithMode(false)
+} // }}}
+
+// getSourcesWithMode pairs each entry of the source array with its hash. In
+// strict mode, the source and hashes arrays must have the same length. In
+// lenient mode, mismatched lengths are tolerated so that diagnostic commands
+// still work on a half-edited PKGBUILD: sources are paired with hashes by
+// index, sources without a hash get an empty hash, and surplus hashes are
+// ignored.
+func (p *PKGBUILD) getSourcesWithMode(lenient bool) ([]PKGBUILD_source, error) { // {{{
+	hashesName, hashesVar, err := p.getHashesVar()
 	if err != nil {
 		return nil, err
 	}
@@ -306,7 +528,7 @@ func (p *PKGBUILD) getSources() ([]PKGBUILD_source, error) { // {{{
 	if err != nil {
 		return nil, err
 	}
-	if len(hashesVar) != len(sourceVar) {
+	if !lenient && len(hashesVar) != len(sourceVar) {
 		return nil, fmt.Errorf("source and hashes variables have different lengths")
 	}
 
@@ -315,7 +537,10 @@ func (p *PKGBUILD) getSources() ([]PKGBUILD_source, error) { // {{{
 		sourceInfo := PKGBUILD_source{
 			localName: filepath.Base(sourceSpec),
 			remoteURL: sourceSpec,
-			hash:      hashesVar[idx],
+		}
+		if idx < len(hashesVar) {
+			sourceInfo.hash = hashesVar[idx]
+			sourceInfo.hashesVar = hashesName
 		}
 
 		if strings.Contains(sourceSpec, "::") {
@@ -355,42 +580,45 @@ func (p *PKGBUILD) getLatestRepologyPkgVersion() (string, error) { // {{{
 		return "SKIP", nil
 	}
 
-	httpClient := &http.Client{Timeout: 30 * time.Second}
-	req, err := http.NewRequest("GET", "https://repology.org/api/v1/project/" + pkgname, nil)
-	req.Header.Add("User-Agent", "github.com/jrop/mpr-cli")
-	if err != nil {
-		return "", err
-	}
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
+	return fetchRepologyNewestVersion(pkgname)
+} // }}}
 
-	var data []map[string]interface{}
-	err = json.NewDecoder(resp.Body).Decode(&data)
+// getLatestRepologyPkgVersionCached is getLatestRepologyPkgVersion, but serves
+// the version from the on-disk cache if it was fetched less than maxAge ago.
+// Otherwise (or if the cache can't be read), repology is asked, and the cache
+// is updated.
+func (p *PKGBUILD) getLatestRepologyPkgVersionCached(maxAge time.Duration) (string, error) { // {{{
+	pkgname, err := p.getRepologyPkgname()
 	if err != nil {
 		return "", err
 	}
-	var newData []map[string]interface{}
-	for _, entry := range data {
-		if entry["status"] == "newest" {
-			newData = append(newData, entry)
-		}
+	if pkgname == "SKIP" {
+		return "SKIP", nil
 	}
 
-	var versions []string
-	for _, entry := range newData {
-		versions = append(versions, entry["version"].(string))
+	now := time.Now()
+	if entry, err := readRepologyCache(pkgname); err == nil && now.Sub(entry.FetchedAt) < maxAge {
+		return entry.Version, nil
 	}
 
-	if len(versions) == 0 {
-		return "", fmt.Errorf("could not find any versions for package %s", pkgname)
+	version, err := fetchRepologyNewestVersion(pkgname)
+	if err != nil {
+		return "", err
+	}
+	if err := writeRepologyCache(pkgname, repologyCacheEntry{Version: version, FetchedAt: now}); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: could not cache the repology version of %s: %s\n", pkgname, err)
 	}
-	return versions[0], nil
+	return version, nil
 } // }}}
 
 func (p *PKGBUILD) executeFunction(fnName string) error { // {{{
+	return p.runFunction(context.Background(), fnName, os.Stdout)
+} // }}}
+
+// runFunction runs the PKGBUILD function fnName (if it is defined) in the
+// PKGBUILD directory, writing its output to stdout. Like makedeb, it sets
+// $srcdir and $startdir for the function.
+func (p *PKGBUILD) runFunction(ctx context.Context, fnName string, stdout io.Writer) error { // {{{
 	tmpScript, err := os.CreateTemp(p.dirPath, "pkgbuild-fn-executor.sh")
 	if err != nil {
 		return err
@@ -410,13 +638,20 @@ func (p *PKGBUILD) executeFunction(fnName string) error { // {{{
 	}
 
 	// run the script
-	cmd := exec.Command("bash", tmpScript.Name())
+	cmd := exec.CommandContext(ctx, "bash", tmpScript.Name())
 	cmd.Dir = p.dirPath
-	cmd.Env = append(os.Environ(), fmt.Sprintf("PKGBUILD_FN=%s", fnName))
-	cmd.Stdout = os.Stdout
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("PKGBUILD_FN=%s", fnName),
+		fmt.Sprintf("srcdir=%s", filepath.Join(p.dirPath, "src")),
+		fmt.Sprintf("startdir=%s", p.dirPath),
+	)
+	cmd.Stdout = stdout
 	cmd.Stderr = os.Stderr
 	cmd.Stdin = os.Stdin
 	err = cmd.Run()
+	if ctx.Err() != nil {
+		return fmt.Errorf("%s() did not finish in time: %w", fnName, ctx.Err())
+	}
 	if err != nil {
 		return err
 	}
@@ -424,7 +659,10 @@ func (p *PKGBUILD) executeFunction(fnName string) error { // {{{
 	return nil
 } // }}}
 
-func (p *PKGBUILD) downloadSources() ([]PKGBUILD_source, error) { // {{{
+// downloadSources downloads all of the package's sources into the PKGBUILD
+// directory, up to jobs of them at a time. A failed source does not stop the
+// others: all failures are reported together once every download finished.
+func (p *PKGBUILD) downloadSources(jobs int) ([]PKGBUILD_source, error) { // {{{
 	mkerr := func(err error) ([]PKGBUILD_source, error) {
 		return make([]PKGBUILD_source, 0), err
 	}
@@ -433,69 +671,81 @@ func (p *PKGBUILD) downloadSources() ([]PKGBUILD_source, error) { // {{{
 		return mkerr(err)
 	}
 
-	for _, source := range sources {
-		// parse the URL scheme of remoteURL so we know how to download it
-		parsedRemoteURL, err := url.Parse(source.remoteURL)
+	mux := sync.Mutex{}
+	done := 0
+	sourceErrors := make([]error, len(sources))
+	doParallel(len(sources), jobs, func(i int) error {
+		err := p.downloadSource(sources[i], func(progress int64, totalLength int64) {
+			mux.Lock()
+			defer mux.Unlock()
+			setLine(fmt.Sprintf("(%d/%d) Downloading %s %s", done, len(sources), sources[i].localName, formatProgress(progress, totalLength)))
+		})
+
+		mux.Lock()
+		defer mux.Unlock()
+		done++
+		sourceErrors[i] = err
+		status := "Downloaded"
 		if err != nil {
-			return mkerr(err)
+			status = "Failed"
 		}
+		setLine(fmt.Sprintf("(%d/%d) %s %s", done, len(sources), status, sources[i].localName))
+		return nil
+	})
+	if len(sources) > 0 {
+		fmt.Println()
+	}
 
-		switch parsedRemoteURL.Scheme {
-		case "http", "https":
-			// TODO: convert to this pure Go in the future: {{{
-			// fmt.Printf("Downloading %s\n", source.remoteURL)
-			// resp, err := http.Get(source.remoteURL)
-			// if err != nil {
-			// 	return mkerr(err)
-			// }
-			// defer resp.Body.Close()
-
-			// totalLength := resp.ContentLength
-
-			// localFile, err := os.Create(filepath.Join(p.dirPath, source.localName))
-			// if err != nil {
-			// 	return mkerr(err)
-			// }
-			// defer localFile.Close()
-
-			// _, err = io.Copy(
-			// 	localFile,
-			// 	io.TeeReader(
-			// 		resp.Body,
-			// 		newProgressReader(
-			// 			totalLength,
-			// 			func(progress int64, totalLength int64) {
-			// 				// TODO: print a nice progress bar:
-			// 			},
-			// 		),
-			// 	),
-			// )
-			// if err != nil {
-			// 	return mkerr(err)
-			// }
-			// }}}
-			cmd := exec.Command("curl", "-L", "-o", source.localName, source.remoteURL)
-			cmd.Dir = p.dirPath
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			cmd.Stdin = os.Stdin
-			err = cmd.Run()
-			if err != nil {
-				return mkerr(err)
-			}
+	failures := make([]string, 0)
+	for i, err := range sourceErrors {
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", sources[i].localName, err))
+		}
+	}
+	if len(failures) > 0 {
+		return mkerr(fmt.Errorf("could not download %d of %d sources:\n  %s", len(failures), len(sources), strings.Join(failures, "\n  ")))
+	}
 
-			// TODO: verify the hash of the downloaded file
+	return sources, nil
+} // }}}
 
-		case "git", "git+ssh":
-			// TODO
+// downloadSource downloads a single source into the PKGBUILD directory,
+// reporting the progress of HTTP downloads to onProgress
+func (p *PKGBUILD) downloadSource(source PKGBUILD_source, onProgress func(progress int64, totalLength int64)) error { // {{{
+	// parse the URL scheme of remoteURL so we know how to download it
+	parsedRemoteURL, err := url.Parse(source.remoteURL)
+	if err != nil {
+		return err
+	}
 
-			// Q: How to handle localName?
+	switch parsedRemoteURL.Scheme {
+	case "http", "https", "ftp":
+		localPath := filepath.Join(p.dirPath, source.localName)
+		if isDownloaded(localPath, source) {
+			return nil
+		}
+		err := downloadHTTP(source.remoteURL, localPath, onProgress)
+		if isUnsupportedSchemeError(err) {
+			err = downloadCurl(source.remoteURL, localPath)
+		}
+		if err != nil {
+			return err
+		}
 
-			// If you want to check out a specific commit, you would put the commit
-			// hash in the #commit=<hash> fragment of the source URL, or use a
-			// #tag=<tag> or #branch=<branch> fragment. Here is an example:
+		if err := verifySourceHash(localPath, source); err != nil {
+			return err
 		}
+
+	case "git", "git+ssh", "git+https", "git+http", "git+file":
+		// if the source is already checked out (e.g., by makedeb), make
+		// sure it matches its pinned ref:
+		checkoutDir := filepath.Join(p.dirPath, gitSourceDir(source))
+		if _, err := os.Stat(checkoutDir); err == nil {
+			_, key, value := parseSourceFragment(source.remoteURL)
+			return verifyGitPin(checkoutDir, key, value)
+		}
+		return cloneGitSource(checkoutDir, source)
 	}
 
-	return sources, nil
+	return nil
 } // }}}
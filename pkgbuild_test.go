@@ -1,7 +1,15 @@
 package main
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestPKGBUILDUpdateVariable(t *testing.T) {
@@ -128,3 +136,326 @@ extensions=('zipman')`
 		t.Errorf("Expected pkgbuild.contents to be:\n%s\n\nGot:\n%s\n", expectedPkgbuildSource, pkgbuild.contents)
 	}
 }
+
+func TestUpdateVarsMatchesSequentialUpdateVar(t *testing.T) {
+	pkgbuildSource := `pkgname=foo
+pkgver=1.0.0
+pkgrel=1
+source=("https://example.com/foo-${pkgver}.tar.gz"
+        "https://example.com/foo-extra-${pkgver}.tar.gz")
+md5sums=('aaaa' 'bbbb')
+sha256sums=('cccc'
+            'dddd')
+b2sums="eeee"`
+	newValues := map[string]string{
+		"sha256sums": "('1111111111111111' '2222222222222222')",
+		"md5sums":    "('3' '4')",
+		"b2sums":     "\"5555555555\"",
+		"pkgver":     "1.0.1",
+	}
+
+	sequential, err := NewPKGBUILDFromContents(pkgbuildSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for varName, varValue := range newValues {
+		if err := sequential.updateVar(varName, varValue); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	batch, err := NewPKGBUILDFromContents(pkgbuildSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.updateVars(newValues); err != nil {
+		t.Fatal(err)
+	}
+
+	if sequential.contents != batch.contents {
+		t.Errorf("Expected batch output to match sequential output:\n%s\n\nGot:\n%s\n", sequential.contents, batch.contents)
+	}
+}
+
+func TestUpdateVarsQuotingForms(t *testing.T) {
+	pkgbuildSource := "bare=1\nsingle='a b'\ndouble=\"c d\"\narray=(e\n  f)\nend=2"
+	newValues := map[string]string{
+		"bare":   "11",
+		"single": "'x'",
+		"double": "\"y\"",
+		"array":  "(z)",
+	}
+
+	pkgbuild, err := NewPKGBUILDFromContents(pkgbuildSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pkgbuild.updateVars(newValues); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "bare=11\nsingle='x'\ndouble=\"y\"\narray=(z)\nend=2"
+	if pkgbuild.contents != expected {
+		t.Errorf("Expected pkgbuild.contents to be:\n%s\n\nGot:\n%s\n", expected, pkgbuild.contents)
+	}
+}
+
+func TestUpdateVarAnchorsAtLineStart(t *testing.T) {
+	pkgbuildSource := "_pkgverbump=1\nepkgver=2\n# pkgver=3 is what we want\npkgname=foo\n  pkgver=4\nend=5"
+	pkgbuild, err := NewPKGBUILDFromContents(pkgbuildSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pkgbuild.updateVar("pkgver", "6"); err != nil {
+		t.Fatal(err)
+	}
+	expected := "_pkgverbump=1\nepkgver=2\n# pkgver=3 is what we want\npkgname=foo\n  pkgver=6\nend=5"
+	if pkgbuild.contents != expected {
+		t.Errorf("Expected pkgbuild.contents to be:\n%s\n\nGot:\n%s\n", expected, pkgbuild.contents)
+	}
+
+	pkgbuild, err = NewPKGBUILDFromContents("_pkgver=1\n# url=x\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, varName := range []string{"pkgver", "url"} {
+		if err := pkgbuild.updateVar(varName, "2"); err == nil {
+			t.Errorf("Expected an error for %s, which is only declared as a substring", varName)
+		}
+	}
+}
+
+func TestUpdateVarArrays(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{
+			name:     "multi-line array",
+			source:   "source=(\n  'a'\n  'b'\n)\nend=2",
+			expected: "source=('c')\nend=2",
+		},
+		{
+			name:     "paren inside quotes",
+			source:   "source=('a)b' \"c)d\"\n  'e')\nend=2",
+			expected: "source=('c')\nend=2",
+		},
+		{
+			name:     "paren inside a comment",
+			source:   "source=('a' # (b) c)\n  'd')\nend=2",
+			expected: "source=('c')\nend=2",
+		},
+		{
+			name:     "escaped paren",
+			source:   "source=(a\\)b)\nend=2",
+			expected: "source=('c')\nend=2",
+		},
+		{
+			name:     "empty array",
+			source:   "source=()\nend=2",
+			expected: "source=('c')\nend=2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkgbuild, err := NewPKGBUILDFromContents(tt.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := pkgbuild.updateVar("source", "('c')"); err != nil {
+				t.Fatal(err)
+			}
+			if pkgbuild.contents != tt.expected {
+				t.Errorf("Expected pkgbuild.contents to be:\n%s\n\nGot:\n%s\n", tt.expected, pkgbuild.contents)
+			}
+		})
+	}
+
+	pkgbuild, err := NewPKGBUILDFromContents("source=('a' 'b'\nend=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pkgbuild.updateVar("source", "('c')"); err == nil {
+		t.Error("Expected an error for an unterminated array")
+	}
+}
+
+func TestUpdateVarsMissingVariableLeavesFileUntouched(t *testing.T) {
+	dir := t.TempDir()
+	pkgbuildSource := "pkgname=foo\npkgver=1.0\nsha256sums=('aaaa')\nmd5sums=('bbbb')\n"
+	if err := os.WriteFile(filepath.Join(dir, "PKGBUILD"), []byte(pkgbuildSource), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pkgbuild := NewPKGBUILD(dir)
+	err := pkgbuild.updateVars(map[string]string{
+		"sha256sums": "('cccc')",
+		"md5sums":    "('dddd')",
+		"b2sums":     "('eeee')",
+	})
+	if err == nil {
+		t.Fatal("Expected an error for the missing variable")
+	}
+
+	contents, err := os.ReadFile(filepath.Join(dir, "PKGBUILD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != pkgbuildSource {
+		t.Errorf("Expected the PKGBUILD to be untouched, got:\n%s\n", contents)
+	}
+}
+
+func BenchmarkUpdateVars(b *testing.B) {
+	// build a large PKGBUILD with many sums arrays:
+	var sb strings.Builder
+	sb.WriteString("pkgname=foo\npkgver=1.0.0\n")
+	newValues := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("sha256sums_%d", i)
+		sb.WriteString(name + "=(")
+		for j := 0; j < 20; j++ {
+			sb.WriteString(fmt.Sprintf("'%064d'\n", j))
+		}
+		sb.WriteString(")\n")
+		newValues[name] = fmt.Sprintf("('%064d')", i)
+	}
+	pkgbuildSource := sb.String()
+
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			pkgbuild, _ := NewPKGBUILDFromContents(pkgbuildSource)
+			for varName, varValue := range newValues {
+				pkgbuild.updateVar(varName, varValue)
+			}
+		}
+	})
+	b.Run("batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			pkgbuild, _ := NewPKGBUILDFromContents(pkgbuildSource)
+			pkgbuild.updateVars(newValues)
+		}
+	})
+}
+
+func TestDebianArchFor(t *testing.T) {
+	for goarch, expected := range map[string]string{"amd64": "amd64", "arm64": "arm64", "386": "i386", "arm": "armhf", "ppc64le": "ppc64el"} {
+		if arch := debianArchFor(goarch); arch != expected {
+			t.Errorf("debianArchFor(%q): expected %q, got %q", goarch, expected, arch)
+		}
+	}
+}
+
+func TestGetSourcesWithMode(t *testing.T) {
+	pkgbuild, err := NewPKGBUILDFromContents(`source=("https://example.com/a.tar.gz" "b::https://example.com/b.tar.gz" "https://example.com/c.tar.gz")
+sha256sums=('aaaa' 'bbbb')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pkgbuild.getSourcesWithMode(false); err == nil {
+		t.Errorf("expected strict mode to reject mismatched source/hashes lengths")
+	}
+
+	sources, err := pkgbuild.getSourcesWithMode(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 3 {
+		t.Fatalf("expected 3 sources, got %d", len(sources))
+	}
+	if sources[0].hash != "aaaa" || sources[1].hash != "bbbb" || sources[2].hash != "" {
+		t.Errorf("expected hashes to be paired by index, got %+v", sources)
+	}
+	if sources[1].localName != "b" || sources[1].remoteURL != "https://example.com/b.tar.gz" {
+		t.Errorf("expected b::... to be split into name and URL, got %+v", sources[1])
+	}
+}
+
+func TestDownloadSourcesConcurrently(t *testing.T) {
+	// the handler only answers once all three downloads are in flight, so this
+	// only passes if they really run concurrently:
+	mux := sync.Mutex{}
+	inFlight := 0
+	allInFlight := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		inFlight++
+		if inFlight == 3 {
+			close(allInFlight)
+		}
+		mux.Unlock()
+
+		select {
+		case <-allInFlight:
+			w.Write([]byte("contents of " + r.URL.Path))
+		case <-time.After(5 * time.Second):
+			http.Error(w, "downloads did not run concurrently", http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	pkgbuild, err := NewPKGBUILDFromContents(fmt.Sprintf(
+		"pkgname=foo\nsource=(%[1]s/a %[1]s/b %[1]s/c)\nsha256sums=(SKIP SKIP SKIP)\n", server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pkgbuild.downloadSources(3); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		contents, err := os.ReadFile(filepath.Join(pkgbuild.dirPath, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != "contents of /"+name {
+			t.Errorf("unexpected contents of %s: %q", name, contents)
+		}
+	}
+}
+
+func TestDownloadSourcesAggregatesErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/missing") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	pkgbuild, err := NewPKGBUILDFromContents(fmt.Sprintf(
+		"pkgname=foo\nsource=(%[1]s/missing1 %[1]s/a %[1]s/missing2)\nsha256sums=(SKIP SKIP SKIP)\n", server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pkgbuild.downloadSources(2)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), "2 of 3") || !strings.Contains(err.Error(), "missing1") || !strings.Contains(err.Error(), "missing2") {
+		t.Errorf("expected both failures to be reported, got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(pkgbuild.dirPath, "a")); err != nil {
+		t.Errorf("expected the other source to be downloaded anyway: %v", err)
+	}
+}
+
+func TestDownloadSourcesVerifiesHashes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello world"))
+	}))
+	defer server.Close()
+
+	pkgbuild, err := NewPKGBUILDFromContents(fmt.Sprintf(
+		"pkgname=foo\nsource=(%[1]s/good %[1]s/bad)\nsha256sums=(b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9 %[2]s)\n",
+		server.URL, strings.Repeat("0", 64)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pkgbuild.downloadSources(2)
+	if err == nil || !strings.Contains(err.Error(), "1 of 2") || !strings.Contains(err.Error(), "bad does not match") {
+		t.Errorf("expected only the bad source to fail verification, got: %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// runPkgver enables computing the version of VCS packages by running their
+// pkgver() function (--run-pkgver). This runs arbitrary bash from the
+// PKGBUILD, so it is opt-in.
+var runPkgver = false
+
+// pkgverTimeout bounds how long a pkgver() function may run
+var pkgverTimeout = 30 * time.Second
+
+var pkgverFunctionRegex = regexp.MustCompile(`(?m)^\s*(function\s+)?pkgver\s*\(\s*\)`)
+
+// getPkgver returns the package's version: the output of its pkgver() function
+// if it has one and --run-pkgver is given, or else the pkgver variable
+func (p *PKGBUILD) getPkgver() (string, error) { // {{{
+	if runPkgver {
+		contents, err := p.readContents()
+		if err != nil {
+			return "", err
+		}
+		if pkgverFunctionRegex.MatchString(contents) {
+			return p.getCachedDynamicPkgver()
+		}
+	}
+	return p.getSingleVariable("pkgver")
+} // }}}
+
+// pkgverCachePath is keyed by a hash of the absolute path of the package, so
+// that e.g. a PKGBUILD in ./foo and the clone of foo don't share an entry
+func pkgverCachePath(dirPath string) string {
+	if absPath, err := filepath.Abs(dirPath); err == nil {
+		dirPath = absPath
+	}
+	sum := sha256.Sum256([]byte(dirPath))
+	return mprDir(".cache", "pkgver", hex.EncodeToString(sum[:]))
+}
+
+// getCachedDynamicPkgver runs pkgver(), unless it already ran at the current
+// HEAD of the package: its result only changes when the checkout does. The
+// cache holds a single "<HEAD> <version>" line per package.
+func (p *PKGBUILD) getCachedDynamicPkgver() (string, error) { // {{{
+	head, err := gitRevParse(p.dirPath, "HEAD")
+	if err != nil {
+		return "", err
+	}
+
+	cachePath := pkgverCachePath(p.dirPath)
+	if contents, err := os.ReadFile(cachePath); err == nil {
+		parts := strings.SplitN(strings.TrimSpace(string(contents)), " ", 2)
+		if len(parts) == 2 && parts[0] == head {
+			return parts[1], nil
+		}
+	}
+
+	pkgver, err := p.runPkgverFunction()
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(cachePath, []byte(head+" "+pkgver+"\n"), 0644); err != nil {
+		return "", err
+	}
+	return pkgver, nil
+} // }}}
+
+func (p *PKGBUILD) runPkgverFunction() (string, error) { // {{{
+	ctx, cancel := context.WithTimeout(context.Background(), pkgverTimeout)
+	defer cancel()
+
+	var sbout strings.Builder
+	if err := p.runFunction(ctx, "pkgver", &sbout); err != nil {
+		return "", fmt.Errorf("could not run pkgver(): %w", err)
+	}
+	pkgver := strings.TrimSpace(sbout.String())
+	if pkgver == "" {
+		return "", fmt.Errorf("pkgver() printed no version")
+	}
+	return pkgver, nil
+} // }}}
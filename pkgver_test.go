@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGetPkgverCachesByHEAD(t *testing.T) {
+	setupTestMprDir(t)
+	counter := filepath.Join(t.TempDir(), "runs")
+	dir := createTestPackage(t, "foo-git", `pkgname=foo-git
+pkgver=0
+pkgrel=1
+pkgver() {
+  echo run >> `+counter+`
+  echo 1.2.3.r4
+}
+`)
+	runs := func() int {
+		contents, _ := os.ReadFile(counter)
+		return strings.Count(string(contents), "run")
+	}
+
+	runPkgver = true
+	defer func() { runPkgver = false }()
+
+	for i := 0; i < 2; i++ {
+		pkgver, err := NewPKGBUILD(dir).getPkgver()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkgver != "1.2.3.r4" {
+			t.Errorf("expected pkgver() to be used, got %q", pkgver)
+		}
+	}
+	if runs() != 1 {
+		t.Errorf("expected pkgver() to run once at the same HEAD, ran %d times", runs())
+	}
+
+	// moving HEAD invalidates the cache:
+	runTestGit(t, dir, "commit", "-q", "--allow-empty", "-m", "new commit")
+	if _, err := NewPKGBUILD(dir).getPkgver(); err != nil {
+		t.Fatal(err)
+	}
+	if runs() != 2 {
+		t.Errorf("expected pkgver() to run again after HEAD moved, ran %d times", runs())
+	}
+
+	// without --run-pkgver, the variable is used:
+	runPkgver = false
+	if pkgver, err := NewPKGBUILD(dir).getPkgver(); err != nil || pkgver != "0" {
+		t.Errorf("expected the pkgver variable, got %q (%v)", pkgver, err)
+	}
+	if runs() != 2 {
+		t.Errorf("expected pkgver() not to run without --run-pkgver")
+	}
+}
+
+func TestPkgverCachePathByDirectory(t *testing.T) {
+	setupTestMprDir(t)
+	// two directories with the same name are cached separately:
+	a, b := filepath.Join(t.TempDir(), "foo"), filepath.Join(t.TempDir(), "foo")
+	if pkgverCachePath(a) == pkgverCachePath(b) {
+		t.Errorf("expected %s and %s not to share a cache entry", a, b)
+	}
+	if pkgverCachePath(a) != pkgverCachePath(a+"/") {
+		t.Errorf("expected the same directory to map to the same cache entry")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Like git, mpr can be extended with external commands: `mpr foo ...` runs
+// the first `mpr-foo` executable on $PATH, unless foo is a built-in command.
+const pluginPrefix = "mpr-"
+
+// pluginInvocation is a command line that runs a plugin
+type pluginInvocation struct {
+	path       string
+	globalArgs []string // mpr's global flags, given before the plugin's name
+	args       []string // the plugin's own arguments
+}
+
+// lookupPlugin returns the plugin that args (the command line, without the
+// program name) invokes, if any. Built-in commands always take precedence.
+func lookupPlugin(root *cobra.Command, args []string) (pluginInvocation, bool) {
+	globalArgs, rest, ok := splitGlobalFlags(root, args)
+	if !ok || len(rest) == 0 {
+		return pluginInvocation{}, false
+	}
+	switch rest[0] {
+	case "help", "completion", cobra.ShellCompRequestCmd, cobra.ShellCompNoDescRequestCmd:
+		// cobra adds these when executing the root command
+		return pluginInvocation{}, false
+	}
+	if c, _, err := root.Find(rest); err == nil && c != root {
+		return pluginInvocation{}, false
+	}
+
+	path, err := exec.LookPath(pluginPrefix + rest[0])
+	if err != nil {
+		return pluginInvocation{}, false
+	}
+	return pluginInvocation{path: path, globalArgs: globalArgs, args: rest[1:]}, true
+}
+
+// splitGlobalFlags splits the root command's (persistent) flags off the start
+// of args, e.g. `--git /opt/git -y foo ...`. ok is false if args start with
+// anything else that looks like a flag, which is left for cobra to report.
+func splitGlobalFlags(root *cobra.Command, args []string) (globalArgs []string, rest []string, ok bool) { // {{{
+	flags := root.PersistentFlags()
+	i := 0
+	for i < len(args) && strings.HasPrefix(args[i], "-") {
+		arg := args[i]
+		if arg == "--" {
+			return nil, nil, false
+		}
+		needsValue := false
+		if strings.HasPrefix(arg, "--") {
+			name, _, hasValue := strings.Cut(arg[2:], "=")
+			flag := flags.Lookup(name)
+			if flag == nil {
+				return nil, nil, false
+			}
+			needsValue = !hasValue && flag.NoOptDefVal == ""
+		} else {
+			// shorthands can be combined, e.g. `-yV`, and the last one may
+			// take a value, e.g. `-o json` or `-ojson`:
+			for j := 1; j < len(arg); j++ {
+				flag := flags.ShorthandLookup(arg[j : j+1])
+				if flag == nil {
+					return nil, nil, false
+				}
+				if flag.NoOptDefVal == "" {
+					needsValue = j == len(arg)-1
+					break
+				}
+			}
+		}
+		if needsValue {
+			if i+1 >= len(args) {
+				return nil, nil, false
+			}
+			i++
+		}
+		i++
+	}
+	return args[:i], args[i:], true
+} // }}}
+
+// runPlugin runs the plugin at path with the given arguments. The plugin gets
+// mpr's resolved configuration through its environment (see pluginEnv).
+func runPlugin(path string, args []string) error {
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), pluginEnv()...)
+	return cmd.Run()
+}
+
+// pluginEnv is mpr's configuration, as resolved from its flags and
+// environment, in the environment variables that mpr itself reads. This way a
+// plugin that runs mpr again gets the same configuration.
+func pluginEnv() []string {
+	env := currentEnv()
+	vars := []string{
+		"MPR_DIR=" + env.MprDir,
+		"MPR_MAKEDEB=" + env.Makedeb,
+		"MPR_GIT=" + env.Git,
+		"MPR_APT=" + env.Apt,
+		"MPR_URL=" + env.MprURL,
+		"MPR_REPOLOGY_URL=" + env.RepologyURL,
+		"MPR_MAKEDEB_INSTALL=" + env.MakedebInstall,
+	}
+	if !env.Color {
+		vars = append(vars, "NO_COLOR=1")
+	}
+	return vars
+}
+
+// findPlugins lists the names of all plugins on $PATH
+func findPlugins() []string {
+	seen := make(map[string]bool)
+	plugins := make([]string, 0)
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if !strings.HasPrefix(name, pluginPrefix) || entry.IsDir() || seen[name] {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || info.Mode()&0111 == 0 {
+				continue
+			}
+			seen[name] = true
+			plugins = append(plugins, strings.TrimPrefix(name, pluginPrefix))
+		}
+	}
+	sort.Strings(plugins)
+	return plugins
+}
+
+// printPlugins adds the discovered plugins to `mpr help`
+func printPlugins(w io.Writer) {
+	plugins := findPlugins()
+	if len(plugins) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "\nPlugins (mpr-* on $PATH):")
+	for _, plugin := range plugins {
+		fmt.Fprintf(w, "  %s\n", plugin)
+	}
+}
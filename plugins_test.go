@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestPlugins(t *testing.T) {
+	mprDirPath := setupTestMprDir(t)
+	binDir := t.TempDir()
+	outFile := filepath.Join(t.TempDir(), "out")
+	script := "#!/bin/sh\necho \"$MPR_DIR $MPR_GIT $*\" > " + outFile + "\n"
+	if err := os.WriteFile(filepath.Join(binDir, "mpr-foo"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// a plugin that shadows a built-in command:
+	if err := os.WriteFile(filepath.Join(binDir, "mpr-list"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	root := &cobra.Command{Use: "mpr"}
+	root.PersistentFlags().BoolP("yes", "y", false, "")
+	root.PersistentFlags().String("git", "", "")
+	root.AddCommand(&cobra.Command{Use: "list", Run: func(*cobra.Command, []string) {}})
+
+	plugin, ok := lookupPlugin(root, []string{"foo", "a", "b"})
+	if !ok {
+		t.Fatal("expected mpr-foo to be found")
+	}
+	// global flags may come before the plugin's name:
+	withFlags, ok := lookupPlugin(root, []string{"--git", "/opt/git", "-y", "foo", "-y"})
+	if !ok || withFlags.path != plugin.path {
+		t.Fatalf("expected mpr-foo to be found after the global flags, got %+v", withFlags)
+	}
+	if strings.Join(withFlags.globalArgs, " ") != "--git /opt/git -y" || strings.Join(withFlags.args, " ") != "-y" {
+		t.Errorf("expected the global flags to be split from the plugin's, got %+v", withFlags)
+	}
+	if _, ok := lookupPlugin(root, []string{"--bogus", "foo"}); ok {
+		t.Errorf("expected an unknown flag to be left for cobra to report")
+	}
+	if _, ok := lookupPlugin(root, []string{"list"}); ok {
+		t.Errorf("expected built-in commands to take precedence")
+	}
+	if _, ok := lookupPlugin(root, []string{"nonexistent"}); ok {
+		t.Errorf("expected no plugin for an unknown command")
+	}
+
+	originalGitPath := gitPath
+	gitPath = "/opt/git"
+	defer func() { gitPath = originalGitPath }()
+	if err := runPlugin(plugin.path, []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.ReadFile(outFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(out)) != mprDirPath+" /opt/git a b" {
+		t.Errorf("expected the plugin to get the configuration and its arguments, got %q", out)
+	}
+
+	if plugins := strings.Join(findPlugins(), ","); !strings.Contains(plugins, "foo") {
+		t.Errorf("expected foo to be listed as a plugin, got %v", plugins)
+	}
+}
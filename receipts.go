@@ -1,8 +1,13 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
+	"path"
+	"sort"
 	"strings"
+	"time"
 )
 
 func updateMakedebInstallReceipt(pkg string) error {
@@ -15,7 +20,36 @@ func updateMakedebInstallReceipt(pkg string) error {
 	if err != nil {
 		return err
 	}
-	return nil
+	return writeMakedebBuildTime(pkg, time.Now())
+}
+
+// writeMakedebBuildTime records when the package was last built successfully.
+// This is kept next to the install receipt (rather than in it), so that
+// receipts stay compatible with older versions of mpr.
+func writeMakedebBuildTime(pkg string, t time.Time) error {
+	return os.WriteFile(mprDir(pkg, ".git", "makedeb-build-time"), []byte(t.Format(time.RFC3339)), 0644)
+}
+
+// readMakedebBuildTime returns when the package was last built, or a zero
+// time if it never was (or was built by a version of mpr that did not record
+// it)
+func readMakedebBuildTime(pkg string) (time.Time, error) {
+	contents, err := os.ReadFile(mprDir(pkg, ".git", "makedeb-build-time"))
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, strings.TrimSpace(string(contents)))
+}
+
+// formatBuildTime formats a time returned by readMakedebBuildTime for humans
+func formatBuildTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format("2006-01-02 15:04")
 }
 
 func readMakedebInstallReceipt(pkg string) (string, error) {
@@ -46,3 +80,148 @@ func isBehind(pkg string) (bool, error) {
 	}
 	return (receiptHash != currentHash), nil
 }
+
+// upgradeState is the checkpoint of a bulk `mpr upgrade`: it records the
+// packages that have been upgraded so far in the current run, so that an
+// interrupted run can be resumed
+type upgradeState struct {
+	Upgraded []string `json:"upgraded"`
+}
+
+func upgradeStatePath() string {
+	return mprDir(".upgrade-state.json")
+}
+
+func readUpgradeState() (upgradeState, error) {
+	state := upgradeState{Upgraded: make([]string, 0)}
+	contents, err := os.ReadFile(upgradeStatePath())
+	if err != nil && os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+
+	err = json.Unmarshal(contents, &state)
+	return state, err
+}
+
+func writeUpgradeState(state upgradeState) error {
+	contents, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(upgradeStatePath(), contents, 0644)
+}
+
+func clearUpgradeState() error {
+	err := os.Remove(upgradeStatePath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// failedPackagesPath is where the packages that failed in the last run of a
+// bulk command (e.g. "update" or "upgrade") are recorded, for --retry-failed
+func failedPackagesPath(command string) string {
+	return mprDir(".failed-" + command + ".json")
+}
+
+func readFailedPackages(command string) ([]string, error) {
+	failed := make([]string, 0)
+	contents, err := os.ReadFile(failedPackagesPath(command))
+	if err != nil && os.IsNotExist(err) {
+		return failed, nil
+	}
+	if err != nil {
+		return failed, err
+	}
+
+	err = json.Unmarshal(contents, &failed)
+	return failed, err
+}
+
+// writeFailedPackages records the failed packages of a run, clearing the record
+// if there were none. Only the packages that the run attempted are updated, so
+// that e.g. `mpr upgrade foo` does not forget that bar failed before.
+func writeFailedPackages(command string, attempted []string, failed []string) error {
+	// (a record that cannot be read is replaced)
+	previous, _ := readFailedPackages(command)
+	for _, pkg := range previous {
+		if !stringSliceContainsString(attempted, pkg) && !stringSliceContainsString(failed, pkg) {
+			failed = append(failed, pkg)
+		}
+	}
+	sort.Strings(failed)
+
+	if len(failed) == 0 {
+		err := os.Remove(failedPackagesPath(command))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	contents, err := json.Marshal(failed)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(failedPackagesPath(command), contents, 0644)
+}
+
+// pinnedPackagesPath is where the pinned packages (see `mpr pin`) are
+// recorded, one name per line. This lives outside of the package directories,
+// so that e.g. a `git clean` of a package does not unpin it.
+func pinnedPackagesPath() string {
+	return mprDir(".mpr", "pinned")
+}
+
+func readPinnedPackages() ([]string, error) {
+	pinned := make([]string, 0)
+	contents, err := os.ReadFile(pinnedPackagesPath())
+	if err != nil && os.IsNotExist(err) {
+		return pinned, nil
+	}
+	if err != nil {
+		return pinned, err
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			pinned = append(pinned, line)
+		}
+	}
+	return pinned, nil
+}
+
+func writePinnedPackages(pinned []string) error {
+	if err := os.MkdirAll(path.Dir(pinnedPackagesPath()), 0755); err != nil {
+		return err
+	}
+	sorted := append([]string(nil), pinned...)
+	sort.Strings(sorted)
+	contents := ""
+	for _, pkg := range sorted {
+		contents += pkg + "\n"
+	}
+	return os.WriteFile(pinnedPackagesPath(), []byte(contents), 0644)
+}
+
+// withoutPinnedPackages removes the pinned packages from packages, saying so
+// for each of them
+func withoutPinnedPackages(packages []string) ([]string, error) {
+	pinned, err := readPinnedPackages()
+	if err != nil {
+		return nil, err
+	}
+	kept := make([]string, 0, len(packages))
+	for _, pkg := range packages {
+		if stringSliceContainsString(pinned, pkg) {
+			fmt.Printf("=> skipping pinned %s\n", pkg)
+			continue
+		}
+		kept = append(kept, pkg)
+	}
+	return kept, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMakedebBuildTime(t *testing.T) {
+	setupTestMprDir(t)
+	createTestPackage(t, "foo", "pkgname=foo\npkgver=1.0.0\n")
+
+	// receipts written by older versions have no build time:
+	if err := os.WriteFile(mprDir("foo", ".git", "makedeb-install-receipt"), []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lastBuilt, err := readMakedebBuildTime("foo")
+	if err != nil || !lastBuilt.IsZero() {
+		t.Errorf("expected no build time for an old receipt, got %v (%v)", lastBuilt, err)
+	}
+	if formatBuildTime(lastBuilt) != "never" {
+		t.Errorf("expected a missing build time to be shown as never, got %q", formatBuildTime(lastBuilt))
+	}
+
+	before := time.Now().Truncate(time.Second)
+	if err := updateMakedebInstallReceipt("foo"); err != nil {
+		t.Fatal(err)
+	}
+	lastBuilt, err = readMakedebBuildTime("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastBuilt.Before(before) || lastBuilt.After(time.Now()) {
+		t.Errorf("expected the build time to be now, got %v", lastBuilt)
+	}
+	if behind, err := isBehind("foo"); err != nil || behind {
+		t.Errorf("expected the receipt to still be written (behind: %v, %v)", behind, err)
+	}
+}
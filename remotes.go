@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// isRepoNotFound reports whether git's stderr says that the remote repository
+// does not exist (anymore), which is how a moved/renamed upstream shows up
+func isRepoNotFound(stderr string) bool {
+	stderr = strings.ToLower(stderr)
+	for _, needle := range []string{"repository not found", "has moved", "does not appear to be a git repository"} {
+		if strings.Contains(stderr, needle) {
+			return true
+		}
+	}
+	// e.g. "fatal: repository 'https://example.com/foo.git/' not found", but
+	// not "git: command not found" or "host not found":
+	return quotedRepoNotFound.MatchString(stderr)
+}
+
+var quotedRepoNotFound = regexp.MustCompile(`repository '[^']*' not found`)
+
+var scpLikeRemote = regexp.MustCompile(`^[^@/]+@([^:/]+):(.+)$`)
+
+// remoteWebURL converts a git remote URL to the web URL of the repository,
+// e.g. "git@github.com:user/repo.git" to "https://github.com/user/repo"
+func remoteWebURL(remoteURL string) string {
+	if m := scpLikeRemote.FindStringSubmatch(remoteURL); m != nil {
+		remoteURL = "https://" + m[1] + "/" + m[2]
+	}
+	return strings.TrimSuffix(remoteURL, ".git")
+}
+
+// findRepoRedirect checks whether the web URL of a remote redirects somewhere
+// else (as GitHub does for renamed repositories), returning the new remote URL
+// in the same style as the old one, or "" if the repository has not moved
+func findRepoRedirect(remoteURL string) (string, error) {
+	webURL := remoteWebURL(remoteURL)
+	if !strings.HasPrefix(webURL, "http://") && !strings.HasPrefix(webURL, "https://") {
+		return "", nil
+	}
+
+	httpClient := &http.Client{
+		Timeout: 30 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := httpClient.Head(webURL)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusPermanentRedirect:
+	default:
+		return "", nil
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return "", fmt.Errorf("%s redirects, but without a valid location: %w", webURL, err)
+	}
+
+	newURL := strings.TrimSuffix(location.String(), "/")
+	if m := scpLikeRemote.FindStringSubmatch(remoteURL); m != nil && location.Host == m[1] {
+		// keep using ssh:
+		newURL = strings.SplitN(remoteURL, ":", 2)[0] + ":" + strings.TrimPrefix(location.Path, "/")
+	}
+	if strings.HasSuffix(remoteURL, ".git") && !strings.HasSuffix(newURL, ".git") {
+		newURL += ".git"
+	}
+	return newURL, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestRemoteWebURL(t *testing.T) {
+	tests := map[string]string{
+		"https://github.com/user/repo.git": "https://github.com/user/repo",
+		"https://mpr.makedeb.org/foo":      "https://mpr.makedeb.org/foo",
+		"git@github.com:user/repo.git":     "https://github.com/user/repo",
+	}
+	for remoteURL, expected := range tests {
+		if webURL := remoteWebURL(remoteURL); webURL != expected {
+			t.Errorf("remoteWebURL(%q): expected %q, got %q", remoteURL, expected, webURL)
+		}
+	}
+}
+
+// fakeGitHost serves a repository that was renamed from user/old to user/new
+func fakeGitHost(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/user/old" {
+			http.Redirect(w, r, "/user/new", http.StatusMovedPermanently)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestIsRepoNotFound(t *testing.T) {
+	for stderr, expected := range map[string]bool{
+		"remote: Repository not found.\nfatal: repository 'https://github.com/user/old.git/' not found": true,
+		"fatal: repository 'https://mpr.makedeb.org/foo.git/' not found":                                true,
+		"fatal: 'origin' does not appear to be a git repository":                                        true,
+		"sh: 1: git: command not found":                                                                 false,
+		"fatal: unable to access 'https://example.com/': Could not resolve host: example.com":           false,
+		"ssh: Could not resolve hostname example.com: Name or service not known":                        false,
+		"error: host not found": false,
+	} {
+		if actual := isRepoNotFound(stderr); actual != expected {
+			t.Errorf("isRepoNotFound(%q): expected %v, got %v", stderr, expected, actual)
+		}
+	}
+}
+
+func TestFindRepoRedirect(t *testing.T) {
+	server := fakeGitHost(t)
+
+	newURL, err := findRepoRedirect(server.URL + "/user/old.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newURL != server.URL+"/user/new.git" {
+		t.Errorf("expected the new location, got %q", newURL)
+	}
+
+	newURL, err = findRepoRedirect(server.URL + "/user/new.git")
+	if err != nil || newURL != "" {
+		t.Errorf("expected no redirect, got %q (%v)", newURL, err)
+	}
+}
+
+func TestRunUpdateFollowsMovedRepo(t *testing.T) {
+	setupTestMprDir(t)
+	server := fakeGitHost(t)
+	dir := createTestPackage(t, "foo", "pkgname=foo\npkgver=1.0.0\n")
+	runTestGit(t, dir, "remote", "add", "origin", server.URL+"/user/old.git")
+
+	// the first pull fails the way git does for a renamed repository:
+	commands := make([]string, 0)
+	pulls := 0
+	fakeRunCmd(t, func(cmd *exec.Cmd) error {
+		commands = append(commands, strings.Join(cmd.Args[1:], " "))
+		if cmd.Args[1] == "pull" {
+			pulls++
+			if pulls == 1 {
+				fmt.Fprintln(cmd.Stderr, "remote: Repository not found.")
+				return fmt.Errorf("exit status 128")
+			}
+		}
+		return nil
+	})
+
+	err := runUpdate(updateArgs{packagesToUpdate: []string{"foo"}, followRedirects: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"pull", "remote set-url origin " + server.URL + "/user/new.git", "pull"}
+	if strings.Join(commands, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, got %v", expected, commands)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultRepologyURL = "https://repology.org/api/v1/"
+
+// repologyURL is the base URL of the repology API. It can be overridden with
+// --repology-url or $MPR_REPOLOGY_URL, e.g. to point at a mirror.
+var repologyURL = defaultRepologyURL
+
+// defaultRepologyDelay keeps requests to repology below one per second, as
+// repology asks of API users
+const defaultRepologyDelay = 1100 * time.Millisecond
+
+// repologyLimiter spaces out all requests to repology. The delay can be
+// changed with `check-stale --rate-limit` or $MPR_REPOLOGY_DELAY, e.g. for a
+// local mirror.
+var repologyLimiter = newRateLimiter(defaultRepologyDelay)
+
+// defaultRepologyMaxAge is how long a version fetched from repology is reused
+// from the cache, see getLatestRepologyPkgVersionCached
+const defaultRepologyMaxAge = 24 * time.Hour
+
+type repologyCacheEntry struct {
+	Version   string    `json:"version"`
+	FetchedAt time.Time `json:"fetchedAt"`
+}
+
+func repologyCachePath(pkgname string) string {
+	return mprDir(".cache", "repology", url.PathEscape(pkgname)+".json")
+}
+
+func readRepologyCache(pkgname string) (*repologyCacheEntry, error) {
+	contents, err := os.ReadFile(repologyCachePath(pkgname))
+	if err != nil {
+		return nil, err
+	}
+	var entry repologyCacheEntry
+	if err := json.Unmarshal(contents, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func writeRepologyCache(pkgname string, entry repologyCacheEntry) error {
+	path := repologyCachePath(pkgname)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	contents, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, contents, 0644)
+}
+
+// resolveRepologyDelay picks the delay between requests to repology: the
+// flag if it was set, then $MPR_REPOLOGY_DELAY, then the flag's default
+func resolveRepologyDelay(flagValue time.Duration, flagChanged bool) (time.Duration, error) {
+	delay := flagValue
+	if !flagChanged {
+		if env := os.Getenv("MPR_REPOLOGY_DELAY"); env != "" {
+			parsed, err := time.ParseDuration(env)
+			if err != nil {
+				return 0, usageErrorf("invalid $MPR_REPOLOGY_DELAY %q: %s", env, err)
+			}
+			delay = parsed
+		}
+	}
+	if delay < 0 {
+		return 0, usageErrorf("the repology rate limit must not be negative, got %s", delay)
+	}
+	return delay, nil
+}
+
+// rateLimiter is a token bucket: it holds up to burst tokens, one of which is
+// added every interval, and each caller takes one. Callers that find the
+// bucket empty reserve a future token and sleep until it is due, without
+// holding up the others, so any number of goroutines can share a limiter.
+type rateLimiter struct {
+	mux      sync.Mutex
+	interval time.Duration
+	burst    int
+	tokens   float64   // may go negative, by the outstanding reservations
+	last     time.Time // when tokens was last refilled
+}
+
+func newRateLimiter(interval time.Duration) *rateLimiter {
+	return newTokenBucket(interval, 1)
+}
+
+func newTokenBucket(interval time.Duration, burst int) *rateLimiter {
+	return &rateLimiter{interval: interval, burst: burst, tokens: float64(burst)}
+}
+
+// getInterval returns the current delay between requests
+func (l *rateLimiter) getInterval() time.Duration {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.interval
+}
+
+// slowDown at least doubles the delay between requests, and makes it at least
+// atLeast. seen is the delay that the caller observed: if another caller has
+// already slowed the limiter down since, it is left alone, so that callers
+// that are rate limited at the same time don't compound each other. It
+// returns the new delay.
+func (l *rateLimiter) slowDown(seen time.Duration, atLeast time.Duration) time.Duration {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.interval > seen {
+		return l.interval
+	}
+	next := 2 * l.interval
+	if next < atLeast {
+		next = atLeast
+	}
+	l.interval = next
+	return l.interval
+}
+
+// wait blocks until the caller may proceed
+func (l *rateLimiter) wait() {
+	time.Sleep(l.reserve(time.Now()))
+}
+
+// reserve takes a token, and returns how long the caller has to wait for it
+func (l *rateLimiter) reserve(now time.Time) time.Duration {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if l.interval <= 0 {
+		return 0
+	}
+	if !l.last.IsZero() {
+		l.tokens += float64(now.Sub(l.last)) / float64(l.interval)
+		if l.tokens > float64(l.burst) {
+			l.tokens = float64(l.burst)
+		}
+	}
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens * float64(l.interval))
+}
+
+// validateBaseURL checks that a user-supplied base URL is a well-formed
+// http(s) URL, and normalizes it to end with a "/"
+func validateBaseURL(name string, baseURL string) (string, error) {
+	parsedURL, err := url.Parse(baseURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s %q: %w", name, baseURL, err)
+	}
+	if (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Host == "" {
+		return "", fmt.Errorf("invalid %s %q: expected an http(s) URL", name, baseURL)
+	}
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	return baseURL, nil
+}
+
+// repologyRateLimitError is returned when repology answers with 429 (too many
+// requests). retryAfter is how long repology asked to wait, if it did.
+type repologyRateLimitError struct {
+	project    string
+	retryAfter time.Duration
+}
+
+func (e *repologyRateLimitError) Error() string {
+	return fmt.Sprintf("%s: rate limited by repology", e.project)
+}
+
+func (e *repologyRateLimitError) Is(target error) bool { return target == errNetwork }
+
+// parseRetryAfter parses a Retry-After header, in either of its forms: a number
+// of seconds, or an HTTP date
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if seconds, err := strconv.Atoi(strings.TrimSpace(header)); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// fetchRepologyNewestVersion asks repology for the newest version of the
+// given project
+func fetchRepologyNewestVersion(project string) (string, error) { // {{{
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	req, err := http.NewRequest("GET", repologyURL+"project/"+url.PathEscape(project), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("User-Agent", "github.com/jrop/mpr-cli")
+	repologyLimiter.wait()
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return "", &repologyRateLimitError{project: project, retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", markError(fmt.Errorf("%s: repology answered with %s", project, resp.Status), errNetwork)
+	}
+
+	var data []map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		return "", err
+	}
+	if len(data) == 0 {
+		// repology answers with an empty list for projects it doesn't know
+		return "", fmt.Errorf("%s: %w", project, errRepologyNotTracked)
+	}
+	var newData []map[string]interface{}
+	for _, entry := range data {
+		if entry["status"] == "newest" {
+			newData = append(newData, entry)
+		}
+	}
+
+	var versions []string
+	for _, entry := range newData {
+		versions = append(versions, entry["version"].(string))
+	}
+
+	if len(versions) == 0 {
+		return "", fmt.Errorf("could not find any versions for package %s", project)
+	}
+	return versions[0], nil
+} // }}}
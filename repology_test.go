@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeRepology points repologyURL at a mock server (without rate limiting)
+// for the duration of the test
+func fakeRepology(t testing.TB, handler http.HandlerFunc) *httptest.Server {
+	server := httptest.NewServer(handler)
+	original, originalLimiter := repologyURL, repologyLimiter
+	repologyURL = server.URL + "/"
+	repologyLimiter = newRateLimiter(0)
+	t.Cleanup(func() {
+		repologyURL, repologyLimiter = original, originalLimiter
+		server.Close()
+	})
+	return server
+}
+
+func TestFetchRepologyNewestVersion(t *testing.T) {
+	fakeRepology(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/project/foo":
+			w.Write([]byte(`[{"status":"outdated","version":"1.0"},{"status":"newest","version":"1.2"}]`))
+		default:
+			w.Write([]byte(`[]`))
+		}
+	})
+
+	version, err := fetchRepologyNewestVersion("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "1.2" {
+		t.Errorf("expected 1.2, got %s", version)
+	}
+
+	if _, err := fetchRepologyNewestVersion("unknown"); err == nil {
+		t.Errorf("expected an error for an untracked project")
+	}
+}
+
+func TestFetchRepologyNewestVersionRateLimited(t *testing.T) {
+	fakeRepology(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/project/limited" {
+			w.Header().Set("Retry-After", "3")
+		}
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte("Too many requests"))
+	})
+
+	_, err := fetchRepologyNewestVersion("limited")
+	var rateLimitErr *repologyRateLimitError
+	if !errors.As(err, &rateLimitErr) {
+		t.Fatalf("expected a rate limit error, got %v", err)
+	}
+	if rateLimitErr.retryAfter != 3*time.Second {
+		t.Errorf("expected to be asked to retry after 3s, got %s", rateLimitErr.retryAfter)
+	}
+	if exitCodeFor(err) != exitNetwork {
+		t.Errorf("expected a rate limit error to be a network error, got exit code %d", exitCodeFor(err))
+	}
+
+	_, err = fetchRepologyNewestVersion("other")
+	if !errors.As(err, &rateLimitErr) || rateLimitErr.retryAfter != 0 {
+		t.Errorf("expected a rate limit error without a delay, got %v", err)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	for header, expected := range map[string]time.Duration{
+		"120":                           2 * time.Minute,
+		"Mon, 01 May 2023 12:00:30 GMT": 30 * time.Second,
+		"Mon, 01 May 2023 11:00:00 GMT": 0,
+		"soon":                          0,
+		"":                              0,
+	} {
+		if actual := parseRetryAfter(header, now); actual != expected {
+			t.Errorf("parseRetryAfter(%q): expected %s, got %s", header, expected, actual)
+		}
+	}
+}
+
+func TestRateLimiterSlowDown(t *testing.T) {
+	limiter := newRateLimiter(time.Second)
+	if delay := limiter.slowDown(time.Second, 0); delay != 2*time.Second {
+		t.Errorf("expected the delay to double, got %s", delay)
+	}
+	// another caller that saw the old delay doesn't double it again:
+	if delay := limiter.slowDown(time.Second, 0); delay != 2*time.Second {
+		t.Errorf("expected the delay to stay at 2s, got %s", delay)
+	}
+	if delay := limiter.slowDown(2*time.Second, 10*time.Second); delay != 10*time.Second {
+		t.Errorf("expected the delay to be at least 10s, got %s", delay)
+	}
+}
+
+func TestRunCheckStaleRetriesRateLimited(t *testing.T) {
+	setupTestMprDir(t)
+	createTestPackage(t, "foo", "pkgname=foo\npkgver=1.0\n")
+	var requests int32
+	fakeRepology(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`[{"status":"newest","version":"1.0"}]`))
+	})
+	repologyLimiter = newRateLimiter(time.Millisecond)
+
+	if err := runCheckStale(checkStaleArgs{jobs: 1}); err != nil {
+		t.Fatalf("expected the package to be checked once repology stopped rate limiting, got %v", err)
+	}
+	if requests != 3 {
+		t.Errorf("expected 3 requests, got %d", requests)
+	}
+	if interval := repologyLimiter.getInterval(); interval != 4*time.Millisecond {
+		t.Errorf("expected the delay to have been doubled twice, got %s", interval)
+	}
+}
+
+func TestValidateBaseURL(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		valid    bool
+	}{
+		{"https://repology.org/api/v1", "https://repology.org/api/v1/", true},
+		{"http://localhost:8080/", "http://localhost:8080/", true},
+		{"repology.org/api/v1", "", false},
+		{"ftp://example.com/", "", false},
+		{"https://", "", false},
+	}
+	for _, test := range tests {
+		baseURL, err := validateBaseURL("test URL", test.input)
+		if (err == nil) != test.valid {
+			t.Errorf("validateBaseURL(%q): expected valid=%v, got %v", test.input, test.valid, err)
+		}
+		if test.valid && baseURL != test.expected {
+			t.Errorf("validateBaseURL(%q): expected %q, got %q", test.input, test.expected, baseURL)
+		}
+	}
+}
+
+func TestRateLimiterSpacing(t *testing.T) {
+	interval := 50 * time.Millisecond
+	limiter := newRateLimiter(interval)
+
+	mux := sync.Mutex{}
+	times := make([]time.Time, 0)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limiter.wait()
+			mux.Lock()
+			times = append(times, time.Now())
+			mux.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// the times are taken after wait returns, so a single gap can be shortened
+	// by scheduling jitter; the total span is what the limiter guarantees:
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	expected := time.Duration(len(times)-1) * interval
+	if span := times[len(times)-1].Sub(times[0]); span < expected-5*time.Millisecond {
+		t.Errorf("expected %d calls to span at least %s, got %s", len(times), expected, span)
+	}
+}
+
+func TestResolveRepologyDelay(t *testing.T) {
+	t.Setenv("MPR_REPOLOGY_DELAY", "")
+	if delay, err := resolveRepologyDelay(defaultRepologyDelay, false); err != nil || delay != defaultRepologyDelay {
+		t.Errorf("expected the default delay, got %s (%v)", delay, err)
+	}
+
+	t.Setenv("MPR_REPOLOGY_DELAY", "200ms")
+	if delay, err := resolveRepologyDelay(defaultRepologyDelay, false); err != nil || delay != 200*time.Millisecond {
+		t.Errorf("expected $MPR_REPOLOGY_DELAY to be honored, got %s (%v)", delay, err)
+	}
+	if delay, err := resolveRepologyDelay(0, true); err != nil || delay != 0 {
+		t.Errorf("expected the flag to win over the environment, got %s (%v)", delay, err)
+	}
+
+	if _, err := resolveRepologyDelay(-time.Second, true); exitCodeFor(err) != exitUsage {
+		t.Errorf("expected a negative delay to be a usage error, got %v", err)
+	}
+	t.Setenv("MPR_REPOLOGY_DELAY", "soon")
+	if _, err := resolveRepologyDelay(defaultRepologyDelay, false); exitCodeFor(err) != exitUsage {
+		t.Errorf("expected an invalid $MPR_REPOLOGY_DELAY to be a usage error, got %v", err)
+	}
+}
+
+func TestTokenBucketReservations(t *testing.T) {
+	interval := time.Second
+	limiter := newTokenBucket(interval, 2)
+	now := time.Now()
+
+	// the burst is available at once:
+	for i := 0; i < 2; i++ {
+		if wait := limiter.reserve(now); wait != 0 {
+			t.Errorf("expected call %d to proceed at once, got a wait of %s", i, wait)
+		}
+	}
+	// then, each caller reserves the next token:
+	if wait := limiter.reserve(now); wait != interval {
+		t.Errorf("expected the 3rd call to wait %s, got %s", interval, wait)
+	}
+	if wait := limiter.reserve(now); wait != 2*interval {
+		t.Errorf("expected the 4th call to wait %s, got %s", 2*interval, wait)
+	}
+	// tokens keep being added while no-one is waiting, up to the burst:
+	later := now.Add(10 * interval)
+	for i := 0; i < 2; i++ {
+		if wait := limiter.reserve(later); wait != 0 {
+			t.Errorf("expected call %d after a pause to proceed at once, got a wait of %s", i, wait)
+		}
+	}
+	if wait := limiter.reserve(later); wait != interval {
+		t.Errorf("expected the burst to be capped at 2, got a wait of %s", wait)
+	}
+}
+
+func TestGetLatestRepologyPkgVersionCached(t *testing.T) {
+	setupTestMprDir(t)
+	var requests int64
+	version := "1.0"
+	fakeRepology(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Write([]byte(`[{"status":"newest","version":"` + version + `"}]`))
+	})
+	pkgbuild := NewPKGBUILD(createTestPackage(t, "foo", "pkgname=foo\npkgver=1.0\n"))
+
+	for i := 0; i < 2; i++ {
+		if got, err := pkgbuild.getLatestRepologyPkgVersionCached(time.Hour); err != nil || got != "1.0" {
+			t.Fatalf("getLatestRepologyPkgVersionCached() = %q, %v, want 1.0", got, err)
+		}
+	}
+	if requests := atomic.LoadInt64(&requests); requests != 1 {
+		t.Errorf("expected the second lookup to be served from the cache, got %d requests", requests)
+	}
+
+	// entries older than the max age are fetched again:
+	version = "2.0"
+	if got, err := pkgbuild.getLatestRepologyPkgVersionCached(0); err != nil || got != "2.0" {
+		t.Errorf("getLatestRepologyPkgVersionCached(0) = %q, %v, want 2.0", got, err)
+	}
+	if requests := atomic.LoadInt64(&requests); requests != 2 {
+		t.Errorf("expected an expired entry to be fetched again, got %d requests", requests)
+	}
+
+	// as are entries that can't be parsed:
+	version = "3.0"
+	if err := os.WriteFile(repologyCachePath("foo"), []byte("not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := pkgbuild.getLatestRepologyPkgVersionCached(time.Hour); err != nil || got != "3.0" {
+		t.Errorf("getLatestRepologyPkgVersionCached() = %q, %v, want 3.0 for a corrupt cache", got, err)
+	}
+	if entry, err := readRepologyCache("foo"); err != nil || entry.Version != "3.0" {
+		t.Errorf("expected the cache to be rewritten, got %+v, %v", entry, err)
+	}
+}
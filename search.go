@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// searchCacheTTL is how long search results are served from the cache before
+// the MPR is asked again
+const searchCacheTTL = time.Hour
+
+// mprSearchResult is a package, as returned by the MPR's (aurweb) RPC
+type mprSearchResult struct {
+	Name        string `json:"Name"`
+	Version     string `json:"Version"`
+	Description string `json:"Description"`
+}
+
+type searchCacheEntry struct {
+	FetchedAt time.Time         `json:"fetchedAt"`
+	Results   []mprSearchResult `json:"results"`
+}
+
+type searchArgs struct {
+	term       string
+	cached     bool // only serve from the cache, without touching the network
+	refresh    bool // ignore the cache
+	jsonOutput bool
+}
+
+func searchCachePath(term string) string {
+	return mprDir(".cache", "mpr", "search-"+url.QueryEscape(term)+".json")
+}
+
+func readSearchCache(term string) (*searchCacheEntry, error) {
+	contents, err := os.ReadFile(searchCachePath(term))
+	if err != nil {
+		return nil, err
+	}
+	var entry searchCacheEntry
+	if err := json.Unmarshal(contents, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func writeSearchCache(term string, entry searchCacheEntry) error {
+	path := searchCachePath(term)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	contents, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, contents, 0644)
+}
+
+// fetchMPRSearch asks the MPR's RPC for the packages matching term
+func fetchMPRSearch(term string) ([]mprSearchResult, error) {
+	return fetchMPRRPCSearch("name-desc", term)
+}
+
+// fetchMPRMaintainerPackages asks the MPR's RPC for the packages maintained
+// by the given user
+func fetchMPRMaintainerPackages(maintainer string) ([]mprSearchResult, error) {
+	return fetchMPRRPCSearch("maintainer", maintainer)
+}
+
+// fetchMPRUserExists checks whether the MPR has an account with the given
+// name, using its profile page. known is false if the MPR does not say (e.g.
+// because the page requires logging in).
+func fetchMPRUserExists(name string) (exists bool, known bool, err error) { // {{{
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	req, err := http.NewRequest("GET", mprURL+"account/"+url.PathEscape(name), nil)
+	if err != nil {
+		return false, false, err
+	}
+	req.Header.Add("User-Agent", "github.com/jrop/mpr-cli")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false, false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, true, nil
+	case http.StatusNotFound:
+		return false, true, nil
+	default:
+		return false, false, nil
+	}
+} // }}}
+
+// fetchMPRRPCSearch runs a search of the MPR's RPC, matching arg against the
+// field given by "by"
+func fetchMPRRPCSearch(by string, arg string) ([]mprSearchResult, error) { // {{{
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	req, err := http.NewRequest("GET", mprURL+"rpc/?v=5&type=search&by="+url.QueryEscape(by)+"&arg="+url.QueryEscape(arg), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("User-Agent", "github.com/jrop/mpr-cli")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, markError(fmt.Errorf("searching the MPR failed: %s", resp.Status), errNetwork)
+	}
+
+	var data struct {
+		Type    string            `json:"type"`
+		Error   string            `json:"error"`
+		Results []mprSearchResult `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	if data.Type == "error" {
+		return nil, fmt.Errorf("searching the MPR failed: %s", data.Error)
+	}
+	return data.Results, nil
+} // }}}
+
+// searchMPR searches the MPR, serving results from the cache while they are
+// fresh. If the MPR cannot be reached, stale results are served instead.
+func searchMPR(w io.Writer, args searchArgs, now time.Time) ([]mprSearchResult, error) { // {{{
+	cached, cacheErr := readSearchCache(args.term)
+	if args.cached {
+		if cacheErr != nil {
+			return nil, markError(fmt.Errorf("no cached results for %q (search without --cached first)", args.term), errNotFound)
+		}
+		return cached.Results, nil
+	}
+	if !args.refresh && cacheErr == nil && now.Sub(cached.FetchedAt) < searchCacheTTL {
+		return cached.Results, nil
+	}
+
+	results, err := fetchMPRSearch(args.term)
+	if err != nil {
+		if cacheErr == nil && exitCodeFor(err) == exitNetwork {
+			fmt.Fprintf(w, "warning: %s; showing cached results from %s\n", err, cached.FetchedAt.Local().Format("2006-01-02 15:04"))
+			return cached.Results, nil
+		}
+		return nil, err
+	}
+	if err := writeSearchCache(args.term, searchCacheEntry{FetchedAt: now, Results: results}); err != nil {
+		return nil, err
+	}
+	return results, nil
+} // }}}
+
+// searchResultJSON is a package, as printed by `mpr search --json`
+type searchResultJSON struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	Description string `json:"description"`
+}
+
+func runSearch(w io.Writer, args searchArgs) error { // {{{
+	results, err := searchMPR(os.Stderr, args, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if args.jsonOutput {
+		out := make([]searchResultJSON, 0, len(results))
+		for _, result := range results {
+			out = append(out, searchResultJSON{Name: result.Name, Version: result.Version, Description: result.Description})
+		}
+		return writeJSON(w, out)
+	}
+	if len(results) == 0 {
+		fmt.Fprintf(w, "no packages found matching %q\n", args.term)
+		return nil
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, result := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", result.Name, result.Version, result.Description)
+	}
+	return tw.Flush()
+} // }}}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeMPR points mprURL at a test server for the duration of the test
+func fakeMPR(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	originalURL := mprURL
+	mprURL = server.URL + "/"
+	t.Cleanup(func() { mprURL = originalURL })
+	return server
+}
+
+func TestSearchMPRCaches(t *testing.T) {
+	setupTestMprDir(t)
+	var requests int64
+	server := fakeMPR(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		if r.URL.Path != "/rpc/" || r.URL.Query().Get("type") != "search" || r.URL.Query().Get("arg") != "fire fox" {
+			http.Error(w, "unexpected request: "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"type":"search","resultcount":1,"results":[{"Name":"firefox-bin","Version":"1.0-1","Description":"A browser"}]}`))
+	})
+
+	var warnings strings.Builder
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		results, err := searchMPR(&warnings, searchArgs{term: "fire fox"}, now.Add(time.Duration(i)*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || results[0].Name != "firefox-bin" || results[0].Description != "A browser" {
+			t.Fatalf("unexpected results: %+v", results)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("expected the second search within the TTL to be served from the cache, got %d requests", requests)
+	}
+
+	// --refresh and an expired TTL both go to the MPR:
+	if _, err := searchMPR(&warnings, searchArgs{term: "fire fox", refresh: true}, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := searchMPR(&warnings, searchArgs{term: "fire fox"}, now.Add(2*searchCacheTTL)); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 3 {
+		t.Errorf("expected --refresh and an expired cache to make requests, got %d requests", requests)
+	}
+
+	// offline, the (stale) cache is served:
+	server.Close()
+	results, err := searchMPR(&warnings, searchArgs{term: "fire fox"}, now.Add(10*searchCacheTTL))
+	if err != nil || len(results) != 1 {
+		t.Errorf("expected the cache to be served offline, got %+v (%v)", results, err)
+	}
+	if !strings.Contains(warnings.String(), "showing cached results") {
+		t.Errorf("expected a warning about serving cached results, got %q", warnings.String())
+	}
+	if _, err := searchMPR(&warnings, searchArgs{term: "other", cached: true}, now); exitCodeFor(err) != exitNotFound {
+		t.Errorf("expected --cached without a cache entry to fail, got %v", err)
+	}
+}
+
+func TestRunSearchOutput(t *testing.T) {
+	setupTestMprDir(t)
+	fakeMPR(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("arg") == "nothing" {
+			w.Write([]byte(`{"type":"search","resultcount":0,"results":[]}`))
+			return
+		}
+		w.Write([]byte(`{"type":"search","resultcount":2,"results":[` +
+			`{"Name":"zsh-bin","Version":"5.9-1","Description":"A shell"},` +
+			`{"Name":"bash-bin","Version":"5.2-1","Description":"Another shell"}]}`))
+	})
+
+	var out strings.Builder
+	if err := runSearch(&out, searchArgs{term: "sh"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := "bash-bin  5.2-1  Another shell\nzsh-bin   5.9-1  A shell\n"
+	if out.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+
+	out.Reset()
+	if err := runSearch(&out, searchArgs{term: "sh", jsonOutput: true}); err != nil {
+		t.Fatal(err)
+	}
+	var results []map[string]string
+	if err := json.Unmarshal([]byte(out.String()), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0]["name"] != "zsh-bin" || results[0]["version"] != "5.9-1" || results[0]["description"] != "A shell" {
+		t.Errorf("unexpected JSON results: %v", results)
+	}
+
+	out.Reset()
+	if err := runSearch(&out, searchArgs{term: "nothing"}); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "no packages found matching \"nothing\"\n" {
+		t.Errorf("expected a clear message for no results, got %q", out.String())
+	}
+}
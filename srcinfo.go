@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// parseSRCINFO parses the contents of a .SRCINFO file. A .SRCINFO looks like
+// this:
+//
+//	pkgbase = foo
+//		pkgdesc = Some description
+//		pkgver = 1.2.3
+//		depends = bar
+//		depends = baz
+//
+//	pkgname = foo
+//
+// Each line is a "key = value" pair, optionally indented, and keys may be
+// repeated to express arrays. The pkgbase section holds the global variables,
+// and each pkgname section the variables that a (split) package overrides.
+// Each section collects every value for each key, in order.
+func parseSRCINFO(contents string) srcinfoFile {
+	info := srcinfoFile{base: make(map[string][]string), packages: make(map[string]map[string][]string)}
+	section := info.base
+	for _, line := range strings.Split(contents, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		if key == "pkgname" {
+			section = make(map[string][]string)
+			info.packages[value] = section
+			continue
+		}
+		section[key] = append(section[key], value)
+	}
+	return info
+}
+
+// srcinfoFile is a parsed .SRCINFO, see parseSRCINFO
+type srcinfoFile struct {
+	base     map[string][]string            // the pkgbase section
+	packages map[string]map[string][]string // the pkgname sections, by pkgname
+}
+
+// readSRCINFO reads and parses the .SRCINFO file in the given package
+// directory
+func readSRCINFO(dirPath string) (srcinfoFile, error) {
+	contents, err := os.ReadFile(filepath.Join(dirPath, ".SRCINFO"))
+	if err != nil {
+		return srcinfoFile{}, err
+	}
+	return parseSRCINFO(string(contents)), nil
+}
+
+// generateSRCINFO returns the .SRCINFO of the PKGBUILD in the given package
+// directory, per makedeb --print-srcinfo
+func generateSRCINFO(dirPath string) ([]byte, error) {
+	var sberr strings.Builder
+	cmd := exec.Command(makedebBin(), "--print-srcinfo")
+	cmd.Dir = dirPath
+	cmd.Stderr = &sberr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not run makedeb --print-srcinfo: %s%s", err, outputTail(sberr.String(), 10))
+	}
+	return output, nil
+}
+
+// writeSRCINFO regenerates the .SRCINFO file in the given package directory
+func writeSRCINFO(dirPath string) error {
+	contents, err := generateSRCINFO(dirPath)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dirPath, ".SRCINFO"), contents, 0644)
+}
+
+type srcinfoDifference struct {
+	name     string
+	srcinfo  []string
+	pkgbuild []string
+}
+
+// diffSRCINFO compares the global variables recorded in a .SRCINFO (its
+// pkgbase section) against the variables evaluated from the PKGBUILD. Only keys
+// that appear in the .SRCINFO are considered, since the PKGBUILD may define any
+// number of helper variables that never make it into the .SRCINFO. The
+// overrides of split packages are set in their package functions, so they
+// cannot be compared with the evaluated globals.
+func diffSRCINFO(info srcinfoFile, pkgbuildVars map[string][]string) []srcinfoDifference {
+	diffs := make([]srcinfoDifference, 0)
+	for name, srcinfoVals := range info.base {
+		pkgbuildVals := pkgbuildVars[name]
+		if name == "pkgbase" && len(pkgbuildVals) == 0 && len(pkgbuildVars["pkgname"]) > 0 {
+			// the pkgbase defaults to the first pkgname:
+			pkgbuildVals = pkgbuildVars["pkgname"][:1]
+		}
+		if strings.Join(srcinfoVals, "\x00") == strings.Join(pkgbuildVals, "\x00") {
+			continue
+		}
+		diffs = append(diffs, srcinfoDifference{
+			name:     name,
+			srcinfo:  srcinfoVals,
+			pkgbuild: pkgbuildVals,
+		})
+	}
+	return diffs
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseSRCINFO(t *testing.T) {
+	info := parseSRCINFO(`pkgbase = foo
+	pkgdesc = A thing = with equals
+	pkgver = 1.2.3
+	depends = bar
+	depends = baz
+
+pkgname = foo
+
+pkgname = foo-doc
+	depends = foo
+`)
+
+	vars := info.base
+	if vars["pkgver"][0] != "1.2.3" {
+		t.Errorf("expected pkgver to be 1.2.3, got %v", vars["pkgver"])
+	}
+	if vars["pkgdesc"][0] != "A thing = with equals" {
+		t.Errorf("expected pkgdesc to keep everything after the first =, got %v", vars["pkgdesc"])
+	}
+	if len(vars["depends"]) != 2 || vars["depends"][0] != "bar" || vars["depends"][1] != "baz" {
+		t.Errorf("expected depends to be [bar baz], got %v", vars["depends"])
+	}
+	if vars["pkgbase"][0] != "foo" {
+		t.Errorf("expected pkgbase to be foo, got %v", vars["pkgbase"])
+	}
+	if _, ok := vars["pkgname"]; ok {
+		t.Errorf("expected the pkgnames to start their own sections, got %v", vars["pkgname"])
+	}
+	if len(info.packages) != 2 || len(info.packages["foo"]) != 0 {
+		t.Errorf("expected the sections foo and foo-doc, got %v", info.packages)
+	}
+	if depends := info.packages["foo-doc"]["depends"]; len(depends) != 1 || depends[0] != "foo" {
+		t.Errorf("expected foo-doc to override depends with [foo], got %v", depends)
+	}
+}
+
+func TestDiffSRCINFO(t *testing.T) {
+	info := parseSRCINFO("pkgbase = foo\n\tpkgver = 1.2.3\n\tpkgrel = 1\n\tdepends = bar\n\tdepends = baz\n\npkgname = foo\n")
+	pkgbuildVars := map[string][]string{
+		"pkgname": {"foo"},
+		"pkgver":  {"1.2.4"},
+		"pkgrel":  {"1"},
+		"depends": {"bar", "baz"},
+		"_helper": {"ignored"},
+	}
+
+	// (the PKGBUILD does not set pkgbase, so it is its pkgname)
+	diffs := diffSRCINFO(info, pkgbuildVars)
+	if len(diffs) != 1 {
+		t.Fatalf("expected 1 difference, got %d: %+v", len(diffs), diffs)
+	}
+	if diffs[0].name != "pkgver" || diffs[0].srcinfo[0] != "1.2.3" || diffs[0].pkgbuild[0] != "1.2.4" {
+		t.Errorf("unexpected difference: %+v", diffs[0])
+	}
+
+	pkgbuildVars["pkgname"] = []string{"bar"}
+	pkgbuildVars["pkgver"] = []string{"1.2.3"}
+	if diffs := diffSRCINFO(info, pkgbuildVars); len(diffs) != 1 || diffs[0].name != "pkgbase" {
+		t.Errorf("expected a renamed package to differ in its pkgbase, got %+v", diffs)
+	}
+}
+
+func TestDiffSRCINFOSplitPackage(t *testing.T) {
+	info := parseSRCINFO(`pkgbase = foo
+	pkgver = 1.0
+	depends = bar
+
+pkgname = foo
+	depends = bar
+	depends = baz
+
+pkgname = foo-doc
+	depends = foo
+`)
+	pkgbuildVars := map[string][]string{
+		"pkgbase": {"foo"},
+		"pkgname": {"foo", "foo-doc"},
+		"pkgver":  {"1.0"},
+		"depends": {"bar"},
+	}
+	if diffs := diffSRCINFO(info, pkgbuildVars); len(diffs) != 0 {
+		t.Errorf("expected the overrides of the split packages to be left out, got %+v", diffs)
+	}
+}
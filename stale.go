@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+type stalePkgInfo struct {
+	name    string
+	version string
+	newest  string
+}
+
+type stalePkgError struct {
+	name string
+	err  error
+}
+
+// staleReport is the result of `mpr check-stale`, grouping every package by
+// how it compares to repology
+type staleReport struct {
+	stale      []stalePkgInfo  // repology knows of a newer version
+	upToDate   []string        // the PKGBUILD has repology's newest version (or a newer one)
+	notTracked []string        // repology_pkgname=SKIP, or unknown to repology
+	errors     []stalePkgError // the package could not be checked
+}
+
+// isStaleVersion tells whether repology's newest version is newer than the
+// pkgver in the PKGBUILD, e.g. "1.10.0" is newer than "1.2.0". With anyDiff,
+// any other version counts, even an older one.
+func isStaleVersion(pkgver string, newest string, anyDiff bool) bool {
+	if anyDiff {
+		return newest != pkgver
+	}
+	return compareDebVersions(newest, pkgver) > 0
+}
+
+// packagingVersionSuffixes are appended to upstream versions by some
+// distributions, and are trimmed before versions are compared
+var packagingVersionSuffixes = []string{"+dfsg", "+ds", "-release", ".release", "-stable", "-final"}
+
+// normalizeVersion trims what tells versions apart without making one newer
+// than the other: a leading "v" (as in "v3.0.1") and packagingVersionSuffixes
+func normalizeVersion(version string) string {
+	if len(version) > 1 && (version[0] == 'v' || version[0] == 'V') && isDigit(version[1]) {
+		version = version[1:]
+	}
+	for _, suffix := range packagingVersionSuffixes {
+		version = strings.TrimSuffix(version, suffix)
+	}
+	return version
+}
+
+// getRepologyVersionNormalizer returns the normalization that is applied to
+// both the pkgver and repology's version before they are compared. By
+// default, this is normalizeVersion. A PKGBUILD can set repology_version_regex
+// instead: the first group it captures (or the whole match, without groups) is
+// the version, and versions it does not match are compared unchanged.
+func (p *PKGBUILD) getRepologyVersionNormalizer() (func(string) string, error) { // {{{
+	val, err := p.getVariable("repology_version_regex")
+	if err != nil || len(val) == 0 || val[0] == "" {
+		return normalizeVersion, nil
+	}
+	re, err := regexp.Compile(val[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid repology_version_regex: %w", err)
+	}
+	return func(version string) string {
+		match := re.FindStringSubmatch(version)
+		switch {
+		case match == nil:
+			return version
+		case len(match) > 1:
+			return match[1]
+		default:
+			return match[0]
+		}
+	}, nil
+} // }}}
+
+func (r *staleReport) sort() {
+	sort.Slice(r.stale, func(i, j int) bool { return r.stale[i].name < r.stale[j].name })
+	sort.Strings(r.upToDate)
+	sort.Strings(r.notTracked)
+	sort.Slice(r.errors, func(i, j int) bool { return r.errors[i].name < r.errors[j].name })
+}
+
+// print writes the report as a set of sections, one per group, skipping
+// empty groups
+func (r *staleReport) print(w io.Writer) {
+	green := color.New(color.FgGreen).SprintFunc()
+	red := color.New(color.FgRed).SprintFunc()
+	bold := color.New(color.Bold).SprintFunc()
+
+	printHeader := func(title string, count int) {
+		fmt.Fprintf(w, "%s (%d):\n", bold(title), count)
+	}
+
+	sections := 0
+	separate := func() {
+		if sections > 0 {
+			fmt.Fprintln(w)
+		}
+		sections++
+	}
+
+	if len(r.stale) > 0 {
+		separate()
+		printHeader("Stale (updatable)", len(r.stale))
+		for _, pkg := range r.stale {
+			fmt.Fprintf(w, "  %s: current=%s, latest=%s\n", pkg.name, red(pkg.version), green(pkg.newest))
+		}
+	}
+	if len(r.upToDate) > 0 {
+		separate()
+		printHeader("Up to date", len(r.upToDate))
+		for _, pkg := range r.upToDate {
+			fmt.Fprintf(w, "  %s\n", pkg)
+		}
+	}
+	if len(r.notTracked) > 0 {
+		separate()
+		printHeader("Not tracked by repology (SKIP / 404)", len(r.notTracked))
+		for _, pkg := range r.notTracked {
+			fmt.Fprintf(w, "  %s\n", pkg)
+		}
+	}
+	if len(r.errors) > 0 {
+		separate()
+		printHeader("Errors", len(r.errors))
+		for _, pkg := range r.errors {
+			fmt.Fprintf(w, "  %s: %s\n", pkg.name, pkg.err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/fatih/color"
+)
+
+func TestStaleReportPrint(t *testing.T) {
+	defer func(noColor bool) { color.NoColor = noColor }(color.NoColor)
+	color.NoColor = true
+
+	report := staleReport{
+		stale: []stalePkgInfo{
+			{name: "zeta", version: "1.0", newest: "1.1"},
+			{name: "alpha", version: "2.0", newest: "2.1"},
+		},
+		upToDate:   []string{"gamma", "beta"},
+		notTracked: []string{"skipped"},
+		errors:     []stalePkgError{{name: "broken", err: fmt.Errorf("oops")}},
+	}
+	report.sort()
+
+	var out strings.Builder
+	report.print(&out)
+
+	expected := `Stale (updatable) (2):
+  alpha: current=2.0, latest=2.1
+  zeta: current=1.0, latest=1.1
+
+Up to date (2):
+  beta
+  gamma
+
+Not tracked by repology (SKIP / 404) (1):
+  skipped
+
+Errors (1):
+  broken: oops
+`
+	if out.String() != expected {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expected, out.String())
+	}
+}
+
+func TestStaleReportPrintSkipsEmptySections(t *testing.T) {
+	defer func(noColor bool) { color.NoColor = noColor }(color.NoColor)
+	color.NoColor = true
+
+	report := staleReport{upToDate: []string{"foo"}}
+
+	var out strings.Builder
+	report.print(&out)
+	if out.String() != "Up to date (1):\n  foo\n" {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+}
+
+func TestIsStaleVersion(t *testing.T) {
+	tests := []struct {
+		pkgver  string
+		newest  string
+		anyDiff bool
+		stale   bool
+	}{
+		{"1.2.0", "1.10.0", false, true},
+		{"1.10.0", "1.2.0", false, false},
+		{"1.10.0", "1.2.0", true, true},
+		{"1.2.0", "1.2.0", false, false},
+		{"1.2.0", "1.2.0", true, false},
+		{"2.3", "1:2.3", false, true},
+		{"1:2.3", "2.4", false, false},
+		{"1:2.3", "1:2.4", false, true},
+		{"1.0", "1.0~rc1", false, false},
+	}
+	for _, test := range tests {
+		if actual := isStaleVersion(test.pkgver, test.newest, test.anyDiff); actual != test.stale {
+			t.Errorf("isStaleVersion(%q, %q, %v): expected %v, got %v", test.pkgver, test.newest, test.anyDiff, test.stale, actual)
+		}
+	}
+}
+
+func TestGetRepologyVersionNormalizer(t *testing.T) {
+	tests := []struct {
+		pkgbuild string
+		versions map[string]string
+	}{
+		{"pkgname=foo\npkgver=1.0\n", map[string]string{
+			"v3.0.1":       "3.0.1",
+			"V3.0":         "3.0",
+			"3.0.1":        "3.0.1",
+			"3.0.1+dfsg":   "3.0.1",
+			"2.0-release":  "2.0",
+			"vim":          "vim",
+			"1.0.0-stable": "1.0.0",
+			"1.0-rc1":      "1.0-rc1",
+		}},
+		{"pkgname=foo\npkgver=1.0\nrepology_version_regex='^release-([0-9.]+)'\n", map[string]string{
+			"release-1.2": "1.2",
+			"1.2":         "1.2",
+			"v1.2":        "v1.2",
+		}},
+		{"pkgname=foo\npkgver=1.0\nrepology_version_regex='[0-9]+\\.[0-9]+'\n", map[string]string{
+			"foo-1.2-beta": "1.2",
+		}},
+	}
+	for _, test := range tests {
+		pkgbuild, err := NewPKGBUILDFromContents(test.pkgbuild)
+		if err != nil {
+			t.Fatal(err)
+		}
+		normalize, err := pkgbuild.getRepologyVersionNormalizer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for version, expected := range test.versions {
+			if actual := normalize(version); actual != expected {
+				t.Errorf("normalizing %q with:\n%s\nexpected %q, got %q", version, test.pkgbuild, expected, actual)
+			}
+		}
+	}
+
+	pkgbuild, err := NewPKGBUILDFromContents("pkgname=foo\nrepology_version_regex='('\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pkgbuild.getRepologyVersionNormalizer(); err == nil {
+		t.Error("expected an error for an invalid repology_version_regex")
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The flags printed by `--porcelain` output. They always appear in this
+// order, with "." in place of a flag that is not set, e.g. "D.R foo". This
+// format is meant for scripts, and is guaranteed not to change.
+const (
+	porcelainFlagDirty         = 'D' // the working tree has local modifications
+	porcelainFlagBehindReceipt = 'B' // HEAD differs from the last installed commit
+	porcelainFlagBehindRemote  = 'R' // the upstream branch has commits not in HEAD
+)
+
+type pkgState struct {
+	dirty         bool
+	behindReceipt bool
+	behindRemote  bool
+	lastBuilt     time.Time // zero if unknown
+
+	// from `git status --porcelain=v2 --branch`, see parseGitStatus:
+	branch   string // empty if HEAD is detached
+	upstream string // empty if the branch has no upstream branch
+	ahead    int
+	behind   int
+}
+
+func (s pkgState) detached() bool { return s.branch == "" }
+
+// porcelainFlags formats the state as a fixed-width set of flags
+func (s pkgState) porcelainFlags() string {
+	flags := []byte("...")
+	if s.dirty {
+		flags[0] = porcelainFlagDirty
+	}
+	if s.behindReceipt {
+		flags[1] = porcelainFlagBehindReceipt
+	}
+	if s.behindRemote {
+		flags[2] = porcelainFlagBehindRemote
+	}
+	return string(flags)
+}
+
+func gitOutput(pkg string, args ...string) (string, error) {
+	return gitOutputIn(mprDir(pkg), args...)
+}
+
+func gitOutputIn(dir string, args ...string) (string, error) {
+	var sbout, sberr strings.Builder
+	cmd := exec.Command(gitBin(), args...)
+	cmd.Stdout = &sbout
+	cmd.Stderr = &sberr
+	cmd.Dir = dir
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s failed in %s: %w: %s", strings.Join(args, " "), dir, err, strings.TrimSpace(sberr.String()))
+	}
+	return strings.TrimSpace(sbout.String()), nil
+}
+
+// isShallowClone reports whether the package was cloned with a limited
+// history, see `clone --depth`
+func isShallowClone(pkg string) bool {
+	out, err := gitOutput(pkg, "rev-parse", "--is-shallow-repository")
+	return err == nil && out == "true"
+}
+
+// shallowHistoryErrors are what `git pull` prints when a shallow clone lacks
+// the history it needs, e.g. for a merge base
+var shallowHistoryErrors = []string{"shallow", "unrelated histories", "no merge base", "bad object", "could not read"}
+
+func isShallowHistoryError(stderr string) bool {
+	stderr = strings.ToLower(stderr)
+	for _, needle := range shallowHistoryErrors {
+		if strings.Contains(stderr, needle) {
+			return true
+		}
+	}
+	return false
+}
+
+// unshallowAndPull fetches the full history of a shallow clone, and pulls.
+// The commands write their errors to stderr, and are killed once ctx is done.
+func unshallowAndPull(ctx context.Context, pkg string, stderr io.Writer) error {
+	for _, args := range [][]string{{"fetch", "--unshallow"}, {"pull"}} {
+		cmd := exec.CommandContext(ctx, gitBin(), args...)
+		cmd.Dir = mprDir(pkg)
+		cmd.Stderr = stderr
+		if err := runCmd(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isDirty reports whether the package's git working tree has local
+// modifications to tracked files. Untracked files do not count, since building
+// a package leaves plenty of them behind (sources, src/, pkg/, *.deb).
+func isDirty(pkg string) (bool, error) {
+	return isDirtyDir(mprDir(pkg))
+}
+
+func isDirtyDir(dir string) (bool, error) {
+	out, err := gitOutputIn(dir, "status", "--porcelain", "--untracked-files=no")
+	if err != nil {
+		return false, err
+	}
+	return out != "", nil
+}
+
+// backupsDir is where the uncommitted changes of deleted packages are saved
+func backupsDir() string {
+	return mprDir(".mpr", "backups")
+}
+
+// backupLocalChanges saves the uncommitted changes to the package's tracked
+// files as a patch in backupsDir, returning its path
+func backupLocalChanges(pkg string) (string, error) {
+	patch, err := gitOutput(pkg, "diff", "--binary", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(backupsDir(), 0755); err != nil {
+		return "", err
+	}
+	backup := filepath.Join(backupsDir(), fmt.Sprintf("%s-%s.patch", pkg, time.Now().Format("20060102-150405")))
+	return backup, os.WriteFile(backup, []byte(patch+"\n"), 0644)
+}
+
+// commitsBehindRemote counts the commits on the package's upstream branch (as
+// of the last fetch) that HEAD does not have. hasUpstream is false if the
+// branch does not track an upstream branch.
+func commitsBehindRemote(pkg string) (count int, hasUpstream bool, err error) {
+	if _, err := gitOutput(pkg, "rev-parse", "--abbrev-ref", "@{upstream}"); err != nil {
+		return 0, false, nil
+	}
+	out, err := gitOutput(pkg, "rev-list", "--count", "HEAD..@{upstream}")
+	if err != nil {
+		return 0, true, err
+	}
+	count, err = strconv.Atoi(out)
+	if err != nil {
+		return 0, true, err
+	}
+	return count, true, nil
+}
+
+func getPkgState(pkg string) (pkgState, error) {
+	// (like isDirty, untracked files do not count)
+	out, err := gitOutput(pkg, "status", "--porcelain=v2", "--branch", "--untracked-files=no")
+	if err != nil {
+		return pkgState{}, err
+	}
+	state, err := parseGitStatus(out)
+	if err != nil {
+		return state, err
+	}
+	if state.behindReceipt, err = isBehind(pkg); err != nil {
+		return state, err
+	}
+	if state.lastBuilt, err = readMakedebBuildTime(pkg); err != nil {
+		return state, err
+	}
+	return state, nil
+}
+
+// parseGitStatus parses the output of `git status --porcelain=v2 --branch`
+// into the git part of a pkgState: whether the working tree is dirty, and
+// where the branch is relative to its upstream branch (as of the last fetch)
+func parseGitStatus(output string) (pkgState, error) {
+	var status pkgState
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "# ") {
+			status.dirty = true
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		switch fields[1] {
+		case "branch.head":
+			if fields[2] != "(detached)" {
+				status.branch = fields[2]
+			}
+		case "branch.upstream":
+			status.upstream = fields[2]
+		case "branch.ab":
+			if len(fields) != 4 {
+				return status, fmt.Errorf("invalid branch.ab line: %q", line)
+			}
+			var err error
+			if status.ahead, err = strconv.Atoi(strings.TrimPrefix(fields[2], "+")); err != nil {
+				return status, fmt.Errorf("invalid branch.ab line: %q", line)
+			}
+			if status.behind, err = strconv.Atoi(strings.TrimPrefix(fields[3], "-")); err != nil {
+				return status, fmt.Errorf("invalid branch.ab line: %q", line)
+			}
+			status.behindRemote = status.behind > 0
+		}
+	}
+	return status, nil
+}
+
+// summary formats the status for `mpr status`, e.g. "dirty, 1 ahead, 2 behind"
+func (s pkgState) summary() string {
+	parts := []string{"clean"}
+	if s.dirty {
+		parts[0] = "dirty"
+	}
+	if s.detached() {
+		parts = append(parts, "detached")
+	} else if s.upstream == "" {
+		parts = append(parts, "no upstream")
+	}
+	if s.ahead > 0 {
+		parts = append(parts, fmt.Sprintf("%d ahead", s.ahead))
+	}
+	if s.behind > 0 {
+		parts = append(parts, fmt.Sprintf("%d behind", s.behind))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPorcelainFlags(t *testing.T) {
+	tests := []struct {
+		state    pkgState
+		expected string
+	}{
+		{pkgState{}, "..."},
+		{pkgState{dirty: true}, "D.."},
+		{pkgState{behindReceipt: true}, ".B."},
+		{pkgState{behindRemote: true}, "..R"},
+		{pkgState{dirty: true, behindReceipt: true, behindRemote: true}, "DBR"},
+	}
+	for _, test := range tests {
+		if flags := test.state.porcelainFlags(); flags != test.expected {
+			t.Errorf("%+v: expected %q, got %q", test.state, test.expected, flags)
+		}
+	}
+}
+
+func TestParseGitStatus(t *testing.T) {
+	tests := []struct {
+		output   string
+		expected pkgState
+		summary  string
+	}{
+		{
+			output:   "# branch.oid abc\n# branch.head main\n# branch.upstream origin/main\n# branch.ab +0 -0\n",
+			expected: pkgState{branch: "main", upstream: "origin/main"},
+			summary:  "clean",
+		},
+		{
+			output:   "# branch.oid abc\n# branch.head main\n# branch.upstream origin/main\n# branch.ab +1 -2\n1 .M N... 100644 100644 100644 abc abc PKGBUILD\n? notes.txt\n",
+			expected: pkgState{branch: "main", upstream: "origin/main", ahead: 1, behind: 2, dirty: true, behindRemote: true},
+			summary:  "dirty, 1 ahead, 2 behind",
+		},
+		{
+			output:   "# branch.oid abc\n# branch.head (detached)\n",
+			expected: pkgState{},
+			summary:  "clean, detached",
+		},
+		{
+			output:   "# branch.oid abc\n# branch.head main\n",
+			expected: pkgState{branch: "main"},
+			summary:  "clean, no upstream",
+		},
+	}
+	for _, test := range tests {
+		status, err := parseGitStatus(test.output)
+		if err != nil {
+			t.Errorf("%q: %s", test.output, err)
+			continue
+		}
+		if status != test.expected {
+			t.Errorf("%q: expected %+v, got %+v", test.output, test.expected, status)
+		}
+		if summary := status.summary(); summary != test.summary {
+			t.Errorf("%q: expected summary %q, got %q", test.output, test.summary, summary)
+		}
+	}
+
+	if _, err := parseGitStatus("# branch.ab +x -1\n"); err == nil {
+		t.Errorf("expected an invalid branch.ab line to be rejected")
+	}
+}
+
+func TestRunStatusDirtyOnly(t *testing.T) {
+	setupTestMprDir(t)
+	createTestPackage(t, "clean", "pkgname=clean\npkgver=1.0\n")
+	dir := createTestPackage(t, "dirty", "pkgname=dirty\npkgver=1.0\n")
+	if err := os.WriteFile(filepath.Join(dir, "PKGBUILD"), []byte("pkgname=dirty\npkgver=2.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := runStatus(&out, statusArgs{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "clean  clean, no upstream\n") || !strings.Contains(out.String(), "dirty  dirty, no upstream\n") {
+		t.Errorf("expected both packages in the output, got:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := runStatus(&out, statusArgs{dirtyOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "dirty  dirty, no upstream\n" {
+		t.Errorf("expected only the dirty package, got:\n%s", out.String())
+	}
+}
+
+func TestRunStatusPorcelain(t *testing.T) {
+	setupTestMprDir(t)
+	createTestPackage(t, "clean", "pkgname=clean\npkgver=1.0\n")
+	if err := updateMakedebInstallReceipt("clean"); err != nil {
+		t.Fatal(err)
+	}
+	dir := createTestPackage(t, "dirty", "pkgname=dirty\npkgver=1.0\n")
+	if err := os.WriteFile(filepath.Join(dir, "PKGBUILD"), []byte("pkgname=dirty\npkgver=2.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// build artifacts do not make a package dirty:
+	if err := os.WriteFile(mprDir("clean", "clean_1.0-1_amd64.deb"), []byte("deb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := runStatus(&out, statusArgs{porcelain: true}); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "... clean\nDB. dirty\n" {
+		t.Errorf("expected porcelain lines, got:\n%s", out.String())
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// setupTestMprDir points MPR_DIR at a fresh temporary directory for the
+// duration of the test
+func setupTestMprDir(t testing.TB) string {
+	dir := t.TempDir()
+	t.Setenv("MPR_DIR", dir)
+	invalidatePackageIndex()
+	return dir
+}
+
+// runTestGit runs a git command in dir, failing the test if it fails
+func runTestGit(t testing.TB, dir string, args ...string) {
+	args = append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com", "-c", "commit.gpgsign=false"}, args...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %v failed: %s\n%s", args, err, out)
+	}
+}
+
+// createTestPackage creates a package named pkg in the MPR_DIR: a git
+// repository with a single commit containing the given PKGBUILD
+func createTestPackage(t testing.TB, pkg string, pkgbuild string) string {
+	dir := mprDir(pkg)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "PKGBUILD"), []byte(pkgbuild), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runTestGit(t, dir, "init", "-q")
+	runTestGit(t, dir, "add", "PKGBUILD")
+	runTestGit(t, dir, "commit", "-q", "-m", "initial commit")
+	invalidatePackageIndex()
+	return dir
+}
+
+// fakeRunCmd replaces runCmd for the duration of the test. Every command that
+// would have been run is passed to fn instead.
+func fakeRunCmd(t testing.TB, fn func(cmd *exec.Cmd) error) {
+	original := runCmd
+	runCmd = fn
+	t.Cleanup(func() { runCmd = original })
+}
+
+// fakeGitClone replaces runCmd with a fake `git clone` that creates a repository
+// with the PKGBUILD given for the basename of the cloned URL (or no PKGBUILD if
+// there is none). It returns the URLs that were cloned.
+func fakeGitClone(t testing.TB, pkgbuilds map[string]string) func() []string {
+	var mux sync.Mutex
+	var urls []string
+	fakeRunCmd(t, func(cmd *exec.Cmd) error {
+		if len(cmd.Args) != 4 || cmd.Args[1] != "clone" {
+			return fmt.Errorf("unexpected command: %v", cmd.Args)
+		}
+		url, dir := cmd.Args[2], filepath.Join(cmd.Dir, cmd.Args[3])
+		if err := os.MkdirAll(filepath.Join(dir, ".git"), 0755); err != nil {
+			return err
+		}
+		if pkgbuild, ok := pkgbuilds[path.Base(url)]; ok {
+			if err := os.WriteFile(filepath.Join(dir, "PKGBUILD"), []byte(pkgbuild), 0644); err != nil {
+				return err
+			}
+		}
+		mux.Lock()
+		defer mux.Unlock()
+		urls = append(urls, url)
+		return nil
+	})
+	return func() []string {
+		mux.Lock()
+		defer mux.Unlock()
+		sort.Strings(urls)
+		return urls
+	}
+}
+
+// withTestStdout runs f with os.Stdout redirected to a file, and returns what
+// f printed
+func withTestStdout(t testing.TB, f func()) string {
+	out, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	originalStdout := os.Stdout
+	os.Stdout = out
+	defer func() { os.Stdout = originalStdout }()
+	f()
+	contents, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
+
+// withTestStdin runs f with os.Stdin reading the given input, e.g. to answer
+// prompts
+func withTestStdin(t testing.TB, input string, f func()) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteString(input)
+	w.Close()
+	originalStdin := os.Stdin
+	os.Stdin = r
+	defer func() {
+		os.Stdin = originalStdin
+		r.Close()
+	}()
+	f()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// timingRecorder records how long the phases of a command take, for
+// `--timings`. When it is disabled, recording is a no-op.
+type timingRecorder struct {
+	enabled bool
+	mux     sync.Mutex
+	entries []timingEntry
+}
+
+type timingEntry struct {
+	name     string
+	duration time.Duration
+}
+
+// timings is the recorder used by the CLI runners; it is enabled by the
+// `--timings` root flag
+var timings = &timingRecorder{}
+
+func noopStopTiming() {}
+
+// start begins timing the named phase, and returns a function that stops the
+// timer and records the result
+func (t *timingRecorder) start(name string) func() {
+	if !t.enabled {
+		return noopStopTiming
+	}
+
+	startTime := time.Now()
+	return func() {
+		t.record(name, time.Since(startTime))
+	}
+}
+
+// record adds a duration to the named phase, so that a phase can be made up
+// of many separate intervals (e.g. all of the network requests made by
+// check-stale)
+func (t *timingRecorder) record(name string, duration time.Duration) {
+	if !t.enabled {
+		return
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	for i := range t.entries {
+		if t.entries[i].name == name {
+			t.entries[i].duration += duration
+			return
+		}
+	}
+	t.entries = append(t.entries, timingEntry{name: name, duration: duration})
+}
+
+// print writes a summary table of the recorded timings, in the order in
+// which each phase was first recorded
+func (t *timingRecorder) print(w io.Writer) {
+	if !t.enabled {
+		return
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if len(t.entries) == 0 {
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nPHASE\tDURATION")
+	for _, entry := range t.entries {
+		fmt.Fprintf(tw, "%s\t%s\n", entry.name, entry.duration.Round(time.Millisecond))
+	}
+	tw.Flush()
+}
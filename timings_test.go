@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimingRecorder(t *testing.T) {
+	recorder := &timingRecorder{enabled: true}
+	recorder.record("network", 100*time.Millisecond)
+	recorder.record("build foo", 2*time.Second)
+	recorder.record("network", 200*time.Millisecond)
+	recorder.start("total")()
+
+	if len(recorder.entries) != 3 {
+		t.Fatalf("expected 3 entries, got %+v", recorder.entries)
+	}
+	if recorder.entries[0].name != "network" || recorder.entries[0].duration != 300*time.Millisecond {
+		t.Errorf("expected repeated phases to accumulate, got %+v", recorder.entries[0])
+	}
+
+	var out strings.Builder
+	recorder.print(&out)
+	if !strings.Contains(out.String(), "build foo") || !strings.Contains(out.String(), "2s") {
+		t.Errorf("expected summary to contain each phase, got:\n%s", out.String())
+	}
+}
+
+func TestTimingRecorderDisabled(t *testing.T) {
+	recorder := &timingRecorder{}
+	recorder.record("network", time.Second)
+	recorder.start("total")()
+
+	if len(recorder.entries) != 0 {
+		t.Errorf("expected a disabled recorder to record nothing, got %+v", recorder.entries)
+	}
+
+	var out strings.Builder
+	recorder.print(&out)
+	if out.String() != "" {
+		t.Errorf("expected a disabled recorder to print nothing, got %q", out.String())
+	}
+}
@@ -1,12 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
+	"github.com/fatih/color"
+	"github.com/mattn/go-isatty"
 	"golang.org/x/sync/semaphore"
 )
 
@@ -33,6 +43,64 @@ func stringSliceContainsString(slice []string, str string) bool {
 	return false
 }
 
+// promptYesNo writes prompt to w and reads a yes/no answer from r. Answers
+// are case-insensitive ("y", "yes", "n", "no"); an empty answer or EOF (e.g.
+// when stdin is an empty pipe) yields def. Unrecognized answers cause the
+// question to be asked again.
+func promptYesNo(w io.Writer, r io.Reader, prompt string, def bool) (bool, error) {
+	choices := "[y/N]"
+	if def {
+		choices = "[Y/n]"
+	}
+
+	for {
+		fmt.Fprintf(w, "%s %s ", prompt, choices)
+
+		line, err := readLine(r)
+		if err != nil && err != io.EOF {
+			return def, err
+		}
+		if err == io.EOF && line == "" {
+			fmt.Fprintln(w)
+			return def, nil
+		}
+
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "":
+			return def, nil
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+
+		if err == io.EOF {
+			return def, nil
+		}
+	}
+}
+
+// readLine reads from r up to (and including) the next newline, one byte at a
+// time: unlike a bufio.Reader, it leaves the rest of the input (e.g. the
+// answers to later prompts, piped into stdin) unread. The line is returned
+// with io.EOF if the input ends without a newline.
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	buf := make([]byte, 1)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			line = append(line, buf[0])
+			if buf[0] == '\n' {
+				return string(line), nil
+			}
+		}
+		if err != nil {
+			return string(line), err
+		}
+	}
+}
+
 // func setLine(line string) {{{
 var setLine_lastLineLength int = 0
 
@@ -45,7 +113,21 @@ func setLine(line string) {
 	fmt.Print("\r" + line)
 }
 
+// doParallel runs work for each index, at most maxConcurrency at a time, and
+// returns the error of the first index that failed
 func doParallel(totalIterations int, maxConcurrency int, work func(int) error) error {
+	for _, err := range doParallelCollect(totalIterations, maxConcurrency, work) {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// doParallelCollect is doParallel, but returns the error of every index (nil
+// where the work succeeded)
+func doParallelCollect(totalIterations int, maxConcurrency int, work func(int) error) []error {
+	// the context is never canceled, so acquiring the semaphore cannot fail:
 	ctx := context.TODO()
 	sem := semaphore.NewWeighted(int64(maxConcurrency))
 
@@ -53,10 +135,7 @@ func doParallel(totalIterations int, maxConcurrency int, work func(int) error) e
 	errors := make([]error, totalIterations)
 
 	for i := 0; i < totalIterations; i++ {
-		if err := sem.Acquire(ctx, 1); err != nil {
-			return err
-		}
-
+		sem.Acquire(ctx, 1)
 		go func(i int) {
 			defer sem.Release(1)
 			if err := work(i); err != nil {
@@ -67,35 +146,222 @@ func doParallel(totalIterations int, maxConcurrency int, work func(int) error) e
 		}(i)
 	}
 
-	err := sem.Acquire(ctx, int64(maxConcurrency))
-	if err != nil {
-		return err
+	sem.Acquire(ctx, int64(maxConcurrency))
+	return errors
+}
+
+// outputTail formats the last n lines of a command's output for appending to
+// an error message, or returns "" if there was no output
+func outputTail(output string, n int) string {
+	output = strings.TrimSpace(output)
+	if output == "" {
+		return ""
+	}
+	lines := strings.Split(output, "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return ":\n" + strings.Join(lines, "\n")
+}
+
+// commandErrorLine summarizes why a command failed in one line: the last line
+// it printed to stderr (e.g. git's "fatal: ..."), or err if it printed nothing
+func commandErrorLine(stderr string, err error) string {
+	stderr = strings.TrimSpace(stderr)
+	if stderr == "" {
+		return err.Error()
 	}
+	lines := strings.Split(stderr, "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
 
-	for _, e := range errors {
-		if e != nil {
-			return e
+// dirSize sums the sizes of all files under dir
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
 		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// formatBytes formats a size for humans, e.g. "1.5 MiB"
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
 	}
-	return nil
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
 }
 
+// progressReportInterval throttles progressReader, which would otherwise
+// redraw the status line for every chunk of a download
+const progressReportInterval = 100 * time.Millisecond
+
 type progressReader struct {
-	progress    int64
-	totalLength int64
-	onProgress  func(progress int64, totalLength int64)
+	progress     int64
+	totalLength  int64
+	onProgress   func(progress int64, totalLength int64)
+	lastReported time.Time
 }
 
-func (p progressReader) Write(data []byte) (int, error) {
+// Write must have a pointer receiver: otherwise it would only advance the
+// progress of a copy
+func (p *progressReader) Write(data []byte) (int, error) {
 	p.progress += int64(len(data))
-	p.onProgress(p.progress, p.totalLength)
+	if time.Since(p.lastReported) >= progressReportInterval {
+		p.report()
+	}
 	return len(data), nil
 }
 
-func newProgressReader(totalLength int64, onProgress func(progress int64, totalLength int64)) progressReader {
-	return progressReader{
+// report passes the progress on to onProgress, e.g. once a download is done
+func (p *progressReader) report() {
+	p.lastReported = time.Now()
+	p.onProgress(p.progress, p.totalLength)
+}
+
+func newProgressReader(totalLength int64, onProgress func(progress int64, totalLength int64)) *progressReader {
+	return &progressReader{
 		progress:    0,
 		totalLength: totalLength,
 		onProgress:  onProgress,
 	}
 }
+
+// prefixWriter prefixes every line written to it with a fixed string. Several
+// prefixWriters can share one underlying writer: each complete line is
+// written while holding the shared mutex, so lines from different writers
+// never interleave within a line. Partial lines are buffered until their
+// newline arrives (or until Flush).
+type prefixWriter struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	prefix string
+	buf    []byte
+}
+
+func newPrefixWriter(mu *sync.Mutex, out io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{mu: mu, out: out, prefix: prefix}
+}
+
+func (w *prefixWriter) Write(data []byte) (int, error) {
+	w.buf = append(w.buf, data...)
+	for {
+		idx := bytes.IndexByte(w.buf, '\n')
+		if idx == -1 {
+			break
+		}
+		if err := w.writeLine(w.buf[:idx+1]); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[idx+1:]
+	}
+	return len(data), nil
+}
+
+// Flush writes out a trailing partial line, terminating it with a newline
+func (w *prefixWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	line := append(w.buf, '\n')
+	w.buf = nil
+	return w.writeLine(line)
+}
+
+func (w *prefixWriter) writeLine(line []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.out.Write(append([]byte(w.prefix), line...))
+	return err
+}
+
+// The modes supported by --color:
+const (
+	colorAuto   = "auto"   // color if stdout is a terminal and $NO_COLOR is unset
+	colorAlways = "always" // color even if $NO_COLOR is set or stdout is not a terminal
+	colorNever  = "never"
+)
+
+// colorDetectedNoColor is fatih/color's own terminal detection, from before
+// --color had a chance to override it
+var colorDetectedNoColor = color.NoColor
+
+// applyColorMode enables/disables colored output. It has to run before anything
+// colored is printed.
+func applyColorMode(mode string) error {
+	switch mode {
+	case colorAuto:
+		// https://no-color.org: NO_COLOR disables color when it is non-empty
+		color.NoColor = colorDetectedNoColor || os.Getenv("NO_COLOR") != ""
+	case colorAlways:
+		color.NoColor = false
+	case colorNever:
+		color.NoColor = true
+	default:
+		return fmt.Errorf("invalid --color %q: expected %s, %s or %s", mode, colorAuto, colorAlways, colorNever)
+	}
+	return nil
+}
+
+// pagerCommand returns the pager to page output through, like git picks it:
+// $GIT_PAGER, then $PAGER, then less. An empty string means no pager.
+func pagerCommand() string {
+	for _, env := range []string{"GIT_PAGER", "PAGER"} {
+		if pager, ok := os.LookupEnv(env); ok {
+			if pager == "cat" {
+				return ""
+			}
+			return pager
+		}
+	}
+	return "less"
+}
+
+// withPager runs f with a writer that pages its output, if stdout is a
+// terminal. Otherwise, f writes to stdout directly.
+func withPager(f func(w io.Writer) error) error {
+	pager := pagerCommand()
+	if pager == "" || !isatty.IsTerminal(os.Stdout.Fd()) {
+		return f(os.Stdout)
+	}
+	return runPager(pager, f)
+}
+
+// runPager runs f with a writer that pipes its output into the pager
+func runPager(pager string, f func(w io.Writer) error) error {
+	// the pager can have arguments (e.g. "less -R"), so it is run by the shell:
+	cmd := exec.Command("sh", "-c", pager)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	if _, ok := os.LookupEnv("LESS"); !ok {
+		cmd.Env = append(cmd.Env, "LESS=FRX") // like git: quit if it fits, keep colors
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	err = f(stdin)
+	stdin.Close()
+	if errors.Is(err, syscall.EPIPE) || errors.Is(err, os.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
+		err = nil // the pager was quit before all of the output was read
+	}
+	if waitErr := cmd.Wait(); err == nil {
+		err = waitErr
+	}
+	return err
+}
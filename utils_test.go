@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fatih/color"
+)
+
+func TestPromptYesNo(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		def      bool
+		expected bool
+	}{
+		{"y", "y\n", false, true},
+		{"uppercase Y", "Y\n", false, true},
+		{"yes", "yes\n", false, true},
+		{"mixed case with whitespace", "  YeS  \n", false, true},
+		{"n", "n\n", true, false},
+		{"no", "No\n", true, false},
+		{"empty line, default no", "\n", false, false},
+		{"empty line, default yes", "\n", true, true},
+		{"EOF, default no", "", false, false},
+		{"EOF, default yes", "", true, true},
+		{"answer without trailing newline", "y", false, true},
+		{"unrecognized answer is asked again", "maybe\nyes\n", false, true},
+		{"unrecognized answer then EOF", "maybe\n", true, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out strings.Builder
+			answer, err := promptYesNo(&out, strings.NewReader(test.input), "Continue?", test.def)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if answer != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, answer)
+			}
+			if !strings.HasPrefix(out.String(), "Continue? ") {
+				t.Errorf("expected prompt to be written, got %q", out.String())
+			}
+		})
+	}
+}
+
+func TestPromptYesNoPipedAnswers(t *testing.T) {
+	// each prompt only reads its own answer from stdin:
+	var answers []bool
+	withTestStdin(t, "y\nn\ny\n", func() {
+		for i := 0; i < 3; i++ {
+			answer, err := promptYesNo(io.Discard, os.Stdin, "Continue?", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			answers = append(answers, answer)
+		}
+	})
+	if fmt.Sprint(answers) != "[true false true]" {
+		t.Errorf("expected the answers [true false true], got %v", answers)
+	}
+}
+
+func TestPromptYesNoChoices(t *testing.T) {
+	var out strings.Builder
+	promptYesNo(&out, strings.NewReader(""), "Continue?", true)
+	if !strings.Contains(out.String(), "[Y/n]") {
+		t.Errorf("expected [Y/n] in prompt, got %q", out.String())
+	}
+
+	out.Reset()
+	promptYesNo(&out, strings.NewReader(""), "Continue?", false)
+	if !strings.Contains(out.String(), "[y/N]") {
+		t.Errorf("expected [y/N] in prompt, got %q", out.String())
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var out strings.Builder
+	mu := sync.Mutex{}
+	w := newPrefixWriter(&mu, &out, "[foo] ")
+
+	// a line split across writes, and several lines in one write:
+	w.Write([]byte("hel"))
+	w.Write([]byte("lo\nwor"))
+	w.Write([]byte("ld\nbye\npartial"))
+	if out.String() != "[foo] hello\n[foo] world\n[foo] bye\n" {
+		t.Errorf("unexpected output before flush: %q", out.String())
+	}
+
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(out.String(), "[foo] partial\n") {
+		t.Errorf("expected the partial line to be flushed, got %q", out.String())
+	}
+}
+
+func TestPrefixWriterConcurrent(t *testing.T) {
+	var out strings.Builder
+	mu := sync.Mutex{}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			prefix := fmt.Sprintf("[%d] ", i)
+			w := newPrefixWriter(&mu, &out, prefix)
+			for j := 0; j < 100; j++ {
+				// write each line in two halves to exercise partial lines:
+				w.Write([]byte(prefix[1:2]))
+				w.Write([]byte(prefix[1:2] + "\n"))
+			}
+			w.Flush()
+		}(i)
+	}
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 800 {
+		t.Fatalf("expected 800 lines, got %d", len(lines))
+	}
+	for _, line := range lines {
+		// every line must be "[N] NN", i.e. not interleaved with another writer:
+		if len(line) != 6 || line[1] != line[4] || line[4] != line[5] {
+			t.Errorf("interleaved line: %q", line)
+		}
+	}
+}
+
+func TestApplyColorMode(t *testing.T) {
+	original, originalDetected := color.NoColor, colorDetectedNoColor
+	defer func() { color.NoColor, colorDetectedNoColor = original, originalDetected }()
+	colorDetectedNoColor = false // pretend stdout is a terminal
+
+	t.Setenv("NO_COLOR", "1")
+	if err := applyColorMode(colorAuto); err != nil {
+		t.Fatal(err)
+	}
+	if !color.NoColor {
+		t.Errorf("expected NO_COLOR to disable color")
+	}
+
+	if err := applyColorMode(colorAlways); err != nil {
+		t.Fatal(err)
+	}
+	if color.NoColor {
+		t.Errorf("expected --color always to override NO_COLOR")
+	}
+
+	t.Setenv("NO_COLOR", "")
+	if err := applyColorMode(colorAuto); err != nil {
+		t.Fatal(err)
+	}
+	if color.NoColor {
+		t.Errorf("expected an empty NO_COLOR not to disable color")
+	}
+
+	if err := applyColorMode(colorNever); err != nil {
+		t.Fatal(err)
+	}
+	if !color.NoColor {
+		t.Errorf("expected --color never to disable color")
+	}
+
+	if err := applyColorMode("sometimes"); err == nil {
+		t.Errorf("expected an invalid mode to be rejected")
+	}
+}
+
+func TestOutputTail(t *testing.T) {
+	if tail := outputTail("  \n", 3); tail != "" {
+		t.Errorf("expected no tail for empty output, got %q", tail)
+	}
+	if tail := outputTail("a\nb\nc\nd\n", 2); tail != ":\nc\nd" {
+		t.Errorf("expected the last 2 lines, got %q", tail)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	cases := map[int64]string{0: "0 B", 1023: "1023 B", 1536: "1.5 KiB", 5 * 1024 * 1024: "5.0 MiB"}
+	for size, expected := range cases {
+		if got := formatBytes(size); got != expected {
+			t.Errorf("formatBytes(%d): expected %q, got %q", size, expected, got)
+		}
+	}
+}
+
+func TestPagerCommand(t *testing.T) {
+	t.Setenv("GIT_PAGER", "less -R")
+	t.Setenv("PAGER", "more")
+	if pager := pagerCommand(); pager != "less -R" {
+		t.Errorf("expected $GIT_PAGER to win, got %q", pager)
+	}
+	os.Unsetenv("GIT_PAGER")
+	if pager := pagerCommand(); pager != "more" {
+		t.Errorf("expected $PAGER, got %q", pager)
+	}
+	t.Setenv("PAGER", "cat")
+	if pager := pagerCommand(); pager != "" {
+		t.Errorf("expected cat to disable paging, got %q", pager)
+	}
+}
+
+func TestRunPagerQuitEarly(t *testing.T) {
+	// a pager that quits without reading closes the pipe:
+	err := runPager("exit 0", func(w io.Writer) error {
+		for i := 0; i < 100000; i++ {
+			if _, err := fmt.Fprintln(w, "line", i); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("expected quitting the pager early to succeed, got %v", err)
+	}
+
+	if err := runPager("cat >/dev/null", func(w io.Writer) error { return errors.New("boom") }); err == nil || err.Error() != "boom" {
+		t.Errorf("expected other errors to be returned, got %v", err)
+	}
+}
+
+func TestCommandErrorLine(t *testing.T) {
+	err := errors.New("exit status 1")
+	if line := commandErrorLine("remote: warning\nfatal: could not read from remote repository\n", err); line != "fatal: could not read from remote repository" {
+		t.Errorf("expected the last line of stderr, got %q", line)
+	}
+	if line := commandErrorLine("  \n", err); line != "exit status 1" {
+		t.Errorf("expected the error without stderr, got %q", line)
+	}
+}
+
+func TestDoParallelCollect(t *testing.T) {
+	errs := doParallelCollect(5, 2, func(i int) error {
+		if i%2 == 1 {
+			return fmt.Errorf("failed %d", i)
+		}
+		return nil
+	})
+	if len(errs) != 5 {
+		t.Fatalf("expected an error slot per index, got %v", errs)
+	}
+	for i, err := range errs {
+		if (err != nil) != (i%2 == 1) || (err != nil && err.Error() != fmt.Sprintf("failed %d", i)) {
+			t.Errorf("unexpected error for index %d: %v", i, err)
+		}
+	}
+
+	err := doParallel(5, 2, func(i int) error {
+		if i >= 3 {
+			return fmt.Errorf("failed %d", i)
+		}
+		return nil
+	})
+	if err == nil || err.Error() != "failed 3" {
+		t.Errorf("expected doParallel to return the error of the first index, got %v", err)
+	}
+}
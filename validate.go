@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The severities of problems found by `mpr validate`:
+const (
+	severityWarning = "warning"
+	severityError   = "error"
+)
+
+type validationIssue struct {
+	severity string
+	message  string
+}
+
+type validateArgs struct {
+	pkgName     string
+	skipVCSPins bool // skip the check for VCS sources without a pinned ref
+}
+
+// parseSourceFragment splits a source URL like
+// "git+https://example.com/foo.git#tag=v1.0" into the URL without its
+// fragment, and the fragment's key and value (e.g. "tag" and "v1.0"). If the
+// URL has no fragment, key and value are empty.
+func parseSourceFragment(remoteURL string) (string, string, string) {
+	idx := strings.LastIndex(remoteURL, "#")
+	if idx == -1 {
+		return remoteURL, "", ""
+	}
+
+	base, fragment := remoteURL[:idx], remoteURL[idx+1:]
+	parts := strings.SplitN(fragment, "=", 2)
+	if len(parts) != 2 {
+		return base, fragment, ""
+	}
+	return base, parts[0], parts[1]
+}
+
+// isVCSSource reports whether the source is fetched with a version control
+// system (as opposed to being a plain file download)
+func isVCSSource(source PKGBUILD_source) bool {
+	parsedURL, err := url.Parse(source.remoteURL)
+	if err != nil {
+		return false
+	}
+	return parsedURL.Scheme == "git" || strings.HasPrefix(parsedURL.Scheme, "git+")
+}
+
+// checkVCSPins warns about VCS sources that are not pinned to a specific
+// commit or tag, since building those is not reproducible
+func checkVCSPins(sources []PKGBUILD_source) []validationIssue {
+	issues := make([]validationIssue, 0)
+	for idx, source := range sources {
+		if !isVCSSource(source) {
+			continue
+		}
+		_, key, _ := parseSourceFragment(source.remoteURL)
+		if key == "commit" || key == "tag" {
+			continue
+		}
+		issues = append(issues, validationIssue{
+			severity: severityWarning,
+			message:  fmt.Sprintf("source[%d] (%s) is not pinned to a #commit= or #tag=, so builds are not reproducible", idx, source.remoteURL),
+		})
+	}
+	return issues
+}
+
+// hashLengths are the lengths (in hex digits) of the entries of each sums
+// array. cksums are decimal CRCs of no fixed length, so they are not checked.
+var hashLengths = map[string]int{
+	"md5sums":    32,
+	"sha1sums":   40,
+	"sha224sums": 56,
+	"sha256sums": 64,
+	"sha384sums": 96,
+	"sha512sums": 128,
+	"b2sums":     128,
+}
+
+// checkSums checks that every sums array has as many entries as the source
+// array, and that each entry is either SKIP or a hex digest of the right
+// length for its algorithm
+func checkSums(vars map[string][]string) []validationIssue {
+	issues := make([]validationIssue, 0)
+	sources := vars["source"]
+
+	names := make([]string, 0)
+	for _, name := range hashVariables {
+		if _, ok := vars[name]; ok {
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range names {
+		sums := vars[name]
+		if len(sums) != len(sources) {
+			issues = append(issues, validationIssue{
+				severity: severityError,
+				message:  fmt.Sprintf("%s has %d entries, but source has %d", name, len(sums), len(sources)),
+			})
+		}
+		expectedLength, ok := hashLengths[name]
+		if !ok {
+			continue
+		}
+		for idx, sum := range sums {
+			if sum == "SKIP" {
+				continue
+			}
+			if len(sum) != expectedLength || !isHex(sum) {
+				issues = append(issues, validationIssue{
+					severity: severityError,
+					message:  fmt.Sprintf("%s[%d] (%s) is not a valid %s: expected %d hex digits or SKIP", name, idx, sum, strings.TrimSuffix(name, "sums"), expectedLength),
+				})
+			}
+		}
+	}
+	return issues
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// scriptletVars are the PKGBUILD variables that name a maintainer script in
+// the package directory: Arch-style install= files, and the per-script files
+// (preinst=, postinst=, ...) that makedeb supports for Debian
+var scriptletVars = []string{"install", "preinst", "postinst", "prerm", "postrm"}
+
+// checkScriptlets checks that the maintainer scripts referenced by the
+// PKGBUILD exist in the package directory dir
+func checkScriptlets(dir string, vars map[string][]string) []validationIssue {
+	issues := make([]validationIssue, 0)
+	for _, name := range scriptletVars {
+		for _, script := range vars[name] {
+			if script == "" {
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(dir, script)); err != nil {
+				issues = append(issues, validationIssue{
+					severity: severityError,
+					message:  fmt.Sprintf("%s=%s does not exist in the package directory", name, script),
+				})
+			}
+		}
+	}
+	return issues
+}
+
+func (p *PKGBUILD) validate(args validateArgs) ([]validationIssue, error) { // {{{
+	issues := make([]validationIssue, 0)
+
+	vars, err := p.getVariables()
+	if err != nil {
+		return nil, err
+	}
+	issues = append(issues, checkSums(*vars)...)
+	issues = append(issues, checkScriptlets(p.dirPath, *vars)...)
+
+	sources, err := p.getSources()
+	if err != nil {
+		// checkSums already explains mismatched lengths in more detail:
+		if len(issues) == 0 {
+			issues = append(issues, validationIssue{severity: severityError, message: err.Error()})
+		}
+		return issues, nil
+	}
+
+	if !args.skipVCSPins {
+		issues = append(issues, checkVCSPins(sources)...)
+	}
+
+	return issues, nil
+} // }}}
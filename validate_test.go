@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSourceFragment(t *testing.T) {
+	tests := []struct {
+		remoteURL        string
+		base, key, value string
+	}{
+		{"https://example.com/foo.tar.gz", "https://example.com/foo.tar.gz", "", ""},
+		{"git+https://example.com/foo.git#tag=v1.0", "git+https://example.com/foo.git", "tag", "v1.0"},
+		{"git://example.com/foo.git#commit=abc123", "git://example.com/foo.git", "commit", "abc123"},
+		{"git+ssh://git@example.com/foo.git#branch=main", "git+ssh://git@example.com/foo.git", "branch", "main"},
+	}
+	for _, test := range tests {
+		base, key, value := parseSourceFragment(test.remoteURL)
+		if base != test.base || key != test.key || value != test.value {
+			t.Errorf("parseSourceFragment(%q): expected (%q, %q, %q), got (%q, %q, %q)", test.remoteURL, test.base, test.key, test.value, base, key, value)
+		}
+	}
+}
+
+func TestCheckVCSPins(t *testing.T) {
+	sources := []PKGBUILD_source{
+		{localName: "foo.tar.gz", remoteURL: "https://example.com/foo.tar.gz"},
+		{localName: "pinned-commit", remoteURL: "git+https://example.com/a.git#commit=abc123"},
+		{localName: "pinned-tag", remoteURL: "git+https://example.com/b.git#tag=v1.0"},
+		{localName: "branch", remoteURL: "git+https://example.com/c.git#branch=main"},
+		{localName: "bare", remoteURL: "git://example.com/d.git"},
+	}
+
+	issues := checkVCSPins(sources)
+	if len(issues) != 2 {
+		t.Fatalf("expected 2 issues, got %d: %+v", len(issues), issues)
+	}
+	for _, issue := range issues {
+		if issue.severity != severityWarning {
+			t.Errorf("expected unpinned sources to be warnings, got %s", issue.severity)
+		}
+	}
+
+	if issues := checkVCSPins(sources[:3]); len(issues) != 0 {
+		t.Errorf("expected no issues for pinned sources, got %+v", issues)
+	}
+}
+
+func TestCheckSums(t *testing.T) {
+	md5 := strings.Repeat("a", 32)
+	sha256 := strings.Repeat("b", 64)
+
+	issues := checkSums(map[string][]string{
+		"source":     {"a", "b"},
+		"md5sums":    {md5, "SKIP"},
+		"sha256sums": {sha256, strings.ToUpper(sha256)},
+	})
+	if len(issues) != 0 {
+		t.Errorf("expected no issues for valid sums, got %+v", issues)
+	}
+
+	issues = checkSums(map[string][]string{
+		"source":     {"a", "b"},
+		"md5sums":    {md5, "SKIP"},
+		"sha256sums": {md5, sha256, "SKIP"},
+		"cksums":     {"123"},
+	})
+	if len(issues) != 3 {
+		t.Fatalf("expected 3 issues, got %d: %+v", len(issues), issues)
+	}
+	if !strings.Contains(issues[0].message, "cksums has 1 entries, but source has 2") {
+		t.Errorf("expected a length mismatch, got %q", issues[0].message)
+	}
+	if !strings.Contains(issues[1].message, "sha256sums has 3 entries, but source has 2") {
+		t.Errorf("expected a length mismatch, got %q", issues[1].message)
+	}
+	if !strings.Contains(issues[2].message, "sha256sums[0]") {
+		t.Errorf("expected the offending index to be reported, got %q", issues[2].message)
+	}
+
+	issues = checkSums(map[string][]string{
+		"source":     {"a"},
+		"sha512sums": {strings.Repeat("z", 128)},
+	})
+	if len(issues) != 1 || !strings.Contains(issues[0].message, "sha512sums[0]") {
+		t.Errorf("expected a non-hex digest to be reported, got %+v", issues)
+	}
+}
+
+func TestValidateScriptlets(t *testing.T) {
+	setupTestMprDir(t)
+	dir := createTestPackage(t, "foo", "pkgname=foo\npkgver=1.0.0\nsource=(https://example.com/a.tar.gz)\nsha256sums=(SKIP)\ninstall=foo.install\npostinst=foo.postinst\n")
+	if err := os.WriteFile(filepath.Join(dir, "foo.postinst"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	issues, err := NewPKGBUILD(dir).validate(validateArgs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 1 || !strings.Contains(issues[0].message, "install=foo.install does not exist") {
+		t.Errorf("expected the missing install file to be reported, got %+v", issues)
+	}
+
+	// packages without an install file are fine:
+	dir = createTestPackage(t, "bar", "pkgname=bar\npkgver=1.0.0\nsource=(https://example.com/a.tar.gz)\nsha256sums=(SKIP)\n")
+	issues, err = NewPKGBUILD(dir).validate(validateArgs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 0 {
+		t.Errorf("expected no issues, got %+v", issues)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// The states that an installed package can be in, relative to the version
+// declared in its PKGBUILD:
+const (
+	installStateInstalled     = "installed"
+	installStateNotInstalled  = "not installed"
+	installStateSystemNewer   = "system newer"
+	installStatePkgbuildNewer = "pkgbuild newer"
+)
+
+// assembleDebVersion builds the full version string of a package, as makedeb
+// would record it in the built .deb: [epoch:]pkgver-pkgrel
+func assembleDebVersion(epoch string, pkgver string, pkgrel string) string {
+	version := pkgver
+	if pkgrel != "" {
+		version += "-" + pkgrel
+	}
+	if epoch != "" && epoch != "0" {
+		version = epoch + ":" + version
+	}
+	return version
+}
+
+// getPkgbuildDebVersion returns the [epoch:]pkgver-pkgrel version declared in
+// the PKGBUILD
+func (p *PKGBUILD) getPkgbuildDebVersion() (string, error) { // {{{
+	pkgver, err := p.getPkgver()
+	if err != nil {
+		return "", err
+	}
+	pkgrel, err := p.getSingleVariable("pkgrel")
+	if err != nil {
+		return "", err
+	}
+	epoch, _ := p.getSingleVariable("epoch") // epoch is optional
+	return assembleDebVersion(epoch, pkgver, pkgrel), nil
+} // }}}
+
+// getInstalledDebVersion asks dpkg for the version of the given package that
+// is installed on the system. An empty string is returned if the package is
+// not installed.
+func getInstalledDebVersion(pkgname string) (string, error) {
+	var sbout, sberr strings.Builder
+	cmd := exec.Command("dpkg-query", "-W", "-f", "${db:Status-Status} ${Version}", pkgname)
+	cmd.Stdout = &sbout
+	cmd.Stderr = &sberr
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(sberr.String(), "no packages found") {
+			return "", nil
+		}
+		return "", fmt.Errorf("could not query installed version of %s: %w", pkgname, err)
+	}
+
+	parts := strings.SplitN(strings.TrimSpace(sbout.String()), " ", 2)
+	if len(parts) != 2 || parts[0] != "installed" {
+		return "", nil
+	}
+	return parts[1], nil
+}
+
+// getInstallState compares the version installed on the system with the
+// version declared in the PKGBUILD. For split packages, the first member
+// package that is installed is used for the comparison. The installed version
+// is returned alongside the state.
+func (p *PKGBUILD) getInstallState() (string, string, error) { // {{{
+	pkgbuildVersion, err := p.getPkgbuildDebVersion()
+	if err != nil {
+		return "", "", err
+	}
+	pkgnames, err := p.getVariable("pkgname")
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, pkgname := range pkgnames {
+		installedVersion, err := getInstalledDebVersion(pkgname)
+		if err != nil {
+			return "", "", err
+		}
+		if installedVersion == "" {
+			continue
+		}
+		return compareInstallState(installedVersion, pkgbuildVersion), installedVersion, nil
+	}
+
+	return installStateNotInstalled, "", nil
+} // }}}
+
+// compareInstallState returns the install state given the installed version
+// and the version in the PKGBUILD
+func compareInstallState(installedVersion string, pkgbuildVersion string) string {
+	if installedVersion == "" {
+		return installStateNotInstalled
+	}
+	switch cmp := compareDebVersions(installedVersion, pkgbuildVersion); {
+	case cmp < 0:
+		return installStatePkgbuildNewer
+	case cmp > 0:
+		return installStateSystemNewer
+	default:
+		return installStateInstalled
+	}
+}
+
+// compareDebVersions compares two Debian version strings using the same
+// semantics as `dpkg --compare-versions`. It returns a negative number if a <
+// b, zero if a == b, and a positive number if a > b.
+func compareDebVersions(a string, b string) int {
+	aEpoch, aUpstream, aRevision := splitDebVersion(a)
+	bEpoch, bUpstream, bRevision := splitDebVersion(b)
+
+	if aEpoch != bEpoch {
+		if aEpoch < bEpoch {
+			return -1
+		}
+		return 1
+	}
+	if cmp := compareDebVersionPart(aUpstream, bUpstream); cmp != 0 {
+		return cmp
+	}
+	return compareDebVersionPart(aRevision, bRevision)
+}
+
+// splitDebVersion splits [epoch:]upstream[-revision] into its parts
+func splitDebVersion(version string) (int, string, string) {
+	epoch := 0
+	if idx := strings.Index(version, ":"); idx != -1 {
+		epoch, _ = strconv.Atoi(version[:idx])
+		version = version[idx+1:]
+	}
+
+	revision := ""
+	if idx := strings.LastIndex(version, "-"); idx != -1 {
+		revision = version[idx+1:]
+		version = version[:idx]
+	}
+	return epoch, version, revision
+}
+
+// debVersionCharOrder returns the sort weight of a character in the non-digit
+// portion of a version: "~" sorts before everything (even the end of the
+// string), letters sort before non-letters.
+func debVersionCharOrder(c byte) int {
+	switch {
+	case c == '~':
+		return -1
+	case c >= '0' && c <= '9':
+		return 0
+	case (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+		return int(c)
+	default:
+		return int(c) + 256
+	}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// compareDebVersionPart implements dpkg's verrevcmp: the strings are compared
+// as alternating runs of non-digits (compared lexically, with the weights
+// from debVersionCharOrder) and digits (compared numerically)
+func compareDebVersionPart(a string, b string) int {
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		firstDiff := 0
+		for (i < len(a) && !isDigit(a[i])) || (j < len(b) && !isDigit(b[j])) {
+			ac, bc := 0, 0
+			if i < len(a) {
+				ac = debVersionCharOrder(a[i])
+			}
+			if j < len(b) {
+				bc = debVersionCharOrder(b[j])
+			}
+			if ac != bc {
+				return ac - bc
+			}
+			i++
+			j++
+		}
+
+		for i < len(a) && a[i] == '0' {
+			i++
+		}
+		for j < len(b) && b[j] == '0' {
+			j++
+		}
+		for i < len(a) && isDigit(a[i]) && j < len(b) && isDigit(b[j]) {
+			if firstDiff == 0 {
+				firstDiff = int(a[i]) - int(b[j])
+			}
+			i++
+			j++
+		}
+		if i < len(a) && isDigit(a[i]) {
+			return 1
+		}
+		if j < len(b) && isDigit(b[j]) {
+			return -1
+		}
+		if firstDiff != 0 {
+			return firstDiff
+		}
+	}
+	return 0
+}
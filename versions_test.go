@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAssembleDebVersion(t *testing.T) {
+	tests := []struct {
+		epoch, pkgver, pkgrel string
+		expected              string
+	}{
+		{"", "1.2.3", "1", "1.2.3-1"},
+		{"0", "1.2.3", "1", "1.2.3-1"},
+		{"2", "1.2.3", "4", "2:1.2.3-4"},
+		{"", "1.2.3", "", "1.2.3"},
+	}
+	for _, test := range tests {
+		version := assembleDebVersion(test.epoch, test.pkgver, test.pkgrel)
+		if version != test.expected {
+			t.Errorf("assembleDebVersion(%q, %q, %q): expected %q, got %q", test.epoch, test.pkgver, test.pkgrel, test.expected, version)
+		}
+	}
+}
+
+func TestCompareDebVersions(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.0-1", "1.0-1", 0},
+		{"1.0-1", "1.0-2", -1},
+		{"1.2.0", "1.10.0", -1},
+		{"1.10.0", "1.2.0", 1},
+		{"1:1.0", "2.0", 1},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0", "1.0a", -1},
+		{"1.0a", "1.0+", -1},
+		{"1.01", "1.1", 0},
+		{"2.0-1", "10.0-1", -1},
+	}
+	for _, test := range tests {
+		cmp := compareDebVersions(test.a, test.b)
+		if sign(cmp) != test.expected {
+			t.Errorf("compareDebVersions(%q, %q): expected %d, got %d", test.a, test.b, test.expected, cmp)
+		}
+	}
+}
+
+func TestCompareInstallState(t *testing.T) {
+	tests := []struct {
+		installed, pkgbuild string
+		expected            string
+	}{
+		{"", "1.0-1", installStateNotInstalled},
+		{"1.0-1", "1.0-1", installStateInstalled},
+		{"1.0-1", "1.1-1", installStatePkgbuildNewer},
+		{"1.1-1", "1.0-1", installStateSystemNewer},
+	}
+	for _, test := range tests {
+		state := compareInstallState(test.installed, test.pkgbuild)
+		if state != test.expected {
+			t.Errorf("compareInstallState(%q, %q): expected %q, got %q", test.installed, test.pkgbuild, test.expected, state)
+		}
+	}
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// whyReport gathers everything that makes mpr consider a package out of date,
+// for `mpr why`. The commands that act on each of these are:
+//   - receipt vs HEAD: `mpr outdated` / `mpr upgrade`
+//   - HEAD vs the remote: `mpr update`
+//   - pkgver vs repology: `mpr check-stale`
+//   - the installed version vs the PKGBUILD: `mpr list --long`
+type whyReport struct {
+	pkg string
+
+	receiptHash string // empty if the package was never installed by mpr
+	headHash    string
+
+	fetched      bool  // whether the remote was fetched before comparing
+	hasUpstream  bool  // whether HEAD tracks an upstream branch
+	remoteAhead  int   // commits on the upstream branch that HEAD does not have
+	remoteErr    error // the remote could not be compared
+	pkgver       string
+	repology     string              // the newest version known to repology; "SKIP" if not tracked
+	repologyErr  error               // repology could not be asked
+	normalize    func(string) string // applied to pkgver and repology before comparing; nil for normalizeVersion
+	pkgbuildDeb  string              // [epoch:]pkgver-pkgrel declared in the PKGBUILD
+	installedDeb string              // the version installed on the system, empty if not installed
+	installState string
+}
+
+func gatherWhyReport(pkg string, fetch bool, maxAge time.Duration) (whyReport, error) { // {{{
+	report := whyReport{pkg: pkg}
+	var err error
+
+	if report.receiptHash, err = readMakedebInstallReceipt(pkg); err != nil {
+		return report, err
+	}
+	if report.headHash, err = getPkgHEADCommitHash(pkg); err != nil {
+		return report, err
+	}
+
+	if fetch {
+		if _, err := gitOutput(pkg, "fetch", "--quiet"); err != nil {
+			report.remoteErr = err
+		} else {
+			report.fetched = true
+		}
+	}
+	if report.remoteErr == nil {
+		report.remoteAhead, report.hasUpstream, report.remoteErr = commitsBehindRemote(pkg)
+	}
+
+	pkgbuild := NewPKGBUILD(mprDir(pkg))
+	if report.pkgver, err = pkgbuild.getPkgver(); err != nil {
+		return report, fmt.Errorf("could not read pkgver: %w", err)
+	}
+	if report.normalize, err = pkgbuild.getRepologyVersionNormalizer(); err != nil {
+		return report, err
+	}
+	report.repology, report.repologyErr = pkgbuild.getLatestRepologyPkgVersionCached(maxAge)
+	if errors.Is(report.repologyErr, errRepologyNotTracked) {
+		report.repology, report.repologyErr = "SKIP", nil
+	}
+
+	if report.pkgbuildDeb, err = pkgbuild.getPkgbuildDebVersion(); err != nil {
+		return report, err
+	}
+	if report.installState, report.installedDeb, err = pkgbuild.getInstallState(); err != nil {
+		return report, err
+	}
+	return report, nil
+} // }}}
+
+// conclusions explains the report in plain language, one sentence per reason
+// that the package is (or is not) out of date
+func (r whyReport) conclusions() []string { // {{{
+	var out []string
+	normalize := r.normalize
+	if normalize == nil {
+		normalize = normalizeVersion
+	}
+
+	switch {
+	case r.receiptHash == "":
+		out = append(out, fmt.Sprintf("%s was never installed by mpr, so `mpr outdated` lists it; run `mpr upgrade %s` to build and install it", r.pkg, r.pkg))
+	case r.receiptHash != r.headHash:
+		out = append(out, fmt.Sprintf("HEAD has moved since %s was last installed, so a rebuild is needed; run `mpr upgrade %s`", r.pkg, r.pkg))
+	}
+
+	switch {
+	case r.remoteErr != nil:
+		out = append(out, fmt.Sprintf("the remote could not be checked: %s", r.remoteErr))
+	case !r.hasUpstream:
+		out = append(out, "the package does not track a remote branch, so `mpr update` cannot bring in new commits")
+	case r.remoteAhead > 0:
+		out = append(out, fmt.Sprintf("the remote has %s that are not in HEAD; run `mpr update %s`", pluralize(r.remoteAhead, "new commit"), r.pkg))
+	case !r.fetched:
+		out = append(out, "the remote had no new commits when it was last fetched (use --fetch to check again)")
+	}
+
+	switch {
+	case r.repologyErr != nil:
+		out = append(out, fmt.Sprintf("repology could not be checked: %s", r.repologyErr))
+	case r.repology == "SKIP":
+		out = append(out, "the package is not tracked by repology, so `mpr check-stale` cannot tell whether upstream has a newer version")
+	case isStaleVersion(normalize(r.pkgver), normalize(r.repology), false):
+		out = append(out, fmt.Sprintf("repology knows of version %s but the PKGBUILD has %s, so `mpr check-stale` reports it as stale; run `mpr update-version %s %s`", r.repology, r.pkgver, r.pkg, r.repology))
+	}
+
+	switch r.installState {
+	case installStateNotInstalled:
+		out = append(out, "the package is not installed on the system")
+	case installStatePkgbuildNewer:
+		out = append(out, fmt.Sprintf("the system has %s installed, older than the PKGBUILD's %s; run `mpr reinstall %s`", r.installedDeb, r.pkgbuildDeb, r.pkg))
+	case installStateSystemNewer:
+		out = append(out, fmt.Sprintf("the system has %s installed, newer than the PKGBUILD's %s (it was installed from elsewhere, or the PKGBUILD was downgraded)", r.installedDeb, r.pkgbuildDeb))
+	}
+
+	if len(out) == 0 {
+		out = append(out, fmt.Sprintf("%s is up to date", r.pkg))
+	}
+	return out
+} // }}}
+
+func (r whyReport) print(w io.Writer) { // {{{
+	receipt := r.receiptHash
+	if receipt == "" {
+		receipt = "(never installed)"
+	}
+	remote := "(no upstream branch)"
+	switch {
+	case r.remoteErr != nil:
+		remote = "(unknown)"
+	case r.hasUpstream:
+		remote = fmt.Sprintf("%s ahead of HEAD", pluralize(r.remoteAhead, "commit"))
+		if !r.fetched {
+			remote += " (as of the last fetch)"
+		}
+	}
+	repology := r.repology
+	if r.repologyErr != nil {
+		repology = "(unknown)"
+	}
+	installed := r.installedDeb
+	if installed == "" {
+		installed = "(not installed)"
+	}
+
+	fmt.Fprintf(w, "receipt:   %s\n", receipt)
+	fmt.Fprintf(w, "HEAD:      %s\n", r.headHash)
+	fmt.Fprintf(w, "remote:    %s\n", remote)
+	fmt.Fprintf(w, "pkgver:    %s (repology: %s)\n", r.pkgver, repology)
+	fmt.Fprintf(w, "installed: %s (PKGBUILD: %s)\n", installed, r.pkgbuildDeb)
+	fmt.Fprintln(w)
+	for _, conclusion := range r.conclusions() {
+		fmt.Fprintf(w, "=> %s\n", conclusion)
+	}
+} // }}}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWhyConclusions(t *testing.T) {
+	upToDate := whyReport{
+		pkg:          "foo",
+		receiptHash:  "abc",
+		headHash:     "abc",
+		fetched:      true,
+		hasUpstream:  true,
+		pkgver:       "1.0",
+		repology:     "1.0",
+		pkgbuildDeb:  "1.0-1",
+		installedDeb: "1.0-1",
+		installState: installStateInstalled,
+	}
+
+	tests := []struct {
+		name   string
+		modify func(r *whyReport)
+		want   string
+	}{
+		{"up to date", func(r *whyReport) {}, "foo is up to date"},
+		{"never installed", func(r *whyReport) { r.receiptHash = "" }, "never installed by mpr"},
+		{"rebuild needed", func(r *whyReport) { r.headHash = "def" }, "a rebuild is needed; run `mpr upgrade foo`"},
+		{"remote ahead", func(r *whyReport) { r.remoteAhead = 2 }, "the remote has 2 new commits that are not in HEAD"},
+		{"remote not fetched", func(r *whyReport) { r.fetched = false }, "use --fetch to check again"},
+		{"no upstream", func(r *whyReport) { r.hasUpstream = false }, "does not track a remote branch"},
+		{"remote error", func(r *whyReport) { r.remoteErr = errors.New("boom") }, "the remote could not be checked: boom"},
+		{"repology newer", func(r *whyReport) { r.repology = "1.1" }, "repology knows of version 1.1 but the PKGBUILD has 1.0"},
+		{"repology skip", func(r *whyReport) { r.repology = "SKIP" }, "not tracked by repology"},
+		{"repology error", func(r *whyReport) { r.repologyErr = errors.New("boom") }, "repology could not be checked: boom"},
+		{"not installed", func(r *whyReport) { r.installState, r.installedDeb = installStateNotInstalled, "" }, "not installed on the system"},
+		{"pkgbuild newer", func(r *whyReport) { r.installState, r.installedDeb = installStatePkgbuildNewer, "0.9-1" }, "the system has 0.9-1 installed, older than the PKGBUILD's 1.0-1"},
+		{"system newer", func(r *whyReport) { r.installState, r.installedDeb = installStateSystemNewer, "2.0-1" }, "the system has 2.0-1 installed, newer than the PKGBUILD's 1.0-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := upToDate
+			tt.modify(&report)
+			conclusions := report.conclusions()
+			if len(conclusions) != 1 {
+				t.Fatalf("conclusions() = %q, want exactly one", conclusions)
+			}
+			if !strings.Contains(conclusions[0], tt.want) {
+				t.Errorf("conclusions() = %q, want it to contain %q", conclusions[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestGatherWhyReport(t *testing.T) {
+	setupTestMprDir(t)
+	fakeRepology(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"status":"newest","version":"1.1"}]`))
+	})
+
+	upstream := createTestPackage(t, "upstream", "pkgname=mpr-test-why\npkgver=1.0\npkgrel=1\n")
+	runTestGit(t, mprDir(), "clone", "-q", upstream, "mpr-test-why")
+	runTestGit(t, upstream, "commit", "-q", "--allow-empty", "-m", "newer commit")
+	invalidatePackageIndex()
+
+	report, err := gatherWhyReport("mpr-test-why", true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.receiptHash != "" || report.headHash == "" {
+		t.Errorf("receipt = %q, HEAD = %q, want no receipt and a HEAD", report.receiptHash, report.headHash)
+	}
+	if !report.fetched || !report.hasUpstream || report.remoteAhead != 1 || report.remoteErr != nil {
+		t.Errorf("fetched = %v, hasUpstream = %v, remoteAhead = %d, remoteErr = %v, want the remote to be 1 commit ahead", report.fetched, report.hasUpstream, report.remoteAhead, report.remoteErr)
+	}
+	if report.pkgver != "1.0" || report.repology != "1.1" {
+		t.Errorf("pkgver = %q, repology = %q, want 1.0 and 1.1", report.pkgver, report.repology)
+	}
+	if report.pkgbuildDeb != "1.0-1" || report.installState != installStateNotInstalled {
+		t.Errorf("pkgbuildDeb = %q, installState = %q, want 1.0-1 and not installed", report.pkgbuildDeb, report.installState)
+	}
+	if got := len(report.conclusions()); got != 4 {
+		t.Errorf("got %d conclusions, want 4: %q", got, report.conclusions())
+	}
+}